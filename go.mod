@@ -3,7 +3,20 @@ module dev.io/cloud
 go 1.13
 
 require (
-	google.golang.org/grpc v1.27.0
+	dev.io/cloud/gw v0.0.0
+	dev.io/cloud/protoc v0.0.0
+	dev.io/cloud/utils v0.0.0
+	github.com/golang-jwt/jwt/v4 v4.5.2
 	github.com/gorilla/mux v1.8.0
+	github.com/gorilla/websocket v1.4.2
 	github.com/graphql-go/graphql v0.7.9
+	google.golang.org/genproto v0.0.0-20200526211855-cb27e3aa2013
+	google.golang.org/grpc v1.37.0
+	google.golang.org/protobuf v1.25.0
+)
+
+replace (
+	dev.io/cloud/gw => ./staging/src/dev.io/gateway
+	dev.io/cloud/protoc => ./staging/src/dev.io/protoc
+	dev.io/cloud/utils => ./staging/src/dev.io/utils
 )
@@ -0,0 +1,104 @@
+package gw
+
+import (
+  pb "dev.io/cloud/protoc"
+  "dev.io/cloud/utils"
+
+  "google.golang.org/protobuf/encoding/protojson"
+  "google.golang.org/protobuf/proto"
+  "google.golang.org/grpc/codes"
+  "github.com/gorilla/mux"
+  "io/ioutil"
+  "net/http"
+)
+
+// @NOTE: the endpoint name which is reserved for the admin api inside the
+// version it's exposed on
+const adminEndpoint = "routes"
+
+/*! \brief Expose the registration api as a REST endpoint
+ *
+ *  This method is used to let backends which can't speak grpc manage their
+ * routes, it works exactly like the Gateway rpc methods:
+ *
+ *   GET    /<version>/routes?version=v2  lists routes
+ *   POST   /<version>/routes             registers a RegisterRequest
+ *   PUT    /<version>/routes/{lease}     renews a lease
+ *   DELETE /<version>/routes/{lease}     unregisters a lease
+ *
+ *  \param version: the version which the endpoint is created in
+ *  \return *utils.Api: the endpoint, its level should be restricted since
+ *                      it's PUBLIC by default
+ */
+func (self *Gateway) Admin(version string) *utils.Api {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
+  key := version + "/" + adminEndpoint
+
+  // @NOTE: reserve the endpoint and its paths so backends can't take them
+  self.owners[key] = adminEndpoint
+  self.paths[version + "/routes"] = key
+  self.paths[version + "/routes/{lease}"] = key
+
+  return self.api.Version(version).Endpoint(adminEndpoint).
+    Handle("GET", self.list).
+    Handle("POST", self.register).
+    Handle("PUT", self.renew).
+    Handle("DELETE", self.unregister).
+    Mock("/routes").
+    Mock("/routes/{lease}")
+}
+
+func (self *Gateway) list(w http.ResponseWriter, r *http.Request) {
+  in := &pb.ListRoutesRequest{Version: r.URL.Query().Get("version")}
+
+  self.reply(w)(self.ListRoutes(r.Context(), in))
+}
+
+func (self *Gateway) register(w http.ResponseWriter, r *http.Request) {
+  in := &pb.RegisterRequest{}
+
+  if data, err := ioutil.ReadAll(r.Body); err != nil {
+    self.api.Fail(w)(utils.NewError(codes.InvalidArgument, err.Error()))
+  } else if err := protojson.Unmarshal(data, in); err != nil {
+    self.api.Fail(w)(utils.NewError(codes.InvalidArgument, err.Error()))
+  } else {
+    self.reply(w)(self.Register(r.Context(), in))
+  }
+}
+
+func (self *Gateway) renew(w http.ResponseWriter, r *http.Request) {
+  if lease, ok := mux.Vars(r)["lease"]; ! ok {
+    self.api.Fail(w)(utils.NewError(codes.InvalidArgument, "lease is missing"))
+  } else {
+    self.reply(w)(self.Renew(r.Context(), &pb.RenewRequest{Lease: lease}))
+  }
+}
+
+func (self *Gateway) unregister(w http.ResponseWriter, r *http.Request) {
+  if lease, ok := mux.Vars(r)["lease"]; ! ok {
+    self.api.Fail(w)(utils.NewError(codes.InvalidArgument, "lease is missing"))
+  } else {
+    self.reply(w)(self.Unregister(r.Context(),
+                                  &pb.UnregisterRequest{Lease: lease}))
+  }
+}
+
+/*! \brief Write the result of a rpc method to client
+ *
+ *  \param w: the response writer
+ *  \return func(proto.Message, error): a lambda which packs the response
+ *                                      or the status into our envelope
+ */
+func (self *Gateway) reply(w http.ResponseWriter) func(proto.Message, error) {
+  return func(message proto.Message, err error) {
+    if err != nil {
+      self.api.Fail(w)(err)
+    } else if data, err := protojson.Marshal(message); err != nil {
+      self.api.Fail(w)(utils.NewError(codes.Internal, err.Error()))
+    } else {
+      self.api.Ok(w)(string(data))
+    }
+  }
+}
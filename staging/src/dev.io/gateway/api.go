@@ -1,10 +1,491 @@
 package gw
 
 import (
-  utils "dev.io/clould/utils"
-  pb "dev.io/clould/protoc"
+  pb "dev.io/cloud/protoc"
+  "dev.io/cloud/utils"
+
+  "google.golang.org/grpc/status"
+  "google.golang.org/grpc/codes"
+  "google.golang.org/grpc"
+  "github.com/google/uuid"
+  "net/http"
+  "context"
+  "strings"
+  "errors"
+  "sort"
+  "sync"
+  "time"
+  "fmt"
+  "net"
+)
+
+const (
+  // @NOTE: the lease duration which is used when backend doesn't choose one
+  defaultLeaseTTL = 30 * time.Second
+
+  // @NOTE: backends must renew at least once per hour, so a dead backend
+  // never keeps its routes too long
+  maxLeaseTTL = time.Hour
 )
 
+type iRoute struct {
+  // @NOTE: route stores the route as it's announced by backend
+  route *pb.Route
+
+  // @NOTE: api is the endpoint which exposes this route
+  api *utils.Api
+
+  // @NOTE: upstream is used to forward requests of this route to backend
+  upstream *utils.Upstream
+}
+
+type iLease struct {
+  // @NOTE: backend is the name of service which owns this lease
+  backend string
+
+  // @NOTE: routes stores every route which is announced with this lease
+  routes []*iRoute
+
+  // @NOTE: ttl is how long the lease lives after each renewal
+  ttl time.Duration
+
+  // @NOTE: expires stores when the lease must be dropped, the timer may
+  // fire late or early after a renewal so it's always checked again
+  expires time.Time
+  timer *time.Timer
+}
+
 type Gateway struct {
-  pb.GatewayService
+  pb.UnimplementedGatewayServiceServer
+
+  // @NOTE: api is the server which exposes routes of backends
+  api *utils.ApiServer
+
+  // @NOTE: rpc is the context which this gateway is served on
+  rpc *utils.GRpcContext
+
+  // @NOTE: proxy is used to forward requests to backends
+  proxy *utils.Gateway
+
+  // @NOTE: leases maps lease id to the routes which are registered with it
+  leases map[string]*iLease
+
+  // @NOTE: owners maps version/endpoint to the lease which owns it, an
+  // endpoint can be owned by one backend at the same time
+  owners map[string]string
+
+  // @NOTE: paths maps version/path to the endpoint which it's mocked to,
+  // prefixes of a version never overlap so each request has one owner
+  paths map[string]string
+
+  version string
+  lock sync.Mutex
+}
+
+/*! \brief Serve the gateway
+ *
+ *  This method is used to serve the gateway service on its GRpcContext,
+ * it blocks until the gateway is stopped
+ *
+ *  \return error: the reason why the gateway is stopped
+ */
+func (self *Gateway) Serve() error {
+  return self.rpc.Serve(self)
+}
+
+func (self *Gateway) Version() string {
+  return self.version
+}
+
+func (self *Gateway) Listen(protocol string) (net.Listener, error) {
+  // @NOTE: the gateway uses listeners of the context, their addresses are
+  // configured by GRpcContext.SetAddress
+  return nil, nil
+}
+
+func (self *Gateway) New(serv *grpc.Server) error {
+  pb.RegisterGatewayServiceServer(serv, self)
+  return nil
+}
+
+func (self *Gateway) OnServing(protocol string) error {
+  return nil
+}
+
+func (self *Gateway) OnStopping() {
+}
+
+func (self *Gateway) Ping(ctx context.Context, in *pb.GatewayRequest) (*pb.GatewayResponse, error) {
+  return &pb.GatewayResponse{}, nil
+}
+
+/*! \brief Register routes of a backend
+ *
+ *  This method is used to expose routes of a backend through ApiServer,
+ * either every route is registered or none of them is. Routes are dropped
+ * automatically when the lease isn't renewed before its ttl expires
+ *
+ *  \param ctx: the request context
+ *  \param in: the routes and the backend which owns them
+ *  \return *pb.RegisterResponse: the lease which is used to unregister
+ *  \return error: InvalidArgument if a route is malformed or
+ *                 AlreadyExists if it conflicts with another backend,
+ *                 leases of the same backend are replaced instead
+ */
+func (self *Gateway) Register(ctx context.Context, in *pb.RegisterRequest) (*pb.RegisterResponse, error) {
+  if err := validateRegisterRequest(in); err != nil {
+    return nil, status.Error(codes.InvalidArgument, err.Error())
+  }
+
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
+  replaced, err := self.check(in.Backend, in.Routes)
+  if err != nil {
+    return nil, status.Error(codes.AlreadyExists, err.Error())
+  }
+
+  // @NOTE: a backend which restarts registers again before its old lease
+  // expires, the new lease takes over every route of the old one
+  for _, id := range replaced {
+    self.drop(id)
+  }
+
+  id := uuid.New().String()
+  lease := &iLease{backend: in.Backend, ttl: leaseTTLOf(in.Ttl)}
+
+  for _, route := range in.Routes {
+    lease.routes = append(lease.routes, self.expose(route))
+    self.owners[endpointKey(route)] = id
+  }
+
+  lease.expires = time.Now().Add(lease.ttl)
+  lease.timer = time.AfterFunc(lease.ttl, func() {
+    self.expire(id)
+  })
+
+  self.leases[id] = lease
+  return &pb.RegisterResponse{
+    Lease: id,
+    Ttl: int64(lease.ttl / time.Second),
+  }, nil
+}
+
+/*! \brief Renew a lease
+ *
+ *  \param ctx: the request context
+ *  \param in: the lease
+ *  \return *pb.RenewResponse: the ttl which the lease lives from now
+ *  \return error: NotFound if the lease doesn't exist or has expired
+ */
+func (self *Gateway) Renew(ctx context.Context, in *pb.RenewRequest) (*pb.RenewResponse, error) {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
+  lease, ok := self.leases[in.Lease]
+  if ! ok {
+    return nil, status.Error(codes.NotFound,
+                             fmt.Sprintf("lease %s not found", in.Lease))
+  }
+
+  lease.expires = time.Now().Add(lease.ttl)
+  lease.timer.Reset(lease.ttl)
+  return &pb.RenewResponse{Ttl: int64(lease.ttl / time.Second)}, nil
+}
+
+/*! \brief Unregister routes of a lease
+ *
+ *  \param ctx: the request context
+ *  \param in: the lease
+ *  \return *pb.UnregisterResponse: empty response
+ *  \return error: NotFound if the lease doesn't exist
+ */
+func (self *Gateway) Unregister(ctx context.Context, in *pb.UnregisterRequest) (*pb.UnregisterResponse, error) {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
+  if ! self.drop(in.Lease) {
+    return nil, status.Error(codes.NotFound,
+                             fmt.Sprintf("lease %s not found", in.Lease))
+  }
+
+  return &pb.UnregisterResponse{}, nil
+}
+
+/*! \brief List routes which are being exposed
+ *
+ *  \param ctx: the request context
+ *  \param in: the version filter
+ *  \return *pb.ListRoutesResponse: routes ordered by version and endpoint
+ *  \return error: always nil
+ */
+func (self *Gateway) ListRoutes(ctx context.Context, in *pb.ListRoutesRequest) (*pb.ListRoutesResponse, error) {
+  ret := &pb.ListRoutesResponse{}
+
+  self.lock.Lock()
+  for _, lease := range self.leases {
+    for _, item := range lease.routes {
+      if len(in.Version) == 0 || item.route.Version == in.Version {
+        ret.Routes = append(ret.Routes, item.route)
+      }
+    }
+  }
+  self.lock.Unlock()
+
+  sort.Slice(ret.Routes, func(i, j int) bool {
+    return endpointKey(ret.Routes[i]) < endpointKey(ret.Routes[j])
+  })
+
+  return ret, nil
+}
+
+/*! \brief Check if routes conflict with the current ones
+ *
+ *  This method must be called with the lock is held, routes conflict when
+ * their endpoints are owned by another backend or when their prefixes
+ * overlap since the first one would shadow the other
+ *
+ *  \param backend: the backend which announces routes
+ *  \param routes: the routes which are going to be registered
+ *  \return []string: leases of this backend which are replaced by routes
+ *  \return error: the reason if one of them conflicts
+ */
+func (self *Gateway) check(backend string, routes []*pb.Route) ([]string, error) {
+  announced := make(map[string]string)
+  replaced := []string{}
+
+  // @NOTE: endpoints of stale leases of this backend are given back, so
+  // only other backends could conflict with routes
+  owned := func(endpoint string) (string, bool) {
+    id, ok := self.owners[endpoint]
+    if ! ok {
+      return "", false
+    } else if lease, ok := self.leases[id]; ok && lease.backend == backend {
+      return id, false
+    }
+
+    return id, true
+  }
+
+  for _, route := range routes {
+    endpoint := endpointKey(route)
+
+    if _, ok := announced[endpoint]; ok {
+      return nil, errors.New(fmt.Sprintf("endpoint %s is announced twice",
+                                         endpoint))
+    } else if id, ok := owned(endpoint); ok {
+      return nil, errors.New(fmt.Sprintf("endpoint %s is owned by another backend",
+                                         endpoint))
+    } else if len(id) > 0 {
+      replaced = append(replaced, id)
+    }
+
+    for key, owner := range self.paths {
+      path := strings.TrimPrefix(key, route.Version)
+
+      if ! strings.HasPrefix(path, "/") || ! overlapPrefixes(path, route.Path) {
+        continue
+      } else if id, ok := owned(owner); ok {
+        return nil, errors.New(fmt.Sprintf("path %s overlaps %s of %s",
+                                           route.Path, path, owner))
+      } else if len(id) > 0 {
+        replaced = append(replaced, id)
+      }
+    }
+
+    for other, path := range announced {
+      if strings.HasPrefix(other, route.Version + "/") &&
+         overlapPrefixes(path, route.Path) {
+        return nil, errors.New(fmt.Sprintf("path %s overlaps %s of %s",
+                                           route.Path, path, other))
+      }
+    }
+
+    announced[endpoint] = route.Path
+  }
+
+  return replaced, nil
+}
+
+/*! \brief Expose a route through ApiServer
+ *
+ *  This method must be called with the lock is held
+ *
+ *  \param route: the route
+ *  \return *iRoute: the exposed route
+ */
+func (self *Gateway) expose(route *pb.Route) *iRoute {
+  ret := &iRoute{
+    route: route,
+    api: self.api.Version(route.Version).Endpoint(route.Endpoint),
+    upstream: self.proxy.Upstream(utils.NewStaticDiscovery(route.Upstream)),
+  }
+
+  // @NOTE: every method goes through one handler, so routes which accept
+  // different methods are forwarded by the same prefix
+  ret.api.Level(int(route.Level)).Handle("*", ret.forward).VersionPrefix(route.Path)
+  self.paths[route.Version + route.Path] = endpointKey(route)
+
+  return ret
+}
+
+/*! \brief Drop routes of a lease
+ *
+ *  This method must be called with the lock is held
+ *
+ *  \param id: the lease id
+ *  \return bool: false if the lease doesn't exist
+ */
+func (self *Gateway) drop(id string) bool {
+  lease, ok := self.leases[id]
+  if ! ok {
+    return false
+  }
+
+  lease.timer.Stop()
+
+  for _, item := range lease.routes {
+    item.api.Unhandle("*").Unprefix(item.route.Path)
+    self.proxy.Release(item.upstream)
+    delete(self.owners, endpointKey(item.route))
+    delete(self.paths, item.route.Version + item.route.Path)
+  }
+
+  delete(self.leases, id)
+  return true
+}
+
+/*! \brief Drop a lease if it has expired
+ *
+ *  \param id: the lease id
+ */
+func (self *Gateway) expire(id string) {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
+  if lease, ok := self.leases[id]; ok && ! time.Now().Before(lease.expires) {
+    // @TODO: we should write log here since the backend may be dead
+    self.drop(id)
+  }
+}
+
+/*! \brief Forward a request to backend of this route
+ *
+ *  \param w: the response writer
+ *  \param r: the request
+ */
+func (self *iRoute) forward(w http.ResponseWriter, r *http.Request) {
+  for _, method := range self.route.Methods {
+    if method == "*" || method == r.Method {
+      self.upstream.Forward(w, r)
+      return
+    }
+  }
+
+  self.api.Fail(w)(utils.NewError(codes.Unimplemented,
+                                  fmt.Sprintf("%s isn't allowed", r.Method)))
+}
+
+/* --------------------------- helper ----------------------------- */
+
+/*! \brief Check if a register request is well-formed
+ *
+ *  This function also fills methods of routes which don't mention any
+ * method, they accept every method
+ *
+ *  \param in: the request
+ *  \return error: the reason if the request is malformed
+ */
+func validateRegisterRequest(in *pb.RegisterRequest) error {
+  if len(in.Backend) == 0 {
+    return errors.New("backend is empty")
+  } else if len(in.Routes) == 0 {
+    return errors.New(fmt.Sprintf("%s doesn't have any route", in.Backend))
+  } else if in.Ttl < 0 {
+    return errors.New("ttl must not be negative")
+  }
+
+  for _, route := range in.Routes {
+    switch {
+    case route == nil:
+      return errors.New("route is nil")
+
+    case len(route.Version) == 0 || len(route.Endpoint) == 0:
+      return errors.New("route must have version and endpoint")
+
+    case ! strings.HasPrefix(route.Path, "/"):
+      return errors.New(fmt.Sprintf("path of %s must be absolute",
+                                    endpointKey(route)))
+
+    case len(route.Upstream) == 0:
+      return errors.New(fmt.Sprintf("upstream of %s is empty",
+                                    endpointKey(route)))
+
+    case route.Level < pb.Level_PUBLIC || route.Level > pb.Level_PROTECTED:
+      return errors.New(fmt.Sprintf("level of %s is invalid",
+                                    endpointKey(route)))
+    }
+
+    if len(route.Methods) == 0 {
+      route.Methods = []string{"*"}
+    }
+
+    for index, method := range route.Methods {
+      route.Methods[index] = strings.ToUpper(method)
+    }
+  }
+
+  return nil
+}
+
+/*! \brief Convert the ttl which is requested by backend
+ *
+ *  \param seconds: the requested ttl, zero means the default one
+ *  \return time.Duration: the ttl which is used
+ */
+func leaseTTLOf(seconds int64) time.Duration {
+  if seconds == 0 {
+    return defaultLeaseTTL
+  } else if seconds >= int64(maxLeaseTTL / time.Second) {
+    return maxLeaseTTL
+  } else {
+    return time.Duration(seconds) * time.Second
+  }
+}
+
+/*! \brief Check if two prefixes overlap
+ *
+ *  \param left: a prefix
+ *  \param right: another prefix
+ *  \return bool: true if one of them shadows the other
+ */
+func overlapPrefixes(left, right string) bool {
+  return strings.HasPrefix(left, right) || strings.HasPrefix(right, left)
+}
+
+/*! \brief Build the key of an endpoint
+ *
+ *  \param route: the route
+ *  \return string: version/endpoint
+ */
+func endpointKey(route *pb.Route) string {
+  return route.Version + "/" + route.Endpoint
+}
+
+/*! \brief Create a gateway
+ *
+ *  \param api: the server which exposes routes of backends
+ *  \param rpc: the context which the gateway is served on
+ *  \return *Gateway: the gateway object
+ */
+func NewGateway(api *utils.ApiServer, rpc *utils.GRpcContext) *Gateway {
+  return &Gateway{
+    api: api,
+    rpc: rpc,
+    proxy: utils.NewGateway(api, rpc),
+    leases: make(map[string]*iLease),
+    owners: make(map[string]string),
+    paths: make(map[string]string),
+    version: "v1",
+  }
 }
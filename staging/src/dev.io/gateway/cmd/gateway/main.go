@@ -0,0 +1,67 @@
+package main
+
+import (
+  "dev.io/cloud/utils"
+  "dev.io/cloud/gw"
+
+  "net/http"
+  "strings"
+  "flag"
+  "log"
+)
+
+func main() {
+  address := flag.String("http", ":8080",
+                         "the address which routes of backends are exposed on")
+  protocols := flag.String("prefer", "",
+                           "comma separated protocols which are used to serve rpc")
+  tcp := flag.String("rpc", "",
+                     "the tcp address which backends register on, e.g :50051")
+  ipc := flag.String("socket", "",
+                     "the unix socket which backends on this host register on")
+  admin := flag.String("admin", "v1",
+                       "the version which the REST admin endpoint is mounted in")
+  key := flag.String("admin-key", "",
+                     "the key which the REST admin endpoint requires in X-Gateway-Key")
+  flag.Parse()
+
+  api := utils.NewApiServer()
+  rpc := utils.NewGRpcContext()
+
+  if len(*tcp) > 0 {
+    if err := rpc.SetAddress("tcp", *tcp); err != nil {
+      log.Fatal(err)
+    }
+  }
+
+  if len(*ipc) > 0 {
+    if err := rpc.SetAddress("ipc", *ipc); err != nil {
+      log.Fatal(err)
+    }
+  }
+
+  if len(*protocols) > 0 {
+    if err := rpc.Prefer(strings.Split(*protocols, ",")...); err != nil {
+      log.Fatal(err)
+    }
+  }
+
+  gateway := gw.NewGateway(api, rpc)
+
+  // @NOTE: backends which can't speak grpc register through the admin
+  // endpoint, it's open to everyone unless a key is given
+  if len(*key) > 0 {
+    api.Authenticate(utils.NewApiKeyAuthenticator("X-Gateway-Key").
+      Key(*key, utils.Principal{Name: "admin"}))
+    gateway.Admin(*admin).Level(utils.AUTHENTICATED)
+  } else {
+    log.Printf("the admin endpoint of %s doesn't require any key", *admin)
+    gateway.Admin(*admin)
+  }
+
+  go func() {
+    log.Fatal(http.ListenAndServe(*address, api))
+  }()
+
+  log.Fatal(gateway.Serve())
+}
@@ -0,0 +1,17 @@
+module dev.io/cloud/gw
+
+go 1.13
+
+require (
+	dev.io/cloud/protoc v0.0.0
+	dev.io/cloud/utils v0.0.0
+	github.com/google/uuid v1.1.2
+	github.com/gorilla/mux v1.8.0
+	google.golang.org/grpc v1.37.0
+	google.golang.org/protobuf v1.25.0
+)
+
+replace (
+	dev.io/cloud/protoc => ../protoc
+	dev.io/cloud/utils => ../utils
+)
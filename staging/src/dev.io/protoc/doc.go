@@ -0,0 +1,3 @@
+package protoc
+
+//go:generate protoc --go_out=plugins=grpc:. --go_opt=paths=source_relative gateway.proto
@@ -0,0 +1,9 @@
+module dev.io/cloud/protoc
+
+go 1.13
+
+require (
+	github.com/golang/protobuf v1.4.3
+	google.golang.org/grpc v1.37.0
+	google.golang.org/protobuf v1.25.0
+)
@@ -0,0 +1,549 @@
+package utils
+
+import (
+  "google.golang.org/grpc/codes"
+  "net/http"
+  "net/url"
+  "strings"
+  "errors"
+  "bytes"
+  "sync"
+  "time"
+  "fmt"
+  "net"
+  "io"
+  "io/ioutil"
+)
+
+const (
+  ROUND_ROBIN   = 0
+  LEAST_REQUEST = 1
+)
+
+const (
+  // @NOTE: how often we ask discovery for new upstreams
+  defaultProxyRefresh = 10 * time.Second
+
+  // @NOTE: how many consecutive failures eject an upstream
+  defaultProxyFailures = 5
+
+  // @NOTE: how long an ejected upstream is kept out of balancing
+  defaultProxyEjection = 30 * time.Second
+
+  // @NOTE: how many times a request is tried, including the first one
+  defaultProxyAttempts = 3
+
+  // @NOTE: retries are allowed as long as they are less than this percent
+  // of active requests
+  defaultProxyBudget = 0.2
+
+  // @NOTE: this number of retries is always allowed, even with few active
+  // requests
+  defaultProxyMinRetries = 3
+
+  // @NOTE: bodies which are larger than this size are streamed to upstream
+  // and never retried
+  maxProxyReplayBody = 1024 * 1024
+)
+
+// @NOTE: these headers are meaningful only for a single connection and must
+// not be forwarded
+var hopByHopHeaders = []string{
+  "Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
+  "Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+type iApiUpstreamNode struct {
+  // @NOTE: address stores the address which discovery returned
+  address string
+
+  // @NOTE: target stores the parsed url of this node
+  target *url.URL
+
+  // @NOTE: active counts requests which are being sent to this node
+  active int
+
+  // @NOTE: failures counts consecutive failures of this node
+  failures int
+
+  // @NOTE: ejected stores the time this node will come back to balancing
+  ejected time.Time
+}
+
+type Upstream struct {
+  // @NOTE: discovery is used to find nodes of this upstream
+  discovery Discovery
+
+  // @NOTE: nodes stores every node which discovery returned recently
+  nodes []*iApiUpstreamNode
+
+  // @NOTE: resolved stores the last time we asked discovery
+  resolved time.Time
+
+  // @NOTE: balance defines how we choose nodes, see ROUND_ROBIN and
+  // LEAST_REQUEST
+  balance int
+
+  // @NOTE: next is the cursor of round robin
+  next int
+
+  // @NOTE: failures and ejection configure passive outlier ejection
+  failures int
+  ejection time.Duration
+
+  // @NOTE: attempts, budget and minRetries configure retry budget
+  attempts int
+  budget float64
+  minRetries int
+
+  // @NOTE: active and retrying count requests and retries in flight, they
+  // are used to enforce the retry budget
+  active, retrying int
+
+  owner *iApiGateway
+  lock sync.Mutex
+}
+
+/*! \brief Create an upstream which is proxied through this gateway
+ *
+ *  This method is used to create an upstream whose nodes are found by a
+ * discovery, the upstream's Forward is used as handler of Api
+ *
+ *  \param discovery: the discovery which finds nodes
+ *  \return *Upstream: to make a chain call, we will return the upstream to
+ *                     make configuring it easily
+ */
+func (self *Gateway) Upstream(discovery Discovery) *Upstream {
+  ret := &Upstream{
+    discovery: discovery,
+    balance: ROUND_ROBIN,
+    failures: defaultProxyFailures,
+    ejection: defaultProxyEjection,
+    attempts: defaultProxyAttempts,
+    budget: defaultProxyBudget,
+    minRetries: defaultProxyMinRetries,
+    owner: self.http,
+  }
+
+  self.http.lock.Lock()
+  self.http.upstreams = append(self.http.upstreams, ret)
+  self.http.lock.Unlock()
+  return ret
+}
+
+/*! \brief Release an upstream which isn't used anymore
+ *
+ *  This method is used to drop an upstream from this gateway, requests
+ * which are being forwarded by it still finish as usual
+ *
+ *  \param upstream: the upstream
+ */
+func (self *Gateway) Release(upstream *Upstream) {
+  self.http.lock.Lock()
+  defer self.http.lock.Unlock()
+
+  for index, item := range self.http.upstreams {
+    if item == upstream {
+      copy(self.http.upstreams[index:], self.http.upstreams[index + 1:])
+      self.http.upstreams = self.http.upstreams[:len(self.http.upstreams) - 1]
+      return
+    }
+  }
+}
+
+/*! \brief Choose the load balancing policy
+ *
+ *  \param policy: ROUND_ROBIN or LEAST_REQUEST
+ *  \return *Upstream: to make a chain call, we will return itself
+ */
+func (self *Upstream) Balance(policy int) *Upstream {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
+  self.balance = policy
+  return self
+}
+
+/*! \brief Configure passive outlier ejection
+ *
+ *  This method is used to define how many consecutive failures eject a node
+ * and how long it's ejected, a failure is a 5xx response or a broken
+ * connection
+ *
+ *  \param failures: the number of consecutive failures, zero disables it
+ *  \param duration: how long the node is ejected
+ *  \return *Upstream: to make a chain call, we will return itself
+ */
+func (self *Upstream) Eject(failures int, duration time.Duration) *Upstream {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
+  self.failures = failures
+  self.ejection = duration
+  return self
+}
+
+/*! \brief Configure retries
+ *
+ *  This method is used to define how many times a request is tried and the
+ * budget which limits retries, retries in flight can't exceed the budget
+ * percent of active requests, except a few minimum retries
+ *
+ *  \param attempts: the number of attempts, including the first one
+ *  \param budget: the ratio of retries to active requests, e.g 0.2
+ *  \param minRetries: the number of retries which is always allowed
+ *  \return *Upstream: to make a chain call, we will return itself
+ */
+func (self *Upstream) Retry(attempts int, budget float64, minRetries int) *Upstream {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
+  self.attempts = attempts
+  self.budget = budget
+  self.minRetries = minRetries
+  return self
+}
+
+/*! \brief Forward a request to upstream
+ *
+ *  This method is used as a Handler of Api, the request is sent to a node
+ * of this upstream and the response is copied back to client, idempotent
+ * requests are retried on another node when they fail
+ *
+ *  \param w: the response writer
+ *  \param r: the user request
+ */
+func (self *Upstream) Forward(w http.ResponseWriter, r *http.Request) {
+  var body []byte
+  var last error
+
+  retries := 0
+
+  replayable := isIdempotentMethod(r.Method)
+
+  if r.Body != nil && r.ContentLength != 0 {
+    if r.ContentLength > 0 && r.ContentLength <= maxProxyReplayBody {
+      if data, err := ioutil.ReadAll(r.Body); err != nil {
+        fail(w, NewError(codes.InvalidArgument, err.Error()))
+        return
+      } else {
+        body = data
+      }
+    } else {
+      replayable = false
+    }
+  }
+
+  self.enter()
+  defer self.leave(&retries)
+
+  tried := make(map[*iApiUpstreamNode]bool)
+
+  for attempt := 0; ; attempt++ {
+    node, err := self.pick(tried)
+    if err != nil {
+      if last == nil {
+        last = err
+      }
+      break
+    }
+
+    tried[node] = true
+
+    outgoing := self.prepare(r, node, body)
+    response, err := self.owner.transport.RoundTrip(outgoing)
+
+    if err == nil && response.StatusCode < 500 {
+      self.report(node, true)
+      writeProxyResponse(w, response)
+      return
+    }
+
+    self.report(node, false)
+
+    if err != nil {
+      last = err
+    } else {
+      last = errors.New(fmt.Sprintf("upstream responds %d", response.StatusCode))
+    }
+
+    if ! replayable || attempt + 1 >= self.attempts || ! self.acquire() {
+      if response != nil {
+        writeProxyResponse(w, response)
+        return
+      }
+
+      break
+    }
+
+    if response != nil {
+      response.Body.Close()
+    }
+
+    retries += 1
+  }
+
+  // @NOTE: no grpc code means bad gateway, so the status is written here
+  w.WriteHeader(502)
+  Pack(w)(502, last.Error())
+}
+
+/*! \brief Ask discovery for nodes if they are out of date
+ *
+ *  This method must be called with the lock is held
+ */
+func (self *Upstream) refresh() {
+  if ! self.resolved.IsZero() &&
+     time.Since(self.resolved) < defaultProxyRefresh {
+    return
+  }
+
+  addresses, err := self.discovery.Resolve()
+  self.resolved = time.Now()
+
+  if err != nil {
+    // @TODO: we should write log here, old nodes are kept as is
+    return
+  }
+
+  nodes := make([]*iApiUpstreamNode, 0, len(addresses))
+  known := make(map[string]*iApiUpstreamNode)
+
+  for _, node := range self.nodes {
+    known[node.address] = node
+  }
+
+  for _, address := range addresses {
+    if node, ok := known[address]; ok {
+      nodes = append(nodes, node)
+    } else if target, err := parseUpstreamAddress(address); err == nil {
+      nodes = append(nodes, &iApiUpstreamNode{
+        address: address,
+        target: target,
+      })
+    }
+  }
+
+  self.nodes = nodes
+}
+
+/*! \brief Pick a node following the balancing policy
+ *
+ *  This method is used to choose a healthy node which hasn't been tried by
+ * this request, when every node is ejected we will ignore ejection
+ *
+ *  \param tried: nodes which have been tried
+ *  \return *iApiUpstreamNode: the node
+ */
+func (self *Upstream) pick(tried map[*iApiUpstreamNode]bool) (*iApiUpstreamNode, error) {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
+  self.refresh()
+
+  now := time.Now()
+  candidates := make([]*iApiUpstreamNode, 0, len(self.nodes))
+  untried := make([]*iApiUpstreamNode, 0, len(self.nodes))
+
+  for _, node := range self.nodes {
+    if tried[node] {
+      continue
+    }
+
+    untried = append(untried, node)
+
+    if now.After(node.ejected) {
+      candidates = append(candidates, node)
+    }
+  }
+
+  if len(candidates) == 0 {
+    candidates = untried
+  }
+
+  if len(candidates) == 0 {
+    return nil, errors.New("there is no upstream to serve this request")
+  }
+
+  chosen := candidates[self.next % len(candidates)]
+  self.next += 1
+
+  if self.balance == LEAST_REQUEST {
+    for _, node := range candidates {
+      if node.active < chosen.active {
+        chosen = node
+      }
+    }
+  }
+
+  chosen.active += 1
+  return chosen, nil
+}
+
+/*! \brief Report the result of a request
+ *
+ *  This method is used to update outlier detection of a node
+ *
+ *  \param node: the node
+ *  \param ok: true if the request is succeed
+ */
+func (self *Upstream) report(node *iApiUpstreamNode, ok bool) {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
+  node.active -= 1
+
+  if ok {
+    node.failures = 0
+    return
+  }
+
+  node.failures += 1
+
+  if self.failures > 0 && node.failures >= self.failures {
+    node.failures = 0
+    node.ejected = time.Now().Add(self.ejection)
+  }
+}
+
+/*! \brief Acquire a retry from the budget
+ *
+ *  \return bool: true if we are allowed to retry
+ */
+func (self *Upstream) acquire() bool {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
+  limit := int(self.budget * float64(self.active))
+
+  if limit < self.minRetries {
+    limit = self.minRetries
+  }
+
+  if self.retrying >= limit {
+    return false
+  }
+
+  self.retrying += 1
+  return true
+}
+
+func (self *Upstream) enter() {
+  self.lock.Lock()
+  self.active += 1
+  self.lock.Unlock()
+}
+
+/*! \brief Finish a request
+ *
+ *  \param retries: the number of retries which must be given back to the
+ *                  budget
+ */
+func (self *Upstream) leave(retries *int) {
+  self.lock.Lock()
+  self.active -= 1
+  self.retrying -= *retries
+  self.lock.Unlock()
+}
+
+/*! \brief Build the request which is sent to a node
+ *
+ *  \param r: the user request
+ *  \param node: the node
+ *  \param body: the buffered body, nil if the body is streamed
+ *  \return *http.Request: the outgoing request
+ */
+func (self *Upstream) prepare(r *http.Request, node *iApiUpstreamNode,
+                              body []byte) *http.Request {
+  outgoing := r.Clone(r.Context())
+
+  outgoing.RequestURI = ""
+  outgoing.URL.Scheme = node.target.Scheme
+  outgoing.URL.Host = node.target.Host
+  outgoing.Host = node.target.Host
+
+  if len(node.target.Path) > 0 && node.target.Path != "/" {
+    outgoing.URL.Path = strings.TrimSuffix(node.target.Path, "/") + r.URL.Path
+  }
+
+  if body != nil {
+    outgoing.Body = ioutil.NopCloser(bytes.NewReader(body))
+    outgoing.ContentLength = int64(len(body))
+  }
+
+  for _, header := range hopByHopHeaders {
+    outgoing.Header.Del(header)
+  }
+
+  if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+    if prior := r.Header.Get("X-Forwarded-For"); len(prior) > 0 {
+      host = prior + ", " + host
+    }
+
+    outgoing.Header.Set("X-Forwarded-For", host)
+  }
+
+  if id := RequestIdOf(r.Context()); len(id) > 0 {
+    outgoing.Header.Set(REQUEST_ID_HEADER, id)
+  }
+
+  return outgoing
+}
+
+/* --------------------------- helper ----------------------------- */
+
+/*! \brief Copy a response of upstream back to client
+ *
+ *  \param w: the response writer
+ *  \param response: the response of upstream
+ */
+func writeProxyResponse(w http.ResponseWriter, response *http.Response) {
+  defer response.Body.Close()
+
+  for key, values := range response.Header {
+    // @NOTE: we have echoed our request id already, upstream mustn't add
+    // another one
+    if key == http.CanonicalHeaderKey(REQUEST_ID_HEADER) && len(w.Header().Get(key)) > 0 {
+      continue
+    }
+
+    for _, value := range values {
+      w.Header().Add(key, value)
+    }
+  }
+
+  for _, header := range hopByHopHeaders {
+    w.Header().Del(header)
+  }
+
+  w.WriteHeader(response.StatusCode)
+  io.Copy(w, response.Body)
+}
+
+/*! \brief Parse an address of upstream
+ *
+ *  \param address: host:port or an url
+ *  \return *url.URL: the parsed url, http is used when scheme is missing
+ */
+func parseUpstreamAddress(address string) (*url.URL, error) {
+  if ! strings.Contains(address, "://") {
+    address = "http://" + address
+  }
+
+  return url.Parse(address)
+}
+
+/*! \brief Check if a method could be retried safely
+ *
+ *  \param method: the http method
+ *  \return bool: true if the method is idempotent
+ */
+func isIdempotentMethod(method string) bool {
+  switch(method) {
+    case "GET", "HEAD", "OPTIONS", "PUT", "DELETE":
+      return true
+
+    default:
+      return false
+  }
+}
@@ -1,8 +1,13 @@
 package utils
 
 import (
+  "google.golang.org/grpc/codes"
   "github.com/gorilla/mux"
+  "encoding/json"
   "net/http"
+  "context"
+  "sync"
+  "time"
   "fmt"
 )
 
@@ -11,6 +16,10 @@ type Handler func(http.ResponseWriter, *http.Request)
 type Version struct {
   endpoints map[string]*Api
   code string
+
+  // @NOTE: limit is shared by every endpoint of this version, nil means
+  // unlimited
+  limit *RateLimit
 }
 
 type Alias struct {
@@ -18,9 +27,28 @@ type Alias struct {
   enable bool
 }
 
+type iPrefix struct {
+  // @NOTE: active is false once the prefix has been removed, the route of
+  // mux can't be deleted so it stops matching instead
+  active bool
+}
+
 type Api struct {
   methods map[string]Handler
 
+  // @NOTE: roles and scopes store what a principal needs to call each
+  // method, "*" covers methods which aren't listed
+  roles map[string][]string
+  scopes map[string][]string
+
+  // @NOTE: limits stores token buckets of each method, "*" is shared by
+  // every method of this endpoint
+  limits map[string]RateLimit
+
+  // @NOTE: namespaces restricts PROTECTED endpoints to service accounts of
+  // these namespaces, empty means every namespace of our cluster
+  namespaces []string
+
   level int
   owner *ApiServer
   enable bool
@@ -34,12 +62,47 @@ type ApiServer struct {
   apis map[string]*Api
 
   base, currentVersion string
+
+  // @NOTE: heartbeat defines how often streams send pings to clients so
+  // proxies won't close idle connections and dead clients are detected
+  heartbeat time.Duration
+
+  // @NOTE: stopping is closed when the server is shutting down, every
+  // stream watches it to finish gently
+  stopping chan struct{}
+
+  // @NOTE: streams is used to wait until every stream has finished
+  streams sync.WaitGroup
+
+  // @NOTE: authenticators are tried in order to find who sends a request
+  authenticators []Authenticator
+
+  // @NOTE: bindings grant roles to principals, endpoints which require
+  // roles refuse everyone without them
+  bindings *RoleBindings
+
+  // @NOTE: limiter stores token buckets of rate limits
+  limiter LimitStore
+
+  // @NOTE: tracer starts a span for each routed request
+  tracer *Tracer
+
+  // @NOTE: prefixes stores every prefix which is being mocked by its
+  // absolute path, see Api.Prefix and Api.Unprefix
+  prefixes map[string]*iPrefix
+
+  // @NOTE: lock protects routes and endpoints since they could be changed
+  // while we are serving, handlers are always called without holding it
+  lock sync.RWMutex
 }
 
 const (
   PUBLIC    = 0
   PRIVATE   = 1
   PROTECTED = 2
+
+  // @NOTE: endpoints of this level need a principal from our authenticators
+  AUTHENTICATED = 3
 )
 
 /*! \brief Make an alias path to specific endpoint
@@ -52,39 +115,10 @@ const (
  *                next function easily
  */
 func (self *Api) Alias(path string) *Api {
-  var endpoint *Alias
-
-  if tmp, ok := self.owner.aliases[path]; ok {
-    endpoint = tmp
-  } else {
-    endpoint = &Alias{}
-
-    endpoint.methods = make(map[string]*Api)
-    endpoint.enable = true
-  }
-
-  if endpoint.methods == nil {
-    endpoint.methods = make(map[string]*Api)
-  }
-
-  for k, _ := range(self.methods) {
-    endpoint.methods[k] = self
-  }
-
-  self.owner.aliases[path] = endpoint
-  self.owner.router.HandleFunc(path,
-    func(w http.ResponseWriter, r *http.Request) {
-      if link, ok := self.owner.aliases[path]; ! ok {
-        self.Nok(w)(404, "not found")
-      } else if ! link.enable {
-        self.Nok(w)(404, "not found")
-      } else if api, ok := link.methods[r.Method]; ! ok {
-        self.Nok(w)(404, "not found")
-      } else {
-        self.owner.reorder(api.name, api.code)(w, r)
-      }
-    })
+  self.owner.lock.Lock()
+  defer self.owner.lock.Unlock()
 
+  self.owner.router.HandleFunc(path, self.alias(path))
   return self
 }
 
@@ -105,16 +139,54 @@ func (self *Api) Version(code string) *ApiServer {
  *
  *  This method is used to assign a handler to solve specific endpoint's method
  *
- *  \param method: the method we would like to resolve
+ *  \param method: the method we would like to resolve, "*" means every
+ *                 method which doesn't have its own handler
  *  \param handler: the handler
  *  \return *Api: to make a chain call, we will return itself to make calling
  *                next function easily
  */
 func (self *Api) Handle(method string, handler Handler) *Api {
+  self.owner.lock.Lock()
+  defer self.owner.lock.Unlock()
+
   self.methods[method] = handler
   return self
 }
 
+/*! \brief Stop resolving specific endpoint's methods
+ *
+ *  This method is used to remove handlers of an endpoint while we are
+ * serving, requests of these methods will receive 404 afterward
+ *
+ *  \param methods: the methods we would like to stop resolving
+ *  \return *Api: to make a chain call, we will return itself to make calling
+ *                next function easily
+ */
+func (self *Api) Unhandle(methods ...string) *Api {
+  self.owner.lock.Lock()
+  defer self.owner.lock.Unlock()
+
+  for _, method := range methods {
+    delete(self.methods, method)
+  }
+
+  return self
+}
+
+/*! \brief Set access level of this endpoint
+ *
+ *  \param level: PUBLIC, PRIVATE or PROTECTED
+ *  \return *Api: to make a chain call, we will return itself to make calling
+ *                next function easily
+ */
+func (self *Api) Level(level int) *Api {
+  self.owner.lock.Lock()
+  defer self.owner.lock.Unlock()
+
+  self.level = level
+  return self
+}
+
 /*! \brief Access an endpoint object
  *
  *  This method is used to access an endpoint object using ApiServer, if the
@@ -138,22 +210,103 @@ func (self *Api) Endpoint(endpoint string) *Api {
  *                next function easily
  */
 func (self *Api) Mock(path string) *Api {
-  var dest string
+  self.owner.lock.Lock()
+  defer self.owner.lock.Unlock()
 
-  if len(self.owner.base) > 0 {
-    dest = fmt.Sprintf("/%s/%s%s", self.owner.base, self.code, path)
-  } else {
-    dest = fmt.Sprintf("/%s%s", self.code, path)
-  }
+  dest, alias := self.mock(path)
 
   self.owner.router.HandleFunc(dest,
     self.owner.reorder(self.name, self.code))
+  self.owner.router.HandleFunc(alias, self.alias(alias))
+  return self
+}
 
-  if len(self.owner.base) > 0 {
-    path = fmt.Sprintf("/%s%s", self.owner.base, path)
+/*! \brief Mock every path under a prefix to this endpoint
+ *
+ *  This method works like Mock but every request whose path begins with
+ * the prefix is handled by this endpoint, which is useful for proxying
+ *
+ *  \param path: the prefix which will receive requests
+ *  \return *Api: to make a chain call, we will return itself to make calling
+ *                next function easily
+ */
+func (self *Api) Prefix(path string) *Api {
+  self.owner.lock.Lock()
+  defer self.owner.lock.Unlock()
+
+  dest, alias := self.mock(path)
+
+  self.prefix(dest, self.owner.reorder(self.name, self.code))
+  self.prefix(alias, self.alias(alias))
+  return self
+}
+
+/*! \brief Mock every path under a prefix of this version to this endpoint
+ *
+ *  This method works like Prefix but only the versioned path is mocked, so
+ * the same prefix could be mocked by endpoints of other versions
+ *
+ *  \param path: the prefix which will receive requests
+ *  \return *Api: to make a chain call, we will return itself to make calling
+ *                next function easily
+ */
+func (self *Api) VersionPrefix(path string) *Api {
+  self.owner.lock.Lock()
+  defer self.owner.lock.Unlock()
+
+  dest, _ := self.mock(path)
+
+  self.prefix(dest, self.owner.reorder(self.name, self.code))
+  return self
+}
+
+/*! \brief Stop mocking a prefix
+ *
+ *  This method is used to release a prefix while we are serving, requests
+ * under it reach the next matching route or receive 404 afterward
+ *
+ *  \param path: the prefix which has been mocked by Prefix
+ *  \return *Api: to make a chain call, we will return itself to make calling
+ *                next function easily
+ */
+func (self *Api) Unprefix(path string) *Api {
+  self.owner.lock.Lock()
+  defer self.owner.lock.Unlock()
+
+  dest, alias := self.mock(path)
+
+  for _, path := range []string{dest, alias} {
+    if prefix, ok := self.owner.prefixes[path]; ok {
+      prefix.active = false
+      delete(self.owner.prefixes, path)
+    }
   }
 
-  return self.Alias(path)
+  return self
+}
+
+/*! \brief Route every path under a prefix to a handler
+ *
+ *  This method must be called with the lock is held, a prefix which is
+ * still active keeps its route
+ *
+ *  \param path: the absolute prefix
+ *  \param handler: the handler
+ */
+func (self *Api) prefix(path string, handler Handler) {
+  if prefix, ok := self.owner.prefixes[path]; ok && prefix.active {
+    return
+  }
+
+  prefix := &iPrefix{active: true}
+  self.owner.prefixes[path] = prefix
+
+  // @NOTE: routes are matched under our lock, so the flag is safe to read
+  self.owner.router.PathPrefix(path).
+    MatcherFunc(func(r *http.Request, match *mux.RouteMatch) bool {
+      return prefix.active
+    }).
+    HandlerFunc(handler)
 }
 
 /*! \brief Send ok code and message to client
@@ -182,6 +335,104 @@ func (self *Api) Nok(w http.ResponseWriter) func(int, string) {
   return self.owner.Nok(w)
 }
 
+/*! \brief Send an error to client
+ *
+ *  \param w: the response writer
+ *  \return func(error): a lambda which is used to pack an error into an
+ *                       json object, see ApiServer.Fail
+ */
+func (self *Api) Fail(w http.ResponseWriter) func(error) {
+  return self.owner.Fail(w)
+}
+
+/*! \brief Link an alias path to this endpoint
+ *
+ *  This method is used to store the alias and produce a handler which
+ * redirects requests of this alias to the endpoint
+ *
+ *  \param path: the absolute path of this alias
+ *  \return Handler: the handler which is registered to our router
+ */
+func (self *Api) alias(path string) Handler {
+  var endpoint *Alias
+
+  if tmp, ok := self.owner.aliases[path]; ok {
+    endpoint = tmp
+  } else {
+    endpoint = &Alias{}
+
+    endpoint.methods = make(map[string]*Api)
+    endpoint.enable = true
+  }
+
+  if endpoint.methods == nil {
+    endpoint.methods = make(map[string]*Api)
+  }
+
+  for k, _ := range(self.methods) {
+    endpoint.methods[k] = self
+  }
+
+  self.owner.aliases[path] = endpoint
+
+  return func(w http.ResponseWriter, r *http.Request) {
+    var api *Api
+
+    self.owner.lock.RLock()
+    if link, ok := self.owner.aliases[path]; ok && link.enable {
+      if api, ok = link.methods[r.Method]; ! ok {
+        api = link.methods["*"]
+      }
+    }
+    self.owner.lock.RUnlock()
+
+    if api == nil {
+      self.Fail(w)(NewError(codes.NotFound, "not found"))
+    } else {
+      self.owner.reorder(api.name, api.code)(w, r)
+    }
+  }
+}
+
+/*! \brief Build paths which are used to mock this endpoint
+ *
+ *  \param path: the path which will receive requests
+ *  \return string, string: the versioned path and the alias path
+ */
+func (self *Api) mock(path string) (string, string) {
+  var dest string
+
+  if len(self.owner.base) > 0 {
+    dest = fmt.Sprintf("/%s/%s%s", self.owner.base, self.code, path)
+  } else {
+    dest = fmt.Sprintf("/%s%s", self.code, path)
+  }
+
+  if len(self.owner.base) > 0 {
+    path = fmt.Sprintf("/%s%s", self.owner.base, path)
+  }
+
+  return dest, path
+}
+
+/*! \brief Find the handler of a method
+ *
+ *  This method is used to find the handler of specific method, the handler
+ * of "*" is used when the method isn't handled explicitly
+ *
+ *  \param method: the http method
+ *  \return Handler: the handler
+ *  \return bool: false if this endpoint doesn't handle the method
+ */
+func (self *Api) handlerOf(method string) (Handler, bool) {
+  if handler, ok := self.methods[method]; ok {
+    return handler, true
+  }
+
+  handler, ok := self.methods["*"]
+  return handler, ok
+}
+
 /*! \brief Check if the endpoint is allowed to handle requests
  *
  *  This method is used to check and return what if the endpoint could be used
@@ -204,7 +455,11 @@ func (self *Api) isAllowed(r *http.Request) bool {
       return self.owner.isLocal(r)
 
     case PROTECTED:
-      return self.owner.isInternal(r)
+      return self.owner.isInternal(r) &&
+             PrincipalOf(r.Context()).isFrom(self.namespaces)
+
+    case AUTHENTICATED:
+      return PrincipalOf(r.Context()) != nil
 
     default:
       return false
@@ -221,6 +476,9 @@ func (self *Api) isAllowed(r *http.Request) bool {
  *                make calling next function easily
  */
 func (self *ApiServer) Endpoint(endpoint string) *Api {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
   if len(self.currentVersion) == 0 {
     return nil
   } else {
@@ -246,6 +504,9 @@ func (self *ApiServer) Endpoint(endpoint string) *Api {
  *                      to make calling next function easily
  */
 func (self *ApiServer) Version(code string) *ApiServer {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
   if _, ok := self.versions[code]; ! ok {
     self.versions[code] = &Version{}
 
@@ -291,6 +552,82 @@ func (self *ApiServer) GetMuxer() *mux.Router {
   return self.router
 }
 
+/*! \brief Configure how often streams send heartbeats
+ *
+ *  \param heartbeat: the interval, it must be positive
+ *  \return *ApiServer: to make a chain call, we will return itself
+ *                      to make calling next function easily
+ */
+func (self *ApiServer) SetHeartbeat(heartbeat time.Duration) *ApiServer {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
+  if heartbeat > 0 {
+    self.heartbeat = heartbeat
+  }
+
+  return self
+}
+
+/*! \brief Stop every stream of this server
+ *
+ *  This method is used before shutting down the http server since it
+ * never waits for streams, new streams are refused from now on
+ *
+ *  \param ctx: the context which defines the deadline
+ *  \return error: if streams don't finish before the deadline, we will
+ *                 receive the error of ctx
+ */
+func (self *ApiServer) Shutdown(ctx context.Context) error {
+  done := make(chan struct{})
+
+  self.lock.Lock()
+  select {
+  case <-self.stopping:
+  default:
+    close(self.stopping)
+  }
+  self.lock.Unlock()
+
+  go func() {
+    self.streams.Wait()
+    close(done)
+  }()
+
+  select {
+  case <-done:
+    return nil
+
+  case <-ctx.Done():
+    return ctx.Err()
+  }
+}
+
+/*! \brief Serve a request
+ *
+ *  This method is used to serve requests while routes are still being
+ * added, the route is matched under our lock but the handler is called
+ * without holding it so long requests never block new routes
+ *
+ *  \param w: the response writer
+ *  \param r: the request
+ */
+func (self *ApiServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+  var match mux.RouteMatch
+
+  r = self.identify(w, r)
+
+  self.lock.RLock()
+  found := self.router.Match(r, &match)
+  self.lock.RUnlock()
+
+  if ! found || match.Handler == nil {
+    self.Fail(w)(NewError(codes.NotFound, "not found"))
+  } else {
+    match.Handler.ServeHTTP(w, mux.SetURLVars(r, match.Vars))
+  }
+}
+
 /*! \brief Order a handler to redirect request to specific endpoint's version
  *
  *  This method is used to link a path to specific endpoint's version, in order
@@ -301,18 +638,59 @@ func (self *ApiServer) GetMuxer() *mux.Router {
  *                next function easily
  */
 func (self *ApiServer) reorder(endpoint, code string) Handler {
-  return func(w http.ResponseWriter, r *http.Request) {
-    if ver, ok := self.versions[code]; ! ok {
-      self.Nok(w)(404, fmt.Sprintf("Not found %s", endpoint))
-    } else if api, ok := ver.endpoints[endpoint]; ! ok {
-      self.Nok(w)(404, fmt.Sprintf("Not found %s", endpoint))
-    } else if handler, ok := api.methods[r.Method]; ! ok {
-      self.Nok(w)(404, fmt.Sprintf("Not found %s", endpoint))
-    } else if api.isAllowed(r) {
-      handler(w, r)
+  return self.trace(endpoint, code, func(w http.ResponseWriter, r *http.Request) {
+    handler, status := self.lookup(endpoint, code, r)
+
+    if status == 200 {
+      if wait := self.throttle(endpoint, code, r); wait > 0 {
+        self.refuse(w, wait)
+      } else {
+        rescued := &iRescuedWriter{ResponseWriter: w}
+
+        defer self.rescue(rescued, r, fmt.Sprintf("%s/%s/%s", code, endpoint, r.Method))
+        handler(rescued, r)
+      }
+    } else if status == 401 {
+      self.challenge(w, "authentication is required")
+    } else if status == 403 {
+      self.Fail(w)(NewError(codes.PermissionDenied,
+                            fmt.Sprintf("Forbidden %s", endpoint)))
     } else {
-      self.Nok(w)(404, fmt.Sprintf("Not found %s", endpoint))
+      self.Fail(w)(NewError(codes.NotFound, fmt.Sprintf("Not found %s", endpoint)))
     }
+  })
+}
+
+/*! \brief Find the handler which resolves a request
+ *
+ *  \param endpoint: the endpoint name
+ *  \param code: the version code
+ *  \param r: the request
+ *  \return Handler: the handler
+ *  \return int: 200 if the request could reach this endpoint, 401 if it
+ *               needs a principal, 403 if the principal isn't authorized
+ *               or 404 otherwise
+ */
+func (self *ApiServer) lookup(endpoint, code string, r *http.Request) (Handler, int) {
+  self.lock.RLock()
+  defer self.lock.RUnlock()
+
+  if ver, ok := self.versions[code]; ! ok {
+    return nil, 404
+  } else if api, ok := ver.endpoints[endpoint]; ! ok {
+    return nil, 404
+  } else if handler, ok := api.handlerOf(r.Method); ! ok {
+    return nil, 404
+  } else if api.isAllowed(r) {
+    if code := api.authorize(r); code != 200 {
+      return nil, code
+    }
+
+    return handler, 200
+  } else if api.enable && api.level == AUTHENTICATED {
+    return nil, 401
+  } else {
+    return nil, 404
   }
 }
 
@@ -363,20 +741,33 @@ func (self *ApiServer) isLocal(r *http.Request) bool {
  *  \return bool: return if the request is created by cluster or not
  */
 func (self *ApiServer) isInternal(r *http.Request) bool {
-  return false
+  principal := PrincipalOf(r.Context())
+
+  // @NOTE: only service accounts of our cluster carry a namespace
+  return principal != nil && len(principal.Namespace) > 0
 }
 
 /*! \brief Snift in comming requests before redirect it to correct service
  *
  *  This method is used to listen request from everywhere and redirect them
- * to correct placement
+ * to correct placement, requests are authenticated here so handlers and
+ * access levels could find their principal by PrincipalOf
  *
  *  \param next: the handler which is registered
  *  \return http.Handler: the actual handler which server will do
  */
 func (self *ApiServer) handleMiddleware(next http.Handler) http.Handler {
   return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-    next.ServeHTTP(w, r)
+    r = self.identify(w, r)
+    principal, err := self.authenticate(r)
+
+    if err != nil {
+      self.challenge(w, err.Error())
+    } else if principal != nil {
+      next.ServeHTTP(w, r.WithContext(withPrincipal(r.Context(), principal)))
+    } else {
+      next.ServeHTTP(w, r)
+    }
   })
 }
 
@@ -393,16 +784,38 @@ func (self *ApiServer) handleMiddleware(next http.Handler) http.Handler {
  */
 func Pack(w http.ResponseWriter) func(int, string) {
   return func(code int, message string) {
-    if message[0] == '{' && message[len(message) - 1] == '}' {
-      fmt.Fprintf(w, "{\"code\": %d, \"data\": %s}", code, message)
-    } else if message[0] == '[' && message[len(message) - 1] == ']' {
-      fmt.Fprintf(w, "{\"code\": %d, \"data\": %s}", code, message)
+    if len(message) == 0 {
+      pack(w, code, "\"\"")
+    } else if message[0] == '{' && message[len(message) - 1] == '}' && json.Valid([]byte(message)) {
+      pack(w, code, message)
+    } else if message[0] == '[' && message[len(message) - 1] == ']' && json.Valid([]byte(message)) {
+      pack(w, code, message)
     } else {
-      fmt.Fprintf(w, "{\"code\": %d, \"data\": \"%s\"}", code, message)
+      // @NOTE: messages often come from err.Error(), they may contain quotes
+      // or newlines which must be escaped to keep the envelope valid
+      data, _ := json.Marshal(message)
+      pack(w, code, string(data))
     }
   }
 }
 
+/*! \brief Write our json envelope
+ *
+ *  \param w: the response writer
+ *  \param code: the code of the envelope
+ *  \param data: the data which is already encoded in json
+ */
+func pack(w http.ResponseWriter, code int, data string) {
+  trailer := ""
+
+  // @NOTE: errors carry the request id so users could report it to us
+  if id := w.Header().Get(REQUEST_ID_HEADER); code != 200 && isRequestId(id) {
+    trailer = fmt.Sprintf(", \"request_id\": \"%s\"", id)
+  }
+
+  fmt.Fprintf(w, "{\"code\": %d, \"data\": %s%s}", code, data, trailer)
+}
+
 /*! \brief Create Api server
  *
  *  This function is used to generate ApiServer which is used to build
@@ -416,6 +829,10 @@ func NewApiServer() *ApiServer {
   ret.router = mux.NewRouter()
   ret.versions = make(map[string]*Version)
   ret.aliases = make(map[string]*Alias)
+  ret.prefixes = make(map[string]*iPrefix)
+  ret.heartbeat = defaultStreamHeartbeat
+  ret.stopping = make(chan struct{})
+  ret.limiter = NewMemoryLimitStore()
 
   ret.router.Use(ret.handleMiddleware)
   return ret
@@ -0,0 +1,432 @@
+package utils
+
+import (
+  "google.golang.org/grpc/codes"
+  "github.com/gorilla/websocket"
+  "net/http"
+  "context"
+  "strings"
+  "errors"
+  "sync"
+  "time"
+  "fmt"
+)
+
+const (
+  // @NOTE: most proxies close connections which are idle for 30 seconds or
+  // more, so we ping clients twice as often
+  defaultStreamHeartbeat = 15 * time.Second
+
+  // @NOTE: how long we wait for a control frame to be written
+  streamWriteTimeout = 5 * time.Second
+
+  // @NOTE: the number of websocket messages which are buffered before the
+  // handler receives them
+  socketIncomingSize = 16
+)
+
+type EventHandler func(*http.Request, *EventStream) error
+
+type SocketHandler func(*http.Request, *Socket) error
+
+type Event struct {
+  // @NOTE: id is sent back by browsers in Last-Event-ID when they reconnect
+  Id string
+
+  // @NOTE: name is the event type, browsers dispatch unnamed events to
+  // onmessage
+  Name string
+
+  // @NOTE: data is the payload, it could contain several lines
+  Data string
+
+  // @NOTE: retry tells browsers how long they wait before reconnecting
+  Retry time.Duration
+}
+
+type EventStream struct {
+  writer http.ResponseWriter
+  flusher http.Flusher
+  ctx context.Context
+  lock sync.Mutex
+}
+
+type Socket struct {
+  conn *websocket.Conn
+
+  // @NOTE: incoming receives messages from the reading goroutine, it's
+  // closed when the connection is broken
+  incoming chan []byte
+  ctx context.Context
+  lock sync.Mutex
+}
+
+var streamUpgrader = websocket.Upgrader{
+  ReadBufferSize: 4096,
+  WriteBufferSize: 4096,
+}
+
+/*! \brief Resolve GET requests of this endpoint with a server-sent events
+ *
+ *  This method is used to push events to browsers, the handler keeps
+ * sending events until the request's context is done, which happens when
+ * client disconnects or the ApiServer is shutting down. Comments are sent
+ * periodically as heartbeat
+ *
+ *  \param handler: the handler which produces events
+ *  \return *Api: to make a chain call, we will return itself to make calling
+ *                next function easily
+ */
+func (self *Api) Events(handler EventHandler) *Api {
+  server := self.owner
+
+  return self.Handle("GET", func(w http.ResponseWriter, r *http.Request) {
+    flusher, ok := w.(http.Flusher)
+    if ! ok {
+      server.Fail(w)(NewError(codes.Internal, "streaming isn't supported"))
+      return
+    }
+
+    ctx, finish, err := server.openStream(r)
+    if err != nil {
+      server.Fail(w)(NewError(codes.Unavailable, err.Error()))
+      return
+    }
+
+    defer finish()
+
+    ctx, cancel := context.WithCancel(ctx)
+    stream := &EventStream{writer: w, flusher: flusher, ctx: ctx}
+    beating := make(chan struct{})
+
+    w.Header().Set("Content-Type", "text/event-stream")
+    w.Header().Set("Cache-Control", "no-cache")
+    w.Header().Set("Connection", "keep-alive")
+    w.Header().Set("X-Accel-Buffering", "no")
+    w.WriteHeader(200)
+    flusher.Flush()
+
+    go func() {
+      stream.beat(server.heartbeatOf())
+      close(beating)
+    }()
+
+    if err := handler(r.WithContext(ctx), stream); err != nil {
+      stream.Send(Event{Name: "error", Data: err.Error()})
+    }
+
+    // @NOTE: the writer mustn't be touched after this handler returns, so
+    // we wait for the heartbeat to stop
+    cancel()
+    <-beating
+  })
+}
+
+/*! \brief Resolve GET requests of this endpoint with a websocket
+ *
+ *  This method is used to upgrade requests to websocket, the handler owns
+ * the socket until it returns, then the socket is closed. Pings are sent
+ * periodically and clients which don't answer are disconnected
+ *
+ *  \param handler: the handler which talks with client
+ *  \return *Api: to make a chain call, we will return itself to make calling
+ *                next function easily
+ */
+func (self *Api) Socket(handler SocketHandler) *Api {
+  server := self.owner
+
+  return self.Handle("GET", func(w http.ResponseWriter, r *http.Request) {
+    if ! websocket.IsWebSocketUpgrade(r) {
+      server.Fail(w)(NewError(codes.InvalidArgument, "websocket is required"))
+      return
+    }
+
+    ctx, finish, err := server.openStream(r)
+    if err != nil {
+      server.Fail(w)(NewError(codes.Unavailable, err.Error()))
+      return
+    }
+
+    defer finish()
+
+    // @NOTE: upgrader writes the error response by itself
+    conn, err := streamUpgrader.Upgrade(w, r, nil)
+    if err != nil {
+      return
+    }
+
+    ctx, cancel := context.WithCancel(ctx)
+    socket := &Socket{
+      conn: conn,
+      incoming: make(chan []byte, socketIncomingSize),
+      ctx: ctx,
+    }
+    heartbeat := server.heartbeatOf()
+
+    go socket.read(heartbeat, cancel)
+    go socket.beat(heartbeat)
+
+    err = handler(r.WithContext(ctx), socket)
+
+    select {
+    case <-server.stopping:
+      socket.close(websocket.CloseGoingAway, "server is shutting down")
+
+    default:
+      if err != nil {
+        socket.close(websocket.CloseInternalServerErr, err.Error())
+      } else {
+        socket.close(websocket.CloseNormalClosure, "")
+      }
+    }
+
+    cancel()
+  })
+}
+
+/*! \brief Register a new stream
+ *
+ *  \param r: the request
+ *  \return context.Context: the context which is done when client leaves or
+ *                           the server is shutting down
+ *  \return func(): the function which must be called when stream finishes
+ *  \return error: if the server is shutting down, we will receive an error
+ */
+func (self *ApiServer) openStream(r *http.Request) (context.Context, func(), error) {
+  self.lock.Lock()
+  select {
+  case <-self.stopping:
+    self.lock.Unlock()
+    return nil, nil, errors.New("server is shutting down")
+
+  default:
+    self.streams.Add(1)
+  }
+  self.lock.Unlock()
+
+  ctx, cancel := context.WithCancel(r.Context())
+
+  go func() {
+    select {
+    case <-self.stopping:
+      cancel()
+
+    case <-ctx.Done():
+    }
+  }()
+
+  return ctx, func() {
+    cancel()
+    self.streams.Done()
+  }, nil
+}
+
+/*! \brief Get the heartbeat interval
+ *
+ *  \return time.Duration: the interval
+ */
+func (self *ApiServer) heartbeatOf() time.Duration {
+  self.lock.RLock()
+  defer self.lock.RUnlock()
+
+  return self.heartbeat
+}
+
+/* ------------------------- EventStream -------------------------- */
+
+/*! \brief Send an event to client
+ *
+ *  \param event: the event
+ *  \return error: if client has left, we will receive an error
+ */
+func (self *EventStream) Send(event Event) error {
+  var message strings.Builder
+
+  if len(event.Id) > 0 {
+    fmt.Fprintf(&message, "id: %s\n", event.Id)
+  }
+
+  if len(event.Name) > 0 {
+    fmt.Fprintf(&message, "event: %s\n", event.Name)
+  }
+
+  if event.Retry > 0 {
+    fmt.Fprintf(&message, "retry: %d\n", event.Retry / time.Millisecond)
+  }
+
+  for _, line := range strings.Split(event.Data, "\n") {
+    fmt.Fprintf(&message, "data: %s\n", line)
+  }
+
+  message.WriteString("\n")
+  return self.write(message.String())
+}
+
+/*! \brief Get the context of this stream
+ *
+ *  \return context.Context: the context which is done when client leaves
+ *                           or the server is shutting down
+ */
+func (self *EventStream) Context() context.Context {
+  return self.ctx
+}
+
+/*! \brief Write raw data to client and flush it immediately
+ *
+ *  \param data: the data
+ *  \return error: if client has left, we will receive an error
+ */
+func (self *EventStream) write(data string) error {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
+  if err := self.ctx.Err(); err != nil {
+    return err
+  } else if _, err := self.writer.Write([]byte(data)); err != nil {
+    return err
+  }
+
+  self.flusher.Flush()
+  return nil
+}
+
+/*! \brief Send heartbeats until the stream finishes
+ *
+ *  \param heartbeat: the interval
+ */
+func (self *EventStream) beat(heartbeat time.Duration) {
+  ticker := time.NewTicker(heartbeat)
+  defer ticker.Stop()
+
+  for {
+    select {
+    case <-ticker.C:
+      // @NOTE: lines which begin with colon are comments and ignored by
+      // browsers
+      if self.write(": ping\n\n") != nil {
+        return
+      }
+
+    case <-self.ctx.Done():
+      return
+    }
+  }
+}
+
+/* ---------------------------- Socket ---------------------------- */
+
+/*! \brief Send a json message to client
+ *
+ *  \param message: the message which is encoded as json
+ *  \return error: if client has left, we will receive an error
+ */
+func (self *Socket) Send(message interface{}) error {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
+  self.conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+  return self.conn.WriteJSON(message)
+}
+
+/*! \brief Receive a message from client
+ *
+ *  \return []byte: the message
+ *  \return error: if client has left or the server is shutting down, we
+ *                 will receive an error
+ */
+func (self *Socket) Receive() ([]byte, error) {
+  select {
+  case message, ok := <-self.incoming:
+    if ! ok {
+      return nil, errors.New("socket is closed")
+    }
+
+    return message, nil
+
+  case <-self.ctx.Done():
+    return nil, self.ctx.Err()
+  }
+}
+
+/*! \brief Get the context of this socket
+ *
+ *  \return context.Context: the context which is done when client leaves
+ *                           or the server is shutting down
+ */
+func (self *Socket) Context() context.Context {
+  return self.ctx
+}
+
+/*! \brief Read messages until the connection is broken
+ *
+ *  This method also processes pongs, so a client which stops answering
+ * pings for two heartbeats is disconnected
+ *
+ *  \param heartbeat: the interval
+ *  \param cancel: the function which is used to cancel the socket context
+ */
+func (self *Socket) read(heartbeat time.Duration, cancel context.CancelFunc) {
+  defer cancel()
+  defer close(self.incoming)
+
+  self.conn.SetReadDeadline(time.Now().Add(2 * heartbeat))
+  self.conn.SetPongHandler(func(string) error {
+    return self.conn.SetReadDeadline(time.Now().Add(2 * heartbeat))
+  })
+
+  for {
+    _, message, err := self.conn.ReadMessage()
+    if err != nil {
+      return
+    }
+
+    self.conn.SetReadDeadline(time.Now().Add(2 * heartbeat))
+
+    select {
+    case self.incoming <- message:
+    case <-self.ctx.Done():
+      return
+    }
+  }
+}
+
+/*! \brief Send pings until the socket finishes
+ *
+ *  \param heartbeat: the interval
+ */
+func (self *Socket) beat(heartbeat time.Duration) {
+  ticker := time.NewTicker(heartbeat)
+  defer ticker.Stop()
+
+  for {
+    select {
+    case <-ticker.C:
+      deadline := time.Now().Add(streamWriteTimeout)
+
+      if self.conn.WriteControl(websocket.PingMessage, nil, deadline) != nil {
+        return
+      }
+
+    case <-self.ctx.Done():
+      return
+    }
+  }
+}
+
+/*! \brief Close the socket with a close frame
+ *
+ *  \param code: the close code
+ *  \param reason: the reason which is sent to client
+ */
+func (self *Socket) close(code int, reason string) {
+  deadline := time.Now().Add(streamWriteTimeout)
+
+  // @NOTE: control frames can't carry more than 125 bytes
+  if len(reason) > 123 {
+    reason = reason[:123]
+  }
+
+  self.conn.WriteControl(websocket.CloseMessage,
+                         websocket.FormatCloseMessage(code, reason), deadline)
+  self.conn.Close()
+}
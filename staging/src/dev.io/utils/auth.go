@@ -0,0 +1,803 @@
+package utils
+
+import (
+  "google.golang.org/grpc/metadata"
+  "google.golang.org/grpc/status"
+  "google.golang.org/grpc/codes"
+  "google.golang.org/grpc"
+  "github.com/golang-jwt/jwt/v4"
+  "encoding/base64"
+  "encoding/json"
+  "crypto/elliptic"
+  "crypto/subtle"
+  "crypto/sha256"
+  "crypto/ecdsa"
+  "crypto/rsa"
+  "io/ioutil"
+  "math/big"
+  "net/http"
+  "context"
+  "strings"
+  "errors"
+  "sync"
+  "time"
+  "fmt"
+  "os"
+)
+
+// @NOTE: how often tokens could make us check the JWKS file
+const defaultJwksInterval = 30 * time.Second
+
+type iPrincipalKey struct {}
+
+type Principal struct {
+  // @NOTE: name identifies who sends the request, e.g the subject of a
+  // token or the user of basic auth
+  Name string
+
+  // @NOTE: groups and scopes are granted by the credential, authorization
+  // uses them to decide what the principal could do
+  Groups []string
+  Scopes []string
+
+  // @NOTE: kind tells which authenticator produces this principal, e.g
+  // jwt, apikey, basic or serviceaccount
+  Kind string
+
+  // @NOTE: namespace is the Kubernetes namespace of a service account, it's
+  // empty with the other kinds
+  Namespace string
+
+  // @NOTE: claims stores every claim of a token, it's nil with the other
+  // kinds
+  Claims map[string]interface{}
+}
+
+type Authenticator interface {
+  // @NOTE: authenticators return nil and nil when the request doesn't carry
+  // the credential they understand, so the next one could try. An error
+  // means the credential is there but it's invalid
+  Authenticate(r *http.Request) (*Principal, error)
+
+  // @NOTE: challenge is sent by WWW-Authenticate when a request is refused,
+  // empty means nothing to send
+  Challenge() string
+}
+
+type JwtAuthenticator struct {
+  // @NOTE: keys maps key ids to public keys or hmac secrets, tokens which
+  // don't carry a key id are verified with the key of empty id
+  keys map[string]interface{}
+
+  // @NOTE: loaded keeps keys of the JWKS file apart from static keys, it's
+  // replaced as a whole on reloading so removed keys stop being trusted
+  loaded map[string]interface{}
+
+  // @NOTE: jwks is the file which keys are loaded from, it's reloaded when
+  // the file has been modified
+  jwks string
+  modified time.Time
+
+  // @NOTE: tokens are sent by anyone, so the file is checked at most once
+  // per interval no matter how many of them we receive
+  interval time.Duration
+  checked time.Time
+
+  issuer, audience string
+  lock sync.RWMutex
+}
+
+type ApiKeyAuthenticator struct {
+  // @NOTE: header is where clients put their key
+  header string
+
+  // @NOTE: keys maps sha256 of keys to principals so keys are never kept
+  // in memory as they are
+  keys map[[sha256.Size]byte]*Principal
+  lock sync.RWMutex
+}
+
+type BasicAuthenticator struct {
+  realm string
+
+  // @NOTE: users maps user names to sha256 of their passwords
+  users map[string][sha256.Size]byte
+  groups map[string][]string
+  lock sync.RWMutex
+}
+
+/*! \brief Add authenticators to this server
+ *
+ *  This method is used to build the authenticator chain, every request is
+ * passed to authenticators in order and the first principal wins. Requests
+ * which don't carry any credential are served as anonymous
+ *
+ *  \param authenticators: the authenticators
+ *  \return *ApiServer: to make a chain call, we will return itself
+ *                      to make calling next function easily
+ */
+func (self *ApiServer) Authenticate(authenticators ...Authenticator) *ApiServer {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
+  self.authenticators = append(self.authenticators, authenticators...)
+  return self
+}
+
+/*! \brief Authenticate a request with our authenticator chain
+ *
+ *  \param r: the request
+ *  \return *Principal: the principal or nil if the request is anonymous
+ *  \return error: if a credential is invalid, we will receive an error
+ */
+func (self *ApiServer) authenticate(r *http.Request) (*Principal, error) {
+  self.lock.RLock()
+  authenticators := self.authenticators
+  self.lock.RUnlock()
+
+  for _, authenticator := range authenticators {
+    if principal, err := authenticator.Authenticate(r); err != nil {
+      return nil, err
+    } else if principal != nil {
+      return principal, nil
+    }
+  }
+
+  return nil, nil
+}
+
+/*! \brief Refuse a request which isn't authenticated
+ *
+ *  \param w: the response writer
+ *  \param message: the reason
+ */
+func (self *ApiServer) challenge(w http.ResponseWriter, message string) {
+  self.lock.RLock()
+  for _, authenticator := range self.authenticators {
+    if challenge := authenticator.Challenge(); len(challenge) > 0 {
+      w.Header().Add("WWW-Authenticate", challenge)
+    }
+  }
+  self.lock.RUnlock()
+
+  self.Fail(w)(NewError(codes.Unauthenticated, message))
+}
+
+/* -------------------------- Principal --------------------------- */
+
+/*! \brief Get the principal of a request
+ *
+ *  \param ctx: the context of the request
+ *  \return *Principal: the principal or nil if the request is anonymous
+ */
+func PrincipalOf(ctx context.Context) *Principal {
+  principal, _ := ctx.Value(iPrincipalKey{}).(*Principal)
+  return principal
+}
+
+/*! \brief Check if the principal belongs to a group
+ *
+ *  \param group: the group
+ *  \return bool: true if it does
+ */
+func (self *Principal) HasGroup(group string) bool {
+  for _, item := range self.Groups {
+    if item == group {
+      return true
+    }
+  }
+
+  return false
+}
+
+/*! \brief Check if the credential of the principal carries a scope
+ *
+ *  \param scope: the scope
+ *  \return bool: true if it does
+ */
+func (self *Principal) HasScope(scope string) bool {
+  for _, item := range self.Scopes {
+    if item == scope {
+      return true
+    }
+  }
+
+  return false
+}
+
+/*! \brief Attach a principal to a context
+ *
+ *  \param ctx: the context
+ *  \param principal: the principal
+ *  \return context.Context: the context which carries the principal
+ */
+func withPrincipal(ctx context.Context, principal *Principal) context.Context {
+  return context.WithValue(ctx, iPrincipalKey{}, principal)
+}
+
+/* ----------------------- JwtAuthenticator ----------------------- */
+
+/*! \brief Create an authenticator of bearer JWTs
+ *
+ *  \return *JwtAuthenticator: the authenticator, keys must be added by Key
+ *                             or Jwks before using it
+ */
+func NewJwtAuthenticator() *JwtAuthenticator {
+  return &JwtAuthenticator{
+    keys: make(map[string]interface{}),
+    loaded: make(map[string]interface{}),
+    interval: defaultJwksInterval,
+  }
+}
+
+/*! \brief Add a static key
+ *
+ *  \param kid: the key id, empty means tokens without key id
+ *  \param key: *rsa.PublicKey, *ecdsa.PublicKey or []byte for hmac
+ *  \return *JwtAuthenticator: to make a chain call, we will return itself
+ *                             to make calling next function easily
+ */
+func (self *JwtAuthenticator) Key(kid string, key interface{}) *JwtAuthenticator {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
+  self.keys[kid] = key
+  return self
+}
+
+/*! \brief Require claims of tokens
+ *
+ *  \param issuer: the expected iss, empty means any issuer
+ *  \param audience: the expected aud, empty means any audience
+ *  \return *JwtAuthenticator: to make a chain call, we will return itself
+ *                             to make calling next function easily
+ */
+func (self *JwtAuthenticator) Expect(issuer, audience string) *JwtAuthenticator {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
+  self.issuer = issuer
+  self.audience = audience
+  return self
+}
+
+/*! \brief Load keys from a local JWKS file
+ *
+ *  \param path: the path of the file
+ *  \return error: if the file can't be read or parsed, we will receive an
+ *                 error
+ */
+func (self *JwtAuthenticator) Jwks(path string) error {
+  keys, modified, err := loadJwks(path)
+  if err != nil {
+    return err
+  }
+
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
+  self.loaded = keys
+  self.jwks = path
+  self.modified = modified
+  self.checked = time.Now()
+  return nil
+}
+
+/*! \brief Configure how often the JWKS file could be checked
+ *
+ *  \param interval: the minimum time between two checks of the file
+ *  \return *JwtAuthenticator: to make a chain call, we will return itself
+ *                             to make calling next function easily
+ */
+func (self *JwtAuthenticator) Refresh(interval time.Duration) *JwtAuthenticator {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
+  self.interval = interval
+  return self
+}
+
+func (self *JwtAuthenticator) Challenge() string {
+  return "Bearer"
+}
+
+/*! \brief Authenticate a bearer token
+ *
+ *  When an issuer is expected, tokens of other issuers aren't ours and go
+ * to the next authenticator, e.g service account tokens. Without it every
+ * bearer token is claimed, so this authenticator must be the last one of
+ * them in the chain
+ *
+ *  \param r: the request
+ *  \return *Principal: the principal, or nil if the request isn't ours
+ *  \return error: if the token is ours but it's invalid
+ */
+func (self *JwtAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+  header := r.Header.Get("Authorization")
+
+  if len(header) < 7 || ! strings.EqualFold(header[:7], "Bearer ") {
+    return nil, nil
+  }
+
+  raw := strings.TrimSpace(header[7:])
+
+  self.lock.RLock()
+  issuer := self.issuer
+  self.lock.RUnlock()
+
+  if len(issuer) > 0 {
+    claims := jwt.MapClaims{}
+
+    if _, _, err := new(jwt.Parser).ParseUnverified(raw, claims); err == nil && ! claims.VerifyIssuer(issuer, true) {
+      return nil, nil
+    }
+  }
+
+  return self.Verify(raw)
+}
+
+/*! \brief Verify a token and build its principal
+ *
+ *  \param raw: the token
+ *  \return *Principal: the principal which is built from claims
+ *  \return error: if the token is invalid, we will receive an error
+ */
+func (self *JwtAuthenticator) Verify(raw string) (*Principal, error) {
+  claims := jwt.MapClaims{}
+
+  token, err := jwt.ParseWithClaims(raw, claims, self.keyOf)
+  if err != nil {
+    return nil, err
+  } else if ! token.Valid {
+    return nil, errors.New("token is invalid")
+  }
+
+  self.lock.RLock()
+  issuer, audience := self.issuer, self.audience
+  self.lock.RUnlock()
+
+  if len(issuer) > 0 && ! claims.VerifyIssuer(issuer, true) {
+    return nil, errors.New("token is issued by another issuer")
+  } else if len(audience) > 0 && ! claims.VerifyAudience(audience, true) {
+    return nil, errors.New("token is issued for another audience")
+  }
+
+  ret := &Principal{Kind: "jwt", Claims: claims}
+  ret.Name, _ = claims["sub"].(string)
+  ret.Groups = listOfClaim(claims["groups"])
+
+  if scope, ok := claims["scope"].(string); ok {
+    ret.Scopes = strings.Fields(scope)
+  } else {
+    ret.Scopes = listOfClaim(claims["scp"])
+  }
+
+  return ret, nil
+}
+
+/*! \brief Find the key which verifies a token
+ *
+ *  This method also makes sure the algorithm of the token matches the key
+ * so a public key is never used as a hmac secret
+ *
+ *  \param token: the parsed token
+ *  \return interface{}: the key
+ *  \return error: if the key isn't found, we will receive an error
+ */
+func (self *JwtAuthenticator) keyOf(token *jwt.Token) (interface{}, error) {
+  kid, _ := token.Header["kid"].(string)
+
+  self.reload()
+  self.lock.RLock()
+  key, ok := self.keys[kid]
+  if ! ok {
+    key, ok = self.loaded[kid]
+  }
+  self.lock.RUnlock()
+
+  if ! ok {
+    return nil, errors.New(fmt.Sprintf("not found key %s", kid))
+  }
+
+  switch key.(type) {
+    case *rsa.PublicKey:
+      if _, ok := token.Method.(*jwt.SigningMethodRSA); ok {
+        return key, nil
+      } else if _, ok := token.Method.(*jwt.SigningMethodRSAPSS); ok {
+        return key, nil
+      }
+
+    case *ecdsa.PublicKey:
+      if _, ok := token.Method.(*jwt.SigningMethodECDSA); ok {
+        return key, nil
+      }
+
+    case []byte:
+      if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+        return key, nil
+      }
+  }
+
+  return nil, errors.New(fmt.Sprintf("key %s doesn't accept %s", kid,
+                                     token.Method.Alg()))
+}
+
+/*! \brief Reload keys from the JWKS file if it has been modified
+ *
+ *  The file is checked at most once per interval and it's read without
+ * holding the lock, so requests are never blocked by reading it. Keys of
+ * the file replace the loaded ones, so a removed key is rejected since then
+ */
+func (self *JwtAuthenticator) reload() {
+  self.lock.RLock()
+  due := len(self.jwks) > 0 && time.Since(self.checked) >= self.interval
+  self.lock.RUnlock()
+
+  if ! due {
+    return
+  }
+
+  self.lock.Lock()
+  if time.Since(self.checked) < self.interval {
+    self.lock.Unlock()
+    return
+  }
+
+  path, modified := self.jwks, self.modified
+  self.checked = time.Now()
+  self.lock.Unlock()
+
+  if info, err := os.Stat(path); err != nil || info.ModTime().Equal(modified) {
+    return
+  }
+
+  keys, modified, err := loadJwks(path)
+  if err != nil {
+    return
+  }
+
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
+  self.loaded = keys
+  self.modified = modified
+}
+
+/*! \brief Load keys from a JWKS file
+ *
+ *  \param path: the path of the file
+ *  \return map[string]interface{}: the keys which are mapped by key ids
+ *  \return time.Time: the modified time of the file
+ *  \return error: if the file can't be read or parsed, we will receive an
+ *                 error
+ */
+func loadJwks(path string) (map[string]interface{}, time.Time, error) {
+  info, err := os.Stat(path)
+  if err != nil {
+    return nil, time.Time{}, err
+  }
+
+  data, err := ioutil.ReadFile(path)
+  if err != nil {
+    return nil, time.Time{}, err
+  }
+
+  keys, err := parseJwks(data)
+  if err != nil {
+    return nil, time.Time{}, err
+  }
+
+  return keys, info.ModTime(), nil
+}
+
+/* --------------------- ApiKeyAuthenticator ---------------------- */
+
+/*! \brief Create an authenticator of static API keys
+ *
+ *  \param header: the header which carries keys, empty means X-Api-Key
+ *  \return *ApiKeyAuthenticator: the authenticator
+ */
+func NewApiKeyAuthenticator(header string) *ApiKeyAuthenticator {
+  if len(header) == 0 {
+    header = "X-Api-Key"
+  }
+
+  return &ApiKeyAuthenticator{
+    header: header,
+    keys: make(map[[sha256.Size]byte]*Principal),
+  }
+}
+
+/*! \brief Add a key
+ *
+ *  \param key: the key
+ *  \param principal: the principal which owns the key
+ *  \return *ApiKeyAuthenticator: to make a chain call, we will return itself
+ *                                to make calling next function easily
+ */
+func (self *ApiKeyAuthenticator) Key(key string, principal Principal) *ApiKeyAuthenticator {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
+  principal.Kind = "apikey"
+  self.keys[sha256.Sum256([]byte(key))] = &principal
+  return self
+}
+
+func (self *ApiKeyAuthenticator) Challenge() string {
+  return ""
+}
+
+func (self *ApiKeyAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+  return self.verify(r.Header.Get(self.header))
+}
+
+/*! \brief Produce grpc interceptors which authenticate api keys
+ *
+ *  This method is used with GRpcContext.Intercept, keys are read from the
+ * metadata which is named after our header. Calls without a key stay
+ * anonymous and calls with an unknown key are refused, like requests are
+ *
+ *  \return grpc.UnaryServerInterceptor: the interceptor of unary calls
+ *  \return grpc.StreamServerInterceptor: the interceptor of streams
+ */
+func (self *ApiKeyAuthenticator) Interceptors() (grpc.UnaryServerInterceptor,
+                                                 grpc.StreamServerInterceptor) {
+  unary := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+                handler grpc.UnaryHandler) (interface{}, error) {
+    ctx, err := self.intercept(ctx)
+    if err != nil {
+      return nil, err
+    }
+
+    return handler(ctx, req)
+  }
+
+  stream := func(srv interface{}, stream grpc.ServerStream,
+                 info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+    ctx, err := self.intercept(stream.Context())
+    if err != nil {
+      return err
+    }
+
+    return handler(srv, &iGRpcServerStream{ServerStream: stream, ctx: ctx})
+  }
+
+  return unary, stream
+}
+
+/*! \brief Authenticate the key of a call
+ *
+ *  \param ctx: the context of the call
+ *  \return context.Context: the context which carries the principal
+ *  \return error: the status error if the key is unknown
+ */
+func (self *ApiKeyAuthenticator) intercept(ctx context.Context) (context.Context, error) {
+  var key string
+
+  if incoming, ok := metadata.FromIncomingContext(ctx); ok {
+    if values := incoming.Get(strings.ToLower(self.header)); len(values) > 0 {
+      key = values[0]
+    }
+  }
+
+  principal, err := self.verify(key)
+  if err != nil {
+    return nil, status.Error(codes.Unauthenticated, err.Error())
+  } else if principal == nil {
+    return ctx, nil
+  }
+
+  return withPrincipal(ctx, principal), nil
+}
+
+/*! \brief Find the principal which owns a key
+ *
+ *  \param key: the key, empty means the caller is anonymous
+ *  \return *Principal: the principal or nil if there is no key
+ *  \return error: if the key is unknown, we will receive an error
+ */
+func (self *ApiKeyAuthenticator) verify(key string) (*Principal, error) {
+  if len(key) == 0 {
+    return nil, nil
+  }
+
+  self.lock.RLock()
+  principal, ok := self.keys[sha256.Sum256([]byte(key))]
+  self.lock.RUnlock()
+
+  if ! ok {
+    return nil, errors.New("api key is invalid")
+  }
+
+  return principal, nil
+}
+
+/* ---------------------- BasicAuthenticator ---------------------- */
+
+/*! \brief Create an authenticator of HTTP basic auth
+ *
+ *  \param realm: the realm which is shown to browsers
+ *  \return *BasicAuthenticator: the authenticator
+ */
+func NewBasicAuthenticator(realm string) *BasicAuthenticator {
+  return &BasicAuthenticator{
+    realm: realm,
+    users: make(map[string][sha256.Size]byte),
+    groups: make(map[string][]string),
+  }
+}
+
+/*! \brief Add a user
+ *
+ *  \param name: the user name
+ *  \param password: the password
+ *  \param groups: the groups of this user
+ *  \return *BasicAuthenticator: to make a chain call, we will return itself
+ *                               to make calling next function easily
+ */
+func (self *BasicAuthenticator) User(name, password string,
+                                     groups ...string) *BasicAuthenticator {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
+  self.users[name] = sha256.Sum256([]byte(password))
+  self.groups[name] = groups
+  return self
+}
+
+func (self *BasicAuthenticator) Challenge() string {
+  return fmt.Sprintf("Basic realm=%q", self.realm)
+}
+
+func (self *BasicAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+  name, password, ok := r.BasicAuth()
+  if ! ok {
+    return nil, nil
+  }
+
+  self.lock.RLock()
+  expected, found := self.users[name]
+  groups := self.groups[name]
+  self.lock.RUnlock()
+
+  // @NOTE: compare hashes in constant time, unknown users are compared too
+  // so timing won't tell which users exist
+  hash := sha256.Sum256([]byte(password))
+
+  if subtle.ConstantTimeCompare(hash[:], expected[:]) != 1 || ! found {
+    return nil, errors.New("user or password is invalid")
+  }
+
+  return &Principal{Name: name, Groups: groups, Kind: "basic"}, nil
+}
+
+/* --------------------------- helper ----------------------------- */
+
+/*! \brief Read a claim which is a list of strings
+ *
+ *  \param claim: the claim
+ *  \return []string: the list, a single string becomes a list of one
+ */
+func listOfClaim(claim interface{}) []string {
+  switch value := claim.(type) {
+    case string:
+      return []string{value}
+
+    case []interface{}:
+      ret := make([]string, 0, len(value))
+
+      for _, item := range value {
+        if text, ok := item.(string); ok {
+          ret = append(ret, text)
+        }
+      }
+
+      return ret
+
+    default:
+      return nil
+  }
+}
+
+/*! \brief Parse keys of a JWKS document
+ *
+ *  \param data: the document
+ *  \return map[string]interface{}: the keys which are indexed by key ids,
+ *                                  RSA, EC and oct keys are supported
+ *  \return error: if the document is malformed, we will receive an error
+ */
+func parseJwks(data []byte) (map[string]interface{}, error) {
+  var jwks struct {
+    Keys []struct {
+      Kid string `json:"kid"`
+      Kty string `json:"kty"`
+      Use string `json:"use"`
+      Crv string `json:"crv"`
+      N string `json:"n"`
+      E string `json:"e"`
+      X string `json:"x"`
+      Y string `json:"y"`
+      K string `json:"k"`
+    } `json:"keys"`
+  }
+
+  if err := json.Unmarshal(data, &jwks); err != nil {
+    return nil, err
+  }
+
+  ret := make(map[string]interface{})
+  decode := base64.RawURLEncoding.DecodeString
+
+  for _, key := range jwks.Keys {
+    if len(key.Use) > 0 && key.Use != "sig" {
+      continue
+    }
+
+    switch key.Kty {
+      case "RSA":
+        n, err := decode(key.N)
+        if err != nil {
+          return nil, err
+        }
+
+        e, err := decode(key.E)
+        if err != nil {
+          return nil, err
+        }
+
+        ret[key.Kid] = &rsa.PublicKey{
+          N: new(big.Int).SetBytes(n),
+          E: int(new(big.Int).SetBytes(e).Int64()),
+        }
+
+      case "EC":
+        var curve elliptic.Curve
+
+        switch key.Crv {
+          case "P-256":
+            curve = elliptic.P256()
+
+          case "P-384":
+            curve = elliptic.P384()
+
+          case "P-521":
+            curve = elliptic.P521()
+
+          default:
+            return nil, errors.New(fmt.Sprintf("curve %s isn't supported",
+                                               key.Crv))
+        }
+
+        x, err := decode(key.X)
+        if err != nil {
+          return nil, err
+        }
+
+        y, err := decode(key.Y)
+        if err != nil {
+          return nil, err
+        }
+
+        ret[key.Kid] = &ecdsa.PublicKey{
+          Curve: curve,
+          X: new(big.Int).SetBytes(x),
+          Y: new(big.Int).SetBytes(y),
+        }
+
+      case "oct":
+        secret, err := decode(key.K)
+        if err != nil {
+          return nil, err
+        }
+
+        ret[key.Kid] = secret
+
+      default:
+        return nil, errors.New(fmt.Sprintf("key type %s isn't supported",
+                                           key.Kty))
+    }
+  }
+
+  return ret, nil
+}
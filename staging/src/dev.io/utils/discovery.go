@@ -0,0 +1,192 @@
+package utils
+
+import (
+  "encoding/json"
+  "io/ioutil"
+  "strings"
+  "errors"
+  "fmt"
+  "net"
+)
+
+type Discovery interface {
+  // @NOTE: this method is used to list addresses of every upstream, each
+  // address is either host:port or an url
+  Resolve() ([]string, error)
+}
+
+type iStaticDiscovery struct {
+  addresses []string
+}
+
+type iDnsDiscovery struct {
+  service, proto, name string
+}
+
+type iHeadlessDiscovery struct {
+  name, port string
+}
+
+type iKubeDiscovery struct {
+  // @NOTE: path stores the file which is dumped from kubectl get endpoints
+  // -o json, it's read again every time we resolve
+  path string
+
+  // @NOTE: port stores the port name which we would like to use, the first
+  // port is used when it's empty
+  port string
+}
+
+type iKubeEndpoints struct {
+  Items []iKubeEndpoints `json:"items"`
+
+  Subsets []struct {
+    Addresses []struct {
+      Ip string `json:"ip"`
+    } `json:"addresses"`
+
+    Ports []struct {
+      Name string `json:"name"`
+      Port int `json:"port"`
+    } `json:"ports"`
+  } `json:"subsets"`
+}
+
+/*! \brief Create a discovery which always returns the same addresses
+ *
+ *  \param addresses: the addresses of upstreams
+ *  \return Discovery: the discovery object
+ */
+func NewStaticDiscovery(addresses ...string) Discovery {
+  return &iStaticDiscovery{addresses: addresses}
+}
+
+/*! \brief Create a discovery which resolves DNS SRV records
+ *
+ *  This function is used to resolve _service._proto.name records, which is
+ * the way kubernetes publishes named ports of a service
+ *
+ *  \param service: the service name, e.g http
+ *  \param proto: the protocol, e.g tcp
+ *  \param name: the domain name
+ *  \return Discovery: the discovery object
+ */
+func NewDnsDiscovery(service, proto, name string) Discovery {
+  return &iDnsDiscovery{service: service, proto: proto, name: name}
+}
+
+/*! \brief Create a discovery which resolves every address of a host
+ *
+ *  This function is used with kubernetes headless services, whose name is
+ * resolved to addresses of every ready pod
+ *
+ *  \param name: the host name, e.g orders.default.svc.cluster.local
+ *  \param port: the port which pods listen to
+ *  \return Discovery: the discovery object
+ */
+func NewHeadlessDiscovery(name, port string) Discovery {
+  return &iHeadlessDiscovery{name: name, port: port}
+}
+
+/*! \brief Create a discovery which reads a kubernetes Endpoints dump
+ *
+ *  This function is used to read upstreams from a json file of Endpoints
+ * or EndpointsList object, only ready addresses are used
+ *
+ *  \param path: the json file
+ *  \param port: the port name, the first port is used when it's empty
+ *  \return Discovery: the discovery object
+ */
+func NewKubeDiscovery(path, port string) Discovery {
+  return &iKubeDiscovery{path: path, port: port}
+}
+
+func (self *iStaticDiscovery) Resolve() ([]string, error) {
+  return append([]string{}, self.addresses...), nil
+}
+
+func (self *iDnsDiscovery) Resolve() ([]string, error) {
+  _, records, err := net.LookupSRV(self.service, self.proto, self.name)
+
+  if err != nil {
+    return nil, err
+  }
+
+  ret := make([]string, 0, len(records))
+
+  for _, record := range records {
+    ret = append(ret, net.JoinHostPort(strings.TrimSuffix(record.Target, "."),
+                                       fmt.Sprintf("%d", record.Port)))
+  }
+
+  return ret, nil
+}
+
+func (self *iHeadlessDiscovery) Resolve() ([]string, error) {
+  hosts, err := net.LookupHost(self.name)
+
+  if err != nil {
+    return nil, err
+  }
+
+  ret := make([]string, 0, len(hosts))
+
+  for _, host := range hosts {
+    ret = append(ret, net.JoinHostPort(host, self.port))
+  }
+
+  return ret, nil
+}
+
+func (self *iKubeDiscovery) Resolve() ([]string, error) {
+  var endpoints iKubeEndpoints
+
+  if data, err := ioutil.ReadFile(self.path); err != nil {
+    return nil, err
+  } else if err := json.Unmarshal(data, &endpoints); err != nil {
+    return nil, err
+  }
+
+  ret := self.collect(&endpoints, []string{})
+
+  if len(ret) == 0 {
+    return nil, errors.New(fmt.Sprintf("%s doesn't have any address",
+                                       self.path))
+  }
+
+  return ret, nil
+}
+
+/*! \brief Collect addresses of an Endpoints object
+ *
+ *  \param endpoints: the Endpoints or EndpointsList object
+ *  \param ret: the addresses which have been collected
+ *  \return []string: the addresses
+ */
+func (self *iKubeDiscovery) collect(endpoints *iKubeEndpoints,
+                                    ret []string) []string {
+  for index := range endpoints.Items {
+    ret = self.collect(&endpoints.Items[index], ret)
+  }
+
+  for _, subset := range endpoints.Subsets {
+    port := -1
+
+    for _, item := range subset.Ports {
+      if len(self.port) == 0 || item.Name == self.port {
+        port = item.Port
+        break
+      }
+    }
+
+    if port < 0 {
+      continue
+    }
+
+    for _, address := range subset.Addresses {
+      ret = append(ret, net.JoinHostPort(address.Ip, fmt.Sprintf("%d", port)))
+    }
+  }
+
+  return ret
+}
@@ -0,0 +1,270 @@
+package utils
+
+import (
+  "google.golang.org/protobuf/encoding/protojson"
+  "google.golang.org/protobuf/types/known/anypb"
+  "google.golang.org/protobuf/proto"
+  "google.golang.org/grpc/status"
+  "google.golang.org/grpc/codes"
+  legacy "github.com/golang/protobuf/proto"
+  "encoding/json"
+  "runtime/debug"
+  "net/http"
+  "errors"
+  "bufio"
+  "fmt"
+  "log"
+  "net"
+)
+
+type ErrHandler func(http.ResponseWriter, *http.Request) error
+
+type iRescuedWriter struct {
+  http.ResponseWriter
+
+  // @NOTE: written is true once the handler has sent headers or a part of
+  // the body, a panic can't be turned into an envelope anymore then
+  written bool
+}
+
+type Error struct {
+  // @NOTE: code is shared with grpc, HttpStatusOf decides the code of our
+  // json envelope
+  Code codes.Code
+  Message string
+
+  // @NOTE: details are sent as they are through grpc and as json with
+  // their @type inside our json envelope, e.g errdetails.BadRequest
+  Details []proto.Message
+}
+
+/*! \brief Create an error which is understood by ApiServer and GRpcContext
+ *
+ *  \param code: the grpc status code
+ *  \param message: the message which is shown to client
+ *  \param details: the details of this error
+ *  \return *Error: the error, it could be returned by grpc methods and
+ *                  by ErrHandler, or be used with panic inside handlers
+ */
+func NewError(code codes.Code, message string, details ...proto.Message) *Error {
+  return &Error{Code: code, Message: message, Details: details}
+}
+
+/*! \brief Convert any error to our error
+ *
+ *  This function is used to understand errors of grpc calls, of contexts
+ * and of handlers in the same way, other errors become codes.Unknown
+ *
+ *  \param err: the error
+ *  \return *Error: our error or nil if err is nil
+ */
+func ErrorOf(err error) *Error {
+  var ret *Error
+
+  if err == nil {
+    return nil
+  } else if errors.As(err, &ret) {
+    return ret
+  }
+
+  reason, ok := status.FromError(err)
+  if ! ok {
+    reason = status.FromContextError(err)
+  }
+
+  ret = &Error{Code: reason.Code(), Message: reason.Message()}
+
+  for _, detail := range reason.Details() {
+    if message, ok := detail.(legacy.Message); ok {
+      ret.Details = append(ret.Details, legacy.MessageV2(message))
+    }
+  }
+
+  return ret
+}
+
+func (self *Error) Error() string {
+  return fmt.Sprintf("%s: %s", self.Code, self.Message)
+}
+
+/*! \brief Convert this error to a grpc status
+ *
+ *  This method is used by grpc to send our error to clients, so grpc
+ * methods could return *Error directly
+ *
+ *  \return *status.Status: the status
+ */
+func (self *Error) GRPCStatus() *status.Status {
+  ret := status.New(self.Code, self.Message)
+
+  if len(self.Details) == 0 {
+    return ret
+  }
+
+  details := []legacy.Message{}
+
+  for _, detail := range self.Details {
+    details = append(details, legacy.MessageV1(detail))
+  }
+
+  if detailed, err := ret.WithDetails(details...); err == nil {
+    return detailed
+  }
+
+  return ret
+}
+
+/*! \brief Get the code of our json envelope
+ *
+ *  \return int: the http status code
+ */
+func (self *Error) Status() int {
+  return HttpStatusOf(self.Code)
+}
+
+/*! \brief Format the data of our json envelope
+ *
+ *  The data is the message alone like every Nok does, errors with details
+ * produce an object of the message and the details instead
+ *
+ *  \return string: the data in json
+ */
+func (self *Error) data() string {
+  var ret []byte
+
+  if len(self.Details) == 0 {
+    ret, _ = json.Marshal(self.Message)
+  } else {
+    body := struct {
+      Message string `json:"message"`
+      Details []json.RawMessage `json:"details"`
+    }{Message: self.Message}
+
+    for _, detail := range self.Details {
+      if wrapped, err := anypb.New(detail); err != nil {
+        continue
+      } else if data, err := protojson.Marshal(wrapped); err == nil {
+        body.Details = append(body.Details, json.RawMessage(data))
+      }
+    }
+
+    ret, _ = json.Marshal(body)
+  }
+
+  return string(ret)
+}
+
+/*! \brief Set handler which returns errors to resolve specific endpoint's method
+ *
+ *  This method works like Handle but errors which are returned by the
+ * handler are written by Fail, so handlers don't need to pack them
+ *
+ *  \param method: the method we would like to resolve
+ *  \param handler: the handler
+ *  \return *Api: to make a chain call, we will return itself to make calling
+ *                next function easily
+ */
+func (self *Api) HandleErr(method string, handler ErrHandler) *Api {
+  server := self.owner
+
+  return self.Handle(method, func(w http.ResponseWriter, r *http.Request) {
+    if err := handler(w, r); err != nil {
+      server.Fail(w)(err)
+    }
+  })
+}
+
+/*! \brief Send an error to client
+ *
+ *  This function is used to produce a lambda which converts an error by
+ * ErrorOf and writes it like Nok, the code comes from HttpStatusOf and is
+ * used as the http status too. Every error which is raised by ApiServer
+ * itself is written here, so clients see the same status and envelope
+ *
+ *  \param w: the response writer
+ *  \return func(error): a lambda which is used to pack an error into an
+ *                       json object
+ */
+func (self *ApiServer) Fail(w http.ResponseWriter) func(error) {
+  return func(err error) {
+    fail(w, err)
+  }
+}
+
+/*! \brief Write an error with its http status and our json envelope
+ *
+ *  \param w: the response writer
+ *  \param err: the error, nil writes nothing
+ */
+func fail(w http.ResponseWriter, err error) {
+  if reason := ErrorOf(err); reason != nil {
+    w.WriteHeader(reason.Status())
+    pack(w, reason.Status(), reason.data())
+  }
+}
+
+/*! \brief Recover a panic of a handler
+ *
+ *  This method is used with defer, panics of *Error are written like they
+ * are returned, other panics are logged with their stack and become 500.
+ * Nothing is written if the handler has already started its response
+ *
+ *  \param w: the response writer
+ *  \param r: the request
+ *  \param name: the name of the handler which is used in logs
+ */
+func (self *ApiServer) rescue(w *iRescuedWriter, r *http.Request, name string) {
+  value := recover()
+
+  if value == nil {
+    return
+  } else if value == http.ErrAbortHandler {
+    // @NOTE: net/http uses this panic to abort a response silently
+    panic(value)
+  }
+
+  var reason *Error
+
+  if err, ok := value.(error); ! ok || ! errors.As(err, &reason) {
+    log.Printf("panic in %s, request %s: %v\n%s", name,
+               RequestIdOf(r.Context()), value, debug.Stack())
+    reason = NewError(codes.Internal, "Internal server error")
+  }
+
+  // @NOTE: the status and a part of the body may have been sent already,
+  // another envelope would only corrupt the response
+  if w.written {
+    log.Printf("can't send %s to request %s, its response has been started",
+               reason.Error(), RequestIdOf(r.Context()))
+  } else {
+    self.Fail(w)(reason)
+  }
+}
+
+/* ------------------------ iRescuedWriter ------------------------ */
+
+func (self *iRescuedWriter) WriteHeader(status int) {
+  self.written = true
+  self.ResponseWriter.WriteHeader(status)
+}
+
+func (self *iRescuedWriter) Write(data []byte) (int, error) {
+  self.written = true
+  return self.ResponseWriter.Write(data)
+}
+
+func (self *iRescuedWriter) Flush() {
+  if flusher, ok := self.ResponseWriter.(http.Flusher); ok {
+    self.written = true
+    flusher.Flush()
+  }
+}
+
+func (self *iRescuedWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+  if hijacker, ok := self.ResponseWriter.(http.Hijacker); ok {
+    self.written = true
+    return hijacker.Hijack()
+  }
+
+  return nil, nil, errors.New("response writer can't be hijacked")
+}
@@ -1,10 +1,573 @@
 package utils
 
+import (
+  "google.golang.org/genproto/googleapis/api/annotations"
+  "google.golang.org/protobuf/reflect/protoregistry"
+  "google.golang.org/protobuf/reflect/protoreflect"
+  "google.golang.org/protobuf/encoding/protojson"
+  "google.golang.org/protobuf/types/dynamicpb"
+  "google.golang.org/protobuf/proto"
+  "google.golang.org/grpc/codes"
+  "google.golang.org/grpc"
+  "github.com/gorilla/mux"
+
+  legacy "github.com/golang/protobuf/proto"
+
+  "encoding/json"
+  "net/http"
+  "strconv"
+  "strings"
+  "errors"
+  "sync"
+  "fmt"
+  "io"
+)
+
 type iApiGateway struct {
+  // @NOTE: transport is shared by every upstream to reuse connections
+  transport *http.Transport
+
+  // @NOTE: upstreams stores every upstream which is proxied by this gateway
+  upstreams []*Upstream
+
+  lock sync.Mutex
+}
+
+type iGrpcUpstream struct {
+  // @NOTE: version stores the version which we use to negotiate with
+  // implementers
+  version string
+
+  // @NOTE: connection stores the connection to implementers, it's provided
+  // by GRpcContext when the upstream is connected
+  connection *grpc.ClientConn
+
+  // @NOTE: sock stores the socket which GRpcContext assigned to us
+  sock int
 }
 
 type iGrpcGateway struct {
+  // @NOTE: version stores the version which the proxy is served with
+  version string
+
+  // @NOTE: local is the connection to implementers of our own GRpcContext,
+  // it's used to transcode http requests
+  local *iGrpcUpstream
+
+  // @NOTE: targets stores every connection which is used by proxy rules,
+  // rules which route to the same target or discovery share one connection
+  targets []*iGrpcTarget
+
+  // @NOTE: rules stores every proxy rule, they are matched in order
+  rules []*ProxyRule
+
+  lock sync.RWMutex
 }
 
 type Gateway struct {
+  // @NOTE: api is the server which exposes routes of this gateway
+  api *ApiServer
+
+  // @NOTE: rpc is the context which is used to reach implementers
+  rpc *GRpcContext
+
+  http *iApiGateway
+  grpc *iGrpcGateway
+}
+
+/*! \brief Connect the gateway to implementers
+ *
+ *  This method is used to connect the gateway to implementers which are
+ * served by the GRpcContext, the gateway works as an invent here
+ *
+ *  \param version: the version we would like to negotiate with implementers
+ *  \return error: if everything ok, we will receive nil object otherwide we
+ *                 will receive error which indicate issue during connecting
+ */
+func (self *Gateway) Connect(version string) error {
+  self.grpc.local.version = version
+  return self.rpc.Connect(self.grpc.local)
+}
+
+/*! \brief Disconnect the gateway from implementers
+ *
+ *  This method is used to close the connection to our own implementers and
+ * every upstream which is used by proxy rules, the rules are dropped too
+ *
+ *  \return error: if the gateway isn't connected, we will receive an error
+ */
+func (self *Gateway) Disconnect() error {
+  self.grpc.lock.Lock()
+  targets := self.grpc.targets
+
+  self.grpc.targets = nil
+  self.grpc.rules = nil
+  self.grpc.lock.Unlock()
+
+  for _, target := range targets {
+    target.close()
+  }
+
+  return self.rpc.Disconnect(self.grpc.local)
+}
+
+/*! \brief Produce a handler which transcodes requests to a rpc method
+ *
+ *  This method is used to map an endpoint's method to a rpc method
+ * explicitly, path params, query string and json body are merged into the
+ * rpc request and the rpc response is packed into our json envelope
+ *
+ *  \param method: the full rpc method name, e.g /package.Service/Method
+ *  \return Handler: the handler which is used with Api.Handle
+ */
+func (self *Gateway) Transcode(method string) Handler {
+  return self.transcode(method, "*")
+}
+
+/*! \brief Expose every annotated rpc method of a service
+ *
+ *  This method is used to read google.api.http annotations of a service and
+ * create an endpoint for each rpc method inside the current version of
+ * ApiServer, the endpoint is named by the rpc method. Streaming methods are
+ * bridged to SSE or websocket
+ *
+ *  \param service: the full service name, e.g package.Service
+ *  \return error: if the service isn't found, we will receive an error
+ */
+func (self *Gateway) Expose(service string) error {
+  descriptor, err := protoregistry.GlobalFiles.FindDescriptorByName(
+    protoreflect.FullName(service))
+
+  if err != nil {
+    return err
+  }
+
+  desc, ok := descriptor.(protoreflect.ServiceDescriptor)
+  if ! ok {
+    return errors.New(fmt.Sprintf("%s isn't a service", service))
+  }
+
+  methods := desc.Methods()
+
+  for i := 0; i < methods.Len(); i++ {
+    method := methods.Get(i)
+    rule, ok := proto.GetExtension(method.Options(),
+                                   annotations.E_Http).(*annotations.HttpRule)
+
+    if ! ok || rule == nil {
+      continue
+    }
+
+    name := fmt.Sprintf("/%s/%s", desc.FullName(), method.Name())
+    rules := append([]*annotations.HttpRule{rule},
+                    rule.GetAdditionalBindings()...)
+
+    for _, binding := range rules {
+      verb, path := parseHttpRule(binding)
+
+      if len(verb) == 0 {
+        continue
+      }
+
+      api := self.api.Endpoint(string(method.Name()))
+      if api == nil {
+        return errors.New("please choose a version before exposing")
+      }
+
+      // @NOTE: browsers only open streams with GET, clients which send a
+      // stream need a websocket while the others could use SSE
+      switch {
+      case ! method.IsStreamingClient() && ! method.IsStreamingServer():
+        api.Handle(verb, self.transcode(name, binding.GetBody()))
+
+      case verb != "GET":
+        continue
+
+      case method.IsStreamingClient():
+        api.Socket(self.Socket(name))
+
+      default:
+        api.Events(self.Events(name))
+      }
+
+      api.Mock(self.relative(path))
+    }
+  }
+
+  return nil
+}
+
+/*! \brief Produce a handler which transcodes requests to a rpc method
+ *
+ *  \param method: the full rpc method name
+ *  \param body: which field receives the json body, "*" means the whole
+ *               request and empty means the body is ignored
+ *  \return Handler: the handler
+ */
+func (self *Gateway) transcode(method string, body string) Handler {
+  return func(w http.ResponseWriter, r *http.Request) {
+    input, output, err := findRpcMessages(method)
+
+    if err != nil {
+      self.api.Fail(w)(NewError(codes.NotFound, err.Error()))
+      return
+    }
+
+    request := dynamicpb.NewMessage(input)
+    response := dynamicpb.NewMessage(output)
+
+    if err := decodeRpcRequest(r, body, request); err != nil {
+      self.api.Fail(w)(NewError(codes.InvalidArgument, err.Error()))
+      return
+    }
+
+    connection := self.grpc.local.connection
+
+    if connection == nil {
+      self.api.Fail(w)(NewError(codes.Unavailable, "gateway isn't connected"))
+      return
+    }
+
+    err = connection.Invoke(r.Context(), method,
+                            legacy.MessageV1(request),
+                            legacy.MessageV1(response))
+    if err != nil {
+      self.api.Fail(w)(err)
+    } else if data, err := protojson.Marshal(response); err != nil {
+      self.api.Fail(w)(NewError(codes.Internal, err.Error()))
+    } else {
+      self.api.Ok(w)(string(data))
+    }
+  }
+}
+
+/*! \brief Make an annotated path relative to the current version
+ *
+ *  This method is used to strip the version prefix from a path since Mock
+ * always adds the version by itself
+ *
+ *  \param path: the annotated path
+ *  \return string: the path which is used with Api.Mock
+ */
+func (self *Gateway) relative(path string) string {
+  prefix := fmt.Sprintf("/%s/", self.api.currentVersion)
+
+  if strings.HasPrefix(path, prefix) {
+    return path[len(prefix) - 1:]
+  }
+
+  return path
+}
+
+/* ------------------------- iGrpcUpstream ------------------------ */
+
+func (self *iGrpcUpstream) Version() string {
+  return self.version
+}
+
+func (self *iGrpcUpstream) Socket() int {
+  return self.sock
+}
+
+func (self *iGrpcUpstream) New(conn *grpc.ClientConn) error {
+  self.connection = conn
+  return nil
+}
+
+func (self *iGrpcUpstream) OnConnecting(protocol string) error {
+  return nil
+}
+
+func (self *iGrpcUpstream) OnConnected(sock int) error {
+  self.sock = sock
+  return nil
+}
+
+func (self *iGrpcUpstream) OnBroken(sock int) error {
+  return nil
+}
+
+func (self *iGrpcUpstream) OnDisconnecting() {
+  self.connection = nil
+  self.sock = -1
+}
+
+/* --------------------------- helper ----------------------------- */
+
+/*! \brief Convert a grpc status code to http status code
+ *
+ *  This function is used to map grpc status codes to the codes which we
+ * use inside our json envelope
+ *
+ *  \param code: the grpc status code
+ *  \return int: the http status code
+ */
+func HttpStatusOf(code codes.Code) int {
+  switch(code) {
+    case codes.OK:
+      return 200
+
+    case codes.Canceled:
+      return 499
+
+    case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange:
+      return 400
+
+    case codes.Unauthenticated:
+      return 401
+
+    case codes.PermissionDenied:
+      return 403
+
+    case codes.NotFound:
+      return 404
+
+    case codes.AlreadyExists, codes.Aborted:
+      return 409
+
+    case codes.ResourceExhausted:
+      return 429
+
+    case codes.Unimplemented:
+      return 501
+
+    case codes.Unavailable:
+      return 503
+
+    case codes.DeadlineExceeded:
+      return 504
+
+    default:
+      return 500
+  }
+}
+
+/*! \brief Find message types of a rpc method
+ *
+ *  \param method: the full rpc method name, e.g /package.Service/Method
+ *  \return protoreflect.MessageDescriptor: the input and output types
+ */
+func findRpcMessages(method string) (protoreflect.MessageDescriptor,
+                                     protoreflect.MessageDescriptor, error) {
+  if desc, err := findRpcMethod(method); err != nil {
+    return nil, nil, err
+  } else {
+    return desc.Input(), desc.Output(), nil
+  }
+}
+
+/*! \brief Find the descriptor of a rpc method
+ *
+ *  \param method: the full rpc method name, e.g /package.Service/Method
+ *  \return protoreflect.MethodDescriptor: the method descriptor
+ */
+func findRpcMethod(method string) (protoreflect.MethodDescriptor, error) {
+  parts := strings.Split(strings.TrimPrefix(method, "/"), "/")
+
+  if len(parts) != 2 {
+    return nil, errors.New(fmt.Sprintf("%s isn't a rpc method", method))
+  }
+
+  descriptor, err := protoregistry.GlobalFiles.FindDescriptorByName(
+    protoreflect.FullName(parts[0]))
+
+  if err != nil {
+    return nil, err
+  } else if service, ok := descriptor.(protoreflect.ServiceDescriptor); ! ok {
+    return nil, errors.New(fmt.Sprintf("%s isn't a service", parts[0]))
+  } else if desc := service.Methods().ByName(
+                       protoreflect.Name(parts[1])); desc == nil {
+    return nil, errors.New(fmt.Sprintf("not found %s", method))
+  } else {
+    return desc, nil
+  }
+}
+
+/*! \brief Decode a http request into a rpc request
+ *
+ *  This function is used to merge json body, query string and path params
+ * into a rpc request, path params have the highest priority
+ *
+ *  \param r: the http request
+ *  \param body: which field receives the json body
+ *  \param request: the rpc request
+ *  \return error: if the http request is malformed, we will receive an error
+ */
+func decodeRpcRequest(r *http.Request, body string,
+                      request protoreflect.Message) error {
+  fields := request.Descriptor().Fields()
+  values := make(map[string]interface{})
+
+  if len(body) > 0 && r.Body != nil {
+    var content interface{}
+
+    decoder := json.NewDecoder(r.Body)
+    decoder.UseNumber()
+
+    if err := decoder.Decode(&content); err != nil && err != io.EOF {
+      return err
+    } else if content == nil {
+      // @NOTE: empty body, nothing to merge
+    } else if body != "*" {
+      values[body] = content
+    } else if object, ok := content.(map[string]interface{}); ok {
+      values = object
+    } else {
+      return errors.New("body must be a json object")
+    }
+  }
+
+  for key, items := range r.URL.Query() {
+    if field := findRpcField(fields, key); field == nil {
+      continue
+    } else if field.IsList() {
+      list := make([]interface{}, 0, len(items))
+
+      for _, item := range items {
+        list = append(list, transcodeRpcValue(field, item))
+      }
+
+      values[key] = list
+    } else if len(items) > 0 {
+      values[key] = transcodeRpcValue(field, items[0])
+    }
+  }
+
+  for key, value := range mux.Vars(r) {
+    if field := findRpcField(fields, key); field != nil {
+      values[key] = transcodeRpcValue(field, value)
+    }
+  }
+
+  if data, err := json.Marshal(values); err != nil {
+    return err
+  } else {
+    options := protojson.UnmarshalOptions{DiscardUnknown: true}
+
+    return options.Unmarshal(data, request.Interface())
+  }
+}
+
+/*! \brief Find a field by its proto or json name
+ *
+ *  \param fields: the fields of a message
+ *  \param name: the name
+ *  \return protoreflect.FieldDescriptor: the field or nil
+ */
+func findRpcField(fields protoreflect.FieldDescriptors,
+                  name string) protoreflect.FieldDescriptor {
+  if field := fields.ByName(protoreflect.Name(name)); field != nil {
+    return field
+  }
+
+  return fields.ByJSONName(name)
+}
+
+/*! \brief Convert a string param to the json value of a field
+ *
+ *  This function is used because protojson accepts numbers and enums as
+ * strings but bools must be real json bools
+ *
+ *  \param field: the field
+ *  \param value: the string value
+ *  \return interface{}: the json value
+ */
+func transcodeRpcValue(field protoreflect.FieldDescriptor,
+                       value string) interface{} {
+  if field.Kind() == protoreflect.BoolKind {
+    if ret, err := strconv.ParseBool(value); err == nil {
+      return ret
+    }
+  }
+
+  return value
+}
+
+/*! \brief Parse a google.api.http rule
+ *
+ *  \param rule: the rule
+ *  \return string, string: the http method and the path which is converted
+ *                          into gorilla's template
+ */
+func parseHttpRule(rule *annotations.HttpRule) (string, string) {
+  var verb, path string
+
+  switch pattern := rule.GetPattern().(type) {
+    case *annotations.HttpRule_Get:
+      verb, path = "GET", pattern.Get
+
+    case *annotations.HttpRule_Post:
+      verb, path = "POST", pattern.Post
+
+    case *annotations.HttpRule_Put:
+      verb, path = "PUT", pattern.Put
+
+    case *annotations.HttpRule_Delete:
+      verb, path = "DELETE", pattern.Delete
+
+    case *annotations.HttpRule_Patch:
+      verb, path = "PATCH", pattern.Patch
+
+    case *annotations.HttpRule_Custom:
+      verb, path = pattern.Custom.GetKind(), pattern.Custom.GetPath()
+  }
+
+  return verb, convertHttpTemplate(path)
+}
+
+/*! \brief Convert a google.api.http path template to gorilla's template
+ *
+ *  This function is used to convert {name=*} to {name} and {name=**} or
+ * other patterns to {name:.+}
+ *
+ *  \param path: the google.api.http path template
+ *  \return string: the gorilla's path template
+ */
+func convertHttpTemplate(path string) string {
+  var ret strings.Builder
+
+  for len(path) > 0 {
+    begin := strings.Index(path, "{")
+    end := strings.Index(path, "}")
+
+    if begin < 0 || end < begin {
+      ret.WriteString(path)
+      break
+    }
+
+    ret.WriteString(path[:begin])
+
+    variable := path[begin + 1:end]
+    path = path[end + 1:]
+
+    if index := strings.Index(variable, "="); index < 0 {
+      ret.WriteString(fmt.Sprintf("{%s}", variable))
+    } else if variable[index + 1:] == "*" {
+      ret.WriteString(fmt.Sprintf("{%s}", variable[:index]))
+    } else {
+      ret.WriteString(fmt.Sprintf("{%s:.+}", variable[:index]))
+    }
+  }
+
+  return ret.String()
+}
+
+/*! \brief Create a gateway
+ *
+ *  This function is used to create a gateway which bridges ApiServer and
+ * GRpcContext, rpc methods of implementers are exposed as RESTful APIs
+ *
+ *  \param api: the server which exposes routes
+ *  \param rpc: the context which is used to reach implementers
+ *  \return *Gateway: the gateway object
+ */
+func NewGateway(api *ApiServer, rpc *GRpcContext) *Gateway {
+  return &Gateway{
+    api: api,
+    rpc: rpc,
+    http: &iApiGateway{
+      transport: http.DefaultTransport.(*http.Transport).Clone(),
+    },
+    grpc: &iGrpcGateway{local: &iGrpcUpstream{sock: -1}},
+  }
 }
@@ -4,6 +4,12 @@ go 1.13
 
 require (
 	google.golang.org/grpc v1.37.0
+	google.golang.org/protobuf v1.25.0
+	google.golang.org/genproto v0.0.0-20200526211855-cb27e3aa2013
+	github.com/golang/protobuf v1.4.3
 	github.com/gorilla/mux v1.8.0
+	github.com/gorilla/websocket v1.4.2
+	github.com/golang-jwt/jwt/v4 v4.5.2
+	gopkg.in/yaml.v2 v2.4.0
 	github.com/graphql-go/graphql v0.7.9
 )
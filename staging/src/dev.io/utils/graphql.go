@@ -0,0 +1,266 @@
+package utils
+
+import (
+  "github.com/graphql-go/graphql/language/parser"
+  "github.com/graphql-go/graphql/language/ast"
+  "github.com/graphql-go/graphql"
+  "encoding/json"
+  "io/ioutil"
+  "net/http"
+  "context"
+  "strings"
+  "errors"
+  "bytes"
+  "fmt"
+  "io"
+)
+
+type iGraphQLRequestKey struct {}
+
+type iGraphQLRequest struct {
+  Query string `json:"query"`
+  Variables map[string]interface{} `json:"variables"`
+  OperationName string `json:"operationName"`
+}
+
+type iApiRecorder struct {
+  header http.Header
+  body bytes.Buffer
+  code int
+}
+
+/*! \brief Resolve requests of this endpoint with a GraphQL schema
+ *
+ *  This method is used to serve queries of a schema, they are sent by POST
+ * as json or application/graphql body, or by GET with query string. The
+ * response follows GraphQL spec instead of our envelope so GraphQL clients
+ * could understand it. Resolvers receive the request's context, which lets
+ * them reach ApiServer.Call and GRpcContext.Invoke
+ *
+ *  \param schema: the schema
+ *  \param graphiql: true if browsers should receive the GraphiQL page when
+ *                   they GET this endpoint without a query
+ *  \return *Api: to make a chain call, we will return itself to make calling
+ *                next function easily
+ */
+func (self *Api) Schema(schema *graphql.Schema, graphiql bool) *Api {
+  handler := func(w http.ResponseWriter, r *http.Request) {
+    if graphiql && r.Method == "GET" && len(r.URL.Query().Get("query")) == 0 &&
+       strings.Contains(r.Header.Get("Accept"), "text/html") {
+      w.Header().Set("Content-Type", "text/html; charset=utf-8")
+      io.WriteString(w, graphiqlPage)
+      return
+    }
+
+    request, err := parseGraphQLRequest(r)
+    if err != nil {
+      writeGraphQLError(w, 400, err)
+      return
+    }
+
+    // @NOTE: GET must be safe, so mutations are only accepted via POST
+    if r.Method == "GET" && isGraphQLMutation(request) {
+      writeGraphQLError(w, 405, errors.New("mutation must be sent by POST"))
+      return
+    }
+
+    result := graphql.Do(graphql.Params{
+      Schema: *schema,
+      RequestString: request.Query,
+      VariableValues: request.Variables,
+      OperationName: request.OperationName,
+      Context: context.WithValue(r.Context(), iGraphQLRequestKey{}, r),
+    })
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(result)
+  }
+
+  return self.Handle("GET", handler).Handle("POST", handler)
+}
+
+/*! \brief Call an endpoint of this server without going through network
+ *
+ *  This method is used by resolvers to reuse registered REST handlers, the
+ * headers of the GraphQL request which owns ctx are forwarded so handlers
+ * still see the same client
+ *
+ *  \param ctx: the context, usually ResolveParams.Context
+ *  \param method: the http method
+ *  \param path: the absolute path, e.g /v1/users/1
+ *  \param body: the json body or nil
+ *  \return interface{}: the decoded data of our envelope
+ *  \return error: if the endpoint responds an error code, we will receive
+ *                 an error which contains the code and the message
+ */
+func (self *ApiServer) Call(ctx context.Context, method, path string,
+                            body io.Reader) (interface{}, error) {
+  var envelope struct {
+    Code int `json:"code"`
+    Data json.RawMessage `json:"data"`
+  }
+  var ret interface{}
+
+  r, err := http.NewRequestWithContext(ctx, method, path, body)
+  if err != nil {
+    return nil, err
+  }
+
+  if origin, ok := ctx.Value(iGraphQLRequestKey{}).(*http.Request); ok {
+    r.Header = origin.Header.Clone()
+    r.RemoteAddr = origin.RemoteAddr
+  }
+
+  if body != nil {
+    r.Header.Set("Content-Type", "application/json")
+  }
+
+  w := &iApiRecorder{header: make(http.Header), code: 200}
+  self.ServeHTTP(w, r)
+
+  if err := json.Unmarshal(w.body.Bytes(), &envelope); err != nil {
+    return nil, errors.New(fmt.Sprintf("%s %s responds an invalid body",
+                                       method, path))
+  } else if len(envelope.Data) > 0 {
+    if err := json.Unmarshal(envelope.Data, &ret); err != nil {
+      return nil, err
+    }
+  }
+
+  if envelope.Code >= 400 {
+    return nil, errors.New(fmt.Sprintf("%s %s responds %d: %v", method, path,
+                                       envelope.Code, ret))
+  }
+
+  return ret, nil
+}
+
+/* ------------------------- iApiRecorder ------------------------- */
+
+func (self *iApiRecorder) Header() http.Header {
+  return self.header
+}
+
+func (self *iApiRecorder) Write(data []byte) (int, error) {
+  return self.body.Write(data)
+}
+
+func (self *iApiRecorder) WriteHeader(code int) {
+  self.code = code
+}
+
+/* --------------------------- helper ----------------------------- */
+
+/*! \brief Read a GraphQL request from http request
+ *
+ *  \param r: the http request
+ *  \return *iGraphQLRequest: the query, its variables and operation name
+ *  \return error: if the request is malformed
+ */
+func parseGraphQLRequest(r *http.Request) (*iGraphQLRequest, error) {
+  ret := &iGraphQLRequest{}
+
+  if r.Method == "GET" {
+    query := r.URL.Query()
+
+    ret.Query = query.Get("query")
+    ret.OperationName = query.Get("operationName")
+
+    if variables := query.Get("variables"); len(variables) > 0 {
+      if err := json.Unmarshal([]byte(variables), &ret.Variables); err != nil {
+        return nil, err
+      }
+    }
+  } else if data, err := ioutil.ReadAll(r.Body); err != nil {
+    return nil, err
+  } else if strings.HasPrefix(r.Header.Get("Content-Type"),
+                              "application/graphql") {
+    ret.Query = string(data)
+  } else if err := json.Unmarshal(data, ret); err != nil {
+    return nil, err
+  }
+
+  if len(ret.Query) == 0 {
+    return nil, errors.New("query is empty")
+  }
+
+  return ret, nil
+}
+
+/*! \brief Check if a GraphQL request would run a mutation
+ *
+ *  \param request: the request
+ *  \return bool: true if the chosen operation is a mutation, a request
+ *                which can't be parsed is left to graphql to report
+ */
+func isGraphQLMutation(request *iGraphQLRequest) bool {
+  document, err := parser.Parse(parser.ParseParams{Source: request.Query})
+  if err != nil {
+    return false
+  }
+
+  for _, node := range document.Definitions {
+    operation, ok := node.(*ast.OperationDefinition)
+    if ! ok {
+      continue
+    }
+
+    if len(request.OperationName) > 0 &&
+       (operation.Name == nil || operation.Name.Value != request.OperationName) {
+      continue
+    }
+
+    if operation.Operation == ast.OperationTypeMutation {
+      return true
+    }
+  }
+
+  return false
+}
+
+/*! \brief Write an error in GraphQL format
+ *
+ *  \param w: the response writer
+ *  \param code: the http status code
+ *  \param err: the error
+ */
+func writeGraphQLError(w http.ResponseWriter, code int, err error) {
+  w.Header().Set("Content-Type", "application/json")
+  w.WriteHeader(code)
+
+  json.NewEncoder(w).Encode(map[string]interface{}{
+    "errors": []map[string]string{{"message": err.Error()}},
+  })
+}
+
+// @NOTE: the page loads GraphiQL from cdn and sends queries back to the
+// path it's served on
+const graphiqlPage = `<!DOCTYPE html>
+<html>
+  <head>
+    <title>GraphiQL</title>
+    <link rel="stylesheet" href="https://unpkg.com/graphiql@1.4.0/graphiql.min.css" />
+  </head>
+  <body style="margin: 0;">
+    <div id="graphiql" style="height: 100vh;"></div>
+    <script crossorigin src="https://unpkg.com/react@17/umd/react.production.min.js"></script>
+    <script crossorigin src="https://unpkg.com/react-dom@17/umd/react-dom.production.min.js"></script>
+    <script crossorigin src="https://unpkg.com/graphiql@1.4.0/graphiql.min.js"></script>
+    <script>
+      function fetcher(params) {
+        return fetch(window.location.pathname, {
+          method: "POST",
+          headers: {"Content-Type": "application/json"},
+          body: JSON.stringify(params),
+          credentials: "same-origin",
+        }).then(function (response) {
+          return response.json();
+        });
+      }
+
+      ReactDOM.render(React.createElement(GraphiQL, {fetcher: fetcher}),
+                      document.getElementById("graphiql"));
+    </script>
+  </body>
+</html>
+`
@@ -0,0 +1,449 @@
+package utils
+
+import (
+  "google.golang.org/protobuf/reflect/protoregistry"
+  "google.golang.org/protobuf/reflect/protoreflect"
+  "google.golang.org/protobuf/encoding/protojson"
+  "google.golang.org/protobuf/types/descriptorpb"
+  "google.golang.org/protobuf/types/dynamicpb"
+  "github.com/graphql-go/graphql/language/ast"
+  "github.com/graphql-go/graphql"
+
+  legacy "github.com/golang/protobuf/proto"
+
+  "encoding/json"
+  "strconv"
+  "strings"
+  "context"
+  "errors"
+  "fmt"
+)
+
+// @NOTE: rpc methods whose name begins with one of these prefixes are read
+// only, so they become queries even without idempotency_level option
+var graphqlQueryPrefixes = []string{
+  "Get", "List", "Find", "Search", "Query", "Count",
+}
+
+// @NOTE: maps, well-known types and empty messages don't fit into GraphQL
+// objects, they are exchanged as their protojson form instead
+var graphqlJSON = graphql.NewScalar(graphql.ScalarConfig{
+  Name: "JSON",
+  Description: "an arbitrary json value",
+  Serialize: func(value interface{}) interface{} {
+    return value
+  },
+  ParseValue: func(value interface{}) interface{} {
+    return value
+  },
+  ParseLiteral: parseGraphQLLiteral,
+})
+
+type iGraphQLStitcher struct {
+  outputs map[protoreflect.FullName]graphql.Output
+  inputs map[protoreflect.FullName]graphql.Input
+  enums map[protoreflect.FullName]*graphql.Enum
+}
+
+/*! \brief Derive a GraphQL schema from grpc services
+ *
+ *  This method is used to expose unary rpc methods as GraphQL fields, read
+ * only methods become queries and the others become mutations. Fields of
+ * the request message become arguments and the response message becomes
+ * the field's type, calls are sent to implementers through the connection
+ * which is created by Connect
+ *
+ *  \param services: full service names, every service which is hosted by
+ *                   the GRpcContext is used when it's empty
+ *  \return *graphql.Schema: the schema which is used with Api.Schema
+ *  \return error: if a service isn't found or two methods have the same
+ *                 field name, we will receive an error
+ */
+func (self *Gateway) Stitch(services ...string) (*graphql.Schema, error) {
+  if len(services) == 0 {
+    services = self.rpc.Services()
+  }
+
+  stitcher := &iGraphQLStitcher{
+    outputs: make(map[protoreflect.FullName]graphql.Output),
+    inputs: make(map[protoreflect.FullName]graphql.Input),
+    enums: make(map[protoreflect.FullName]*graphql.Enum),
+  }
+  queries := graphql.Fields{}
+  mutations := graphql.Fields{}
+
+  for _, service := range services {
+    descriptor, err := protoregistry.GlobalFiles.FindDescriptorByName(
+      protoreflect.FullName(service))
+
+    if err != nil {
+      return nil, err
+    }
+
+    desc, ok := descriptor.(protoreflect.ServiceDescriptor)
+    if ! ok {
+      return nil, errors.New(fmt.Sprintf("%s isn't a service", service))
+    }
+
+    methods := desc.Methods()
+
+    for i := 0; i < methods.Len(); i++ {
+      method := methods.Get(i)
+      name := string(method.Name())
+      name = strings.ToLower(name[:1]) + name[1:]
+
+      // @NOTE: GraphQL doesn't support streaming, so these methods are left
+      // to Transcode and grpc proxy
+      if method.IsStreamingClient() || method.IsStreamingServer() {
+        continue
+      }
+
+      if _, ok := queries[name]; ok {
+        return nil, errors.New(fmt.Sprintf("%s is declared twice", name))
+      } else if _, ok := mutations[name]; ok {
+        return nil, errors.New(fmt.Sprintf("%s is declared twice", name))
+      }
+
+      field := &graphql.Field{
+        Type: stitcher.output(method.Output()),
+        Args: stitcher.arguments(method.Input()),
+        Resolve: self.resolve(method),
+        Description: fmt.Sprintf("/%s/%s", desc.FullName(), method.Name()),
+      }
+
+      if isGraphQLQuery(method) {
+        queries[name] = field
+      } else {
+        mutations[name] = field
+      }
+    }
+  }
+
+  // @NOTE: GraphQL requires a query type with at least one field
+  if len(queries) == 0 {
+    queries["services"] = &graphql.Field{
+      Type: graphql.NewList(graphql.String),
+      Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+        return services, nil
+      },
+    }
+  }
+
+  config := graphql.SchemaConfig{
+    Query: graphql.NewObject(graphql.ObjectConfig{
+      Name: "Query",
+      Fields: queries,
+    }),
+  }
+
+  if len(mutations) > 0 {
+    config.Mutation = graphql.NewObject(graphql.ObjectConfig{
+      Name: "Mutation",
+      Fields: mutations,
+    })
+  }
+
+  if schema, err := graphql.NewSchema(config); err != nil {
+    return nil, err
+  } else {
+    return &schema, nil
+  }
+}
+
+/*! \brief Produce a resolver which calls a rpc method
+ *
+ *  \param method: the rpc method
+ *  \return graphql.FieldResolveFn: the resolver
+ */
+func (self *Gateway) resolve(method protoreflect.MethodDescriptor) graphql.FieldResolveFn {
+  name := fmt.Sprintf("/%s/%s", method.Parent().FullName(), method.Name())
+
+  return func(p graphql.ResolveParams) (interface{}, error) {
+    var ret interface{}
+
+    ctx := p.Context
+    if ctx == nil {
+      ctx = context.Background()
+    }
+
+    request := dynamicpb.NewMessage(method.Input())
+    response := dynamicpb.NewMessage(method.Output())
+
+    if data, err := json.Marshal(p.Args); err != nil {
+      return nil, err
+    } else if err := protojson.Unmarshal(data, request); err != nil {
+      return nil, err
+    }
+
+    err := self.rpc.Invoke(ctx, self.grpc.local, name,
+                           legacy.MessageV1(request),
+                           legacy.MessageV1(response))
+    if err != nil {
+      return nil, err
+    }
+
+    // @NOTE: zero values must be kept, otherwide GraphQL sees them as null
+    data, err := protojson.MarshalOptions{EmitUnpopulated: true}.Marshal(response)
+    if err != nil {
+      return nil, err
+    } else if err := json.Unmarshal(data, &ret); err != nil {
+      return nil, err
+    }
+
+    return ret, nil
+  }
+}
+
+/* ----------------------- iGraphQLStitcher ----------------------- */
+
+/*! \brief Convert a message to GraphQL output type
+ *
+ *  \param message: the message descriptor
+ *  \return graphql.Output: the object type, it's shared by every field
+ *                          which uses the same message
+ */
+func (self *iGraphQLStitcher) output(message protoreflect.MessageDescriptor) graphql.Output {
+  if isGraphQLOpaque(message) {
+    return graphqlJSON
+  } else if ret, ok := self.outputs[message.FullName()]; ok {
+    return ret
+  }
+
+  // @NOTE: fields are built lazily since messages could be recursive
+  ret := graphql.NewObject(graphql.ObjectConfig{
+    Name: graphqlNameOf(message.FullName()),
+    Fields: graphql.FieldsThunk(func() graphql.Fields {
+      fields := graphql.Fields{}
+
+      for i := 0; i < message.Fields().Len(); i++ {
+        field := message.Fields().Get(i)
+
+        fields[field.JSONName()] = &graphql.Field{
+          Type: self.typeOf(field, false),
+        }
+      }
+
+      return fields
+    }),
+  })
+
+  self.outputs[message.FullName()] = ret
+  return ret
+}
+
+/*! \brief Convert a message to GraphQL input type
+ *
+ *  \param message: the message descriptor
+ *  \return graphql.Input: the input object type
+ */
+func (self *iGraphQLStitcher) input(message protoreflect.MessageDescriptor) graphql.Input {
+  if isGraphQLOpaque(message) {
+    return graphqlJSON
+  } else if ret, ok := self.inputs[message.FullName()]; ok {
+    return ret
+  }
+
+  ret := graphql.NewInputObject(graphql.InputObjectConfig{
+    Name: graphqlNameOf(message.FullName()) + "Input",
+    Fields: graphql.InputObjectConfigFieldMapThunk(func() graphql.InputObjectConfigFieldMap {
+      fields := graphql.InputObjectConfigFieldMap{}
+
+      for i := 0; i < message.Fields().Len(); i++ {
+        field := message.Fields().Get(i)
+
+        fields[field.JSONName()] = &graphql.InputObjectFieldConfig{
+          Type: self.typeOf(field, true),
+        }
+      }
+
+      return fields
+    }),
+  })
+
+  self.inputs[message.FullName()] = ret
+  return ret
+}
+
+/*! \brief Convert fields of a request message to GraphQL arguments
+ *
+ *  \param message: the request message descriptor
+ *  \return graphql.FieldConfigArgument: the arguments
+ */
+func (self *iGraphQLStitcher) arguments(message protoreflect.MessageDescriptor) graphql.FieldConfigArgument {
+  ret := graphql.FieldConfigArgument{}
+
+  for i := 0; i < message.Fields().Len(); i++ {
+    field := message.Fields().Get(i)
+
+    ret[field.JSONName()] = &graphql.ArgumentConfig{
+      Type: self.typeOf(field, true),
+    }
+  }
+
+  return ret
+}
+
+/*! \brief Convert an enum to GraphQL enum type
+ *
+ *  \param enum: the enum descriptor
+ *  \return *graphql.Enum: the enum type whose values are the value names,
+ *                         which is the way protojson encodes enums
+ */
+func (self *iGraphQLStitcher) enum(enum protoreflect.EnumDescriptor) *graphql.Enum {
+  if ret, ok := self.enums[enum.FullName()]; ok {
+    return ret
+  }
+
+  values := graphql.EnumValueConfigMap{}
+
+  for i := 0; i < enum.Values().Len(); i++ {
+    name := string(enum.Values().Get(i).Name())
+
+    values[name] = &graphql.EnumValueConfig{Value: name}
+  }
+
+  ret := graphql.NewEnum(graphql.EnumConfig{
+    Name: graphqlNameOf(enum.FullName()),
+    Values: values,
+  })
+
+  self.enums[enum.FullName()] = ret
+  return ret
+}
+
+/*! \brief Convert a field to GraphQL type
+ *
+ *  \param field: the field descriptor
+ *  \param input: true if the type is used by arguments
+ *  \return graphql.Type: the type
+ */
+func (self *iGraphQLStitcher) typeOf(field protoreflect.FieldDescriptor,
+                                     input bool) graphql.Type {
+  var ret graphql.Type
+
+  if field.IsMap() {
+    return graphqlJSON
+  }
+
+  switch field.Kind() {
+  case protoreflect.BoolKind:
+    ret = graphql.Boolean
+
+  case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+    ret = graphql.Int
+
+  case protoreflect.Uint32Kind, protoreflect.Fixed32Kind,
+       protoreflect.FloatKind, protoreflect.DoubleKind:
+    // @NOTE: GraphQL Int is signed 32 bits, so uint32 can't fit into it
+    ret = graphql.Float
+
+  case protoreflect.EnumKind:
+    ret = self.enum(field.Enum())
+
+  case protoreflect.MessageKind, protoreflect.GroupKind:
+    if input {
+      ret = self.input(field.Message())
+    } else {
+      ret = self.output(field.Message())
+    }
+
+  default:
+    // @NOTE: 64 bits integers and bytes are strings in protojson
+    ret = graphql.String
+  }
+
+  if field.IsList() {
+    return graphql.NewList(ret)
+  }
+
+  return ret
+}
+
+/* --------------------------- helper ----------------------------- */
+
+/*! \brief Check if a rpc method is read only
+ *
+ *  \param method: the method descriptor
+ *  \return bool: true if the method should be a query
+ */
+func isGraphQLQuery(method protoreflect.MethodDescriptor) bool {
+  options, ok := method.Options().(*descriptorpb.MethodOptions)
+
+  if ok && options.GetIdempotencyLevel() == descriptorpb.MethodOptions_NO_SIDE_EFFECTS {
+    return true
+  }
+
+  for _, prefix := range graphqlQueryPrefixes {
+    if strings.HasPrefix(string(method.Name()), prefix) {
+      return true
+    }
+  }
+
+  return false
+}
+
+/*! \brief Check if a message must be exchanged as json
+ *
+ *  \param message: the message descriptor
+ *  \return bool: true for well-known types and empty messages
+ */
+func isGraphQLOpaque(message protoreflect.MessageDescriptor) bool {
+  return message.Fields().Len() == 0 ||
+         strings.HasPrefix(string(message.FullName()), "google.protobuf.")
+}
+
+/*! \brief Convert a protobuf name to GraphQL name
+ *
+ *  \param name: the full name, e.g package.Message
+ *  \return string: the GraphQL name, e.g package_Message
+ */
+func graphqlNameOf(name protoreflect.FullName) string {
+  return strings.Replace(string(name), ".", "_", -1)
+}
+
+/*! \brief Convert a GraphQL literal to json value
+ *
+ *  \param value: the literal
+ *  \return interface{}: the value, variables inside literals become nil
+ */
+func parseGraphQLLiteral(value ast.Value) interface{} {
+  switch literal := value.(type) {
+  case *ast.StringValue:
+    return literal.Value
+
+  case *ast.BooleanValue:
+    return literal.Value
+
+  case *ast.EnumValue:
+    return literal.Value
+
+  case *ast.IntValue:
+    ret, _ := strconv.ParseInt(literal.Value, 10, 64)
+    return ret
+
+  case *ast.FloatValue:
+    ret, _ := strconv.ParseFloat(literal.Value, 64)
+    return ret
+
+  case *ast.ListValue:
+    ret := make([]interface{}, 0, len(literal.Values))
+
+    for _, item := range literal.Values {
+      ret = append(ret, parseGraphQLLiteral(item))
+    }
+
+    return ret
+
+  case *ast.ObjectValue:
+    ret := make(map[string]interface{})
+
+    for _, field := range literal.Fields {
+      ret[field.Name.Value] = parseGraphQLLiteral(field.Value)
+    }
+
+    return ret
+
+  default:
+    return nil
+  }
+}
@@ -0,0 +1,572 @@
+package utils
+
+import (
+  "google.golang.org/grpc/resolver/manual"
+  "google.golang.org/grpc/balancer/base"
+  "google.golang.org/grpc/connectivity"
+  "google.golang.org/grpc/attributes"
+  "google.golang.org/grpc/balancer"
+  "google.golang.org/grpc/resolver"
+  "google.golang.org/grpc"
+  "sync/atomic"
+  "math/rand"
+  "errors"
+  "sort"
+  "sync"
+  "time"
+  "fmt"
+)
+
+const (
+  // @NOTE: these policies follow ROUND_ROBIN and LEAST_REQUEST, they are only
+  // supported by connections of GRpcContext
+  PICK_FIRST           = 2
+  WEIGHTED_ROUND_ROBIN = 3
+)
+
+const (
+  // @NOTE: how often we ask discovery for new servers of a protocol
+  defaultGRpcRefresh = 10 * time.Second
+)
+
+type Balanced interface {
+  // @NOTE: this event is raised when a server behind a balanced connection
+  // becomes reachable or unreachable, it's optional for invents
+  OnHealth(sock int, address string, healthy bool)
+}
+
+// @NOTE: keys of attributes which carry our states through grpc
+type iGRpcResolvingKey struct{}
+type iGRpcAddressKey struct{}
+
+type iGRpcAddressInfo struct {
+  // @NOTE: index is the order which discovery returned, PICK_FIRST prefers
+  // the lowest one
+  index int
+  weight int
+}
+
+type iGRpcResolving struct {
+  resolver *manual.Resolver
+  discovery Discovery
+  policy int
+
+  // @NOTE: bundle provides weights, they are read under the lock of owner
+  bundle *iGRpcConnectivityBundle
+  owner *GRpcContext
+  invent Invent
+
+  // @NOTE: caller forgets versions of servers which become unreachable
+  caller *iGRpcCaller
+
+  // @NOTE: sock is the socket of the invent, health which is observed while
+  // dialing is kept in pending until the invent is connected
+  sock int
+  pending []iGRpcHealth
+  lock sync.Mutex
+
+  done chan struct{}
+  stopping sync.Once
+}
+
+type iGRpcHealth struct {
+  address string
+  healthy bool
+}
+
+type iGRpcBalancerBuilder struct {
+  name string
+  policy int
+}
+
+type iGRpcBalancer struct {
+  balancer.Balancer
+
+  // @NOTE: resolving is where health of servers is reported
+  resolving *iGRpcResolving
+
+  // @NOTE: addresses and healthy track every subconnection, grpc calls a
+  // balancer from a single goroutine so they don't need any lock
+  addresses map[balancer.SubConn]string
+  healthy map[balancer.SubConn]bool
+}
+
+type iGRpcBalancerConn struct {
+  balancer.ClientConn
+
+  owner *iGRpcBalancer
+}
+
+type iGRpcPickerBuilder struct {
+  policy int
+
+  // @NOTE: active counts calls of each subconnection for LEAST_REQUEST, it
+  // outlives pickers since they are rebuilt on every change
+  active map[balancer.SubConn]*int32
+}
+
+type iGRpcPickerNode struct {
+  conn balancer.SubConn
+  info iGRpcAddressInfo
+  active *int32
+
+  // @NOTE: current is the running weight of smooth weighted round robin
+  current int
+}
+
+type iGRpcPicker struct {
+  nodes []*iGRpcPickerNode
+  policy int
+  next int
+  lock sync.Mutex
+}
+
+var grpcBalancerNames = map[int]string{
+  ROUND_ROBIN: "devio_round_robin",
+  LEAST_REQUEST: "devio_least_request",
+  PICK_FIRST: "devio_pick_first",
+  WEIGHTED_ROUND_ROBIN: "devio_weighted_round_robin",
+}
+
+var grpcBalancerRegistering sync.Once
+var grpcResolvingCount uint32
+
+/*! \brief Balance connections of a protocol across many servers
+ *
+ *  This function is used to dial every server which a discovery returns,
+ * e.g a static list, DNS or a kubernetes headless service, instead of the
+ * only address of the protocol. Servers are resolved again periodically and
+ * invents which implement Balanced receive health of each server
+ *
+ *  \param protocol: the protocol name
+ *  \param discovery: the discovery which finds servers
+ *  \param policy: ROUND_ROBIN, LEAST_REQUEST, PICK_FIRST or
+ *                 WEIGHTED_ROUND_ROBIN
+ *  \return error: if the protocol or the policy isn't supported
+ */
+func (self *GRpcContext) Resolve(protocol string, discovery Discovery,
+                                 policy int) error {
+  if self.protocols == nil {
+    initGRpcProtocols(self)
+  }
+
+  bundle, ok := self.protocols[protocol]
+  if ! ok {
+    return errors.New(fmt.Sprintf("don't support %s", protocol))
+  } else if _, ok := grpcBalancerNames[policy]; ! ok {
+    return errors.New(fmt.Sprintf("don't support balancing policy %d", policy))
+  }
+
+  grpcBalancerRegistering.Do(func() {
+    for policy, name := range grpcBalancerNames {
+      balancer.Register(&iGRpcBalancerBuilder{name: name, policy: policy})
+    }
+  })
+
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
+  bundle.discovery = discovery
+  bundle.balance = policy
+  return nil
+}
+
+/*! \brief Weigh a server of a protocol
+ *
+ *  \param protocol: the protocol name
+ *  \param address: the address which discovery returns
+ *  \param weight: the weight which is used by WEIGHTED_ROUND_ROBIN, servers
+ *                 weigh 1 by default
+ *  \return error: if the protocol isn't supported
+ */
+func (self *GRpcContext) Weigh(protocol, address string, weight int) error {
+  if self.protocols == nil {
+    initGRpcProtocols(self)
+  }
+
+  bundle, ok := self.protocols[protocol]
+  if ! ok {
+    return errors.New(fmt.Sprintf("don't support %s", protocol))
+  }
+
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
+  if bundle.weights == nil {
+    bundle.weights = make(map[string]int)
+  }
+
+  bundle.weights[address] = weight
+  return nil
+}
+
+/*! \brief Prepare how an invent reaches servers of a protocol
+ *
+ *  \param bundle: the protocol
+ *  \param caller: the caller of the invent
+ *  \return string: the target which is dialed
+ *  \return *iGRpcResolving: the resolving of balanced protocols, or nil
+ *  \return error: if discovery can't find any server
+ */
+func (self *GRpcContext) resolve(bundle *iGRpcConnectivityBundle,
+                                 caller *iGRpcCaller) (string, *iGRpcResolving, error) {
+  self.lock.Lock()
+  discovery := bundle.discovery
+  policy := bundle.balance
+  self.lock.Unlock()
+
+  if discovery == nil {
+    return bundle.address, nil, nil
+  }
+
+  scheme := fmt.Sprintf("devio-%d", atomic.AddUint32(&grpcResolvingCount, 1))
+  ret := &iGRpcResolving{
+    resolver: manual.NewBuilderWithScheme(scheme),
+    discovery: discovery,
+    policy: policy,
+    bundle: bundle,
+    owner: self,
+    invent: caller.invent,
+    caller: caller,
+    sock: -1,
+    done: make(chan struct{}),
+  }
+
+  state, err := ret.state()
+  if err != nil {
+    return "", nil, err
+  }
+
+  ret.resolver.InitialState(state)
+  return scheme + ":///" + bundle.address, ret, nil
+}
+
+/* ------------------------ iGRpcResolving ------------------------ */
+
+/*! \brief Produce the options which install our resolver and balancer on
+ *  a connection
+ *
+ *  \return []grpc.DialOption: the options, nil for unbalanced connections
+ */
+func (self *iGRpcResolving) options() []grpc.DialOption {
+  if self == nil {
+    return nil
+  }
+
+  config := fmt.Sprintf(`{"loadBalancingConfig": [{"%s": {}}]}`,
+                        grpcBalancerNames[self.policy])
+
+  return []grpc.DialOption{
+    grpc.WithResolvers(self.resolver),
+    grpc.WithDefaultServiceConfig(config),
+  }
+}
+
+/*! \brief Resolve servers periodically until the connection is closed
+ *
+ *  \param sock: the socket of the invent, health which has been observed
+ *               while dialing is reported now
+ */
+func (self *iGRpcResolving) watch(sock int) {
+  if self == nil {
+    return
+  }
+
+  self.lock.Lock()
+  self.sock = sock
+
+  for _, item := range self.pending {
+    self.notify(item.address, item.healthy)
+  }
+
+  self.pending = nil
+  self.lock.Unlock()
+
+  go func() {
+    ticker := time.NewTicker(defaultGRpcRefresh)
+    defer ticker.Stop()
+
+    for {
+      select {
+      case <-self.done:
+        return
+
+      case <-ticker.C:
+        // @NOTE: we keep the last servers when discovery is broken
+        if state, err := self.state(); err == nil {
+          self.resolver.UpdateState(state)
+        }
+      }
+    }
+  }()
+}
+
+/*! \brief Stop resolving servers
+ */
+func (self *iGRpcResolving) stop() {
+  if self == nil {
+    return
+  }
+
+  self.stopping.Do(func() {
+    close(self.done)
+  })
+}
+
+/*! \brief Build the resolver state from discovery
+ *
+ *  \return resolver.State: the state
+ *  \return error: if discovery fails or doesn't find any server
+ */
+func (self *iGRpcResolving) state() (resolver.State, error) {
+  addresses, err := self.discovery.Resolve()
+
+  if err != nil {
+    return resolver.State{}, err
+  } else if len(addresses) == 0 {
+    return resolver.State{}, errors.New("discovery doesn't find any server")
+  }
+
+  ret := resolver.State{
+    Attributes: attributes.New(iGRpcResolvingKey{}, self),
+  }
+
+  self.owner.lock.Lock()
+  defer self.owner.lock.Unlock()
+
+  for index, address := range addresses {
+    info := iGRpcAddressInfo{index: index, weight: 1}
+
+    if weight, ok := self.bundle.weights[address]; ok && weight > 0 {
+      info.weight = weight
+    }
+
+    ret.Addresses = append(ret.Addresses, resolver.Address{
+      Addr: address,
+      Attributes: attributes.New(iGRpcAddressKey{}, info),
+    })
+  }
+
+  return ret, nil
+}
+
+/*! \brief Report health of a server to the invent
+ *
+ *  \param address: the address of the server
+ *  \param healthy: true if the server becomes reachable
+ */
+func (self *iGRpcResolving) report(address string, healthy bool) {
+  if ! healthy {
+    self.caller.forget(address)
+  }
+
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
+  if self.sock < 0 {
+    self.pending = append(self.pending, iGRpcHealth{address: address, healthy: healthy})
+  } else {
+    self.notify(address, healthy)
+  }
+}
+
+/*! \brief Raise OnHealth of the invent, the lock must be held so events
+ *  are never reordered
+ *
+ *  \param address: the address of the server
+ *  \param healthy: true if the server becomes reachable
+ */
+func (self *iGRpcResolving) notify(address string, healthy bool) {
+  if observer, ok := self.invent.(Balanced); ok {
+    observer.OnHealth(self.sock, address, healthy)
+  }
+}
+
+/* --------------------- iGRpcBalancerBuilder --------------------- */
+
+func (self *iGRpcBalancerBuilder) Name() string {
+  return self.name
+}
+
+func (self *iGRpcBalancerBuilder) Build(cc balancer.ClientConn,
+                                       opts balancer.BuildOptions) balancer.Balancer {
+  ret := &iGRpcBalancer{
+    addresses: make(map[balancer.SubConn]string),
+    healthy: make(map[balancer.SubConn]bool),
+  }
+
+  picker := &iGRpcPickerBuilder{
+    policy: self.policy,
+    active: make(map[balancer.SubConn]*int32),
+  }
+
+  // @NOTE: base balancer manages subconnections, we only watch them through
+  // a wrapped client connection and choose them by our pickers
+  ret.Balancer = base.NewBalancerBuilder(self.name, picker, base.Config{}).
+    Build(&iGRpcBalancerConn{ClientConn: cc, owner: ret}, opts)
+  return ret
+}
+
+/* ------------------------ iGRpcBalancer ------------------------- */
+
+func (self *iGRpcBalancer) UpdateClientConnState(state balancer.ClientConnState) error {
+  if attrs := state.ResolverState.Attributes; attrs != nil {
+    if resolving, ok := attrs.Value(iGRpcResolvingKey{}).(*iGRpcResolving); ok {
+      self.resolving = resolving
+    }
+  }
+
+  return self.Balancer.UpdateClientConnState(state)
+}
+
+func (self *iGRpcBalancer) UpdateSubConnState(conn balancer.SubConn,
+                                              state balancer.SubConnState) {
+  address, known := self.addresses[conn]
+
+  switch state.ConnectivityState {
+    case connectivity.Ready:
+      self.observe(conn, address, known, true)
+
+    case connectivity.TransientFailure:
+      self.observe(conn, address, known, false)
+
+    case connectivity.Shutdown:
+      // @NOTE: the server is removed by discovery or the connection is
+      // closed, it's unhealthy only if it was serving
+      if self.healthy[conn] {
+        self.observe(conn, address, known, false)
+      }
+
+      delete(self.addresses, conn)
+      delete(self.healthy, conn)
+  }
+
+  self.Balancer.UpdateSubConnState(conn, state)
+}
+
+/*! \brief Report health of a subconnection if it changes
+ *
+ *  \param conn: the subconnection
+ *  \param address: its address
+ *  \param known: true if we created it
+ *  \param healthy: its health
+ */
+func (self *iGRpcBalancer) observe(conn balancer.SubConn, address string,
+                                   known, healthy bool) {
+  if previous, ok := self.healthy[conn]; ! known || (ok && previous == healthy) {
+    return
+  }
+
+  self.healthy[conn] = healthy
+
+  if self.resolving != nil {
+    self.resolving.report(address, healthy)
+  }
+}
+
+/* ---------------------- iGRpcBalancerConn ----------------------- */
+
+func (self *iGRpcBalancerConn) NewSubConn(addrs []resolver.Address,
+                                          opts balancer.NewSubConnOptions) (balancer.SubConn, error) {
+  conn, err := self.ClientConn.NewSubConn(addrs, opts)
+
+  if err == nil && len(addrs) > 0 {
+    self.owner.addresses[conn] = addrs[0].Addr
+  }
+
+  return conn, err
+}
+
+/* ---------------------- iGRpcPickerBuilder ---------------------- */
+
+func (self *iGRpcPickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+  if len(info.ReadySCs) == 0 {
+    return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+  }
+
+  ret := &iGRpcPicker{policy: self.policy}
+  active := make(map[balancer.SubConn]*int32)
+
+  for conn, item := range info.ReadySCs {
+    node := &iGRpcPickerNode{conn: conn, info: iGRpcAddressInfo{weight: 1}}
+
+    if attrs := item.Address.Attributes; attrs != nil {
+      if info, ok := attrs.Value(iGRpcAddressKey{}).(iGRpcAddressInfo); ok {
+        node.info = info
+      }
+    }
+
+    // @NOTE: calls in flight are kept while the subconnection stays ready
+    if node.active, _ = self.active[conn]; node.active == nil {
+      node.active = new(int32)
+    }
+
+    active[conn] = node.active
+    ret.nodes = append(ret.nodes, node)
+  }
+
+  self.active = active
+
+  sort.Slice(ret.nodes, func(i, j int) bool {
+    return ret.nodes[i].info.index < ret.nodes[j].info.index
+  })
+
+  // @NOTE: pickers of every connection start at different servers, so
+  // short-lived connections don't pile up on the first one
+  ret.next = rand.Intn(len(ret.nodes))
+  return ret
+}
+
+/* ------------------------- iGRpcPicker -------------------------- */
+
+func (self *iGRpcPicker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+  var chosen *iGRpcPickerNode
+
+  self.lock.Lock()
+
+  switch(self.policy) {
+    case PICK_FIRST:
+      chosen = self.nodes[0]
+
+    case LEAST_REQUEST:
+      for i := range self.nodes {
+        node := self.nodes[(self.next + i) % len(self.nodes)]
+
+        if chosen == nil || atomic.LoadInt32(node.active) < atomic.LoadInt32(chosen.active) {
+          chosen = node
+        }
+      }
+
+      self.next += 1
+
+    case WEIGHTED_ROUND_ROBIN:
+      total := 0
+
+      // @NOTE: smooth weighted round robin spreads heavy servers among the
+      // light ones instead of sending them bursts
+      for _, node := range self.nodes {
+        node.current += node.info.weight
+        total += node.info.weight
+
+        if chosen == nil || node.current > chosen.current {
+          chosen = node
+        }
+      }
+
+      chosen.current -= total
+
+    default:
+      chosen = self.nodes[self.next % len(self.nodes)]
+      self.next += 1
+  }
+
+  self.lock.Unlock()
+
+  atomic.AddInt32(chosen.active, 1)
+  return balancer.PickResult{
+    SubConn: chosen.conn,
+    Done: func(balancer.DoneInfo) {
+      atomic.AddInt32(chosen.active, -1)
+    },
+  }, nil
+}
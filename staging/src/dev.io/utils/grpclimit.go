@@ -0,0 +1,301 @@
+package utils
+
+import (
+  "google.golang.org/genproto/googleapis/rpc/errdetails"
+  "google.golang.org/protobuf/types/known/durationpb"
+  "google.golang.org/grpc/status"
+  "google.golang.org/grpc/codes"
+  "google.golang.org/grpc/peer"
+  "google.golang.org/grpc"
+  "context"
+  "math"
+  "sync"
+  "time"
+  "fmt"
+)
+
+type iRpcLimit struct {
+  // @NOTE: method is matched like proxy rules, it's also the scope of the
+  // buckets of this limit
+  method string
+  limit RateLimit
+}
+
+type iGradient struct {
+  // @NOTE: min and max bound the concurrency limit
+  min, max float64
+
+  // @NOTE: long and short are averages of latency, the long one follows
+  // latency slowly and works as the baseline of a healthy backend
+  long, short float64
+}
+
+type RpcLimiter struct {
+  // @NOTE: limits are checked in order and a call must pass every limit
+  // which matches its method
+  limits []iRpcLimit
+  store LimitStore
+
+  // @NOTE: capacity is the max number of in-flight calls, zero means
+  // unlimited. It's changed by gradient in adaptive mode
+  capacity float64
+  inflight int
+  gradient *iGradient
+
+  lock sync.Mutex
+}
+
+const (
+  // @NOTE: how fast the averages of latency follow new samples
+  gradientLongFactor = 0.01
+  gradientShortFactor = 0.1
+
+  // @NOTE: how fast the concurrency limit moves to its new target
+  gradientSmoothing = 0.2
+)
+
+/*! \brief Create a limiter of rpc calls
+ *
+ *  This function is used to create a limiter which is installed by
+ * GRpcContext.Intercept, calls which exceed a limit are refused with
+ * RESOURCE_EXHAUSTED
+ *
+ *  \return *RpcLimiter: the limiter, buckets are kept in memory by default
+ */
+func NewRpcLimiter() *RpcLimiter {
+  return &RpcLimiter{store: NewMemoryLimitStore()}
+}
+
+/*! \brief Limit the rate of calls
+ *
+ *  \param method: the full method name, a service prefix like
+ *                 /package.Service/ or "*" for every method
+ *  \param limit: the limit, LIMIT_BY_APIKEY needs the principal of an api
+ *                key, see ApiKeyAuthenticator.Interceptors
+ *  \return *RpcLimiter: to make a chain call, we will return itself to make
+ *                       calling next function easily
+ */
+func (self *RpcLimiter) Limit(method string, limit RateLimit) *RpcLimiter {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
+  self.limits = append(self.limits, iRpcLimit{method: method, limit: limit})
+  return self
+}
+
+/*! \brief Change where buckets are stored
+ *
+ *  \param store: the store, e.g one which is shared by every replica
+ *  \return *RpcLimiter: to make a chain call, we will return itself to make
+ *                       calling next function easily
+ */
+func (self *RpcLimiter) SetLimitStore(store LimitStore) *RpcLimiter {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
+  self.store = store
+  return self
+}
+
+/*! \brief Limit how many calls are served at once
+ *
+ *  \param max: the max number of in-flight calls, zero means unlimited
+ *  \return *RpcLimiter: to make a chain call, we will return itself to make
+ *                       calling next function easily
+ */
+func (self *RpcLimiter) Concurrency(max int) *RpcLimiter {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
+  self.capacity = float64(max)
+  self.gradient = nil
+  return self
+}
+
+/*! \brief Adapt the concurrency limit to latency of unary calls
+ *
+ *  This method is used to find the concurrency which our backend could
+ * handle without queueing, the limit shrinks when latency grows above its
+ * long-term average and grows again while latency stays healthy
+ *
+ *  \param min: the lowest limit, it's also where we start from
+ *  \param max: the highest limit
+ *  \return *RpcLimiter: to make a chain call, we will return itself to make
+ *                       calling next function easily
+ */
+func (self *RpcLimiter) Adaptive(min, max int) *RpcLimiter {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
+  self.capacity = float64(min)
+  self.gradient = &iGradient{min: float64(min), max: float64(max)}
+  return self
+}
+
+/*! \brief Get the current concurrency limit
+ *
+ *  \return int: the limit, zero means unlimited
+ */
+func (self *RpcLimiter) Capacity() int {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
+  return int(self.capacity)
+}
+
+/*! \brief Produce interceptors which enforce our limits
+ *
+ *  \return grpc.UnaryServerInterceptor: the interceptor of unary calls
+ *  \return grpc.StreamServerInterceptor: the interceptor of streams, they
+ *                                        count as in-flight calls but never
+ *                                        teach the adaptive limit
+ */
+func (self *RpcLimiter) Interceptors() (grpc.UnaryServerInterceptor,
+                                        grpc.StreamServerInterceptor) {
+  unary := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+                handler grpc.UnaryHandler) (interface{}, error) {
+    release, err := self.admit(ctx, info.FullMethod)
+    if err != nil {
+      return nil, err
+    }
+
+    resp, err := handler(ctx, req)
+    release(true)
+    return resp, err
+  }
+
+  stream := func(srv interface{}, stream grpc.ServerStream,
+                 info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+    release, err := self.admit(stream.Context(), info.FullMethod)
+    if err != nil {
+      return err
+    }
+
+    defer release(false)
+    return handler(srv, stream)
+  }
+
+  return unary, stream
+}
+
+/*! \brief Admit a call if it passes every limit
+ *
+ *  \param ctx: the context of the call
+ *  \param method: the full method name
+ *  \return func(bool): the function which must be called when the call
+ *                      finishes, true means its latency is sampled
+ *  \return error: the status error if the call is refused
+ */
+func (self *RpcLimiter) admit(ctx context.Context,
+                              method string) (func(bool), error) {
+  if wait := self.throttle(ctx, method); wait > 0 {
+    reason := status.New(codes.ResourceExhausted,
+                         fmt.Sprintf("too many calls of %s", method))
+
+    if detailed, err := reason.WithDetails(&errdetails.RetryInfo{
+      RetryDelay: durationpb.New(wait),
+    }); err == nil {
+      reason = detailed
+    }
+
+    return nil, reason.Err()
+  }
+
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
+  if self.capacity > 0 && float64(self.inflight) >= math.Floor(self.capacity) {
+    return nil, status.Error(codes.ResourceExhausted,
+                             "too many calls in flight")
+  }
+
+  self.inflight += 1
+  started := time.Now()
+
+  return func(sample bool) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+
+    if sample && self.gradient != nil {
+      self.capacity = self.gradient.update(self.capacity, self.inflight,
+                                           time.Since(started))
+    }
+
+    self.inflight -= 1
+  }, nil
+}
+
+/*! \brief Take a token of every limit which covers a call
+ *
+ *  \param ctx: the context of the call
+ *  \param method: the full method name
+ *  \return time.Duration: how long the caller must wait, zero means the
+ *                         call could be served
+ */
+func (self *RpcLimiter) throttle(ctx context.Context, method string) time.Duration {
+  var addr string
+
+  self.lock.Lock()
+  store := self.store
+  limits := self.limits
+  self.lock.Unlock()
+
+  if caller, ok := peer.FromContext(ctx); ok && caller.Addr != nil {
+    addr = caller.Addr.String()
+  }
+
+  buckets := []iLimitBucket{}
+
+  for _, item := range limits {
+    if ! matchRpcMethod(item.method, method) {
+      continue
+    }
+
+    owner := ownerOfBucket(item.limit.By, PrincipalOf(ctx), addr)
+    buckets = append(buckets, iLimitBucket{
+      key: fmt.Sprintf("%s@%s", item.method, owner),
+      limit: item.limit,
+    })
+  }
+
+  return takeLimitBuckets(store, buckets)
+}
+
+/* -------------------------- iGradient --------------------------- */
+
+/*! \brief Compute the next concurrency limit from a latency sample
+ *
+ *  \param limit: the current limit
+ *  \param inflight: the number of in-flight calls, including the sampled
+ *                   one
+ *  \param latency: the latency of the sampled call
+ *  \return float64: the next limit
+ */
+func (self *iGradient) update(limit float64, inflight int,
+                              latency time.Duration) float64 {
+  sample := float64(latency)
+
+  if self.long == 0 {
+    self.long, self.short = sample, sample
+  }
+
+  self.short += (sample - self.short) * gradientShortFactor
+  self.long += (sample - self.long) * gradientLongFactor
+
+  // @NOTE: latency is below the baseline, the baseline is pulled down so it
+  // won't stay high after a spike
+  if self.long > self.short * 2 {
+    self.long = self.short * 2
+  }
+
+  gradient := math.Max(0.5, math.Min(1, self.long / self.short))
+  target := limit * gradient + math.Sqrt(limit)
+
+  // @NOTE: samples of an idle limiter say nothing about larger limits
+  if target > limit && float64(inflight) < limit / 2 {
+    return limit
+  }
+
+  next := limit * (1 - gradientSmoothing) + target * gradientSmoothing
+  return math.Max(self.min, math.Min(self.max, next))
+}
@@ -0,0 +1,545 @@
+package utils
+
+import (
+  "google.golang.org/grpc/encoding/proto"
+  "google.golang.org/grpc/resolver/manual"
+  "google.golang.org/grpc/resolver"
+  "google.golang.org/grpc/encoding"
+  "google.golang.org/grpc/metadata"
+  "google.golang.org/grpc/status"
+  "google.golang.org/grpc/codes"
+  "google.golang.org/grpc"
+  "sync/atomic"
+  "net/url"
+  "context"
+  "strings"
+  "errors"
+  "time"
+  "fmt"
+  "net"
+  "io"
+)
+
+// @NOTE: the proxy doesn't know messages of upstreams, so every stream is
+// opened as a bidirectional one and it works with unary calls too
+var grpcProxyStreamDesc = &grpc.StreamDesc{
+  ServerStreams: true,
+  ClientStreams: true,
+}
+
+var grpcRawCodec = &iGrpcRawCodec{}
+
+type iGrpcFrame struct {
+  // @NOTE: payload stores the encoded message which is forwarded as is
+  payload []byte
+}
+
+type iGrpcRawCodec struct {}
+
+type ProxyRule struct {
+  // @NOTE: method is the full rpc method name, a name which ends with "/"
+  // matches every method of a service and "*" matches every method
+  method string
+
+  // @NOTE: metadata stores the values which incoming metadata must contain
+  // so this rule can be used
+  metadata map[string]string
+
+  // @NOTE: upstream is the connection which requests are forwarded to
+  upstream *iGrpcTarget
+}
+
+type iGrpcTarget struct {
+  // @NOTE: target is the address which is dialed, it's empty when servers
+  // are found by discovery
+  target string
+  discovery Discovery
+
+  // @NOTE: connection is a plain grpc connection, so upstreams could be any
+  // grpc server and versions are negotiated by callers of the proxy
+  connection *grpc.ClientConn
+
+  // @NOTE: resolver receives servers of discovery until done is closed
+  resolver *manual.Resolver
+  done chan struct{}
+}
+
+/*! \brief Route rpc methods to an upstream
+ *
+ *  This method is used to forward calls of rpc methods to a grpc server,
+ * which doesn't need to be served by GRpcContext. Rules are matched in the
+ * order they are added
+ *
+ *  \param method: the full rpc method name, e.g /package.Service/Method,
+ *                 /package.Service/ for a whole service or * for any method
+ *  \param target: the address of upstream, e.g localhost:50051, or any
+ *                 target which grpc could dial, e.g dns:///orders:50051
+ *  \return *ProxyRule: the rule which could be narrowed by metadata
+ *  \return error: if upstream can't be connected, we will receive an error
+ */
+func (self *Gateway) Route(method, target string) (*ProxyRule, error) {
+  if len(target) == 0 {
+    return nil, errors.New("upstream target is empty")
+  }
+
+  upstream, err := self.grpc.connect(target, nil)
+  if err != nil {
+    return nil, err
+  }
+
+  return self.grpc.route(method, upstream), nil
+}
+
+/*! \brief Route rpc methods to upstreams which are found by a discovery
+ *
+ *  This method works like Route but calls are balanced across servers of
+ * the discovery with round robin, servers are refreshed periodically
+ *
+ *  \param method: the full rpc method name
+ *  \param discovery: the discovery which lists addresses of upstreams
+ *  \return *ProxyRule: the rule which could be narrowed by metadata
+ *  \return error: if upstreams can't be found, we will receive an error
+ */
+func (self *Gateway) RouteDiscovery(method string,
+                                    discovery Discovery) (*ProxyRule, error) {
+  if discovery == nil {
+    return nil, errors.New("upstream discovery is nil")
+  }
+
+  upstream, err := self.grpc.connect("", discovery)
+  if err != nil {
+    return nil, err
+  }
+
+  return self.grpc.route(method, upstream), nil
+}
+
+/*! \brief Serve the gateway as a grpc proxy
+ *
+ *  This method is used to serve the proxy on the GRpcContext of gateway,
+ * every call is forwarded to the upstream of the first matching rule
+ * without decoding its messages
+ *
+ *  \param version: the version which the proxy is served with
+ *  \param protocols: the protocols, every supported one is used when empty
+ *  \return *GRpcServing: the serving object which is used to stop proxy
+ *  \return error: if the proxy can't be served, we will receive an error
+ */
+func (self *Gateway) Proxy(version string,
+                           protocols ...string) (*GRpcServing, error) {
+  self.grpc.version = version
+  return self.rpc.Start(self.grpc, protocols...)
+}
+
+/*! \brief Require a metadata value before using this rule
+ *
+ *  \param key: the metadata key, it's case-insensitive
+ *  \param value: the value which one of metadata values must be equal to
+ *  \return *ProxyRule: the rule itself
+ */
+func (self *ProxyRule) Match(key, value string) *ProxyRule {
+  self.metadata[strings.ToLower(key)] = value
+  return self
+}
+
+/*! \brief Check if this rule accepts a call
+ *
+ *  \param method: the full rpc method name
+ *  \param md: the incoming metadata
+ *  \return bool: true if the call should be forwarded by this rule
+ */
+func (self *ProxyRule) accept(method string, md metadata.MD) bool {
+  if ! matchRpcMethod(self.method, method) {
+    return false
+  }
+
+  for key, expected := range self.metadata {
+    found := false
+
+    for _, value := range md.Get(key) {
+      if value == expected {
+        found = true
+        break
+      }
+    }
+
+    if ! found {
+      return false
+    }
+  }
+
+  return true
+}
+
+/* ------------------------- iGrpcGateway ------------------------- */
+
+func (self *iGrpcGateway) Version() string {
+  return self.version
+}
+
+func (self *iGrpcGateway) Listen(protocol string) (net.Listener, error) {
+  // @NOTE: the proxy always uses the default listeners of the context
+  return nil, nil
+}
+
+func (self *iGrpcGateway) New(serv *grpc.Server) error {
+  return nil
+}
+
+func (self *iGrpcGateway) OnServing(protocol string) error {
+  return nil
+}
+
+func (self *iGrpcGateway) OnStopping() {
+}
+
+func (self *iGrpcGateway) ServerOptions() []grpc.ServerOption {
+  return []grpc.ServerOption{
+    grpc.CustomCodec(grpcRawCodec),
+    grpc.UnknownServiceHandler(self.forward),
+  }
+}
+
+/*! \brief Connect an upstream
+ *
+ *  This method is used to reuse the connection of an upstream if it has
+ * been connected with the same target or discovery, otherwide a new one is
+ * created
+ *
+ *  \param target: the address of upstream, it's ignored with discovery
+ *  \param discovery: the discovery of upstreams, or nil
+ *  \return *iGrpcTarget: the connection
+ *  \return error: if upstream can't be connected, we will receive an error
+ */
+func (self *iGrpcGateway) connect(target string,
+                                  discovery Discovery) (*iGrpcTarget, error) {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
+  for _, upstream := range self.targets {
+    if discovery != nil && upstream.discovery == discovery {
+      return upstream, nil
+    } else if discovery == nil && upstream.target == target {
+      return upstream, nil
+    }
+  }
+
+  upstream := &iGrpcTarget{target: target, discovery: discovery}
+
+  if err := upstream.dial(); err != nil {
+    return nil, err
+  }
+
+  self.targets = append(self.targets, upstream)
+  return upstream, nil
+}
+
+/*! \brief Add a rule which forwards calls to an upstream
+ *
+ *  \param method: the full rpc method name
+ *  \param upstream: the connection
+ *  \return *ProxyRule: the rule
+ */
+func (self *iGrpcGateway) route(method string, upstream *iGrpcTarget) *ProxyRule {
+  rule := &ProxyRule{
+    method: method,
+    metadata: make(map[string]string),
+    upstream: upstream,
+  }
+
+  self.lock.Lock()
+  self.rules = append(self.rules, rule)
+  self.lock.Unlock()
+  return rule
+}
+
+/*! \brief Find the first rule which accepts a call
+ *
+ *  \param method: the full rpc method name
+ *  \param md: the incoming metadata
+ *  \return *ProxyRule: the rule or nil if there is no matching rule
+ */
+func (self *iGrpcGateway) match(method string, md metadata.MD) *ProxyRule {
+  self.lock.RLock()
+  defer self.lock.RUnlock()
+
+  for _, rule := range self.rules {
+    if rule.accept(method, md) {
+      return rule
+    }
+  }
+
+  return nil
+}
+
+/*! \brief Forward a call to its upstream
+ *
+ *  This method is used as the unknown service handler of proxy, frames are
+ * copied in both directions until upstream finishes the call, then its
+ * status and trailer are returned to the client
+ *
+ *  \param srv: unused, there is no service behind the proxy
+ *  \param stream: the stream of client
+ *  \return error: the status which is returned to client
+ */
+func (self *iGrpcGateway) forward(srv interface{}, stream grpc.ServerStream) error {
+  method, ok := grpc.MethodFromServerStream(stream)
+  if ! ok {
+    return status.Error(codes.Internal, "can't detect method of stream")
+  }
+
+  incoming, _ := metadata.FromIncomingContext(stream.Context())
+  rule := self.match(method, incoming)
+
+  if rule == nil {
+    return status.Error(codes.Unimplemented,
+                        fmt.Sprintf("there is no route for %s", method))
+  }
+
+  return forwardGRpcStream(stream, rule.upstream.connection, method,
+                           forwardedGRpcMetadata(incoming))
+}
+
+/* ------------------------- iGrpcTarget -------------------------- */
+
+/*! \brief Dial this upstream
+ *
+ *  \return error: if upstream can't be reached in time, we will receive an
+ *                 error
+ */
+func (self *iGrpcTarget) dial() error {
+  ctx, cancel := context.WithTimeout(context.Background(), defaultGRpcTimeout)
+  defer cancel()
+
+  target := self.target
+  options := []grpc.DialOption{
+    grpc.WithInsecure(),
+    grpc.WithBlock(),
+    grpc.WithDefaultCallOptions(grpc.ForceCodec(grpcRawCodec)),
+  }
+
+  if self.discovery != nil {
+    scheme := fmt.Sprintf("devio-%d", atomic.AddUint32(&grpcResolvingCount, 1))
+
+    state, err := self.state()
+    if err != nil {
+      return err
+    }
+
+    self.resolver = manual.NewBuilderWithScheme(scheme)
+    self.resolver.InitialState(state)
+    self.done = make(chan struct{})
+
+    target = scheme + ":///proxy"
+    options = append(options,
+                     grpc.WithResolvers(self.resolver),
+                     grpc.WithDefaultServiceConfig(
+                       `{"loadBalancingConfig": [{"round_robin": {}}]}`))
+  }
+
+  connection, err := grpc.DialContext(ctx, target, options...)
+  if err != nil {
+    return err
+  }
+
+  self.connection = connection
+
+  if self.discovery != nil {
+    go self.watch()
+  }
+
+  return nil
+}
+
+/*! \brief Resolve servers periodically until this upstream is closed
+ */
+func (self *iGrpcTarget) watch() {
+  ticker := time.NewTicker(defaultGRpcRefresh)
+  defer ticker.Stop()
+
+  for {
+    select {
+    case <-self.done:
+      return
+
+    case <-ticker.C:
+      // @NOTE: we keep the last servers when discovery is broken
+      if state, err := self.state(); err == nil {
+        self.resolver.UpdateState(state)
+      }
+    }
+  }
+}
+
+/*! \brief Build the resolver state from discovery
+ *
+ *  \return resolver.State: the state
+ *  \return error: if discovery fails or doesn't find any server
+ */
+func (self *iGrpcTarget) state() (resolver.State, error) {
+  addresses, err := self.discovery.Resolve()
+
+  if err != nil {
+    return resolver.State{}, err
+  } else if len(addresses) == 0 {
+    return resolver.State{}, errors.New("discovery doesn't find any server")
+  }
+
+  ret := resolver.State{}
+
+  for _, address := range addresses {
+    // @NOTE: grpc dials host:port only, urls of discovery are cut to it
+    if parsed, err := url.Parse(address); err == nil && len(parsed.Host) > 0 {
+      address = parsed.Host
+    }
+
+    ret.Addresses = append(ret.Addresses, resolver.Address{Addr: address})
+  }
+
+  return ret, nil
+}
+
+/*! \brief Close the connection of this upstream
+ */
+func (self *iGrpcTarget) close() {
+  if self.done != nil {
+    close(self.done)
+  }
+
+  self.connection.Close()
+}
+
+/* ------------------------ iGrpcRawCodec ------------------------- */
+
+func (self *iGrpcRawCodec) Marshal(v interface{}) ([]byte, error) {
+  if frame, ok := v.(*iGrpcFrame); ok {
+    return frame.payload, nil
+  }
+
+  return encoding.GetCodec(proto.Name).Marshal(v)
+}
+
+func (self *iGrpcRawCodec) Unmarshal(data []byte, v interface{}) error {
+  if frame, ok := v.(*iGrpcFrame); ok {
+    frame.payload = append([]byte{}, data...)
+    return nil
+  }
+
+  return encoding.GetCodec(proto.Name).Unmarshal(data, v)
+}
+
+func (self *iGrpcRawCodec) Name() string {
+  // @NOTE: we must keep the content-subtype of proto so upstreams still
+  // accept our requests
+  return proto.Name
+}
+
+func (self *iGrpcRawCodec) String() string {
+  return self.Name()
+}
+
+/* --------------------------- helper ----------------------------- */
+
+/*! \brief Copy metadata of a call which is about to be forwarded
+ *
+ *  \param incoming: the incoming metadata
+ *  \return metadata.MD: the metadata without pseudo headers and without
+ *                       the peer which our front server has attached
+ */
+func forwardedGRpcMetadata(incoming metadata.MD) metadata.MD {
+  // @NOTE: pseudo headers are produced by transport itself, forwarding them
+  // would corrupt the request of upstream
+  ret := metadata.MD{}
+
+  for key, values := range incoming {
+    if ! strings.HasPrefix(key, ":") && key != grpcPeerMetadata {
+      ret[key] = values
+    }
+  }
+
+  return ret
+}
+
+/*! \brief Forward a stream to another connection without decoding it
+ *
+ *  This function is used by the proxy and by the front server of versions,
+ * frames are copied in both directions until upstream finishes the call,
+ * then its status and trailer are returned to the client
+ *
+ *  \param stream: the stream of client
+ *  \param connection: the connection of upstream
+ *  \param method: the full rpc method name
+ *  \param outgoing: the metadata which is sent to upstream
+ *  \return error: the status which is returned to client
+ */
+func forwardGRpcStream(stream grpc.ServerStream, connection *grpc.ClientConn,
+                       method string, outgoing metadata.MD) error {
+  ctx, cancel := context.WithCancel(stream.Context())
+  defer cancel()
+
+  upstream, err := connection.NewStream(metadata.NewOutgoingContext(ctx, outgoing),
+                                        grpcProxyStreamDesc, method,
+                                        grpc.ForceCodec(grpcRawCodec))
+  if err != nil {
+    return err
+  }
+
+  go func() {
+    for {
+      frame := &iGrpcFrame{}
+
+      if err := stream.RecvMsg(frame); err == io.EOF {
+        upstream.CloseSend()
+        return
+      } else if err != nil {
+        cancel()
+        return
+      } else if err := upstream.SendMsg(frame); err != nil {
+        // @NOTE: the reason is reported by RecvMsg of upstream
+        return
+      }
+    }
+  }()
+
+  if header, err := upstream.Header(); err == nil && len(header) > 0 {
+    if err := stream.SendHeader(header); err != nil {
+      return err
+    }
+  }
+
+  for {
+    frame := &iGrpcFrame{}
+
+    if err := upstream.RecvMsg(frame); err != nil {
+      stream.SetTrailer(upstream.Trailer())
+
+      if err == io.EOF {
+        return nil
+      }
+
+      return err
+    } else if err := stream.SendMsg(frame); err != nil {
+      return err
+    }
+  }
+}
+
+/*! \brief Check if a rpc method matches a pattern
+ *
+ *  \param pattern: the full method name, a service prefix which ends with
+ *                  "/" like /package.Service/ or "*" for every method
+ *  \param method: the full method name
+ *  \return bool: true if it matches
+ */
+func matchRpcMethod(pattern, method string) bool {
+  switch {
+  case pattern == "*":
+    return true
+
+  case strings.HasSuffix(pattern, "/"):
+    return strings.HasPrefix(method, pattern)
+
+  default:
+    return method == pattern
+  }
+}
@@ -0,0 +1,493 @@
+package utils
+
+import (
+  "google.golang.org/protobuf/proto"
+  "google.golang.org/grpc/status"
+  "google.golang.org/grpc/codes"
+  "google.golang.org/grpc"
+  "math/rand"
+  "context"
+  "sync"
+  "time"
+)
+
+type RetryPolicy struct {
+  // @NOTE: attempts is how many times a call is sent including the first
+  // one, calls must be idempotent since a server may see them twice
+  Attempts int
+
+  // @NOTE: backoff is the wait before the first retry, it doubles after
+  // every retry up to max backoff and is jittered to spread clients apart
+  Backoff time.Duration
+  MaxBackoff time.Duration
+
+  // @NOTE: codes are retried, empty means UNAVAILABLE only
+  Codes []codes.Code
+}
+
+type HedgePolicy struct {
+  // @NOTE: attempts is how many copies of a call could be in flight, the
+  // first response wins and the others are cancelled
+  Attempts int
+
+  // @NOTE: delay is how long we wait for a response before sending the next
+  // copy, a copy is sent at once when the previous one fails with codes
+  Delay time.Duration
+
+  // @NOTE: codes don't stop hedging, empty means UNAVAILABLE only
+  Codes []codes.Code
+}
+
+type BreakerPolicy struct {
+  // @NOTE: failures is how many consecutive failures open the breaker
+  Failures int
+
+  // @NOTE: cooldown is how long calls fail fast before a probe is sent to
+  // check if the server is back
+  Cooldown time.Duration
+
+  // @NOTE: codes count as failures, empty means UNAVAILABLE,
+  // DEADLINE_EXCEEDED and INTERNAL
+  Codes []codes.Code
+}
+
+type iGRpcRetry struct {
+  method string
+  policy RetryPolicy
+}
+
+type iGRpcHedge struct {
+  method string
+  policy HedgePolicy
+}
+
+type iGRpcBreaker struct {
+  failures int
+  opened time.Time
+
+  // @NOTE: probing is true while the only call which is allowed through an
+  // open breaker is in flight
+  probing bool
+  lock sync.Mutex
+}
+
+type iGRpcCaller struct {
+  // @NOTE: owner provides policies, they are read on every call so they
+  // could be changed after connecting
+  owner *GRpcContext
+  invent Invent
+  breaker iGRpcBreaker
+
+  // @NOTE: negotiated maps addresses of servers to the version which they
+  // have answered with, servers which don't negotiate version are absent
+  negotiated map[string]string
+  lock sync.Mutex
+}
+
+type iGRpcHedgeResult struct {
+  reply proto.Message
+  err error
+}
+
+const (
+  // @NOTE: backoff of retry policies which don't define theirs
+  defaultGRpcBackoff = 100 * time.Millisecond
+  defaultGRpcMaxBackoff = 5 * time.Second
+)
+
+var defaultGRpcRetryCodes = []codes.Code{codes.Unavailable}
+var defaultGRpcBreakerCodes = []codes.Code{
+  codes.Unavailable,
+  codes.DeadlineExceeded,
+  codes.Internal,
+}
+
+/*! \brief Retry failed calls of a method
+ *
+ *  This function is used to configure retries of invents which are
+ * connected by this context, the first policy which matches a method wins
+ *
+ *  \param method: the full method name, a service prefix like
+ *                 /package.Service/ or "*" for every method. Only
+ *                 idempotent methods should be retried
+ *  \param policy: the policy
+ */
+func (self *GRpcContext) Retry(method string, policy RetryPolicy) {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
+  self.retries = append(self.retries, iGRpcRetry{method: method, policy: policy})
+}
+
+/*! \brief Hedge calls of a method
+ *
+ *  This function is used to send copies of slow calls to cut tail latency,
+ * hedging replaces retrying for methods which have both policies
+ *
+ *  \param method: the full method name, a service prefix like
+ *                 /package.Service/ or "*" for every method. Only
+ *                 idempotent methods should be hedged
+ *  \param policy: the policy
+ */
+func (self *GRpcContext) Hedge(method string, policy HedgePolicy) {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
+  self.hedges = append(self.hedges, iGRpcHedge{method: method, policy: policy})
+}
+
+/*! \brief Protect connections with a circuit breaker
+ *
+ *  This function is used to stop calling a failing server, each connection
+ * has its own breaker and OnBroken of its invent is raised when it opens
+ *
+ *  \param policy: the policy, zero failures disables the breaker
+ */
+func (self *GRpcContext) Break(policy BreakerPolicy) {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
+  self.breaker = policy
+}
+
+/*! \brief Find the policies of a method
+ *
+ *  \param method: the full method name
+ *  \return *RetryPolicy: the retry policy or nil
+ *  \return *HedgePolicy: the hedge policy or nil
+ *  \return BreakerPolicy: the breaker policy
+ */
+func (self *GRpcContext) policiesOf(method string) (*RetryPolicy, *HedgePolicy,
+                                                     BreakerPolicy) {
+  var retry *RetryPolicy
+  var hedge *HedgePolicy
+
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
+  for i, item := range self.hedges {
+    if matchRpcMethod(item.method, method) {
+      hedge = &self.hedges[i].policy
+      break
+    }
+  }
+
+  for i, item := range self.retries {
+    if hedge == nil && matchRpcMethod(item.method, method) {
+      retry = &self.retries[i].policy
+      break
+    }
+  }
+
+  return retry, hedge, self.breaker
+}
+
+/* ------------------------- iGRpcCaller -------------------------- */
+
+/*! \brief Produce the options which install our interceptors on a
+ *  connection
+ *
+ *  \return []grpc.DialOption: the options
+ */
+func (self *iGRpcCaller) options() []grpc.DialOption {
+  return []grpc.DialOption{
+    grpc.WithChainUnaryInterceptor(self.unary, self.versioned),
+    grpc.WithChainStreamInterceptor(self.stream, self.versionedStream),
+  }
+}
+
+func (self *iGRpcCaller) unary(ctx context.Context, method string,
+                               req, reply interface{}, cc *grpc.ClientConn,
+                               invoker grpc.UnaryInvoker,
+                               opts ...grpc.CallOption) error {
+  // @NOTE: the handshake isn't a call of the invent, it's neither traced
+  // nor counted by the breaker
+  if method == grpcHandshakeMethod {
+    return invoker(ctx, method, req, reply, cc, opts...)
+  }
+
+  ctx = outgoingRequestId(ctx)
+  tracer := self.owner.tracerOf()
+  if tracer == nil {
+    return self.protect(ctx, method, req, reply, cc, invoker, opts...)
+  }
+
+  // @NOTE: the span covers every retry and hedge of this call
+  ctx, span := tracer.outgoing(ctx, method)
+  err := self.protect(ctx, method, req, reply, cc, invoker, opts...)
+
+  span.End(err)
+  return err
+}
+
+func (self *iGRpcCaller) stream(ctx context.Context, desc *grpc.StreamDesc,
+                                cc *grpc.ClientConn, method string,
+                                streamer grpc.Streamer,
+                                opts ...grpc.CallOption) (grpc.ClientStream, error) {
+  ctx = outgoingRequestId(ctx)
+  tracer := self.owner.tracerOf()
+  if tracer == nil {
+    return self.open(ctx, desc, cc, method, streamer, opts...)
+  }
+
+  ctx, span := tracer.outgoing(ctx, method)
+  stream, err := self.open(ctx, desc, cc, method, streamer, opts...)
+
+  if err != nil {
+    span.End(err)
+    return nil, err
+  }
+
+  return newTracedClientStream(ctx, stream, desc, span), nil
+}
+
+/*! \brief Send a unary call through our retry, hedge and breaker policies
+ */
+func (self *iGRpcCaller) protect(ctx context.Context, method string,
+                                 req, reply interface{}, cc *grpc.ClientConn,
+                                 invoker grpc.UnaryInvoker,
+                                 opts ...grpc.CallOption) error {
+  retry, hedge, breaker := self.owner.policiesOf(method)
+
+  if ! self.breaker.allow(breaker) {
+    return status.Error(codes.Unavailable, "circuit breaker is open")
+  }
+
+  var err error
+
+  if message, ok := reply.(proto.Message); ok && hedge != nil && hedge.Attempts > 1 {
+    err = self.hedge(ctx, *hedge, message, func(ctx context.Context,
+                                                 reply interface{}) error {
+      return invoker(ctx, method, req, reply, cc, opts...)
+    })
+  } else if retry != nil && retry.Attempts > 1 {
+    err = self.retry(ctx, *retry, func() error {
+      return invoker(ctx, method, req, reply, cc, opts...)
+    })
+  } else {
+    err = invoker(ctx, method, req, reply, cc, opts...)
+  }
+
+  self.report(breaker, err)
+  return err
+}
+
+/*! \brief Open a stream through our breaker
+ */
+func (self *iGRpcCaller) open(ctx context.Context, desc *grpc.StreamDesc,
+                              cc *grpc.ClientConn, method string,
+                              streamer grpc.Streamer,
+                              opts ...grpc.CallOption) (grpc.ClientStream, error) {
+  _, _, breaker := self.owner.policiesOf(method)
+
+  if ! self.breaker.allow(breaker) {
+    return nil, status.Error(codes.Unavailable, "circuit breaker is open")
+  }
+
+  // @NOTE: messages of a stream can't be replayed, so only opening it is
+  // protected by the breaker
+  stream, err := streamer(ctx, desc, cc, method, opts...)
+  self.report(breaker, err)
+  return stream, err
+}
+
+/*! \brief Retry a call with jittered exponential backoff
+ *
+ *  \param ctx: the context of the call, we stop retrying when it's done
+ *  \param policy: the retry policy
+ *  \param call: the function which sends the call once
+ *  \return error: the error of the last attempt
+ */
+func (self *iGRpcCaller) retry(ctx context.Context, policy RetryPolicy,
+                               call func() error) error {
+  backoff := policy.Backoff
+  limit := policy.MaxBackoff
+
+  if backoff <= 0 {
+    backoff = defaultGRpcBackoff
+  }
+
+  if limit <= 0 {
+    limit = defaultGRpcMaxBackoff
+  }
+
+  for attempt := 1; ; attempt++ {
+    err := call()
+
+    if err == nil || attempt >= policy.Attempts ||
+       ! hasGRpcCode(policy.Codes, defaultGRpcRetryCodes, err) {
+      return err
+    }
+
+    // @NOTE: equal jitter, we always wait at least half of the backoff
+    wait := backoff / 2 + time.Duration(rand.Int63n(int64(backoff / 2) + 1))
+
+    select {
+    case <-time.After(wait):
+    case <-ctx.Done():
+      return err
+    }
+
+    if backoff *= 2; backoff > limit {
+      backoff = limit
+    }
+  }
+}
+
+/*! \brief Send copies of a call until one of them succeeds
+ *
+ *  \param ctx: the context of the call
+ *  \param policy: the hedge policy
+ *  \param reply: the response message, it receives the winner's response
+ *  \param call: the function which sends a copy of the call
+ *  \return error: nil if a copy succeeds, otherwise the last error
+ */
+func (self *iGRpcCaller) hedge(ctx context.Context, policy HedgePolicy,
+                               reply proto.Message,
+                               call func(context.Context, interface{}) error) error {
+  var last error
+  var next <-chan time.Time
+
+  ctx, cancel := context.WithCancel(ctx)
+  defer cancel()
+
+  results := make(chan iGRpcHedgeResult, policy.Attempts)
+  launched, pending := 0, 0
+
+  launch := func() {
+    // @NOTE: every copy has its own response so they never race
+    copied := proto.Clone(reply)
+    proto.Reset(copied)
+
+    launched += 1
+    pending += 1
+    next = nil
+
+    if launched < policy.Attempts {
+      next = time.After(policy.Delay)
+    }
+
+    go func() {
+      results <- iGRpcHedgeResult{reply: copied, err: call(ctx, copied)}
+    }()
+  }
+
+  launch()
+
+  for pending > 0 {
+    select {
+    case <-next:
+      launch()
+
+    case result := <-results:
+      pending -= 1
+
+      if result.err == nil {
+        proto.Reset(reply)
+        proto.Merge(reply, result.reply)
+        return nil
+      }
+
+      last = result.err
+      if ! hasGRpcCode(policy.Codes, defaultGRpcRetryCodes, last) {
+        return last
+      } else if launched < policy.Attempts {
+        launch()
+      }
+    }
+  }
+
+  return last
+}
+
+/*! \brief Report the result of a call to the breaker
+ *
+ *  \param policy: the breaker policy
+ *  \param err: the error of the call
+ */
+func (self *iGRpcCaller) report(policy BreakerPolicy, err error) {
+  if policy.Failures <= 0 {
+    return
+  }
+
+  failed := err != nil && hasGRpcCode(policy.Codes, defaultGRpcBreakerCodes, err)
+
+  if self.breaker.record(policy, failed) {
+    // @NOTE: the invent may disconnect itself here, so we must not hold any
+    // lock while raising the event
+    self.invent.OnBroken(self.invent.Socket())
+  }
+}
+
+/* ------------------------- iGRpcBreaker ------------------------- */
+
+/*! \brief Check if a call could be sent
+ *
+ *  \param policy: the breaker policy
+ *  \return bool: false if the breaker is open
+ */
+func (self *iGRpcBreaker) allow(policy BreakerPolicy) bool {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
+  if policy.Failures <= 0 || self.failures < policy.Failures {
+    return true
+  } else if self.probing || time.Since(self.opened) < policy.Cooldown {
+    return false
+  }
+
+  self.probing = true
+  return true
+}
+
+/*! \brief Record the result of a call
+ *
+ *  \param policy: the breaker policy
+ *  \param failed: true if the call failed
+ *  \return bool: true if this failure opens the breaker, a failed probe
+ *                reopens it without raising OnBroken again
+ */
+func (self *iGRpcBreaker) record(policy BreakerPolicy, failed bool) bool {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
+  self.probing = false
+
+  if ! failed {
+    self.failures = 0
+    return false
+  }
+
+  self.failures += 1
+
+  if self.failures >= policy.Failures {
+    self.opened = time.Now()
+  }
+
+  return self.failures == policy.Failures
+}
+
+/* --------------------------- helper ----------------------------- */
+
+/*! \brief Check if the status of an error is one of some codes
+ *
+ *  \param expected: the codes, empty means defaults
+ *  \param defaults: the default codes
+ *  \param err: the error
+ *  \return bool: true if it matches
+ */
+func hasGRpcCode(expected, defaults []codes.Code, err error) bool {
+  code := status.Code(err)
+
+  if len(expected) == 0 {
+    expected = defaults
+  }
+
+  for _, item := range expected {
+    if item == code {
+      return true
+    }
+  }
+
+  return false
+}
@@ -1,12 +1,35 @@
 package utils
 
 import (
+  "google.golang.org/grpc/test/bufconn"
+  "google.golang.org/grpc/peer"
   "google.golang.org/grpc"
+  "context"
   "errors"
+  "strings"
+  "sort"
+  "math"
+  "sync"
+  "time"
   "fmt"
   "net"
+  "os"
 )
 
+const (
+  // @NOTE: by default, we won't wait forever for a protocol since we would
+  // like to fallback to the next one as soon as possible
+  defaultGRpcTimeout = 5 * time.Second
+
+  // @NOTE: the size of buffer which is used by each in-memory connection
+  grpcMemoryBufferSize = 1024 * 1024
+)
+
+// @NOTE: this is the default order which is used to try protocols when user
+// doesn't specify any preference, the closer transport is always tried first.
+// The memory protocol is never used unless it's requested explicitly
+var defaultGRpcPreferences = []string{"ipc", "quic", "tcp", "sctp", "tipc"}
+
 type Invent interface {
   // @NOTE: this method is used to get the current client's version
   Version() string
@@ -40,35 +63,155 @@ type Implement interface {
 
   // @NOTE: this method is used to create new Implement with specific protoc
   New(serv *grpc.Server) error
+
+  // @NOTE: this event is raised when a listener of specific protocol is
+  // about to serve requests
+  OnServing(protocol string) error
+
+  // @NOTE: this event is raised when serving is about to be stopped
+  OnStopping()
+}
+
+type Configurable interface {
+  // @NOTE: this method is used to provide extra options which are used to
+  // create grpc server of an Implement, it's optional for implementers
+  ServerOptions() []grpc.ServerOption
+}
+
+type Transportable interface {
+  // @NOTE: this method is used to provide options of the server which
+  // accepts connections, such as credentials, keepalive or limits of
+  // streams and messages. It's optional and only the first version of a
+  // serving decides them since every version shares its listeners
+  TransportOptions() []grpc.ServerOption
 }
 
 type iGRpcConnection struct {
   connection *grpc.ClientConn
   protocol string
   index int
+
+  // @NOTE: caller sends our version with every call and remembers the
+  // version which the server has answered with
+  caller *iGRpcCaller
+
+  // @NOTE: resolving refreshes servers of a balanced connection, it's nil
+  // when the connection dials the only address of its protocol
+  resolving *iGRpcResolving
 }
 
-type iGRpcImplement struct {
+type iGRpcListener struct {
+  // @NOTE: protocol stores the protocol which this listener is working on
+  protocol string
+
+  // @NOTE: listener stores the actual listener object
+  listener net.Listener
+
+  // @NOTE: reason stores the error which is returned when this listener is
+  // stopped serving
+  reason error
+}
+
+type iGRpcMemoryListener struct {
+  *bufconn.Listener
+
+  // @NOTE: release forgets this listener when it's closed, so its address
+  // could be served again
+  release func()
+}
+
+type iGRpcVersion struct {
   // @NOTE: implementer stores the actual implementer which is used to raise
   // events during serving
   implementer Implement
 
-  // @NOTE: protocol stores the current working protocol for this implementer
+  // @NOTE: serving stores the grpc server object of this version
+  serving *grpc.Server
+
+  // @NOTE: incoming is the in-memory listener of this version, calls which
+  // are routed to this version are forwarded through connection
+  incoming *bufconn.Listener
+  connection *grpc.ClientConn
+
+  // @NOTE: stopping makes sure OnStopping is raised only once
+  stopping sync.Once
+}
+
+type GRpcServing struct {
+  // @NOTE: front serves every listener, it chooses the version of each call
+  // by its metadata and forwards the call to that version
+  front *grpc.Server
+
+  // @NOTE: versions stores every version of implementer which are hosted
+  // side by side, the first one is the primary version which serves clients
+  // that don't negotiate version
+  versions []*iGRpcVersion
+
+  // @NOTE: listeners stores every listener which this implementer is being
+  // served on, each of them is accepted on its own goroutine
+  listeners []*iGRpcListener
+
+  // @NOTE: waiting is used to wait until every listener and every version
+  // has been stopped
+  waiting sync.WaitGroup
+
+  // @NOTE: owner stores the context which this serving belongs to
+  owner *GRpcContext
+
+  // @NOTE: closed is true when listeners have been closed by ourself
+  closed bool
+
+  // @NOTE: peers stores callers of calls which are being forwarded to
+  // versions, they are found by the id which travels with each call
+  peers map[string]*peer.Peer
+  sequence uint64
+
+  lock sync.Mutex
+}
+
+// @NOTE: server interceptors which enrich the context of a stream, such as
+// tracing, request ids or principals, hand this stream to their handler
+type iGRpcServerStream struct {
+  grpc.ServerStream
+
+  ctx context.Context
+}
+
+type iGRpcFailure struct {
   protocol string
+  reason error
+}
 
-  // @NOTE: serving stores the grpc server object
-  serving *grpc.Server
+type ConnectError struct {
+  // @NOTE: failures stores the reason why each protocol was rejected, in the
+  // order they have been tried
+  failures []iGRpcFailure
 }
 
 type iGRpcConnectivityBundle struct {
   // @NOTE: newClientInitializer defines a function which is used to generate
-  // a type of GRpc connection between client and server and this could be 
+  // a type of raw connection between client and server and this could be 
   // used along side with specific type of Implementers
-  newClientInitializer func(string) (*grpc.ClientConn, error)
+  newClientInitializer func(context.Context, string) (net.Conn, error)
 
   // @NOTE: listenerInitializer defines a function which is used to generate
-  // a new listener object which is essential to create a new server
-  listenerInitializer func() (net.Listener, error)
+  // a new listener object of an address, it's essential to create a new
+  // server
+  listenerInitializer func(string) (net.Listener, error)
+
+  // @NOTE: address stores the address which servers of this protocol listen
+  // on and which clients of this protocol will dial to
+  address string
+
+  // @NOTE: timeout defines how long we wait for a connection of this
+  // protocol before falling back to the next one
+  timeout time.Duration
+
+  // @NOTE: discovery, balance and weights configure balancing across many
+  // servers of this protocol, see GRpcContext.Resolve
+  discovery Discovery
+  balance int
+  weights map[string]int
 
   // @NOTE: inventors is a container which stores every inventor of this
   // specific protocol
@@ -80,13 +223,39 @@ type GRpcContext struct {
   // object and let developer to access grpc resource and so on
   protocols map[string]*iGRpcConnectivityBundle
 
-  // @NOTE: connections is an array which stores detail information about
-  // each connectivity between client and server
-  connections []*iGRpcConnection
+  // @NOTE: preferences is an ordered list of protocol names which defines
+  // the order we use to try protocols during connecting
+  preferences []string
+
+  // @NOTE: policy defines how versions of invents and implements are
+  // matched, see COMPATIBLE_VERSION, STRICT_VERSION and DOWNGRADE_VERSION
+  policy int
+
+  // @NOTE: connections stores detail information about each connectivity
+  // between client and server, they're mapped by sockets of invents which
+  // never change when other invents disconnect
+  connections map[int]*iGRpcConnection
+  sockets int
 
   // @NOTE: implemnters is a container which stores every implementers of this
   // specific protocol
-  implementers []*iGRpcImplement
+  implementers []*GRpcServing
+
+  // @NOTE: interceptors are installed on every grpc server which is created
+  // by this context, they run before interceptors of Configurable
+  unaryInterceptors []grpc.UnaryServerInterceptor
+  streamInterceptors []grpc.StreamServerInterceptor
+
+  // @NOTE: retries, hedges and breaker are policies of calls which are sent
+  // by invents of this context, see Retry, Hedge and Break
+  retries []iGRpcRetry
+  hedges []iGRpcHedge
+  breaker BreakerPolicy
+
+  // @NOTE: tracer starts spans of calls of invents and implementers
+  tracer *Tracer
+
+  lock sync.Mutex
 }
 
 /*! \brief Connect inventory to implementer
@@ -98,58 +267,150 @@ type GRpcContext struct {
  *                 will receive error which indicate issue during connecting
  */
 func (self *GRpcContext) Connect(invent Invent) error {
-  cnt := len(self.protocols)
-
   if self.protocols == nil {
     initGRpcProtocols(self)
   }
 
-  for name, context := range self.protocols {
-    cnt -= 1
+  failures := &ConnectError{}
 
-    if err := invent.OnConnecting(name); err != nil {
-      if cnt > 0 {
-        // @TODO: again we must write log here
-        continue
-      }
-      
-      return err
-    }
+  for _, name := range self.orderedProtocols() {
+    bundle := self.protocols[name]
+    caller := &iGRpcCaller{owner: self, invent: invent,
+                           negotiated: make(map[string]string)}
+    sock := self.allocate()
 
-    if conn, err := context.newClientInitializer(name); err != nil {
-      // @TODO: how to write log here, we would need to log this one for
-      // further investigation
+    if err := invent.OnConnecting(name); err != nil {
+      failures.record(name, err)
+    } else if target, resolving, err := self.resolve(bundle, caller); err != nil {
+      failures.record(name, err)
+    } else if conn, err := bundle.dial(target, append(caller.options(),
+                                                      resolving.options()...)...); err != nil {
+      failures.record(name, err)
+    } else if err := caller.handshake(bundle.timeout, conn); err != nil {
+      conn.Close()
+      failures.record(name, err)
     } else if err := invent.New(conn); err != nil {
-      if cnt > 0 {
-        // @TODO: again we must write log here
-        continue
-      }
-      
-      return err
-    } else if err := invent.OnConnected(len(self.connections)); err != nil {
       conn.Close()
-
-      if cnt > 0 {
-        // @TODO: again we must write log here
-        continue
-      }
-      
-      return err
+      failures.record(name, err)
+    } else if err := invent.OnConnected(sock); err != nil {
+      conn.Close()
+      failures.record(name, err)
     } else {
       // The connection has been established and we must store this one to
       // our cache to be used later
 
-      self.connections = append(self.connections, &iGRpcConnection{
+      self.lock.Lock()
+      self.connections[sock] = &iGRpcConnection{
         connection: conn,
         protocol: name,
-        index: len(context.inventors),
-      })
-      context.inventors = append(context.inventors, invent)
+        index: len(bundle.inventors),
+        caller: caller,
+        resolving: resolving,
+      }
+      bundle.inventors = append(bundle.inventors, invent)
+      self.lock.Unlock()
+
+      resolving.watch(sock)
       return nil
     }
   }
 
-  return errors.New("can't establish a new connection recently")
+  if len(failures.failures) == 0 {
+    return errors.New("there is no protocol to establish a new connection")
+  }
+
+  return failures
+}
+
+/*! \brief Configure the order of protocols
+ *
+ *  This function is used to define which protocols are tried first when we
+ * connect an invent, protocols which aren't mentioned here won't be used
+ *
+ *  \param protocols: the protocol names, ordered by preference
+ *  \return error: if one of protocols isn't supported, we will receive an
+ *                 error and the current preferences are kept as is
+ */
+func (self *GRpcContext) Prefer(protocols ...string) error {
+  if self.protocols == nil {
+    initGRpcProtocols(self)
+  }
+
+  for _, name := range protocols {
+    if _, ok := self.protocols[name]; ! ok {
+      return errors.New(fmt.Sprintf("don't support %s", name))
+    }
+  }
+
+  self.preferences = append([]string{}, protocols...)
+  return nil
+}
+
+/*! \brief Configure how long we wait for a protocol
+ *
+ *  This function is used to define the deadline of connecting with specific
+ * protocol, when it's reached we will fallback to the next protocol
+ *
+ *  \param protocol: the protocol name
+ *  \param timeout: the deadline, zero means we will wait until connected
+ *  \return error: if the protocol isn't supported, we will receive an error
+ */
+func (self *GRpcContext) SetTimeout(protocol string, timeout time.Duration) error {
+  if self.protocols == nil {
+    initGRpcProtocols(self)
+  }
+
+  if bundle, ok := self.protocols[protocol]; ! ok {
+    return errors.New(fmt.Sprintf("don't support %s", protocol))
+  } else {
+    bundle.timeout = timeout
+    return nil
+  }
+}
+
+/*! \brief Configure the address of a protocol
+ *
+ *  This function is used to change where servers of a protocol listen on
+ * and where clients of that protocol dial to, e.g ":50051" to accept calls
+ * from other hosts or another path of the unix socket
+ *
+ *  \param protocol: the protocol name
+ *  \param address: the address
+ *  \return error: if the protocol isn't supported, we will receive an error
+ */
+func (self *GRpcContext) SetAddress(protocol, address string) error {
+  if self.protocols == nil {
+    initGRpcProtocols(self)
+  }
+
+  if bundle, ok := self.protocols[protocol]; ! ok {
+    return errors.New(fmt.Sprintf("don't support %s", protocol))
+  } else {
+    bundle.address = address
+    return nil
+  }
+}
+
+/*! \brief Intercept calls of every implementer of this context
+ *
+ *  This function is used to install interceptors, e.g authentication, on
+ * every grpc server which is started or hosted from now on
+ *
+ *  \param unary: the interceptor of unary calls, nil means nothing
+ *  \param stream: the interceptor of streams, nil means nothing
+ */
+func (self *GRpcContext) Intercept(unary grpc.UnaryServerInterceptor,
+                                   stream grpc.StreamServerInterceptor) {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
+  if unary != nil {
+    self.unaryInterceptors = append(self.unaryInterceptors, unary)
+  }
+
+  if stream != nil {
+    self.streamInterceptors = append(self.streamInterceptors, stream)
+  }
 }
 
 /*! \brief Disconnect a connection 
@@ -161,81 +422,432 @@ func (self *GRpcContext) Connect(invent Invent) error {
  *                 will receive error which indicate issue during connecting
  */
 func (self *GRpcContext) Disconnect(invent Invent) error {
-  sock := invent.Socket()
+  self.lock.Lock()
+  connection, ok := self.connections[invent.Socket()]
+
+  if ! ok {
+    self.lock.Unlock()
+    return errors.New("disconnect an disconnected invent")
+  }
 
-  if 0 <= sock && sock < len(self.connections) {
-    invent.OnDisconnecting()
-    self.connections[sock].connection.Close()
+  // @NOTE: the protocol name can't cause any corruption here, but if it
+  // crash, we could see the console log here which indicate an issue
+  // buffer-overload elsewhere
+  protocol := self.protocols[connection.protocol]
+  index := connection.index
 
-    // @NOTE: the protocol name can't cause any corruption here, but if it
-    // crash, we could see the console log here which indicate an issue 
-    // buffer-overload elsewhere
-    protocol := self.protocols[self.connections[sock].protocol]
-    index := self.connections[sock].index
+  copy(protocol.inventors[index:], protocol.inventors[index + 1:])
+  protocol.inventors = protocol.inventors[:len(protocol.inventors) - 1]
 
-    copy(protocol.inventors[index:], protocol.inventors[index + 1:])
-    copy(self.connections[sock:], self.connections[sock + 1:])
-    return nil
+  // @NOTE: inventors behind the removed one have been shifted, so their
+  // connections must follow them
+  for _, other := range self.connections {
+    if other.protocol == connection.protocol && other.index > index {
+      other.index -= 1
+    }
+  }
+
+  delete(self.connections, invent.Socket())
+  self.lock.Unlock()
+
+  invent.OnDisconnecting()
+  connection.resolving.stop()
+  connection.connection.Close()
+  return nil
+}
+
+/*! \brief List services which are hosted by this context
+ *
+ *  This function is used to discover every grpc service which implementers
+ * of this context have registered, across all of their versions
+ *
+ *  \return []string: full service names, sorted and without duplication
+ */
+func (self *GRpcContext) Services() []string {
+  found := make(map[string]bool)
+  ret := []string{}
+
+  self.lock.Lock()
+  servings := append([]*GRpcServing{}, self.implementers...)
+  self.lock.Unlock()
+
+  for _, serving := range servings {
+    for _, version := range serving.snapshot() {
+      for name := range version.serving.GetServiceInfo() {
+        if ! found[name] {
+          found[name] = true
+          ret = append(ret, name)
+        }
+      }
+    }
+  }
+
+  sort.Strings(ret)
+  return ret
+}
+
+/*! \brief Invoke a unary rpc method through the connection of an invent
+ *
+ *  This function is used by callers which don't own the generated client
+ * of an invent, e.g GraphQL resolvers, to reuse its connection
+ *
+ *  \param ctx: the context which defines deadline of this call
+ *  \param invent: the invent which has been connected
+ *  \param method: the full rpc method name, e.g /package.Service/Method
+ *  \param in: the request message
+ *  \param out: the response message
+ *  \param opts: options of this call
+ *  \return error: the grpc status or an error if invent isn't connected
+ */
+func (self *GRpcContext) Invoke(ctx context.Context, invent Invent,
+                                method string, in, out interface{},
+                                opts ...grpc.CallOption) error {
+  connection, ok := self.connectionOf(invent)
+
+  if ! ok {
+    return errors.New("invoke through a disconnected invent")
   }
 
-  return errors.New("disconnect an disconnected invent")
+  return connection.connection.Invoke(ctx, method, in, out, opts...)
 }
 
 /*! \brief Serve an implementer to resolve requests
  *
  *  This function is used to start on-board our implementer to serve requests
- * from clients
+ * from clients on every protocol it supports, it blocks until all of them
+ * are stopped
  *
  *  \return error: if everything ok, we will receive nil object otherwide we
  *                 will receive error which indicate issue during connecting
  */
 func (self *GRpcContext) Serve(imp Implement) error {
-  cnt := 0
+  if serving, err := self.Start(imp); err != nil {
+    return err
+  } else {
+    return serving.Wait()
+  }
+}
 
-  for name, context := range self.protocols {
-    cnt += 1
+/*! \brief Start serving an implementer on several protocols
+ *
+ *  This function is used to serve an implementer on several protocols at
+ * the same time without blocking, every protocol is served by its own
+ * listener but they share the same grpc server
+ *
+ *  \param protocols: the protocols we would like to serve on, if it's empty
+ *                    we will try every supported protocol and skip ones which
+ *                    the implementer doesn't accept
+ *  \return *GRpcServing: the handle which is used to control serving
+ *  \return error: if everything ok, we will receive nil object otherwide we
+ *                 will receive error which indicate issue during starting
+ */
+func (self *GRpcContext) Start(imp Implement, protocols ...string) (*GRpcServing, error) {
+  strict := len(protocols) > 0
 
-    if listener, err := imp.Listen(name); err != nil {
-      return err
-    } else {
-      if listener != nil && context.listenerInitializer != nil {
-        listener, err = context.listenerInitializer()
+  if self.protocols == nil {
+    initGRpcProtocols(self)
+  }
+
+  if ! strict {
+    protocols = self.orderedProtocols()
+  }
+
+  ret := &GRpcServing{owner: self}
+
+  // @NOTE: messages are forwarded to versions as they are, so the front
+  // server leaves limits of message size to them unless the implementer
+  // puts its own limits on the transport
+  options := []grpc.ServerOption{
+    grpc.MaxRecvMsgSize(math.MaxInt32),
+    grpc.MaxSendMsgSize(math.MaxInt32),
+  }
+
+  if transportable, ok := imp.(Transportable); ok {
+    options = append(options, transportable.TransportOptions()...)
+  }
+
+  ret.front = grpc.NewServer(append(options, grpc.CustomCodec(grpcRawCodec),
+                                    grpc.UnknownServiceHandler(ret.dispatch))...)
+
+  for _, name := range protocols {
+    listener, err := self.listen(imp, name)
+
+    if err == nil {
+      if err = imp.OnServing(name); err != nil {
+        listener.Close()
       }
+    }
 
-      if err != nil {
-        if cnt < len(self.protocols) {
-          continue
-        } else {
-          return errors.New("Can't serve this implement")
-        }
+    if err != nil {
+      if strict {
+        ret.abort(imp)
+        return nil, err
       }
 
-      serving := grpc.NewServer()
-      index := len(self.implementers)
+      // @TODO: we should write log here for further investigation
+      continue
+    }
 
-      if err = imp.New(serving); err != nil {
-        return err
-      }
+    ret.listeners = append(ret.listeners, &iGRpcListener{
+      protocol: name,
+      listener: listener,
+    })
+  }
 
-      self.implementers = append(self.implementers, &iGRpcImplement{
-        implementer: imp,
-        protocol: name,
-        serving: serving,
-      })
+  if len(ret.listeners) == 0 {
+    return nil, errors.New("can't serve this Implement")
+  }
+
+  if err := ret.host(imp); err != nil {
+    ret.abort(imp)
+    return nil, err
+  }
+
+  self.lock.Lock()
+  self.implementers = append(self.implementers, ret)
+  self.lock.Unlock()
+
+  for _, item := range ret.listeners {
+    ret.waiting.Add(1)
+    go ret.accept(item)
+  }
 
-      defer func() {
-        copy(self.implementers[index:], self.implementers[index + 1:])
-      }()
+  go func() {
+    ret.waiting.Wait()
+    self.forget(ret)
+  }()
 
-      if err = serving.Serve(listener); err != nil {
-        return err
-      } else {
-        return nil
+  return ret, nil
+}
+
+/*! \brief Host another version of implementer side by side
+ *
+ *  This method is used to serve another version of implementer on the same
+ * listeners, every call is routed to the matching version by its metadata
+ * following the version policy of the context
+ *
+ *  \param imp: the implementer which has a different version
+ *  \return error: if everything ok, we will receive nil object otherwide we
+ *                 will receive error which indicate issue during hosting
+ */
+func (self *GRpcServing) Host(imp Implement) error {
+  self.lock.Lock()
+  for _, version := range self.versions {
+    if version.implementer.Version() == imp.Version() {
+      self.lock.Unlock()
+      return errors.New(fmt.Sprintf("%s has been hosted", imp.Version()))
+    }
+  }
+  self.lock.Unlock()
+
+  for index, item := range self.listeners {
+    if err := imp.OnServing(item.protocol); err != nil {
+      // @NOTE: OnStopping balances OnServing of protocols which have been
+      // accepted before this one
+      if index > 0 {
+        imp.OnStopping()
       }
+
+      return err
+    }
+  }
+
+  if err := self.host(imp); err != nil {
+    imp.OnStopping()
+    return err
+  }
+
+  return nil
+}
+
+/*! \brief Stop serving gently
+ *
+ *  This method is used to stop accepting new connections and wait until
+ * every pending request is finished
+ */
+func (self *GRpcServing) GracefulStop() {
+  self.close()
+
+  for _, version := range self.snapshot() {
+    version.notify()
+  }
+
+  self.front.GracefulStop()
+
+  for _, version := range self.snapshot() {
+    version.serving.GracefulStop()
+    version.connection.Close()
+  }
+}
+
+/*! \brief Stop serving immediately
+ *
+ *  This method is used to close every listener and connection immediately
+ */
+func (self *GRpcServing) Stop() {
+  self.close()
+  self.front.Stop()
+
+  for _, version := range self.snapshot() {
+    version.notify()
+    version.serving.Stop()
+    version.connection.Close()
+  }
+}
+
+/*! \brief Stop serving gently with a deadline
+ *
+ *  This method is used to stop serving gently, if pending requests aren't
+ * finished before the context is done, we will stop serving immediately
+ *
+ *  \param ctx: the context which defines the deadline
+ *  \return error: nil if serving is stopped gently, otherwide we will
+ *                 receive the error of the context
+ */
+func (self *GRpcServing) Shutdown(ctx context.Context) error {
+  var reason error
+
+  self.close()
+
+  for _, version := range self.snapshot() {
+    version.notify()
+  }
+
+  // @NOTE: calls which are pending on the front are pending on versions
+  // too, so versions are stopped after the front has been drained
+  reason = shutdownGRpcServer(ctx, self.front)
+
+  for _, version := range self.snapshot() {
+    if err := version.shutdown(ctx); err != nil && reason == nil {
+      reason = err
+    }
+  }
+
+  self.waiting.Wait()
+  self.owner.forget(self)
+  return reason
+}
+
+/*! \brief Wait until every listener is stopped
+ *
+ *  \return error: the first error which is returned by listeners, ordered
+ *                 by protocols, or nil if all of them are stopped gently
+ */
+func (self *GRpcServing) Wait() error {
+  self.waiting.Wait()
+
+  for _, item := range self.listeners {
+    if item.reason != nil {
+      return item.reason
+    }
+  }
+
+  return nil
+}
+
+/*! \brief Get the error of each listener
+ *
+ *  \return map[string]error: the mapping between protocol and the error of
+ *                            its listener, listeners which are still serving
+ *                            or stopped gently are mapped to nil
+ */
+func (self *GRpcServing) Errors() map[string]error {
+  ret := make(map[string]error)
+
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
+  for _, item := range self.listeners {
+    ret[item.protocol] = item.reason
+  }
+
+  return ret
+}
+
+/*! \brief List protocols which are being served
+ *
+ *  \return []string: the protocol names
+ */
+func (self *GRpcServing) Protocols() []string {
+  ret := make([]string, 0, len(self.listeners))
+
+  for _, item := range self.listeners {
+    ret = append(ret, item.protocol)
+  }
+
+  return ret
+}
+
+/*! \brief Get the address of specific protocol
+ *
+ *  \param protocol: the protocol name
+ *  \return net.Addr: the address which the listener is bound to, or nil if
+ *                    this protocol isn't served
+ */
+func (self *GRpcServing) Addr(protocol string) net.Addr {
+  for _, item := range self.listeners {
+    if item.protocol == protocol {
+      return item.listener.Addr()
+    }
+  }
+
+  return nil
+}
+
+/*! \brief Stop serving an implementer
+ *
+ *  This function is used to stop every serving of an implementer gently, if
+ * pending requests aren't finished in time, they will be stopped immediately
+ *
+ *  \param imp: the implementer
+ *  \return error: if everything ok, we will receive nil object otherwide we
+ *                 will receive error which indicate issue during stopping
+ */
+func (self *GRpcContext) Stop(imp Implement) error {
+  var reason error
+
+  servings := make([]*GRpcServing, 0)
+
+  self.lock.Lock()
+  for _, item := range self.implementers {
+    if item.find(imp) != nil {
+      servings = append(servings, item)
+    }
+  }
+  self.lock.Unlock()
+
+  if len(servings) == 0 {
+    return errors.New("stop an unserved implement")
+  }
+
+  ctx, cancel := context.WithTimeout(context.Background(), defaultGRpcTimeout)
+  defer cancel()
+
+  for _, serving := range servings {
+    if err := serving.retire(ctx, imp); err != nil && reason == nil {
+      reason = err
     }
   }
 
-  return errors.New("can't serve this Implement")
+  return reason
+}
+
+/*! \brief Stop serving every implementer
+ *
+ *  This function is used to stop every serving of this context gently, when
+ * the context is done, servings which are still pending will be stopped
+ * immediately
+ *
+ *  \param ctx: the context which defines the deadline
+ *  \return error: if everything ok, we will receive nil object otherwide we
+ *                 will receive error which indicate issue during stopping
+ */
+func (self *GRpcContext) StopAll(ctx context.Context) error {
+  self.lock.Lock()
+  servings := append([]*GRpcServing{}, self.implementers...)
+  self.lock.Unlock()
+
+  return shutdownGRpcServings(ctx, servings)
 }
 
 /*! \brief 
@@ -250,9 +862,10 @@ func (self *GRpcContext) MakeListener(protocol string) (net.Listener, error) {
   if context, ok := self.protocols[protocol]; ! ok {
     return nil, errors.New(fmt.Sprintf("don't support %s", protocol))
   } else if context.listenerInitializer == nil {
-    return nil, errors.New(fmt.Sprintf("%s's listener initializer is nil"))
+    return nil, errors.New(fmt.Sprintf("%s's listener initializer is nil",
+                                       protocol))
   } else {
-    listener, err := context.listenerInitializer()
+    listener, err := context.listenerInitializer(context.address)
     return listener, err
   }
 }
@@ -266,7 +879,475 @@ func (self *GRpcContext) MakeListener(protocol string) (net.Listener, error) {
  *                        pointer
  */
 func NewGRpcContext() *GRpcContext {
-  return &GRpcContext{}
+  ret := &GRpcContext{}
+
+  initGRpcProtocols(ret)
+  return ret
+}
+
+/*! \brief Create a listener of specific protocol for an implementer
+ *
+ *  This method is used to ask the implementer for a listener first, if it
+ * doesn't provide any we will create a new one using the protocol's default
+ *
+ *  \param imp: the implementer
+ *  \param protocol: the protocol name
+ *  \return net.Listener: the listener if everything ok
+ */
+func (self *GRpcContext) listen(imp Implement, protocol string) (net.Listener, error) {
+  if _, ok := self.protocols[protocol]; ! ok {
+    return nil, errors.New(fmt.Sprintf("don't support %s", protocol))
+  } else if listener, err := imp.Listen(protocol); err != nil {
+    return nil, err
+  } else if listener != nil {
+    return listener, nil
+  } else {
+    return self.MakeListener(protocol)
+  }
+}
+
+/*! \brief Forget a serving which has been stopped
+ *
+ *  \param serving: the serving handle
+ */
+func (self *GRpcContext) forget(serving *GRpcServing) {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
+  for index, item := range self.implementers {
+    if item == serving {
+      copy(self.implementers[index:], self.implementers[index + 1:])
+      self.implementers = self.implementers[:len(self.implementers) - 1]
+      return
+    }
+  }
+}
+
+/*! \brief Serve a new version of implementer
+ *
+ *  \param imp: the implementer
+ *  \return error: if the implementer can't be created, we will receive an
+ *                 error
+ */
+func (self *GRpcServing) host(imp Implement) error {
+  options := []grpc.ServerOption{}
+
+  self.owner.lock.Lock()
+  unaries := self.owner.unaryInterceptors
+  streams := self.owner.streamInterceptors
+
+  // @NOTE: tracing goes first so calls which are refused are traced too
+  if self.owner.tracer != nil {
+    unary, stream := self.owner.tracer.Interceptors()
+
+    unaries = append([]grpc.UnaryServerInterceptor{unary}, unaries...)
+    streams = append([]grpc.StreamServerInterceptor{stream}, streams...)
+  }
+
+  // @NOTE: request ids are accepted before anything else so every
+  // interceptor could log them
+  unary, stream := requestIdInterceptors()
+
+  unaries = append([]grpc.UnaryServerInterceptor{unary}, unaries...)
+  streams = append([]grpc.StreamServerInterceptor{stream}, streams...)
+  self.owner.lock.Unlock()
+
+  // @NOTE: calls come from the front in memory, so the actual caller must
+  // be restored before anyone looks at it
+  unary, stream = self.forwardedPeerInterceptors()
+
+  unaries = append([]grpc.UnaryServerInterceptor{unary}, unaries...)
+  streams = append([]grpc.StreamServerInterceptor{stream}, streams...)
+
+  if len(unaries) > 0 {
+    options = append(options, grpc.ChainUnaryInterceptor(unaries...))
+  }
+
+  if len(streams) > 0 {
+    options = append(options, grpc.ChainStreamInterceptor(streams...))
+  }
+
+  if configurable, ok := imp.(Configurable); ok {
+    options = append(options, configurable.ServerOptions()...)
+  }
+
+  version := &iGRpcVersion{
+    implementer: imp,
+    serving: grpc.NewServer(options...),
+    incoming: bufconn.Listen(grpcMemoryBufferSize),
+  }
+
+  if err := imp.New(version.serving); err != nil {
+    return err
+  }
+
+  dialer := func(ctx context.Context, address string) (net.Conn, error) {
+    return version.incoming.Dial()
+  }
+
+  // @NOTE: the connection is lazy, it's established by the first call
+  connection, err := grpc.Dial("bufnet", grpc.WithInsecure(),
+                               grpc.WithContextDialer(dialer),
+                               grpc.WithDefaultCallOptions(
+                                 grpc.MaxCallRecvMsgSize(math.MaxInt32),
+                                 grpc.MaxCallSendMsgSize(math.MaxInt32)))
+  if err != nil {
+    version.incoming.Close()
+    return err
+  }
+
+  version.connection = connection
+
+  self.lock.Lock()
+  self.versions = append(self.versions, version)
+  self.lock.Unlock()
+
+  self.waiting.Add(1)
+
+  go func() {
+    defer self.waiting.Done()
+
+    // @NOTE: bufconn never fails by itself, so the error here only tells
+    // us that the server has been stopped
+    version.serving.Serve(version.incoming)
+  }()
+
+  return nil
+}
+
+/*! \brief Accept connections of a listener
+ *
+ *  This method is used to serve a listener by the front server, which
+ * routes every call to the matching version
+ *
+ *  \param item: the listener
+ */
+func (self *GRpcServing) accept(item *iGRpcListener) {
+  defer self.waiting.Done()
+
+  err := self.front.Serve(item.listener)
+
+  self.lock.Lock()
+  if ! self.closed && err != nil {
+    item.reason = err
+  }
+  self.lock.Unlock()
+}
+
+/*! \brief Stop serving a version of implementer
+ *
+ *  This method is used to stop a specific version, if it's the last one
+ * the whole serving will be stopped
+ *
+ *  \param ctx: the context which defines the deadline
+ *  \param imp: the implementer
+ *  \return error: the error of the context if we can't stop gently
+ */
+func (self *GRpcServing) retire(ctx context.Context, imp Implement) error {
+  self.lock.Lock()
+
+  version := self.find(imp)
+
+  if version == nil {
+    self.lock.Unlock()
+    return nil
+  } else if len(self.versions) == 1 {
+    self.lock.Unlock()
+    return self.Shutdown(ctx)
+  }
+
+  for index, item := range self.versions {
+    if item == version {
+      copy(self.versions[index:], self.versions[index + 1:])
+      self.versions = self.versions[:len(self.versions) - 1]
+      break
+    }
+  }
+
+  self.lock.Unlock()
+  return version.shutdown(ctx)
+}
+
+/*! \brief Find the version of an implementer
+ *
+ *  \param imp: the implementer
+ *  \return *iGRpcVersion: the version or nil if it isn't hosted here
+ */
+func (self *GRpcServing) find(imp Implement) *iGRpcVersion {
+  for _, version := range self.versions {
+    if version.implementer == imp {
+      return version
+    }
+  }
+
+  return nil
+}
+
+/*! \brief Copy hosted versions
+ *
+ *  \return []*iGRpcVersion: the versions which are hosted at this time
+ */
+func (self *GRpcServing) snapshot() []*iGRpcVersion {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
+  return append([]*iGRpcVersion{}, self.versions...)
+}
+
+/*! \brief Give up a serving which can't be started
+ *
+ *  This method is used to close listeners which have been opened and to
+ * raise OnStopping if OnServing has been raised for any of them
+ *
+ *  \param imp: the implementer
+ */
+func (self *GRpcServing) abort(imp Implement) {
+  self.close()
+  self.front.Stop()
+
+  if len(self.listeners) > 0 {
+    imp.OnStopping()
+  }
+}
+
+/*! \brief Close every listener of this serving
+ *
+ */
+func (self *GRpcServing) close() {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
+  if self.closed {
+    return
+  }
+
+  self.closed = true
+
+  for _, item := range self.listeners {
+    item.listener.Close()
+  }
+}
+
+/*! \brief Raise OnStopping of the implementer
+ *
+ *  This method is used to make sure the implementer is notified only once
+ * even if we are stopped several times
+ */
+func (self *iGRpcVersion) notify() {
+  self.stopping.Do(func() {
+    self.implementer.OnStopping()
+  })
+}
+
+/*! \brief Stop a version gently with a deadline
+ *
+ *  \param ctx: the context which defines the deadline
+ *  \return error: nil if this version is stopped gently, otherwide we will
+ *                 receive the error of the context
+ */
+func (self *iGRpcVersion) shutdown(ctx context.Context) error {
+  self.notify()
+
+  defer self.connection.Close()
+  return shutdownGRpcServer(ctx, self.serving)
+}
+
+/*! \brief Stop a grpc server gently with a deadline
+ *
+ *  \param ctx: the context which defines the deadline
+ *  \param server: the grpc server
+ *  \return error: nil if the server is stopped gently, otherwide we will
+ *                 receive the error of the context
+ */
+func shutdownGRpcServer(ctx context.Context, server *grpc.Server) error {
+  done := make(chan struct{})
+
+  go func() {
+    server.GracefulStop()
+    close(done)
+  }()
+
+  select {
+  case <-done:
+    return nil
+
+  case <-ctx.Done():
+    server.Stop()
+    <-done
+    return ctx.Err()
+  }
+}
+
+/*! \brief Shutdown several servings at the same time
+ *
+ *  \param ctx: the context which defines the deadline
+ *  \param servings: the servings which will be stopped
+ *  \return error: the first error we receive during stopping
+ */
+func shutdownGRpcServings(ctx context.Context, servings []*GRpcServing) error {
+  var waiting sync.WaitGroup
+
+  reasons := make([]error, len(servings))
+
+  for index, serving := range servings {
+    waiting.Add(1)
+
+    go func(index int, serving *GRpcServing) {
+      defer waiting.Done()
+
+      reasons[index] = serving.Shutdown(ctx)
+    }(index, serving)
+  }
+
+  waiting.Wait()
+
+  for _, reason := range reasons {
+    if reason != nil {
+      return reason
+    }
+  }
+
+  return nil
+}
+
+/*! \brief Allocate a socket for a new connection
+ *
+ *  \return int: the socket, it's never reused by other connections
+ */
+func (self *GRpcContext) allocate() int {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
+  self.sockets += 1
+  return self.sockets - 1
+}
+
+/*! \brief Find the connection of an invent
+ *
+ *  \param invent: the invent
+ *  \return *iGRpcConnection: the connection
+ *  \return bool: false if the invent isn't connected
+ */
+func (self *GRpcContext) connectionOf(invent Invent) (*iGRpcConnection, bool) {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
+  connection, ok := self.connections[invent.Socket()]
+  return connection, ok
+}
+
+/*! \brief Order supported protocols by preference
+ *
+ *  This method is used to list protocols which will be tried during
+ * connecting, following the preference order
+ *
+ *  \return []string: the protocol names
+ */
+func (self *GRpcContext) orderedProtocols() []string {
+  ret := make([]string, 0, len(self.protocols))
+  preferences := self.preferences
+
+  if len(preferences) == 0 {
+    preferences = defaultGRpcPreferences
+  }
+
+  for _, name := range preferences {
+    if _, ok := self.protocols[name]; ok {
+      ret = append(ret, name)
+    }
+  }
+
+  return ret
+}
+
+/*! \brief Dial to the target of this protocol
+ *
+ *  This method is used to create a new client connection, which respects
+ * the timeout of this protocol
+ *
+ *  \param target: the target, which is the address of this protocol unless
+ *                the connection is balanced
+ *  \param options: extra options of this connection, e.g interceptors
+ *  \return *grpc.ClientConn: the connection if everything ok
+ */
+func (self *iGRpcConnectivityBundle) dial(target string,
+                                          options ...grpc.DialOption) (*grpc.ClientConn, error) {
+  ctx := context.Background()
+
+  if self.timeout > 0 {
+    var cancel context.CancelFunc
+
+    ctx, cancel = context.WithTimeout(ctx, self.timeout)
+    defer cancel()
+  }
+
+  options = append([]grpc.DialOption{
+    grpc.WithInsecure(),
+    grpc.WithBlock(),
+    grpc.FailOnNonTempDialError(true),
+    grpc.WithContextDialer(self.newClientInitializer),
+  }, options...)
+
+  return grpc.DialContext(ctx, target, options...)
+}
+
+/*! \brief Record a failure of specific protocol
+ *
+ *  \param protocol: the protocol name
+ *  \param reason: the reason why this protocol was failed
+ */
+func (self *ConnectError) record(protocol string, reason error) {
+  // @TODO: we should write log here for further investigation
+  self.failures = append(self.failures, iGRpcFailure{
+    protocol: protocol,
+    reason: reason,
+  })
+}
+
+/*! \brief Get the reason of specific protocol
+ *
+ *  \param protocol: the protocol name
+ *  \return error: the reason why this protocol was failed or nil if it wasn't
+ *                 tried
+ */
+func (self *ConnectError) Reason(protocol string) error {
+  for _, failure := range self.failures {
+    if failure.protocol == protocol {
+      return failure.reason
+    }
+  }
+
+  return nil
+}
+
+/*! \brief List protocols which have been tried
+ *
+ *  \return []string: the protocol names, in the order they have been tried
+ */
+func (self *ConnectError) Protocols() []string {
+  ret := make([]string, 0, len(self.failures))
+
+  for _, failure := range self.failures {
+    ret = append(ret, failure.protocol)
+  }
+
+  return ret
+}
+
+func (self *ConnectError) Error() string {
+  reasons := make([]string, 0, len(self.failures))
+
+  for _, failure := range self.failures {
+    reasons = append(reasons, fmt.Sprintf("%s: %s", failure.protocol,
+                                          failure.reason.Error()))
+  }
+
+  return fmt.Sprintf("can't establish a new connection (%s)",
+                     strings.Join(reasons, "; "))
+}
+
+func (self *iGRpcServerStream) Context() context.Context {
+  return self.ctx
 }
 
 /*! \brief Init grpc's protocols
@@ -279,12 +1360,14 @@ func initGRpcProtocols(ctx *GRpcContext) {
   // grpc protocols
 
   ctx.protocols = make(map[string]*iGRpcConnectivityBundle)
+  ctx.connections = make(map[int]*iGRpcConnection)
 
   initGRpcTcpProtocol(ctx)
   initGRpcIpcProtocol(ctx)
   initGRpcTipcProtocol(ctx)
   initGRpcSctpProtocol(ctx)
   initGRpcQuicProtocol(ctx)
+  initGRpcMemoryProtocol(ctx)
 }
 
 /*! \brief Init tcp protocol
@@ -293,21 +1376,26 @@ func initGRpcProtocols(ctx *GRpcContext) {
  *
  */
 func initGRpcTcpProtocol(ctx *GRpcContext) {
-  listenerInitializer := func() (net.Listener, error) {
-    if lis, err := net.Listen("tcp", "localhost:50051"); err != nil {
+  listenerInitializer := func(address string) (net.Listener, error) {
+    if lis, err := net.Listen("tcp", address); err != nil {
       return nil, err
     } else {
       return lis, nil
     }
   }
   
-  newClientInitializer := func(address string) (*grpc.ClientConn, error) {
-    return grpc.Dial(address, grpc.WithInsecure(), grpc.WithBlock())
+  newClientInitializer := func(ctx context.Context,
+                               address string) (net.Conn, error) {
+    var tcp net.Dialer
+
+    return tcp.DialContext(ctx, "tcp", address)
   }
 
   ctx.protocols["tcp"] = &iGRpcConnectivityBundle{
     newClientInitializer: newClientInitializer,
     listenerInitializer: listenerInitializer,
+    address: "localhost:50051",
+    timeout: defaultGRpcTimeout,
     inventors: make([]Invent, 0),
   }
 }
@@ -318,6 +1406,30 @@ func initGRpcTcpProtocol(ctx *GRpcContext) {
  *
  */
 func initGRpcIpcProtocol(ctx *GRpcContext) {
+  listenerInitializer := func(address string) (net.Listener, error) {
+    // @NOTE: a socket file which is left by a crashed server will block us
+    // from listening, so we must clean it before doing anything
+    if err := os.Remove(address); err != nil && ! os.IsNotExist(err) {
+      return nil, err
+    }
+
+    return net.Listen("unix", address)
+  }
+
+  newClientInitializer := func(ctx context.Context,
+                               address string) (net.Conn, error) {
+    var unix net.Dialer
+
+    return unix.DialContext(ctx, "unix", address)
+  }
+
+  ctx.protocols["ipc"] = &iGRpcConnectivityBundle{
+    newClientInitializer: newClientInitializer,
+    listenerInitializer: listenerInitializer,
+    address: "/tmp/dev.io.grpc.sock",
+    timeout: defaultGRpcTimeout,
+    inventors: make([]Invent, 0),
+  }
 }
 
 /*! \brief Init tipc protocol
@@ -343,3 +1455,72 @@ func initGRpcSctpProtocol(ctx *GRpcContext) {
  */
 func initGRpcQuicProtocol(ctx *GRpcContext) {
 }
+
+/*! \brief Init memory protocol
+ *
+ *  This function is used to init an in-memory protocol, invents and
+ * implements of the same context talk to each other without touching the
+ * network, which is useful for testing
+ *
+ */
+func initGRpcMemoryProtocol(ctx *GRpcContext) {
+  var lock sync.Mutex
+
+  // @NOTE: listeners are mapped by addresses like ports of tcp, so a second
+  // serving on the same address is refused instead of stealing connections
+  // of the first one
+  listeners := make(map[string]*iGRpcMemoryListener)
+
+  listenerInitializer := func(address string) (net.Listener, error) {
+    lock.Lock()
+    defer lock.Unlock()
+
+    if _, ok := listeners[address]; ok {
+      return nil, errors.New(fmt.Sprintf("%s is already served in memory",
+                                         address))
+    }
+
+    ret := &iGRpcMemoryListener{Listener: bufconn.Listen(grpcMemoryBufferSize)}
+    ret.release = func() {
+      lock.Lock()
+      defer lock.Unlock()
+
+      if listeners[address] == ret {
+        delete(listeners, address)
+      }
+    }
+
+    listeners[address] = ret
+    return ret, nil
+  }
+
+  newClientInitializer := func(ctx context.Context,
+                               address string) (net.Conn, error) {
+    lock.Lock()
+    listener, ok := listeners[address]
+    lock.Unlock()
+
+    if ! ok {
+      return nil, errors.New(fmt.Sprintf("%s isn't served in memory", address))
+    }
+
+    return listener.Dial()
+  }
+
+  ctx.protocols["memory"] = &iGRpcConnectivityBundle{
+    newClientInitializer: newClientInitializer,
+    listenerInitializer: listenerInitializer,
+    address: "memory",
+    timeout: defaultGRpcTimeout,
+    inventors: make([]Invent, 0),
+  }
+}
+
+/*! \brief Close the in-memory listener
+ *
+ *  \return error: the error of bufconn, its address is released anyway
+ */
+func (self *iGRpcMemoryListener) Close() error {
+  self.release()
+  return self.Listener.Close()
+}
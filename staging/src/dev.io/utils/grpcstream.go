@@ -0,0 +1,201 @@
+package utils
+
+import (
+  "google.golang.org/protobuf/reflect/protoreflect"
+  "google.golang.org/protobuf/encoding/protojson"
+  "google.golang.org/protobuf/types/dynamicpb"
+  "google.golang.org/grpc"
+
+  legacy "github.com/golang/protobuf/proto"
+
+  "encoding/json"
+  "net/http"
+  "context"
+  "errors"
+  "fmt"
+  "io"
+)
+
+/*! \brief Produce a handler which bridges a server-streaming rpc to SSE
+ *
+ *  This method is used with Api.Events, the rpc request is decoded from
+ * query string and path params like Transcode does, then every message of
+ * the rpc stream is sent to browser as an event which carries json. The
+ * rpc stream is cancelled as soon as browser leaves
+ *
+ *  \param method: the full rpc method name, e.g /package.Service/Method
+ *  \return EventHandler: the handler which is used with Api.Events
+ */
+func (self *Gateway) Events(method string) EventHandler {
+  return func(r *http.Request, stream *EventStream) error {
+    desc, err := findRpcMethod(method)
+    if err != nil {
+      return err
+    } else if desc.IsStreamingClient() {
+      return errors.New(fmt.Sprintf("%s receives a stream, please use a socket",
+                                    method))
+    }
+
+    request := dynamicpb.NewMessage(desc.Input())
+
+    if err := decodeRpcRequest(r, "", request); err != nil {
+      return err
+    }
+
+    // @NOTE: the request's context is done when browser leaves, which
+    // cancels the rpc stream too
+    client, err := self.open(r.Context(), desc, method)
+    if err != nil {
+      return err
+    }
+
+    if err := client.SendMsg(legacy.MessageV1(request)); err != nil {
+      return convertRpcStreamError(err)
+    } else if err := client.CloseSend(); err != nil {
+      return convertRpcStreamError(err)
+    }
+
+    return self.pump(client, desc.Output(), func(data []byte) error {
+      return stream.Send(Event{Data: string(data)})
+    })
+  }
+}
+
+/*! \brief Produce a handler which bridges a streaming rpc to websocket
+ *
+ *  This method is used with Api.Socket, every json message of browser is
+ * decoded into a rpc request and every rpc response is sent back as json.
+ * Methods which don't receive a stream only read the first message. The
+ * rpc stream is cancelled as soon as browser leaves
+ *
+ *  \param method: the full rpc method name, e.g /package.Service/Method
+ *  \return SocketHandler: the handler which is used with Api.Socket
+ */
+func (self *Gateway) Socket(method string) SocketHandler {
+  return func(r *http.Request, socket *Socket) error {
+    desc, err := findRpcMethod(method)
+    if err != nil {
+      return err
+    }
+
+    ctx, cancel := context.WithCancel(r.Context())
+    defer cancel()
+
+    client, err := self.open(ctx, desc, method)
+    if err != nil {
+      return err
+    }
+
+    // @NOTE: invalid receives the first message which can't be decoded,
+    // the rpc stream is cancelled because of it
+    invalid := make(chan error, 1)
+
+    go func() {
+      defer client.CloseSend()
+
+      for {
+        message, err := socket.Receive()
+        if err != nil {
+          return
+        }
+
+        request := dynamicpb.NewMessage(desc.Input())
+        options := protojson.UnmarshalOptions{DiscardUnknown: true}
+
+        if err := options.Unmarshal(message, request); err != nil {
+          invalid <- err
+          cancel()
+          return
+        } else if client.SendMsg(legacy.MessageV1(request)) != nil {
+          return
+        } else if ! desc.IsStreamingClient() {
+          return
+        }
+      }
+    }()
+
+    err = self.pump(client, desc.Output(), func(data []byte) error {
+      return socket.Send(json.RawMessage(data))
+    })
+
+    select {
+    case reason := <-invalid:
+      return reason
+
+    default:
+      // @NOTE: browser has left, nobody receives the error anymore
+      if socket.Context().Err() != nil {
+        return nil
+      }
+
+      return err
+    }
+  }
+}
+
+/*! \brief Open a rpc stream to our implementers
+ *
+ *  \param ctx: the context which controls the stream
+ *  \param desc: the method descriptor
+ *  \param method: the full rpc method name
+ *  \return grpc.ClientStream: the stream
+ *  \return error: if the gateway isn't connected, we will receive an error
+ */
+func (self *Gateway) open(ctx context.Context, desc protoreflect.MethodDescriptor,
+                          method string) (grpc.ClientStream, error) {
+  connection := self.grpc.local.connection
+
+  if connection == nil {
+    return nil, errors.New("gateway isn't connected")
+  }
+
+  client, err := connection.NewStream(ctx, &grpc.StreamDesc{
+    StreamName: string(desc.Name()),
+    ServerStreams: desc.IsStreamingServer(),
+    ClientStreams: desc.IsStreamingClient(),
+  }, method)
+
+  if err != nil {
+    return nil, convertRpcStreamError(err)
+  }
+
+  return client, nil
+}
+
+/*! \brief Forward every response of a rpc stream as json
+ *
+ *  \param client: the rpc stream
+ *  \param output: the response type
+ *  \param send: the function which delivers json to browser
+ *  \return error: if the stream fails or browser has left, we will receive
+ *                 an error, nil means the stream finished normally
+ */
+func (self *Gateway) pump(client grpc.ClientStream,
+                          output protoreflect.MessageDescriptor,
+                          send func([]byte) error) error {
+  for {
+    response := dynamicpb.NewMessage(output)
+
+    if err := client.RecvMsg(legacy.MessageV1(response)); err == io.EOF {
+      return nil
+    } else if err != nil {
+      return convertRpcStreamError(err)
+    } else if data, err := protojson.Marshal(response); err != nil {
+      return err
+    } else if err := send(data); err != nil {
+      return err
+    }
+  }
+}
+
+/* --------------------------- helper ----------------------------- */
+
+/*! \brief Convert a rpc error to the error which is shown to browser
+ *
+ *  \param err: the rpc error
+ *  \return error: our error, so the status code and details of the rpc are
+ *                 kept when it's sent to browser
+ */
+func convertRpcStreamError(err error) error {
+  return ErrorOf(err)
+}
@@ -0,0 +1,594 @@
+package utils
+
+import (
+  "google.golang.org/protobuf/types/known/emptypb"
+  "google.golang.org/grpc/metadata"
+  "google.golang.org/grpc/status"
+  "google.golang.org/grpc/codes"
+  "google.golang.org/grpc/peer"
+  "google.golang.org/grpc"
+  "context"
+  "strconv"
+  "strings"
+  "errors"
+  "sync"
+  "time"
+  "fmt"
+)
+
+const (
+  // @NOTE: client is accepted by a server which has the same major version
+  // and a newer or equal minor version, this is the default policy
+  COMPATIBLE_VERSION = 0
+
+  // @NOTE: client and server must have exactly the same version
+  STRICT_VERSION = 1
+
+  // @NOTE: like COMPATIBLE_VERSION but client could be downgraded to an
+  // older minor version when there is no newer one
+  DOWNGRADE_VERSION = 2
+)
+
+const (
+  // @NOTE: our clients send their version with every call, servers answer
+  // with the version which serves the call in the response header. Plain
+  // grpc clients could send it too, otherwide they reach the primary one
+  GRPC_VERSION_METADATA = "x-grpc-version"
+
+  // @NOTE: this is the method which our clients call during Connect to
+  // learn if the server accepts their version, plain grpc servers answer
+  // it with UNIMPLEMENTED and they are used without negotiation
+  grpcHandshakeMethod = "/dev.io.grpc.Version/Negotiate"
+
+  // @NOTE: calls are forwarded to versions in memory, so the front server
+  // tells them which of its callers is the actual one through this metadata
+  grpcPeerMetadata = "x-grpc-peer"
+)
+
+type VersionError struct {
+  // @NOTE: reason stores the message which the server rejected us with
+  reason string
+}
+
+type iGRpcSemver struct {
+  major, minor, patch int
+}
+
+type iGRpcVersionedStream struct {
+  grpc.ClientStream
+
+  caller *iGRpcCaller
+  recording sync.Once
+}
+
+/*! \brief Configure how versions of invents and implements are matched
+ *
+ *  This function is used to choose the policy which servers of this context
+ * use to accept invents with different versions
+ *
+ *  \param policy: COMPATIBLE_VERSION, STRICT_VERSION or DOWNGRADE_VERSION
+ *  \return error: if the policy isn't supported, we will receive an error
+ */
+func (self *GRpcContext) SetVersionPolicy(policy int) error {
+  switch(policy) {
+    case COMPATIBLE_VERSION, STRICT_VERSION, DOWNGRADE_VERSION:
+      self.lock.Lock()
+      defer self.lock.Unlock()
+
+      self.policy = policy
+      return nil
+
+    default:
+      return errors.New(fmt.Sprintf("don't support policy %d", policy))
+  }
+}
+
+/*! \brief Get the version which an invent has been negotiated with
+ *
+ *  This function is used to check which version of implementer is serving
+ * the invent, it could be differ from the invent's version if the invent
+ * has been downgraded
+ *
+ *  \param invent: the connected invent
+ *  \return string: the version of implementer, empty if servers don't
+ *                  negotiate version
+ *  \return error: if the invent isn't connected or servers behind a
+ *                 balanced connection answer with different versions
+ */
+func (self *GRpcContext) Negotiated(invent Invent) (string, error) {
+  connection, ok := self.connectionOf(invent)
+
+  if ! ok {
+    return "", errors.New("negotiate with an disconnected invent")
+  }
+
+  caller := connection.caller
+  ret := ""
+
+  caller.lock.Lock()
+  defer caller.lock.Unlock()
+
+  for address, version := range caller.negotiated {
+    if len(ret) == 0 {
+      ret = version
+    } else if ret != version {
+      return "", errors.New(fmt.Sprintf("%s serves %s but others serve %s",
+                                        address, version, ret))
+    }
+  }
+
+  return ret, nil
+}
+
+/*! \brief Get the version which a server has negotiated with an invent
+ *
+ *  This function is used with balanced connections, whose servers could
+ * answer with different versions during a rollout
+ *
+ *  \param invent: the connected invent
+ *  \param address: the address of server, like discovery returns it
+ *  \return string: the version of implementer, empty if the server doesn't
+ *                  negotiate version or hasn't served the invent yet
+ *  \return error: if the invent isn't connected, we will receive an error
+ */
+func (self *GRpcContext) NegotiatedWith(invent Invent,
+                                        address string) (string, error) {
+  connection, ok := self.connectionOf(invent)
+
+  if ! ok {
+    return "", errors.New("negotiate with an disconnected invent")
+  }
+
+  caller := connection.caller
+
+  caller.lock.Lock()
+  defer caller.lock.Unlock()
+
+  return caller.negotiated[address], nil
+}
+
+func (self *VersionError) Error() string {
+  return fmt.Sprintf("version is rejected: %s", self.reason)
+}
+
+/* -------------------------- handshake --------------------------- */
+
+/*! \brief Ask the server if it accepts the version of our invent
+ *
+ *  This method is used by Connect right after the connection is ready,
+ * the handshake is a normal call so it works through proxies and balancers
+ *
+ *  \param timeout: how long we wait for the answer, zero means forever
+ *  \param conn: the connection
+ *  \return error: if server rejects us, we will receive a VersionError
+ */
+func (self *iGRpcCaller) handshake(timeout time.Duration,
+                                   conn *grpc.ClientConn) error {
+  ctx := context.Background()
+
+  if timeout > 0 {
+    var cancel context.CancelFunc
+
+    ctx, cancel = context.WithTimeout(ctx, timeout)
+    defer cancel()
+  }
+
+  err := conn.Invoke(ctx, grpcHandshakeMethod, &emptypb.Empty{},
+                     &emptypb.Empty{})
+
+  switch(status.Code(err)) {
+    case codes.OK, codes.Unimplemented:
+      return nil
+
+    case codes.FailedPrecondition:
+      return &VersionError{reason: status.Convert(err).Message()}
+
+    default:
+      return err
+  }
+}
+
+/*! \brief Send our version with a unary call
+ *
+ *  This interceptor is the closest one to the transport, so every retry
+ * and every hedge carries the version and records the answer
+ */
+func (self *iGRpcCaller) versioned(ctx context.Context, method string,
+                                   req, reply interface{}, cc *grpc.ClientConn,
+                                   invoker grpc.UnaryInvoker,
+                                   opts ...grpc.CallOption) error {
+  var header metadata.MD
+  var server peer.Peer
+
+  ctx = outgoingGRpcVersion(ctx, self.invent.Version())
+  err := invoker(ctx, method, req, reply, cc,
+                 append(opts, grpc.Header(&header), grpc.Peer(&server))...)
+
+  if server.Addr != nil {
+    self.record(server.Addr.String(), header)
+  }
+
+  return err
+}
+
+/*! \brief Send our version with a stream
+ */
+func (self *iGRpcCaller) versionedStream(ctx context.Context,
+                                         desc *grpc.StreamDesc,
+                                         cc *grpc.ClientConn, method string,
+                                         streamer grpc.Streamer,
+                                         opts ...grpc.CallOption) (grpc.ClientStream, error) {
+  ctx = outgoingGRpcVersion(ctx, self.invent.Version())
+
+  stream, err := streamer(ctx, desc, cc, method, opts...)
+  if err != nil {
+    return nil, err
+  }
+
+  return &iGRpcVersionedStream{ClientStream: stream, caller: self}, nil
+}
+
+/*! \brief Remember the version which a server has answered with
+ *
+ *  \param address: the address of server
+ *  \param header: the response header
+ */
+func (self *iGRpcCaller) record(address string, header metadata.MD) {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
+  if values := header.Get(GRPC_VERSION_METADATA); len(values) > 0 {
+    self.negotiated[address] = values[0]
+  } else {
+    delete(self.negotiated, address)
+  }
+}
+
+/*! \brief Forget the version of a server which becomes unreachable
+ *
+ *  \param address: the address of server
+ */
+func (self *iGRpcCaller) forget(address string) {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
+  delete(self.negotiated, address)
+}
+
+/* --------------------------- dispatch --------------------------- */
+
+/*! \brief Route a call to the version which serves it
+ *
+ *  This method is used as the unknown service handler of the front server,
+ * the version is chosen by metadata of each call and frames are forwarded
+ * to the grpc server of that version without being decoded
+ *
+ *  \param srv: unused, there is no service behind the front server
+ *  \param stream: the stream of client
+ *  \return error: the status which is returned to client
+ */
+func (self *GRpcServing) dispatch(srv interface{}, stream grpc.ServerStream) error {
+  method, ok := grpc.MethodFromServerStream(stream)
+  if ! ok {
+    return status.Error(codes.Internal, "can't detect method of stream")
+  }
+
+  incoming, _ := metadata.FromIncomingContext(stream.Context())
+  client := ""
+
+  if values := incoming.Get(GRPC_VERSION_METADATA); len(values) > 0 {
+    client = values[0]
+  }
+
+  version, err := self.choose(client)
+  if err != nil {
+    return status.Error(codes.FailedPrecondition, err.Error())
+  }
+
+  stream.SetHeader(metadata.Pairs(GRPC_VERSION_METADATA,
+                                  version.implementer.Version()))
+
+  if method == grpcHandshakeMethod {
+    // @NOTE: the header is the answer, the empty frame is an empty message
+    return stream.SendMsg(&iGrpcFrame{})
+  }
+
+  // @NOTE: a peer which is sent by a client is dropped, only ours is trusted
+  outgoing := forwardedGRpcMetadata(incoming)
+
+  if caller, ok := peer.FromContext(stream.Context()); ok {
+    id := self.remember(caller)
+    defer self.release(id)
+
+    outgoing.Set(grpcPeerMetadata, id)
+  }
+
+  return forwardGRpcStream(stream, version.connection, method, outgoing)
+}
+
+/*! \brief Remember the peer of a call until it has been forwarded
+ *
+ *  The peer is kept as it is, so versions see its address and its auth
+ * info such as the certificates of mTLS
+ *
+ *  \param caller: the peer of the call
+ *  \return string: the id which versions use to find the peer
+ */
+func (self *GRpcServing) remember(caller *peer.Peer) string {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
+  if self.peers == nil {
+    self.peers = make(map[string]*peer.Peer)
+  }
+
+  self.sequence++
+  id := strconv.FormatUint(self.sequence, 10)
+
+  self.peers[id] = caller
+  return id
+}
+
+/*! \brief Release the peer of a call which has been forwarded
+ *
+ *  \param id: the id of the peer
+ */
+func (self *GRpcServing) release(id string) {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
+  delete(self.peers, id)
+}
+
+/*! \brief Choose the version which will serve a client
+ *
+ *  \param client: the version of client
+ *  \return *iGRpcVersion: the version which will serve this client
+ *  \return error: if there is no acceptable version, we will receive an error
+ */
+func (self *GRpcServing) choose(client string) (*iGRpcVersion, error) {
+  policy := self.owner.policyOf()
+
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
+  hosted := make([]string, len(self.versions))
+
+  for index, version := range self.versions {
+    hosted[index] = version.implementer.Version()
+  }
+
+  if len(client) == 0 && len(self.versions) > 0 {
+    return self.versions[0], nil
+  } else if index, err := chooseGRpcVersion(policy, hosted, client); err != nil {
+    return nil, err
+  } else {
+    return self.versions[index], nil
+  }
+}
+
+/*! \brief Choose a version among hosted versions following a policy
+ *
+ *  This function is used to pick the matching version first, otherwide the
+ * newest acceptable version following the policy
+ *
+ *  \param policy: the version policy
+ *  \param hosted: the versions which are hosted
+ *  \param client: the version of client
+ *  \return int: the index of chosen version
+ */
+func chooseGRpcVersion(policy int, hosted []string, client string) (int, error) {
+  expected, parsed := parseGRpcSemver(client)
+  chosen := -1
+
+  for index, version := range hosted {
+    if version == client {
+      return index, nil
+    }
+  }
+
+  if policy == STRICT_VERSION || ! parsed {
+    return -1, errors.New(fmt.Sprintf("%s isn't hosted", client))
+  }
+
+  // @NOTE: pick the newest version which still supports the client
+  for index, version := range hosted {
+    if current, ok := parseGRpcSemver(version); ! ok {
+      continue
+    } else if current.major != expected.major {
+      continue
+    } else if current.minor < expected.minor {
+      continue
+    } else if chosen < 0 || newerGRpcSemver(hosted[chosen], version) {
+      chosen = index
+    }
+  }
+
+  if chosen >= 0 {
+    return chosen, nil
+  } else if policy != DOWNGRADE_VERSION {
+    return -1, errors.New(fmt.Sprintf("%s isn't compatible", client))
+  }
+
+  // @NOTE: downgrade to the newest older version of the same major
+  for index, version := range hosted {
+    if current, ok := parseGRpcSemver(version); ! ok {
+      continue
+    } else if current.major != expected.major {
+      continue
+    } else if chosen < 0 || newerGRpcSemver(hosted[chosen], version) {
+      chosen = index
+    }
+  }
+
+  if chosen < 0 {
+    return -1, errors.New(fmt.Sprintf("%s isn't compatible", client))
+  }
+
+  return chosen, nil
+}
+
+/*! \brief Parse a semantic version
+ *
+ *  This function is used to parse versions like v1, v1.2 or 1.2.3
+ *
+ *  \param version: the version string
+ *  \return iGRpcSemver: the parsed version
+ *  \return bool: false if the version isn't a semantic version
+ */
+func parseGRpcSemver(version string) (iGRpcSemver, bool) {
+  ret := iGRpcSemver{}
+  parts := strings.Split(strings.TrimPrefix(version, "v"), ".")
+  fields := []*int{&ret.major, &ret.minor, &ret.patch}
+
+  if len(parts) > len(fields) {
+    return ret, false
+  }
+
+  for index, part := range parts {
+    if value, err := strconv.Atoi(part); err != nil || value < 0 {
+      return ret, false
+    } else {
+      *fields[index] = value
+    }
+  }
+
+  return ret, true
+}
+
+/*! \brief Check if a version is newer than another one
+ *
+ *  \param left: the current version
+ *  \param right: the version which is compared with
+ *  \return bool: true if right is newer than left
+ */
+func newerGRpcSemver(left, right string) bool {
+  lhs, _ := parseGRpcSemver(left)
+  rhs, _ := parseGRpcSemver(right)
+
+  if lhs.major != rhs.major {
+    return rhs.major > lhs.major
+  } else if lhs.minor != rhs.minor {
+    return rhs.minor > lhs.minor
+  } else {
+    return rhs.patch > lhs.patch
+  }
+}
+
+/*! \brief Get the version policy of this context
+ *
+ *  \return int: the policy
+ */
+func (self *GRpcContext) policyOf() int {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
+  return self.policy
+}
+
+/*! \brief Produce interceptors which restore the actual peer of calls
+ *
+ *  This method is used by grpc servers of versions, they are reached by
+ * the front server in memory so the peer of their calls is the front one
+ *
+ *  \return grpc.UnaryServerInterceptor: the interceptor of unary calls
+ *  \return grpc.StreamServerInterceptor: the interceptor of streams
+ */
+func (self *GRpcServing) forwardedPeerInterceptors() (grpc.UnaryServerInterceptor,
+                                                      grpc.StreamServerInterceptor) {
+  unary := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+                handler grpc.UnaryHandler) (interface{}, error) {
+    return handler(self.forwardedGRpcPeer(ctx), req)
+  }
+
+  stream := func(srv interface{}, stream grpc.ServerStream,
+                 info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+    ctx := self.forwardedGRpcPeer(stream.Context())
+    return handler(srv, &iGRpcServerStream{ServerStream: stream, ctx: ctx})
+  }
+
+  return unary, stream
+}
+
+/*! \brief Restore the peer which the front server has forwarded
+ *
+ *  \param ctx: the context of a call
+ *  \return context.Context: the context whose peer is the actual caller
+ */
+func (self *GRpcServing) forwardedGRpcPeer(ctx context.Context) context.Context {
+  incoming, _ := metadata.FromIncomingContext(ctx)
+  values := incoming.Get(grpcPeerMetadata)
+
+  if len(values) != 1 {
+    return ctx
+  }
+
+  self.lock.Lock()
+  caller, ok := self.peers[values[0]]
+  self.lock.Unlock()
+
+  if ! ok {
+    return ctx
+  }
+
+  return peer.NewContext(ctx, caller)
+}
+
+/*! \brief Attach the version of an invent to an outgoing call
+ *
+ *  \param ctx: the context of the call
+ *  \param version: the version of invent
+ *  \return context.Context: the context whose metadata carries the version
+ */
+func outgoingGRpcVersion(ctx context.Context, version string) context.Context {
+  outgoing, ok := metadata.FromOutgoingContext(ctx)
+
+  // @NOTE: proxies forward versions of their callers, it must be replaced
+  // since we are the one who is negotiating with the next server
+  if ok {
+    outgoing = outgoing.Copy()
+  } else {
+    outgoing = metadata.MD{}
+  }
+
+  outgoing.Set(GRPC_VERSION_METADATA, version)
+  return metadata.NewOutgoingContext(ctx, outgoing)
+}
+
+/* --------------------- iGRpcVersionedStream --------------------- */
+
+func (self *iGRpcVersionedStream) Header() (metadata.MD, error) {
+  header, err := self.ClientStream.Header()
+
+  if err == nil {
+    self.recording.Do(func() {
+      self.record(header)
+    })
+  }
+
+  return header, err
+}
+
+func (self *iGRpcVersionedStream) RecvMsg(m interface{}) error {
+  err := self.ClientStream.RecvMsg(m)
+
+  // @NOTE: the header has arrived when we receive anything, so reading it
+  // here doesn't block
+  self.recording.Do(func() {
+    if header, err := self.ClientStream.Header(); err == nil {
+      self.record(header)
+    }
+  })
+
+  return err
+}
+
+/*! \brief Remember the version of the server which serves this stream
+ *
+ *  \param header: the response header
+ */
+func (self *iGRpcVersionedStream) record(header metadata.MD) {
+  if server, ok := peer.FromContext(self.ClientStream.Context()); ok && server.Addr != nil {
+    self.caller.record(server.Addr.String(), header)
+  }
+}
@@ -0,0 +1,353 @@
+package utils
+
+import (
+  "google.golang.org/grpc/codes"
+  "net/http"
+  "strings"
+  "math"
+  "sync"
+  "time"
+  "fmt"
+  "net"
+)
+
+type LimitStore interface {
+  // @NOTE: take removes one token from the bucket of key, the bucket is
+  // refilled with rate tokens per second up to burst. It returns how long
+  // the caller must wait when the bucket is empty, zero means the token has
+  // been taken. Stores which are shared by replicas must do this atomically
+  Take(key string, rate float64, burst int) (time.Duration, error)
+
+  // @NOTE: refund gives back a token which has been taken, it's used when
+  // another bucket refuses the same request so refused requests cost nothing
+  Refund(key string, rate float64, burst int) error
+}
+
+type RateLimit struct {
+  // @NOTE: rate is how many requests per second are refilled
+  Rate float64
+
+  // @NOTE: burst is the size of the bucket, it's how many requests could
+  // be sent at once
+  Burst int
+
+  // @NOTE: by defines who owns a bucket, see LIMIT_BY_IP, LIMIT_BY_PRINCIPAL
+  // and LIMIT_BY_APIKEY
+  By int
+}
+
+type iLimit struct {
+  // @NOTE: scope names the bucket, e.g the version, the endpoint or the
+  // method which the limit is configured on
+  scope string
+  limit RateLimit
+}
+
+type iLimitBucket struct {
+  // @NOTE: key is the key of bucket in the store, e.g scope@owner
+  key string
+  limit RateLimit
+}
+
+type iBucket struct {
+  tokens float64
+  updated time.Time
+
+  // @NOTE: rate and burst are kept to know when the bucket is full again
+  rate float64
+  burst int
+}
+
+type MemoryLimitStore struct {
+  buckets map[string]*iBucket
+
+  // @NOTE: swept is when idle buckets were removed the last time
+  swept time.Time
+  lock sync.Mutex
+}
+
+const (
+  LIMIT_BY_IP        = 0
+  LIMIT_BY_PRINCIPAL = 1
+  LIMIT_BY_APIKEY    = 2
+)
+
+const (
+  // @NOTE: how often the memory store removes buckets which are full again
+  limitSweepInterval = time.Minute
+)
+
+/*! \brief Limit the rate of requests to this endpoint
+ *
+ *  This method is used to configure a token bucket for a method, the
+ * bucket of "*" is shared by every method of this endpoint. A request must
+ * pass every limit of its version, endpoint and method
+ *
+ *  \param method: the http method, "*" means the whole endpoint
+ *  \param limit: the limit
+ *  \return *Api: to make a chain call, we will return itself to make calling
+ *                next function easily
+ */
+func (self *Api) Limit(method string, limit RateLimit) *Api {
+  self.owner.lock.Lock()
+  defer self.owner.lock.Unlock()
+
+  if self.limits == nil {
+    self.limits = make(map[string]RateLimit)
+  }
+
+  self.limits[strings.ToUpper(method)] = limit
+  return self
+}
+
+/*! \brief Limit the rate of requests to the current version
+ *
+ *  \param limit: the limit which is shared by every endpoint of the version
+ *  \return *ApiServer: to make a chain call, we will return itself
+ *                      to make calling next function easily
+ */
+func (self *ApiServer) Limit(limit RateLimit) *ApiServer {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
+  if ver, ok := self.versions[self.currentVersion]; ok {
+    ver.limit = &limit
+  }
+
+  return self
+}
+
+/*! \brief Change where buckets are stored
+ *
+ *  \param store: the store, e.g one which is shared by every replica
+ *  \return *ApiServer: to make a chain call, we will return itself
+ *                      to make calling next function easily
+ */
+func (self *ApiServer) SetLimitStore(store LimitStore) *ApiServer {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
+  self.limiter = store
+  return self
+}
+
+/*! \brief Take a token of every limit which covers a request
+ *
+ *  \param endpoint: the endpoint name
+ *  \param code: the version code
+ *  \param r: the request
+ *  \return time.Duration: how long the client must wait, zero means the
+ *                         request could be served
+ */
+func (self *ApiServer) throttle(endpoint, code string, r *http.Request) time.Duration {
+  var limits []iLimit
+
+  self.lock.RLock()
+  store := self.limiter
+
+  if ver, ok := self.versions[code]; ok {
+    if ver.limit != nil {
+      limits = append(limits, iLimit{scope: code, limit: *ver.limit})
+    }
+
+    if api, ok := ver.endpoints[endpoint]; ok {
+      if limit, ok := api.limits["*"]; ok {
+        limits = append(limits, iLimit{
+          scope: fmt.Sprintf("%s/%s", code, endpoint),
+          limit: limit,
+        })
+      }
+
+      if limit, ok := api.limits[r.Method]; ok {
+        limits = append(limits, iLimit{
+          scope: fmt.Sprintf("%s/%s/%s", code, endpoint, r.Method),
+          limit: limit,
+        })
+      }
+    }
+  }
+  self.lock.RUnlock()
+
+  buckets := make([]iLimitBucket, 0, len(limits))
+
+  for _, item := range limits {
+    buckets = append(buckets, iLimitBucket{
+      key: fmt.Sprintf("%s@%s", item.scope, clientOf(r, item.limit.By)),
+      limit: item.limit,
+    })
+  }
+
+  return takeLimitBuckets(store, buckets)
+}
+
+/*! \brief Refuse a request which exceeds a limit
+ *
+ *  \param w: the response writer
+ *  \param wait: how long the client must wait
+ */
+func (self *ApiServer) refuse(w http.ResponseWriter, wait time.Duration) {
+  seconds := int(math.Ceil(wait.Seconds()))
+
+  w.Header().Set("Retry-After", fmt.Sprintf("%d", seconds))
+  self.Fail(w)(NewError(codes.ResourceExhausted,
+                        fmt.Sprintf("Too many requests, retry after %d seconds",
+                                    seconds)))
+}
+
+/* ----------------------- MemoryLimitStore ----------------------- */
+
+/*! \brief Create a store which keeps buckets in memory
+ *
+ *  \return *MemoryLimitStore: the store, buckets are only shared inside
+ *                             this process
+ */
+func NewMemoryLimitStore() *MemoryLimitStore {
+  return &MemoryLimitStore{
+    buckets: make(map[string]*iBucket),
+    swept: time.Now(),
+  }
+}
+
+func (self *MemoryLimitStore) Take(key string, rate float64,
+                                   burst int) (time.Duration, error) {
+  now := time.Now()
+
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
+  if now.Sub(self.swept) > limitSweepInterval {
+    self.sweep(now)
+  }
+
+  bucket, ok := self.buckets[key]
+  if ! ok {
+    bucket = &iBucket{tokens: float64(burst), updated: now}
+    self.buckets[key] = bucket
+  }
+
+  bucket.tokens = math.Min(float64(burst),
+                           bucket.tokens + now.Sub(bucket.updated).Seconds() * rate)
+  bucket.updated = now
+  bucket.rate = rate
+  bucket.burst = burst
+
+  if bucket.tokens >= 1 {
+    bucket.tokens -= 1
+    return 0, nil
+  } else if rate <= 0 {
+    return time.Duration(math.MaxInt64), nil
+  }
+
+  return time.Duration((1 - bucket.tokens) / rate * float64(time.Second)), nil
+}
+
+func (self *MemoryLimitStore) Refund(key string, rate float64, burst int) error {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
+  // @NOTE: a bucket which has been swept is full already
+  if bucket, ok := self.buckets[key]; ok {
+    bucket.tokens = math.Min(float64(burst), bucket.tokens + 1)
+  }
+
+  return nil
+}
+
+/*! \brief Remove buckets which are full again
+ *
+ *  \param now: the current time
+ */
+func (self *MemoryLimitStore) sweep(now time.Time) {
+  for key, bucket := range self.buckets {
+    refilled := bucket.tokens + now.Sub(bucket.updated).Seconds() * bucket.rate
+
+    // @NOTE: a removed bucket is created full, so only full buckets could
+    // be removed without giving clients more tokens
+    if refilled >= float64(bucket.burst) {
+      delete(self.buckets, key)
+    }
+  }
+
+  self.swept = now
+}
+
+/* --------------------------- helper ----------------------------- */
+
+/*! \brief Take a token of every bucket which covers a request
+ *
+ *  A request is admitted only when every bucket has a token, otherwide
+ * tokens which have been taken for it are refunded
+ *
+ *  \param store: the store of buckets
+ *  \param buckets: the buckets
+ *  \return time.Duration: how long the client must wait, zero means the
+ *                         request could be served
+ */
+func takeLimitBuckets(store LimitStore, buckets []iLimitBucket) time.Duration {
+  taken := make([]iLimitBucket, 0, len(buckets))
+  wait := time.Duration(0)
+
+  for _, item := range buckets {
+    delay, err := store.Take(item.key, item.limit.Rate, item.limit.Burst)
+
+    // @NOTE: we would rather serve requests than refuse everything when the
+    // store is broken
+    if err != nil {
+      continue
+    } else if delay == 0 {
+      taken = append(taken, item)
+    } else if delay > wait {
+      wait = delay
+    }
+  }
+
+  if wait > 0 {
+    for _, item := range taken {
+      store.Refund(item.key, item.limit.Rate, item.limit.Burst)
+    }
+  }
+
+  return wait
+}
+
+/*! \brief Find who owns the bucket of a request
+ *
+ *  \param r: the request
+ *  \param by: LIMIT_BY_IP, LIMIT_BY_PRINCIPAL or LIMIT_BY_APIKEY
+ *  \return string: the owner
+ */
+func clientOf(r *http.Request, by int) string {
+  return ownerOfBucket(by, PrincipalOf(r.Context()), r.RemoteAddr)
+}
+
+/*! \brief Find who owns a bucket
+ *
+ *  \param by: LIMIT_BY_IP, LIMIT_BY_PRINCIPAL or LIMIT_BY_APIKEY, callers
+ *             without a principal or an authenticated key fallback to
+ *             their ip
+ *  \param principal: the principal of the caller or nil
+ *  \param addr: the address of the caller
+ *  \return string: the owner
+ */
+func ownerOfBucket(by int, principal *Principal, addr string) string {
+  switch(by) {
+    case LIMIT_BY_PRINCIPAL:
+      if principal != nil {
+        return fmt.Sprintf("principal:%s:%s", principal.Kind, principal.Name)
+      }
+
+    case LIMIT_BY_APIKEY:
+      // @NOTE: only keys which have been authenticated own a bucket, a key
+      // which nobody knows would give its caller a full bucket every time
+      if principal != nil && principal.Kind == "apikey" {
+        return "apikey:" + principal.Name
+      }
+  }
+
+  host, _, err := net.SplitHostPort(addr)
+  if err != nil {
+    host = addr
+  }
+
+  return "ip:" + host
+}
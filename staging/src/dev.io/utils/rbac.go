@@ -0,0 +1,345 @@
+package utils
+
+import (
+  "gopkg.in/yaml.v2"
+  "io/ioutil"
+  "net/http"
+  "strings"
+  "errors"
+  "bytes"
+  "sync"
+  "time"
+  "fmt"
+  "io"
+  "os"
+)
+
+type iRoleRef struct {
+  Kind string `yaml:"kind"`
+  Name string `yaml:"name"`
+}
+
+type iSubject struct {
+  Kind string `yaml:"kind"`
+  Name string `yaml:"name"`
+  Namespace string `yaml:"namespace"`
+}
+
+type iRoleBinding struct {
+  Kind string `yaml:"kind"`
+  Metadata struct {
+    Name string `yaml:"name"`
+    Namespace string `yaml:"namespace"`
+  } `yaml:"metadata"`
+  RoleRef iRoleRef `yaml:"roleRef"`
+  Subjects []iSubject `yaml:"subjects"`
+}
+
+type RoleBindings struct {
+  // @NOTE: path is the yaml file which bindings are loaded from
+  path string
+  modified time.Time
+
+  // @NOTE: bindings stores the bindings of the last good load, a broken
+  // file never replaces them
+  bindings []iRoleBinding
+
+  // @NOTE: stop is closed to finish watching the file
+  stop chan struct{}
+  lock sync.RWMutex
+}
+
+/*! \brief Require roles to call a method of this endpoint
+ *
+ *  This method is used to declare which roles could call a method, the
+ * principal needs one of them at least. Roles are granted by the role
+ * bindings of ApiServer
+ *
+ *  \param method: the http method, "*" means every method
+ *  \param roles: the roles
+ *  \return *Api: to make a chain call, we will return itself to make calling
+ *                next function easily
+ */
+func (self *Api) Require(method string, roles ...string) *Api {
+  self.owner.lock.Lock()
+  defer self.owner.lock.Unlock()
+
+  if self.roles == nil {
+    self.roles = make(map[string][]string)
+  }
+
+  self.roles[strings.ToUpper(method)] = roles
+  return self
+}
+
+/*! \brief Require scopes to call a method of this endpoint
+ *
+ *  This method is used to declare which scopes a credential must carry to
+ * call a method, the principal needs every one of them
+ *
+ *  \param method: the http method, "*" means every method
+ *  \param scopes: the scopes
+ *  \return *Api: to make a chain call, we will return itself to make calling
+ *                next function easily
+ */
+func (self *Api) Scope(method string, scopes ...string) *Api {
+  self.owner.lock.Lock()
+  defer self.owner.lock.Unlock()
+
+  if self.scopes == nil {
+    self.scopes = make(map[string][]string)
+  }
+
+  self.scopes[strings.ToUpper(method)] = scopes
+  return self
+}
+
+/*! \brief Check if the principal of a request could call this endpoint
+ *
+ *  \param r: the request
+ *  \return int: 200 if it's authorized, 401 if the request is anonymous or
+ *               403 if the principal lacks a role or a scope
+ */
+func (self *Api) authorize(r *http.Request) int {
+  roles, ok := self.roles[r.Method]
+  if ! ok {
+    roles = self.roles["*"]
+  }
+
+  scopes, ok := self.scopes[r.Method]
+  if ! ok {
+    scopes = self.scopes["*"]
+  }
+
+  if len(roles) == 0 && len(scopes) == 0 {
+    return 200
+  }
+
+  principal := PrincipalOf(r.Context())
+  if principal == nil {
+    return 401
+  }
+
+  for _, scope := range scopes {
+    if ! principal.HasScope(scope) {
+      return 403
+    }
+  }
+
+  if len(roles) == 0 {
+    return 200
+  } else if self.owner.bindings == nil {
+    return 403
+  }
+
+  for _, granted := range self.owner.bindings.RolesOf(self.code, principal) {
+    for _, role := range roles {
+      if role == granted {
+        return 200
+      }
+    }
+  }
+
+  return 403
+}
+
+/*! \brief Authorize requests with role bindings
+ *
+ *  \param bindings: the role bindings
+ *  \return *ApiServer: to make a chain call, we will return itself
+ *                      to make calling next function easily
+ */
+func (self *ApiServer) Authorize(bindings *RoleBindings) *ApiServer {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
+  self.bindings = bindings
+  return self
+}
+
+/* ------------------------- RoleBindings ------------------------- */
+
+/*! \brief Load role bindings from a yaml file and watch it
+ *
+ *  This function is used to load RoleBinding and ClusterRoleBinding
+ * documents like Kubernetes does. The namespace of a RoleBinding is the
+ * version which it applies to while ClusterRoleBinding applies to every
+ * version. The file is checked periodically and reloaded when it changes
+ *
+ *  \param path: the path of the yaml file
+ *  \param interval: how often the file is checked, zero means never
+ *  \return *RoleBindings: the role bindings
+ *  \return error: if the file can't be loaded, we will receive an error
+ */
+func LoadRoleBindings(path string, interval time.Duration) (*RoleBindings, error) {
+  ret := &RoleBindings{path: path, stop: make(chan struct{})}
+
+  if err := ret.Reload(); err != nil {
+    return nil, err
+  }
+
+  if interval > 0 {
+    go ret.watch(interval)
+  }
+
+  return ret, nil
+}
+
+/*! \brief Reload role bindings if the file has been modified
+ *
+ *  \return error: if the file can't be loaded, we will receive an error and
+ *                 the previous bindings are kept
+ */
+func (self *RoleBindings) Reload() error {
+  info, err := os.Stat(self.path)
+  if err != nil {
+    return err
+  }
+
+  self.lock.RLock()
+  modified := self.modified
+  self.lock.RUnlock()
+
+  if info.ModTime().Equal(modified) {
+    return nil
+  }
+
+  data, err := ioutil.ReadFile(self.path)
+  if err != nil {
+    return err
+  }
+
+  bindings, err := parseRoleBindings(data)
+  if err != nil {
+    return err
+  }
+
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
+  self.bindings = bindings
+  self.modified = info.ModTime()
+  return nil
+}
+
+/*! \brief Find roles which are granted to a principal
+ *
+ *  \param version: the version which the principal is calling
+ *  \param principal: the principal
+ *  \return []string: the roles
+ */
+func (self *RoleBindings) RolesOf(version string, principal *Principal) []string {
+  var ret []string
+
+  self.lock.RLock()
+  defer self.lock.RUnlock()
+
+  for _, binding := range self.bindings {
+    if binding.Kind == "RoleBinding" && binding.Metadata.Namespace != version {
+      continue
+    }
+
+    for _, subject := range binding.Subjects {
+      if subject.match(principal) {
+        ret = append(ret, binding.RoleRef.Name)
+        break
+      }
+    }
+  }
+
+  return ret
+}
+
+/*! \brief Stop watching the file
+ */
+func (self *RoleBindings) Close() {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
+  select {
+  case <-self.stop:
+  default:
+    close(self.stop)
+  }
+}
+
+/*! \brief Check the file periodically until we are closed
+ *
+ *  \param interval: how often the file is checked
+ */
+func (self *RoleBindings) watch(interval time.Duration) {
+  ticker := time.NewTicker(interval)
+  defer ticker.Stop()
+
+  for {
+    select {
+    case <-ticker.C:
+      // @NOTE: a broken file is ignored, we keep serving with the last good
+      // bindings until it's fixed
+      self.Reload()
+
+    case <-self.stop:
+      return
+    }
+  }
+}
+
+/* --------------------------- iSubject --------------------------- */
+
+/*! \brief Check if a subject matches a principal
+ *
+ *  \param principal: the principal
+ *  \return bool: true if it matches
+ */
+func (self iSubject) match(principal *Principal) bool {
+  switch(self.Kind) {
+    case "User":
+      return self.Name == principal.Name
+
+    case "Group":
+      return principal.HasGroup(self.Name)
+
+    case "ServiceAccount":
+      return principal.Name == fmt.Sprintf("system:serviceaccount:%s:%s",
+                                           self.Namespace, self.Name)
+
+    default:
+      return false
+  }
+}
+
+/* --------------------------- helper ----------------------------- */
+
+/*! \brief Parse role bindings of a yaml stream
+ *
+ *  \param data: the yaml stream, documents are separated by ---
+ *  \return []iRoleBinding: the bindings, documents of other kinds are
+ *                          ignored
+ *  \return error: if a document is malformed, we will receive an error
+ */
+func parseRoleBindings(data []byte) ([]iRoleBinding, error) {
+  var ret []iRoleBinding
+
+  decoder := yaml.NewDecoder(bytes.NewReader(data))
+
+  for {
+    var binding iRoleBinding
+
+    if err := decoder.Decode(&binding); err == io.EOF {
+      break
+    } else if err != nil {
+      return nil, err
+    }
+
+    if binding.Kind != "RoleBinding" && binding.Kind != "ClusterRoleBinding" {
+      continue
+    } else if len(binding.RoleRef.Name) == 0 {
+      return nil, errors.New(fmt.Sprintf("%s %s doesn't refer a role",
+                                         binding.Kind, binding.Metadata.Name))
+    }
+
+    ret = append(ret, binding)
+  }
+
+  return ret, nil
+}
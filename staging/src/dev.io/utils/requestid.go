@@ -0,0 +1,150 @@
+package utils
+
+import (
+  "google.golang.org/grpc/metadata"
+  "google.golang.org/grpc"
+  "net/http"
+  "context"
+)
+
+const (
+  REQUEST_ID_HEADER   = "X-Request-ID"
+  REQUEST_ID_METADATA = "x-request-id"
+)
+
+// @NOTE: ids of callers longer than this are replaced, so a caller can't
+// flood our logs through this header
+const maxRequestIdLength = 128
+
+type iRequestIdKey struct{}
+
+/*! \brief Get the request id of a context
+ *
+ *  \param ctx: the context of a request or a grpc call
+ *  \return string: the request id or empty if there is none
+ */
+func RequestIdOf(ctx context.Context) string {
+  id, _ := ctx.Value(iRequestIdKey{}).(string)
+  return id
+}
+
+/*! \brief Attach a request id to a context
+ *
+ *  This function is used by jobs which don't come from a request but still
+ * want their grpc calls to be joined in logs
+ *
+ *  \param ctx: the context
+ *  \param id: the request id
+ *  \return context.Context: the context which carries the request id
+ */
+func WithRequestId(ctx context.Context, id string) context.Context {
+  return context.WithValue(ctx, iRequestIdKey{}, id)
+}
+
+/*! \brief Accept or assign the request id of a request
+ *
+ *  This method is used to keep X-Request-ID of the caller if it's valid or
+ * to generate a new one, the id is echoed in the response header so Pack
+ * could put it in the envelope of errors
+ *
+ *  \param w: the response writer
+ *  \param r: the request
+ *  \return *http.Request: the request whose context carries the request id
+ */
+func (self *ApiServer) identify(w http.ResponseWriter, r *http.Request) *http.Request {
+  if len(RequestIdOf(r.Context())) > 0 {
+    return r
+  }
+
+  id := r.Header.Get(REQUEST_ID_HEADER)
+  if ! isRequestId(id) {
+    id = randomTraceId(16)
+  }
+
+  w.Header().Set(REQUEST_ID_HEADER, id)
+  return r.WithContext(WithRequestId(r.Context(), id))
+}
+
+/*! \brief Produce interceptors which accept request ids of grpc calls
+ *
+ *  \return grpc.UnaryServerInterceptor: the interceptor of unary calls
+ *  \return grpc.StreamServerInterceptor: the interceptor of streams
+ */
+func requestIdInterceptors() (grpc.UnaryServerInterceptor,
+                              grpc.StreamServerInterceptor) {
+  unary := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+                handler grpc.UnaryHandler) (interface{}, error) {
+    return handler(incomingRequestId(ctx), req)
+  }
+
+  stream := func(srv interface{}, stream grpc.ServerStream,
+                 info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+    ctx := incomingRequestId(stream.Context())
+    return handler(srv, &iGRpcServerStream{ServerStream: stream, ctx: ctx})
+  }
+
+  return unary, stream
+}
+
+/*! \brief Accept the request id of an incoming grpc call
+ *
+ *  \param ctx: the context of the call
+ *  \return context.Context: the context which carries the request id, a new
+ *                           one is assigned if the caller doesn't send any
+ */
+func incomingRequestId(ctx context.Context) context.Context {
+  if len(RequestIdOf(ctx)) > 0 {
+    return ctx
+  }
+
+  if incoming, ok := metadata.FromIncomingContext(ctx); ok {
+    if values := incoming.Get(REQUEST_ID_METADATA); len(values) > 0 && isRequestId(values[0]) {
+      return WithRequestId(ctx, values[0])
+    }
+  }
+
+  return WithRequestId(ctx, randomTraceId(16))
+}
+
+/*! \brief Forward the request id of a context to an outgoing grpc call
+ *
+ *  \param ctx: the context of the call
+ *  \return context.Context: the context whose metadata carries the request id
+ */
+func outgoingRequestId(ctx context.Context) context.Context {
+  id := RequestIdOf(ctx)
+  if len(id) == 0 {
+    return ctx
+  }
+
+  // @NOTE: like traceparent, the id of a proxied caller is replaced by ours
+  // which is the same one unless the caller sent an invalid id
+  outgoing, ok := metadata.FromOutgoingContext(ctx)
+  if ok {
+    outgoing = outgoing.Copy()
+  } else {
+    outgoing = metadata.MD{}
+  }
+
+  outgoing.Set(REQUEST_ID_METADATA, id)
+  return metadata.NewOutgoingContext(ctx, outgoing)
+}
+
+/*! \brief Check if a request id of a caller is acceptable
+ *
+ *  \param id: the request id
+ *  \return bool: true if it's short and made of printable ascii only
+ */
+func isRequestId(id string) bool {
+  if len(id) == 0 || len(id) > maxRequestIdLength {
+    return false
+  }
+
+  for _, char := range id {
+    if char <= ' ' || char > '~' || char == '"' || char == '\\' {
+      return false
+    }
+  }
+
+  return true
+}
@@ -0,0 +1,337 @@
+package utils
+
+import (
+  "github.com/golang-jwt/jwt/v4"
+  "google.golang.org/grpc/metadata"
+  "google.golang.org/grpc/status"
+  "google.golang.org/grpc/codes"
+  "google.golang.org/grpc"
+  "encoding/base64"
+  "crypto/sha256"
+  "crypto/x509"
+  "encoding/pem"
+  "io/ioutil"
+  "net/http"
+  "context"
+  "strings"
+  "errors"
+  "bytes"
+  "fmt"
+)
+
+type ServiceAccountAuthenticator struct {
+  // @NOTE: tokens verifies signatures and standard claims, it holds the
+  // public keys of the cluster's issuer
+  tokens *JwtAuthenticator
+
+  // @NOTE: issuer is used to pick our tokens out of every bearer token so
+  // other authenticators of the chain still receive theirs
+  issuer string
+}
+
+const (
+  serviceAccountPrefix = "system:serviceaccount:"
+)
+
+/*! \brief Only allow principals of some namespaces to reach this endpoint
+ *
+ *  This method is used to make PROTECTED mean "from these namespaces", the
+ * principal is produced by ServiceAccountAuthenticator
+ *
+ *  \param namespaces: the namespaces, empty means every namespace
+ *  \return *Api: to make a chain call, we will return itself to make calling
+ *                next function easily
+ */
+func (self *Api) Protect(namespaces ...string) *Api {
+  self.owner.lock.Lock()
+  defer self.owner.lock.Unlock()
+
+  self.level = PROTECTED
+  self.namespaces = namespaces
+  return self
+}
+
+/*! \brief Create an authenticator of Kubernetes service account tokens
+ *
+ *  This function is used to validate projected service account tokens
+ * offline like TokenReview does, keys of the issuer must be loaded by Keys
+ * before using it
+ *
+ *  \param issuer: the issuer of the cluster, e.g
+ *                 https://kubernetes.default.svc.cluster.local
+ *  \param audience: the audience which tokens must be issued for, empty
+ *                   means any audience
+ *  \return *ServiceAccountAuthenticator: the authenticator
+ */
+func NewServiceAccountAuthenticator(issuer,
+                                    audience string) *ServiceAccountAuthenticator {
+  return &ServiceAccountAuthenticator{
+    tokens: NewJwtAuthenticator().Expect(issuer, audience),
+    issuer: issuer,
+  }
+}
+
+/*! \brief Load public keys of the issuer
+ *
+ *  \param path: a JWKS file, e.g from /openid/v1/jwks, or a PEM file which
+ *               contains public keys or certificates, e.g sa.pub
+ *  \return error: if the file can't be read or parsed, we will receive an
+ *                 error
+ */
+func (self *ServiceAccountAuthenticator) Keys(path string) error {
+  data, err := ioutil.ReadFile(path)
+  if err != nil {
+    return err
+  }
+
+  if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+    return self.tokens.Jwks(path)
+  }
+
+  keys, err := parsePublicKeys(data)
+  if err != nil {
+    return err
+  }
+
+  for kid, key := range keys {
+    self.tokens.Key(kid, key)
+  }
+
+  return nil
+}
+
+func (self *ServiceAccountAuthenticator) Challenge() string {
+  return "Bearer"
+}
+
+func (self *ServiceAccountAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+  header := r.Header.Get("Authorization")
+
+  if len(header) < 7 || ! strings.EqualFold(header[:7], "Bearer ") {
+    return nil, nil
+  }
+
+  return self.Verify(strings.TrimSpace(header[7:]))
+}
+
+/*! \brief Verify a service account token
+ *
+ *  \param raw: the token
+ *  \return *Principal: the principal whose name is the Kubernetes user name
+ *                      system:serviceaccount:<namespace>:<name>, or nil if
+ *                      the token isn't issued by our issuer
+ *  \return error: if the token is invalid, we will receive an error
+ */
+func (self *ServiceAccountAuthenticator) Verify(raw string) (*Principal, error) {
+  claims := jwt.MapClaims{}
+
+  if _, _, err := new(jwt.Parser).ParseUnverified(raw, claims); err != nil {
+    return nil, nil
+  } else if issuer, _ := claims["iss"].(string); issuer != self.issuer {
+    return nil, nil
+  }
+
+  principal, err := self.tokens.Verify(raw)
+  if err != nil {
+    return nil, err
+  }
+
+  namespace, name := serviceAccountOf(principal.Claims)
+
+  if len(namespace) == 0 || len(name) == 0 {
+    return nil, errors.New("token doesn't carry a service account")
+  } else if principal.Name != serviceAccountPrefix + namespace + ":" + name {
+    return nil, errors.New(fmt.Sprintf("subject %s doesn't match %s/%s",
+                                       principal.Name, namespace, name))
+  }
+
+  principal.Kind = "serviceaccount"
+  principal.Namespace = namespace
+  principal.Groups = []string{
+    "system:serviceaccounts",
+    "system:serviceaccounts:" + namespace,
+    "system:authenticated",
+  }
+
+  return principal, nil
+}
+
+/*! \brief Produce interceptors which authenticate grpc calls
+ *
+ *  This method is used with GRpcContext.Intercept, calls must carry a
+ * service account token in the authorization metadata and the principal is
+ * attached to the context of handlers
+ *
+ *  \param namespaces: the namespaces which are allowed to call, empty means
+ *                     every namespace
+ *  \return grpc.UnaryServerInterceptor: the interceptor of unary calls
+ *  \return grpc.StreamServerInterceptor: the interceptor of streams
+ */
+func (self *ServiceAccountAuthenticator) Interceptors(
+    namespaces ...string) (grpc.UnaryServerInterceptor,
+                           grpc.StreamServerInterceptor) {
+  unary := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+                handler grpc.UnaryHandler) (interface{}, error) {
+    ctx, err := self.intercept(ctx, namespaces)
+    if err != nil {
+      return nil, err
+    }
+
+    return handler(ctx, req)
+  }
+
+  stream := func(srv interface{}, stream grpc.ServerStream,
+                 info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+    ctx, err := self.intercept(stream.Context(), namespaces)
+    if err != nil {
+      return err
+    }
+
+    return handler(srv, &iGRpcServerStream{ServerStream: stream, ctx: ctx})
+  }
+
+  return unary, stream
+}
+
+/*! \brief Authenticate the call of a context
+ *
+ *  \param ctx: the context of the call
+ *  \param namespaces: the namespaces which are allowed to call
+ *  \return context.Context: the context which carries the principal
+ *  \return error: the status error if the call is refused
+ */
+func (self *ServiceAccountAuthenticator) intercept(ctx context.Context,
+                                                   namespaces []string) (context.Context, error) {
+  var header string
+
+  if incoming, ok := metadata.FromIncomingContext(ctx); ok {
+    if values := incoming.Get("authorization"); len(values) > 0 {
+      header = values[0]
+    }
+  }
+
+  if len(header) < 7 || ! strings.EqualFold(header[:7], "Bearer ") {
+    return nil, status.Error(codes.Unauthenticated, "token is required")
+  }
+
+  principal, err := self.Verify(strings.TrimSpace(header[7:]))
+  if err != nil {
+    return nil, status.Error(codes.Unauthenticated, err.Error())
+  } else if principal == nil {
+    return nil, status.Error(codes.Unauthenticated,
+                             "token is issued by another issuer")
+  } else if ! principal.isFrom(namespaces) {
+    return nil, status.Error(codes.PermissionDenied,
+                             fmt.Sprintf("%s can't call", principal.Name))
+  }
+
+  return withPrincipal(ctx, principal), nil
+}
+
+/* --------------------------- helper ----------------------------- */
+
+/*! \brief Check if a principal comes from some namespaces
+ *
+ *  \param namespaces: the namespaces, empty means every namespace
+ *  \return bool: true if the principal is a service account of them
+ */
+func (self *Principal) isFrom(namespaces []string) bool {
+  if len(self.Namespace) == 0 {
+    return false
+  } else if len(namespaces) == 0 {
+    return true
+  }
+
+  for _, namespace := range namespaces {
+    if namespace == self.Namespace {
+      return true
+    }
+  }
+
+  return false
+}
+
+/*! \brief Read the service account of token claims
+ *
+ *  \param claims: the claims, both projected and legacy tokens are
+ *                 supported
+ *  \return string, string: the namespace and the service account name
+ */
+func serviceAccountOf(claims map[string]interface{}) (string, string) {
+  if info, ok := claims["kubernetes.io"].(map[string]interface{}); ok {
+    namespace, _ := info["namespace"].(string)
+    account, _ := info["serviceaccount"].(map[string]interface{})
+    name, _ := account["name"].(string)
+
+    return namespace, name
+  }
+
+  namespace, _ := claims["kubernetes.io/serviceaccount/namespace"].(string)
+  name, _ := claims["kubernetes.io/serviceaccount/service-account.name"].(string)
+  return namespace, name
+}
+
+/*! \brief Parse public keys of a PEM file
+ *
+ *  \param data: the PEM file
+ *  \return map[string]interface{}: the keys which are indexed by key ids
+ *                                  like Kubernetes computes them, the first
+ *                                  key also verifies tokens without key id
+ *  \return error: if a block is malformed, we will receive an error
+ */
+func parsePublicKeys(data []byte) (map[string]interface{}, error) {
+  ret := make(map[string]interface{})
+
+  for {
+    var key interface{}
+    var err error
+
+    block, rest := pem.Decode(data)
+    if block == nil {
+      break
+    }
+
+    data = rest
+
+    switch block.Type {
+      case "PUBLIC KEY":
+        key, err = x509.ParsePKIXPublicKey(block.Bytes)
+
+      case "RSA PUBLIC KEY":
+        key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+
+      case "CERTIFICATE":
+        var cert *x509.Certificate
+
+        if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+          key = cert.PublicKey
+        }
+
+      default:
+        continue
+    }
+
+    if err != nil {
+      return nil, err
+    }
+
+    der, err := x509.MarshalPKIXPublicKey(key)
+    if err != nil {
+      return nil, err
+    }
+
+    // @NOTE: Kubernetes uses sha256 of the DER key as the key id
+    digest := sha256.Sum256(der)
+    ret[base64.RawURLEncoding.EncodeToString(digest[:])] = key
+
+    if _, ok := ret[""]; ! ok {
+      ret[""] = key
+    }
+  }
+
+  if len(ret) == 0 {
+    return nil, errors.New("there is no public key")
+  }
+
+  return ret, nil
+}
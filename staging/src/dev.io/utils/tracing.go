@@ -0,0 +1,616 @@
+package utils
+
+import (
+  "google.golang.org/grpc/metadata"
+  "google.golang.org/grpc/status"
+  "google.golang.org/grpc"
+  "encoding/json"
+  "encoding/hex"
+  "crypto/rand"
+  "net/http"
+  "context"
+  "strings"
+  "errors"
+  "bufio"
+  "sync"
+  "time"
+  "fmt"
+  "net"
+  "io"
+  "os"
+)
+
+const (
+  SPAN_INTERNAL = 0
+  SPAN_SERVER   = 1
+  SPAN_CLIENT   = 2
+)
+
+type Exporter interface {
+  // @NOTE: this method is used to send a span which has ended, it's called
+  // by the goroutine which ends the span so it must not block for long
+  Export(span Span)
+}
+
+type Span struct {
+  // @NOTE: ids are hex strings like W3C traceparent carries them, parent is
+  // empty for the root span of a trace
+  TraceId string `json:"trace_id"`
+  SpanId string `json:"span_id"`
+  ParentId string `json:"parent_id,omitempty"`
+
+  Name string `json:"name"`
+  Kind int `json:"kind"`
+  Start time.Time `json:"start"`
+  End time.Time `json:"end"`
+  Attributes map[string]string `json:"attributes,omitempty"`
+
+  // @NOTE: error is the reason why the span failed, empty means ok
+  Error string `json:"error,omitempty"`
+
+  // @NOTE: sampled spans are exported, the decision is inherited from the
+  // caller through traceparent
+  Sampled bool `json:"-"`
+}
+
+type ActiveSpan struct {
+  data Span
+  tracer *Tracer
+  ending sync.Once
+  lock sync.Mutex
+}
+
+type Tracer struct {
+  exporter Exporter
+}
+
+type MemoryExporter struct {
+  spans []Span
+  lock sync.Mutex
+}
+
+type iStdoutExporter struct {
+  output io.Writer
+  lock sync.Mutex
+}
+
+type iTracedWriter struct {
+  http.ResponseWriter
+
+  status int
+}
+
+type iTracedClientStream struct {
+  grpc.ClientStream
+
+  span *ActiveSpan
+
+  // @NOTE: single is true when the server sends only one message, so the
+  // stream ends as soon as it has been received
+  single bool
+
+  // @NOTE: done is closed when the span ends, it stops the goroutine which
+  // ends the span of streams which are abandoned with their context
+  done chan struct{}
+  ending sync.Once
+}
+
+// @NOTE: keys of context values, remote parents come from traceparent and
+// they are only used as parents of the next span
+type iSpanKey struct{}
+type iRemoteSpanKey struct{}
+
+/*! \brief Create a tracer
+ *
+ *  \param exporter: the exporter which receives ended spans
+ *  \return *Tracer: the tracer, which is installed by ApiServer.Trace and
+ *                   GRpcContext.Trace
+ */
+func NewTracer(exporter Exporter) *Tracer {
+  return &Tracer{exporter: exporter}
+}
+
+/*! \brief Start a span
+ *
+ *  This method is used to start a child of the span of a context, or a new
+ * trace if the context doesn't carry any span
+ *
+ *  \param ctx: the context
+ *  \param name: the span name
+ *  \param kind: SPAN_INTERNAL, SPAN_SERVER or SPAN_CLIENT
+ *  \return context.Context: the context which carries the new span
+ *  \return *ActiveSpan: the span, it must be ended by End
+ */
+func (self *Tracer) Start(ctx context.Context, name string,
+                          kind int) (context.Context, *ActiveSpan) {
+  ret := &ActiveSpan{
+    tracer: self,
+    data: Span{
+      SpanId: randomTraceId(8),
+      Name: name,
+      Kind: kind,
+      Start: time.Now(),
+      Attributes: make(map[string]string),
+      Sampled: true,
+    },
+  }
+
+  if parent := SpanOf(ctx); parent != nil {
+    ret.data.TraceId = parent.TraceId
+    ret.data.ParentId = parent.SpanId
+    ret.data.Sampled = parent.Sampled
+  } else if remote, ok := ctx.Value(iRemoteSpanKey{}).(Span); ok {
+    ret.data.TraceId = remote.TraceId
+    ret.data.ParentId = remote.SpanId
+    ret.data.Sampled = remote.Sampled
+  } else {
+    ret.data.TraceId = randomTraceId(16)
+  }
+
+  return context.WithValue(ctx, iSpanKey{}, ret), ret
+}
+
+/*! \brief Continue a trace of another service
+ *
+ *  \param ctx: the context
+ *  \param traceparent: the W3C traceparent header, an invalid one is
+ *                      ignored and a new trace is started later
+ *  \return context.Context: the context whose next span is a child of the
+ *                           remote span
+ */
+func (self *Tracer) Extract(ctx context.Context, traceparent string) context.Context {
+  if remote, err := parseTraceparent(traceparent); err == nil {
+    return context.WithValue(ctx, iRemoteSpanKey{}, remote)
+  }
+
+  return ctx
+}
+
+/*! \brief Produce interceptors which trace grpc calls of a server
+ *
+ *  \return grpc.UnaryServerInterceptor: the interceptor of unary calls
+ *  \return grpc.StreamServerInterceptor: the interceptor of streams
+ */
+func (self *Tracer) Interceptors() (grpc.UnaryServerInterceptor,
+                                    grpc.StreamServerInterceptor) {
+  unary := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+                handler grpc.UnaryHandler) (interface{}, error) {
+    ctx, span := self.Start(self.incoming(ctx), info.FullMethod, SPAN_SERVER)
+    resp, err := handler(ctx, req)
+
+    span.End(err)
+    return resp, err
+  }
+
+  stream := func(srv interface{}, stream grpc.ServerStream,
+                 info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+    ctx, span := self.Start(self.incoming(stream.Context()), info.FullMethod,
+                            SPAN_SERVER)
+    err := handler(srv, &iGRpcServerStream{ServerStream: stream, ctx: ctx})
+
+    span.End(err)
+    return err
+  }
+
+  return unary, stream
+}
+
+/*! \brief Continue the trace of an incoming grpc call
+ *
+ *  \param ctx: the context of the call
+ *  \return context.Context: the context which carries the remote parent
+ */
+func (self *Tracer) incoming(ctx context.Context) context.Context {
+  if incoming, ok := metadata.FromIncomingContext(ctx); ok {
+    if values := incoming.Get("traceparent"); len(values) > 0 {
+      return self.Extract(ctx, values[0])
+    }
+  }
+
+  return ctx
+}
+
+/*! \brief Start the span of an outgoing grpc call
+ *
+ *  \param ctx: the context of the call
+ *  \param method: the full method name
+ *  \return context.Context: the context whose metadata carries traceparent
+ *  \return *ActiveSpan: the span
+ */
+func (self *Tracer) outgoing(ctx context.Context,
+                             method string) (context.Context, *ActiveSpan) {
+  ctx, span := self.Start(ctx, method, SPAN_CLIENT)
+  outgoing, ok := metadata.FromOutgoingContext(ctx)
+
+  // @NOTE: proxies forward traceparent of their callers, it must be
+  // replaced instead of appended so servers see our span as their parent
+  if ok {
+    outgoing = outgoing.Copy()
+  } else {
+    outgoing = metadata.MD{}
+  }
+
+  outgoing.Set("traceparent", span.Traceparent())
+  return metadata.NewOutgoingContext(ctx, outgoing), span
+}
+
+/*! \brief Trace requests of every version of this server
+ *
+ *  This method is used to start a span for each routed request, the span
+ * continues the trace of traceparent header and it's named by the version,
+ * the endpoint and the method, e.g v1/orders/GET
+ *
+ *  \param tracer: the tracer, nil stops tracing
+ *  \return *ApiServer: to make a chain call, we will return itself
+ *                      to make calling next function easily
+ */
+func (self *ApiServer) Trace(tracer *Tracer) *ApiServer {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
+  self.tracer = tracer
+  return self
+}
+
+/*! \brief Wrap a handler of an endpoint into a span
+ *
+ *  \param endpoint: the endpoint name
+ *  \param code: the version code
+ *  \param handler: the handler
+ *  \return Handler: the traced handler
+ */
+func (self *ApiServer) trace(endpoint, code string, handler Handler) Handler {
+  return func(w http.ResponseWriter, r *http.Request) {
+    self.lock.RLock()
+    tracer := self.tracer
+    self.lock.RUnlock()
+
+    if tracer == nil {
+      handler(w, r)
+      return
+    }
+
+    ctx := tracer.Extract(r.Context(), r.Header.Get("traceparent"))
+    ctx, span := tracer.Start(ctx, fmt.Sprintf("%s/%s/%s", code, endpoint,
+                                               r.Method), SPAN_SERVER)
+    writer := &iTracedWriter{ResponseWriter: w, status: 200}
+
+    span.Set("http.method", r.Method)
+    span.Set("http.target", r.URL.Path)
+    defer func() {
+      span.Set("http.status_code", fmt.Sprintf("%d", writer.status))
+
+      if writer.status >= 500 {
+        span.End(errors.New(http.StatusText(writer.status)))
+      } else {
+        span.End(nil)
+      }
+    }()
+
+    handler(writer, r.WithContext(ctx))
+  }
+}
+
+/*! \brief Trace every grpc call of this context
+ *
+ *  This function is used to start spans for calls of every implementer
+ * which is started from now on and for calls of every invent, traceparent
+ * is carried by metadata between them
+ *
+ *  \param tracer: the tracer, nil stops tracing of invents
+ */
+func (self *GRpcContext) Trace(tracer *Tracer) {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
+  self.tracer = tracer
+}
+
+/*! \brief Get the tracer of this context
+ *
+ *  \return *Tracer: the tracer or nil
+ */
+func (self *GRpcContext) tracerOf() *Tracer {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
+  return self.tracer
+}
+
+/*! \brief Get the span of a context
+ *
+ *  \param ctx: the context
+ *  \return *Span: a snapshot of the span, or nil if there is no span
+ */
+func SpanOf(ctx context.Context) *Span {
+  if span, ok := ctx.Value(iSpanKey{}).(*ActiveSpan); ok {
+    ret := span.snapshot()
+    return &ret
+  }
+
+  return nil
+}
+
+/* -------------------------- ActiveSpan -------------------------- */
+
+/*! \brief Set an attribute of this span
+ *
+ *  \param key: the attribute name
+ *  \param value: the value
+ */
+func (self *ActiveSpan) Set(key, value string) {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
+  self.data.Attributes[key] = value
+}
+
+/*! \brief Format this span as W3C traceparent
+ *
+ *  \return string: the traceparent header
+ */
+func (self *ActiveSpan) Traceparent() string {
+  span := self.snapshot()
+  flags := "00"
+
+  if span.Sampled {
+    flags = "01"
+  }
+
+  return fmt.Sprintf("00-%s-%s-%s", span.TraceId, span.SpanId, flags)
+}
+
+/*! \brief End this span and export it, only the first call counts
+ *
+ *  \param err: the reason why the span failed, nil means ok
+ */
+func (self *ActiveSpan) End(err error) {
+  self.ending.Do(func() {
+    self.lock.Lock()
+    self.data.End = time.Now()
+
+    if err != nil {
+      if reason, ok := status.FromError(err); ok {
+        self.data.Error = fmt.Sprintf("%s: %s", reason.Code(), reason.Message())
+      } else {
+        self.data.Error = err.Error()
+      }
+    }
+
+    span := self.data
+    self.lock.Unlock()
+
+    if span.Sampled && self.tracer.exporter != nil {
+      self.tracer.exporter.Export(span)
+    }
+  })
+}
+
+/*! \brief Copy this span so it could be read without any lock
+ *
+ *  \return Span: the copy
+ */
+func (self *ActiveSpan) snapshot() Span {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
+  ret := self.data
+  ret.Attributes = make(map[string]string)
+
+  for key, value := range self.data.Attributes {
+    ret.Attributes[key] = value
+  }
+
+  return ret
+}
+
+/* ------------------------ MemoryExporter ------------------------ */
+
+/*! \brief Create an exporter which keeps spans in memory, e.g for testing
+ *
+ *  \return *MemoryExporter: the exporter
+ */
+func NewMemoryExporter() *MemoryExporter {
+  return &MemoryExporter{}
+}
+
+func (self *MemoryExporter) Export(span Span) {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
+  self.spans = append(self.spans, span)
+}
+
+/*! \brief Get every span which has been exported
+ *
+ *  \return []Span: the spans, in the order they ended
+ */
+func (self *MemoryExporter) Spans() []Span {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
+  return append([]Span{}, self.spans...)
+}
+
+/*! \brief Drop every span which has been exported
+ */
+func (self *MemoryExporter) Reset() {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
+  self.spans = nil
+}
+
+/* ------------------------ iStdoutExporter ----------------------- */
+
+/*! \brief Create an exporter which writes a json line per span
+ *
+ *  \param output: where spans are written, nil means stdout
+ *  \return Exporter: the exporter
+ */
+func NewStdoutExporter(output io.Writer) Exporter {
+  if output == nil {
+    output = os.Stdout
+  }
+
+  return &iStdoutExporter{output: output}
+}
+
+func (self *iStdoutExporter) Export(span Span) {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
+  json.NewEncoder(self.output).Encode(span)
+}
+
+/* ------------------------ iTracedWriter ------------------------- */
+
+func (self *iTracedWriter) WriteHeader(status int) {
+  self.status = status
+  self.ResponseWriter.WriteHeader(status)
+}
+
+func (self *iTracedWriter) Flush() {
+  if flusher, ok := self.ResponseWriter.(http.Flusher); ok {
+    flusher.Flush()
+  }
+}
+
+func (self *iTracedWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+  if hijacker, ok := self.ResponseWriter.(http.Hijacker); ok {
+    return hijacker.Hijack()
+  }
+
+  return nil, nil, errors.New("response writer can't be hijacked")
+}
+
+/* --------------------- iTracedClientStream ---------------------- */
+
+/*! \brief Trace a client stream until it ends
+ *
+ *  \param ctx: the context of the stream, the span ends when it's done
+ *  \param stream: the stream
+ *  \param desc: the description of the stream
+ *  \param span: the span of the stream
+ *  \return *iTracedClientStream: the traced stream
+ */
+func newTracedClientStream(ctx context.Context, stream grpc.ClientStream,
+                           desc *grpc.StreamDesc,
+                           span *ActiveSpan) *iTracedClientStream {
+  ret := &iTracedClientStream{
+    ClientStream: stream,
+    span: span,
+    single: ! desc.ServerStreams,
+    done: make(chan struct{}),
+  }
+
+  // @NOTE: callers may stop reading and cancel the context instead, the
+  // stream is finished by grpc then without reaching RecvMsg
+  go func() {
+    select {
+    case <-ctx.Done():
+      ret.end(status.FromContextError(ctx.Err()).Err())
+
+    case <-ret.done:
+    }
+  }()
+
+  return ret
+}
+
+func (self *iTracedClientStream) RecvMsg(m interface{}) error {
+  err := self.ClientStream.RecvMsg(m)
+
+  // @NOTE: a stream ends when it can't receive anymore, io.EOF means the
+  // server has finished gently
+  if err == io.EOF || (err == nil && self.single) {
+    self.end(nil)
+  } else if err != nil {
+    self.end(err)
+  }
+
+  return err
+}
+
+/*! \brief End the span of this stream once
+ *
+ *  \param err: the reason why the stream fails, nil means ok
+ */
+func (self *iTracedClientStream) end(err error) {
+  self.ending.Do(func() {
+    self.span.End(err)
+    close(self.done)
+  })
+}
+
+/* --------------------------- helper ----------------------------- */
+
+/*! \brief Generate a random id
+ *
+ *  \param size: the number of bytes
+ *  \return string: the id in hex
+ */
+func randomTraceId(size int) string {
+  buffer := make([]byte, size)
+
+  // @NOTE: an all-zero id is invalid, crypto/rand never fails on the
+  // platforms we support but we keep the id valid anyway
+  if _, err := rand.Read(buffer); err != nil {
+    buffer[size - 1] = 1
+  }
+
+  return hex.EncodeToString(buffer)
+}
+
+/*! \brief Parse W3C traceparent
+ *
+ *  \param header: the header, e.g 00-<trace id>-<span id>-01
+ *  \return Span: the remote span, only its ids and sampling are set
+ *  \return error: if the header is malformed
+ */
+func parseTraceparent(header string) (Span, error) {
+  parts := strings.Split(strings.TrimSpace(header), "-")
+
+  if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+    return Span{}, errors.New("traceparent is malformed")
+  } else if parts[0] == "00" && len(parts) != 4 {
+    return Span{}, errors.New("traceparent is malformed")
+  }
+
+  trace, span, flags := parts[1], parts[2], parts[3]
+
+  if ! isTraceId(trace, 32) || ! isTraceId(span, 16) || len(flags) != 2 {
+    return Span{}, errors.New("traceparent is malformed")
+  }
+
+  sampled, err := hex.DecodeString(flags)
+  if err != nil {
+    return Span{}, errors.New("traceparent is malformed")
+  }
+
+  return Span{
+    TraceId: trace,
+    SpanId: span,
+    Sampled: sampled[0] & 1 == 1,
+  }, nil
+}
+
+/*! \brief Check if an id of traceparent is valid
+ *
+ *  \param id: the id
+ *  \param size: the number of hex digits
+ *  \return bool: true if it's lowercase hex and not all zero
+ */
+func isTraceId(id string, size int) bool {
+  if len(id) != size || id == strings.Repeat("0", size) {
+    return false
+  }
+
+  for _, digit := range id {
+    if ! ('0' <= digit && digit <= '9') && ! ('a' <= digit && digit <= 'f') {
+      return false
+    }
+  }
+
+  return true
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+  srv "dev.io/cloud/utils"
+
+  "github.com/golang-jwt/jwt/v4"
+
+  "net/http/httptest"
+  "encoding/base64"
+  "crypto/rand"
+  "crypto/rsa"
+  "io/ioutil"
+  "math/big"
+  "net/http"
+  "strings"
+  "testing"
+  "time"
+  "fmt"
+  "os"
+)
+
+func writeJwks(t *testing.T, path string, keys map[string]*rsa.PublicKey) {
+  encode := base64.RawURLEncoding.EncodeToString
+  items := []string{}
+
+  for kid, key := range keys {
+    items = append(items, fmt.Sprintf(`{"kid": %q, "kty": "RSA", "use": "sig", "n": %q, "e": %q}`,
+                                      kid, encode(key.N.Bytes()),
+                                      encode(big.NewInt(int64(key.E)).Bytes())))
+  }
+
+  data := fmt.Sprintf(`{"keys": [%s]}`, strings.Join(items, ","))
+
+  if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+    t.Fatal("can't write jwks: ", err.Error())
+  }
+}
+
+func sign(t *testing.T, method jwt.SigningMethod, kid string, key interface{},
+          claims jwt.MapClaims) string {
+  token := jwt.NewWithClaims(method, claims)
+
+  if len(kid) > 0 {
+    token.Header["kid"] = kid
+  }
+
+  ret, err := token.SignedString(key)
+  if err != nil {
+    t.Fatal("can't sign token: ", err.Error())
+  }
+
+  return ret
+}
+
+func whoami(api *srv.ApiServer, path string, prepare func(*http.Request)) (int, string) {
+  w := httptest.NewRecorder()
+  r := httptest.NewRequest("GET", path, nil)
+
+  prepare(r)
+  api.ServeHTTP(w, r)
+  return w.Code, w.Body.String()
+}
+
+func TestAuthenticators(t *testing.T) {
+  t.Parallel()
+
+  dir, err := ioutil.TempDir("", "jwks")
+  if err != nil {
+    t.Fatal("can't create directory: ", err.Error())
+  }
+
+  defer os.RemoveAll(dir)
+
+  first, _ := rsa.GenerateKey(rand.Reader, 2048)
+  second, _ := rsa.GenerateKey(rand.Reader, 2048)
+  secret := []byte("secret")
+  path := dir + "/jwks.json"
+
+  writeJwks(t, path, map[string]*rsa.PublicKey{"first": &first.PublicKey})
+
+  tokens := srv.NewJwtAuthenticator().Key("", secret).Expect("dev.io", "").
+                                     Refresh(time.Second)
+  if err := tokens.Jwks(path); err != nil {
+    t.Fatal("can't load jwks: ", err.Error())
+  }
+
+  api := srv.NewApiServer().Authenticate(
+    tokens,
+    srv.NewApiKeyAuthenticator("").
+      Key("k3y", srv.Principal{Name: "robot", Groups: []string{"bots"}}),
+    srv.NewBasicAuthenticator("dev").User("alice", "p4ss", "admins"))
+
+  show := func(w http.ResponseWriter, r *http.Request) {
+    if principal := srv.PrincipalOf(r.Context()); principal == nil {
+      api.Ok(w)("anonymous")
+    } else {
+      api.Ok(w)(fmt.Sprintf("%s %s %v %v", principal.Kind, principal.Name,
+                            principal.Groups, principal.Scopes))
+    }
+  }
+
+  api.Version("v1").Endpoint("me").Handle("GET", show).
+    Level(srv.AUTHENTICATED).Mock("/me")
+  api.Version("v1").Endpoint("hello").Handle("GET", show).Mock("/hello")
+
+  // @NOTE: anonymous requests only reach public endpoints
+  if code, body := whoami(api, "/v1/hello", func(r *http.Request) {}); code != 200 || ! strings.Contains(body, "anonymous") {
+    t.Errorf("receive %d %s, expect anonymous", code, body)
+  }
+
+  w := httptest.NewRecorder()
+  api.ServeHTTP(w, httptest.NewRequest("GET", "/v1/me", nil))
+
+  if w.Code != 401 {
+    t.Errorf("receive %d, expect 401", w.Code)
+  } else if challenges := w.Header()["Www-Authenticate"]; len(challenges) != 2 {
+    t.Errorf("receive challenges %v, expect Bearer and Basic", challenges)
+  }
+
+  now := time.Now()
+  cases := []struct {
+    name string
+    prepare func(*http.Request)
+    code int
+    expect string
+  }{
+    {"api key", func(r *http.Request) {
+      r.Header.Set("X-Api-Key", "k3y")
+    }, 200, "apikey robot [bots] []"},
+    {"wrong api key", func(r *http.Request) {
+      r.Header.Set("X-Api-Key", "key")
+    }, 401, ""},
+    {"basic auth", func(r *http.Request) {
+      r.SetBasicAuth("alice", "p4ss")
+    }, 200, "basic alice [admins] []"},
+    {"wrong password", func(r *http.Request) {
+      r.SetBasicAuth("alice", "pass")
+    }, 401, ""},
+    {"static key", func(r *http.Request) {
+      r.Header.Set("Authorization", "Bearer " + sign(t, jwt.SigningMethodHS256, "", secret, jwt.MapClaims{
+        "sub": "bob", "iss": "dev.io", "scope": "read write",
+      }))
+    }, 200, "jwt bob [] [read write]"},
+    {"jwks key", func(r *http.Request) {
+      r.Header.Set("Authorization", "Bearer " + sign(t, jwt.SigningMethodRS256, "first", first, jwt.MapClaims{
+        "sub": "carol", "iss": "dev.io", "groups": []string{"ops"}, "exp": now.Add(time.Minute).Unix(),
+      }))
+    }, 200, "jwt carol [ops] []"},
+    {"expired token", func(r *http.Request) {
+      r.Header.Set("Authorization", "Bearer " + sign(t, jwt.SigningMethodRS256, "first", first, jwt.MapClaims{
+        "sub": "carol", "iss": "dev.io", "exp": now.Add(-time.Minute).Unix(),
+      }))
+    }, 401, ""},
+    {"another issuer", func(r *http.Request) {
+      r.Header.Set("Authorization", "Bearer " + sign(t, jwt.SigningMethodHS256, "", secret, jwt.MapClaims{
+        "sub": "bob", "iss": "evil.io",
+      }))
+    }, 401, ""},
+    {"unknown key", func(r *http.Request) {
+      r.Header.Set("Authorization", "Bearer " + sign(t, jwt.SigningMethodRS256, "second", second, jwt.MapClaims{
+        "sub": "dave", "iss": "dev.io",
+      }))
+    }, 401, ""},
+  }
+
+  for _, item := range cases {
+    code, body := whoami(api, "/v1/me", item.prepare)
+
+    if code != item.code || ! strings.Contains(body, item.expect) {
+      t.Errorf("%s: receive %d %s, expect %d %s", item.name, code, body,
+               item.code, item.expect)
+    }
+  }
+
+  // @NOTE: keys are rotated by rewriting the jwks file
+  writeJwks(t, path, map[string]*rsa.PublicKey{
+    "first": &first.PublicKey,
+    "second": &second.PublicKey,
+  })
+  os.Chtimes(path, now.Add(time.Hour), now.Add(time.Hour))
+
+  rotated := func(r *http.Request) {
+    r.Header.Set("Authorization", "Bearer " + sign(t, jwt.SigningMethodRS256, "second", second, jwt.MapClaims{
+      "sub": "dave", "iss": "dev.io",
+    }))
+  }
+
+  // @NOTE: unknown keys don't make us check the file again and again, the
+  // rotation is seen once the interval is over
+  if code, _ := whoami(api, "/v1/me", rotated); code != 401 {
+    t.Errorf("receive %d right after rotating keys, expect 401", code)
+  }
+
+  time.Sleep(time.Second)
+
+  if code, body := whoami(api, "/v1/me", rotated); code != 200 || ! strings.Contains(body, "jwt dave") {
+    t.Errorf("receive %d %s after rotating keys, expect dave", code, body)
+  }
+
+  // @NOTE: a key removed from the file must stop being trusted even though
+  // it's still known by the authenticator
+  writeJwks(t, path, map[string]*rsa.PublicKey{"first": &first.PublicKey})
+  os.Chtimes(path, now.Add(2 * time.Hour), now.Add(2 * time.Hour))
+  time.Sleep(time.Second)
+
+  if code, _ := whoami(api, "/v1/me", rotated); code != 401 {
+    t.Errorf("receive %d for a removed key, expect 401", code)
+  }
+
+  // @NOTE: a public key is never accepted as a hmac secret
+  code, _ := whoami(api, "/v1/me", func(r *http.Request) {
+    r.Header.Set("Authorization", "Bearer " + sign(t, jwt.SigningMethodHS256, "first", []byte("first"), jwt.MapClaims{
+      "sub": "mallory", "iss": "dev.io",
+    }))
+  })
+
+  if code != 401 {
+    t.Errorf("receive %d for a confused algorithm, expect 401", code)
+  }
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+  pb "dev.io/cloud/protoc"
+  srv "dev.io/cloud/utils"
+  grpc "google.golang.org/grpc"
+
+  "google.golang.org/genproto/googleapis/rpc/errdetails"
+  "google.golang.org/grpc/codes"
+
+  "net/http/httptest"
+  "encoding/json"
+  "net/http"
+  "strings"
+  "testing"
+  "context"
+  "bytes"
+  "log"
+  "net"
+  "os"
+)
+
+type glitch struct {
+  pb.UnimplementedGatewayServiceServer
+}
+
+func (self *glitch) Version() string {
+  return "v1"
+}
+
+func (self *glitch) Listen(protocol string) (net.Listener, error) {
+  return nil, nil
+}
+
+func (self *glitch) New(srv *grpc.Server) error {
+  pb.RegisterGatewayServiceServer(srv, self)
+  return nil
+}
+
+func (self *glitch) OnServing(protocol string) error {
+  return nil
+}
+
+func (self *glitch) OnStopping() {
+}
+
+func (self *glitch) Ping(ctx context.Context, in *pb.GatewayRequest) (*pb.GatewayResponse, error) {
+  return nil, srv.NewError(codes.FailedPrecondition, "stock is empty",
+                           &errdetails.ErrorInfo{Reason: "EMPTY_STOCK"})
+}
+
+type fixer struct {
+  sock int
+}
+
+func (self *fixer) Version() string {
+  return "v1"
+}
+
+func (self *fixer) Socket() int {
+  return self.sock
+}
+
+func (self *fixer) New(conn *grpc.ClientConn) error {
+  return nil
+}
+
+func (self *fixer) OnConnecting(protocol string) error {
+  return nil
+}
+
+func (self *fixer) OnConnected(sock int) error {
+  self.sock = sock
+  return nil
+}
+
+func (self *fixer) OnBroken(sock int) error {
+  return nil
+}
+
+func (self *fixer) OnDisconnecting() {
+}
+
+type failure struct {
+  Code int `json:"code"`
+  Data json.RawMessage `json:"data"`
+  RequestId string `json:"request_id"`
+}
+
+func failureOf(t *testing.T, api *srv.ApiServer, path string) (int, failure) {
+  var ret failure
+
+  w := httptest.NewRecorder()
+  api.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+
+  if err := json.Unmarshal(w.Body.Bytes(), &ret); err != nil {
+    t.Fatalf("%s: can't decode %s: %s", path, w.Body.String(), err.Error())
+  }
+
+  return w.Code, ret
+}
+
+func TestRecoverPanics(t *testing.T) {
+  output := &bytes.Buffer{}
+
+  log.SetOutput(output)
+  defer log.SetOutput(os.Stderr)
+
+  api := srv.NewApiServer()
+  api.Version("v1").Endpoint("crash").Handle("GET",
+    func(w http.ResponseWriter, r *http.Request) {
+      var orders map[string]int
+      orders["lost"] = 1
+    }).Mock("/crash")
+
+  api.Version("v1").Endpoint("missing").Handle("GET",
+    func(w http.ResponseWriter, r *http.Request) {
+      panic(srv.NewError(codes.NotFound, "order 42 doesn't exist"))
+    }).Mock("/missing")
+
+  api.Version("v1").Endpoint("partial").Handle("GET",
+    func(w http.ResponseWriter, r *http.Request) {
+      w.WriteHeader(202)
+      w.Write([]byte("{\"code\": 202"))
+      panic("lost the rest of the body")
+    }).Mock("/partial")
+
+  status, body := failureOf(t, api, "/v1/crash")
+
+  if status != 500 || body.Code != 500 || len(body.RequestId) == 0 {
+    t.Errorf("receive %d %v, expect 500 with a request id", status, body)
+  } else if ! strings.Contains(output.String(), "v1/crash/GET") ||
+            ! strings.Contains(output.String(), body.RequestId) ||
+            ! strings.Contains(output.String(), "goroutine") {
+    t.Errorf("log %s, expect the handler, the request id and the stack",
+             output.String())
+  }
+
+  // @NOTE: the server keeps serving after a panic
+  if status, body := failureOf(t, api, "/v1/missing"); status != 404 || body.Code != 404 {
+    t.Errorf("receive %d %v, expect 404", status, body)
+  } else if string(body.Data) != "\"order 42 doesn't exist\"" {
+    t.Errorf("receive %s, expect the message", string(body.Data))
+  }
+
+  // @NOTE: routes which don't exist are failures too
+  if status, body := failureOf(t, api, "/v1/nowhere"); status != 404 || body.Code != 404 {
+    t.Errorf("receive %d %v for an unknown route, expect 404", status, body)
+  }
+
+  // @NOTE: a response which has been started isn't followed by an envelope
+  w := httptest.NewRecorder()
+  api.ServeHTTP(w, httptest.NewRequest("GET", "/v1/partial", nil))
+
+  if w.Code != 202 || w.Body.String() != "{\"code\": 202" {
+    t.Errorf("receive %d %s, expect the partial response alone", w.Code,
+             w.Body.String())
+  } else if ! strings.Contains(output.String(), "lost the rest of the body") {
+    t.Errorf("log %s, expect the panic", output.String())
+  }
+}
+
+func TestErrorsAcrossHttpAndRpc(t *testing.T) {
+  t.Parallel()
+
+  ctx := srv.NewGRpcContext()
+  cli := &fixer{sock: -1}
+
+  if err := ctx.Prefer("memory"); err != nil {
+    t.Fatal("can't prefer memory: ", err.Error())
+  } else if _, err := ctx.Start(&glitch{}, "memory"); err != nil {
+    t.Fatal("can't serve glitch: ", err.Error())
+  } else if err := ctx.Connect(cli); err != nil {
+    t.Fatal("can't connect glitch: ", err.Error())
+  }
+
+  defer ctx.StopAll(context.Background())
+  defer ctx.Disconnect(cli)
+
+  // @NOTE: errors of grpc methods keep their code, message and details
+  err := ctx.Invoke(context.Background(), cli, "/internal.GatewayService/Ping",
+                    &pb.GatewayRequest{}, &pb.GatewayResponse{})
+  reason := srv.ErrorOf(err)
+
+  if reason == nil || reason.Code != codes.FailedPrecondition ||
+     reason.Message != "stock is empty" || len(reason.Details) != 1 {
+    t.Fatalf("receive %v, expect FailedPrecondition with details", err)
+  } else if info, ok := reason.Details[0].(*errdetails.ErrorInfo); ! ok || info.Reason != "EMPTY_STOCK" {
+    t.Errorf("receive detail %v, expect EMPTY_STOCK", reason.Details[0])
+  }
+
+  api := srv.NewApiServer()
+  api.Version("v1").Endpoint("stock").HandleErr("GET",
+    func(w http.ResponseWriter, r *http.Request) error {
+      return ctx.Invoke(r.Context(), cli, "/internal.GatewayService/Ping",
+                        &pb.GatewayRequest{}, &pb.GatewayResponse{})
+    }).Mock("/stock")
+
+  var data struct {
+    Message string `json:"message"`
+    Details []map[string]interface{} `json:"details"`
+  }
+
+  status, body := failureOf(t, api, "/v1/stock")
+
+  if status != 400 || body.Code != 400 {
+    t.Errorf("receive status %d and code %d, expect 400", status, body.Code)
+  } else if err := json.Unmarshal(body.Data, &data); err != nil {
+    t.Errorf("can't decode %s: %s", string(body.Data), err.Error())
+  } else if data.Message != "stock is empty" || len(data.Details) != 1 {
+    t.Errorf("receive %s, expect the message and its details", string(body.Data))
+  } else if data.Details[0]["@type"] != "type.googleapis.com/google.rpc.ErrorInfo" ||
+            data.Details[0]["reason"] != "EMPTY_STOCK" {
+    t.Errorf("receive detail %v, expect EMPTY_STOCK", data.Details[0])
+  }
+
+  // @NOTE: errors of contexts are understood too
+  if reason := srv.ErrorOf(context.DeadlineExceeded); reason.Status() != 504 {
+    t.Errorf("receive %v, expect DeadlineExceeded", reason)
+  } else if srv.ErrorOf(nil) != nil {
+    t.Errorf("nil becomes an error")
+  }
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+  pb "dev.io/cloud/protoc"
+  srv "dev.io/cloud/utils"
+  grpc "google.golang.org/grpc"
+
+  "google.golang.org/grpc/status"
+  "google.golang.org/grpc/codes"
+
+  "net/http/httptest"
+  "encoding/json"
+  "strings"
+  "testing"
+  "context"
+  "errors"
+  "fmt"
+  "net"
+)
+
+type registry struct {
+  pb.UnimplementedGatewayServiceServer
+}
+
+func (self *registry) Version() string {
+  return "v1"
+}
+
+func (self *registry) Listen(protocol string) (net.Listener, error) {
+  if protocol != "memory" {
+    return nil, errors.New(fmt.Sprintf("don't support %s", protocol))
+  }
+
+  return nil, nil
+}
+
+func (self *registry) New(srv *grpc.Server) error {
+  pb.RegisterGatewayServiceServer(srv, self)
+  return nil
+}
+
+func (self *registry) OnServing(protocol string) error {
+  return nil
+}
+
+func (self *registry) OnStopping() {
+}
+
+func (self *registry) Register(ctx context.Context, in *pb.RegisterRequest) (*pb.RegisterResponse, error) {
+  if len(in.Backend) == 0 {
+    return nil, status.Error(codes.InvalidArgument, "backend is empty")
+  }
+
+  return &pb.RegisterResponse{Lease: in.Backend, Ttl: in.Ttl}, nil
+}
+
+func (self *registry) Renew(ctx context.Context, in *pb.RenewRequest) (*pb.RenewResponse, error) {
+  return nil, status.Error(codes.NotFound, "lease not found")
+}
+
+type envelope struct {
+  Code int `json:"code"`
+  Data interface{} `json:"data"`
+}
+
+func post(api *srv.ApiServer, path, body string) (*envelope, error) {
+  ret := &envelope{}
+  w := httptest.NewRecorder()
+  r := httptest.NewRequest("POST", path, strings.NewReader(body))
+
+  api.GetMuxer().ServeHTTP(w, r)
+
+  if err := json.Unmarshal(w.Body.Bytes(), ret); err != nil {
+    return nil, errors.New(fmt.Sprintf("%s: %s", err.Error(), w.Body.String()))
+  }
+
+  return ret, nil
+}
+
+func TestTranscodeGateway(t *testing.T) {
+  rpc := srv.NewGRpcContext()
+  rpc.Prefer("memory")
+
+  if _, err := rpc.Start(&registry{}, "memory"); err != nil {
+    t.Fatal("can't start serving: ", err.Error())
+  }
+
+  defer rpc.StopAll(context.Background())
+
+  api := srv.NewApiServer()
+  gw := srv.NewGateway(api, rpc)
+
+  if err := gw.Connect("v1"); err != nil {
+    t.Fatal("can't connect gateway: ", err.Error())
+  }
+
+  api.Version("v1").
+    Endpoint("register").
+      Handle("POST", gw.Transcode("/internal.GatewayService/Register")).
+      Mock("/register/{backend}").
+    Endpoint("renew").
+      Handle("POST", gw.Transcode("/internal.GatewayService/Renew")).
+      Mock("/renew")
+
+  if resp, err := post(api, "/register/orders", `{"ttl": 30}`); err != nil {
+    t.Error("can't parse response: ", err.Error())
+  } else if resp.Code != 200 {
+    t.Error("register is failed with code: ", resp.Code)
+  } else if data, ok := resp.Data.(map[string]interface{}); ! ok {
+    t.Error("receive wrong data: ", resp.Data)
+  } else if data["lease"] != "orders" || data["ttl"] != "30" {
+    t.Error("receive wrong data: ", data)
+  }
+
+  if resp, err := post(api, "/v1/renew", `{"lease": "orders"}`); err != nil {
+    t.Error("can't parse response: ", err.Error())
+  } else if resp.Code != 404 {
+    t.Error("NotFound must be mapped to 404 but got: ", resp.Code)
+  }
+
+  if resp, err := post(api, "/register/orders", `[1, 2]`); err != nil {
+    t.Error("can't parse response: ", err.Error())
+  } else if resp.Code != 400 {
+    t.Error("malformed body must be rejected but got: ", resp.Code)
+  }
+
+  // @NOTE: messages of errors quote the wrong value, the envelope must
+  // still be valid json
+  if resp, err := post(api, "/register/orders", `{"ttl": "thirty"}`); err != nil {
+    t.Error("can't parse response: ", err.Error())
+  } else if message, ok := resp.Data.(string); resp.Code != 400 || ! ok {
+    t.Errorf("receive %d %v, expect 400 with a message", resp.Code, resp.Data)
+  } else if ! strings.Contains(message, "\"thirty\"") {
+    t.Error("receive wrong message: ", message)
+  }
+
+  w := httptest.NewRecorder()
+  srv.Pack(w)(500, "{not json}")
+
+  if err := json.Unmarshal(w.Body.Bytes(), &envelope{}); err != nil {
+    t.Errorf("receive %s, expect a valid envelope", w.Body.String())
+  }
+}
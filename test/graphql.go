@@ -0,0 +1,218 @@
+package main
+
+import (
+  pb "dev.io/cloud/protoc"
+  srv "dev.io/cloud/utils"
+  grpc "google.golang.org/grpc"
+
+  "github.com/graphql-go/graphql"
+  "github.com/gorilla/mux"
+
+  "net/http/httptest"
+  "encoding/json"
+  "net/http"
+  "net/url"
+  "strings"
+  "testing"
+  "context"
+  "net"
+)
+
+type pinger struct {
+  pb.UnimplementedGatewayServiceServer
+
+  pings int
+}
+
+func (self *pinger) Version() string {
+  return "v1"
+}
+
+func (self *pinger) Listen(protocol string) (net.Listener, error) {
+  return nil, nil
+}
+
+func (self *pinger) New(srv *grpc.Server) error {
+  pb.RegisterGatewayServiceServer(srv, self)
+  return nil
+}
+
+func (self *pinger) OnServing(protocol string) error {
+  return nil
+}
+
+func (self *pinger) OnStopping() {
+}
+
+func (self *pinger) Ping(ctx context.Context, in *pb.GatewayRequest) (*pb.GatewayResponse, error) {
+  self.pings += 1
+  return &pb.GatewayResponse{}, nil
+}
+
+type dashboard struct {
+  sock int
+}
+
+func (self *dashboard) Version() string {
+  return "v1"
+}
+
+func (self *dashboard) Socket() int {
+  return self.sock
+}
+
+func (self *dashboard) New(conn *grpc.ClientConn) error {
+  return nil
+}
+
+func (self *dashboard) OnConnecting(protocol string) error {
+  return nil
+}
+
+func (self *dashboard) OnConnected(sock int) error {
+  self.sock = sock
+  return nil
+}
+
+func (self *dashboard) OnBroken(sock int) error {
+  return nil
+}
+
+func (self *dashboard) OnDisconnecting() {
+}
+
+func query(api *srv.ApiServer, r *http.Request) (int, map[string]interface{}) {
+  ret := make(map[string]interface{})
+  w := httptest.NewRecorder()
+
+  api.ServeHTTP(w, r)
+  json.Unmarshal(w.Body.Bytes(), &ret)
+  return w.Code, ret
+}
+
+func TestGraphQLEndpoint(t *testing.T) {
+  t.Parallel()
+
+  api := srv.NewApiServer()
+  ctx := srv.NewGRpcContext()
+  imp := &pinger{}
+  cli := &dashboard{sock: -1}
+
+  if err := ctx.Prefer("memory"); err != nil {
+    t.Fatal("can't prefer memory: ", err.Error())
+  } else if _, err := ctx.Start(imp, "memory"); err != nil {
+    t.Fatal("can't serve pinger: ", err.Error())
+  } else if err := ctx.Connect(cli); err != nil {
+    t.Fatal("can't connect pinger: ", err.Error())
+  }
+
+  defer ctx.StopAll(context.Background())
+  defer ctx.Disconnect(cli)
+
+  api.Version("v1").Endpoint("users").
+    Handle("GET", func(w http.ResponseWriter, r *http.Request) {
+      if id := mux.Vars(r)["id"]; id == "1" {
+        api.Ok(w)(`{"id": "1", "name": "alice", "agent": "` +
+                  r.Header.Get("User-Agent") + `"}`)
+      } else {
+        api.Nok(w)(404, "user not found")
+      }
+    }).
+    Mock("/users/{id}")
+
+  user := graphql.NewObject(graphql.ObjectConfig{
+    Name: "User",
+    Fields: graphql.Fields{
+      "id": &graphql.Field{Type: graphql.String},
+      "name": &graphql.Field{Type: graphql.String},
+      "agent": &graphql.Field{Type: graphql.String},
+    },
+  })
+
+  schema, err := graphql.NewSchema(graphql.SchemaConfig{
+    Query: graphql.NewObject(graphql.ObjectConfig{
+      Name: "Query",
+      Fields: graphql.Fields{
+        "user": &graphql.Field{
+          Type: user,
+          Args: graphql.FieldConfigArgument{
+            "id": &graphql.ArgumentConfig{Type: graphql.String},
+          },
+          Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+            return api.Call(p.Context, "GET", "/v1/users/" + p.Args["id"].(string), nil)
+          },
+        },
+      },
+    }),
+    Mutation: graphql.NewObject(graphql.ObjectConfig{
+      Name: "Mutation",
+      Fields: graphql.Fields{
+        "ping": &graphql.Field{
+          Type: graphql.Boolean,
+          Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+            err := ctx.Invoke(p.Context, cli, "/internal.GatewayService/Ping",
+                              &pb.GatewayRequest{}, &pb.GatewayResponse{})
+            return err == nil, err
+          },
+        },
+      },
+    }),
+  })
+  if err != nil {
+    t.Fatal("can't build schema: ", err.Error())
+  }
+
+  api.Version("v1").Endpoint("graphql").Schema(&schema, true).Mock("/graphql")
+
+  // @NOTE: resolvers see headers of the GraphQL request
+  r := httptest.NewRequest("POST", "/v1/graphql",
+                           strings.NewReader(`{"query": "query($id: String) { user(id: $id) { name agent } }", "variables": {"id": "1"}}`))
+  r.Header.Set("User-Agent", "dashboard")
+
+  if code, resp := query(api, r); code != 200 {
+    t.Errorf("receive %d %v, expect 200", code, resp)
+  } else if data, _ := resp["data"].(map[string]interface{}); data == nil {
+    t.Errorf("receive %v, expect data", resp)
+  } else if found, _ := data["user"].(map[string]interface{}); found["name"] != "alice" || found["agent"] != "dashboard" {
+    t.Errorf("receive %v, expect alice from dashboard", data["user"])
+  }
+
+  r = httptest.NewRequest("GET", "/v1/graphql?query=" +
+                          url.QueryEscape(`{ user(id: "2") { name } }`), nil)
+
+  if code, resp := query(api, r); code != 200 || resp["errors"] == nil {
+    t.Errorf("receive %d %v, expect errors of missing user", code, resp)
+  }
+
+  // @NOTE: mutations are refused by GET but accepted by POST
+  r = httptest.NewRequest("GET", "/v1/graphql?query=" +
+                          url.QueryEscape(`mutation { ping }`), nil)
+
+  if code, _ := query(api, r); code != 405 {
+    t.Errorf("receive %d for mutation by GET, expect 405", code)
+  }
+
+  r = httptest.NewRequest("POST", "/v1/graphql", strings.NewReader(`mutation { ping }`))
+  r.Header.Set("Content-Type", "application/graphql")
+
+  if code, resp := query(api, r); code != 200 || resp["errors"] != nil {
+    t.Errorf("receive %d %v, expect 200", code, resp)
+  } else if imp.pings != 1 {
+    t.Errorf("pinger receives %d pings, expect 1", imp.pings)
+  }
+
+  r = httptest.NewRequest("POST", "/v1/graphql", strings.NewReader(`{}`))
+
+  if code, _ := query(api, r); code != 400 {
+    t.Errorf("receive %d for empty query, expect 400", code)
+  }
+
+  w := httptest.NewRecorder()
+  r = httptest.NewRequest("GET", "/v1/graphql", nil)
+  r.Header.Set("Accept", "text/html")
+  api.ServeHTTP(w, r)
+
+  if ! strings.Contains(w.Body.String(), "GraphiQL") {
+    t.Error("browser doesn't receive GraphiQL page")
+  }
+}
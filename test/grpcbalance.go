@@ -0,0 +1,434 @@
+package main
+
+import (
+  pb "dev.io/cloud/protoc"
+  srv "dev.io/cloud/utils"
+  grpc "google.golang.org/grpc"
+
+  "sync/atomic"
+  "testing"
+  "context"
+  "strings"
+  "sync"
+  "time"
+  "net"
+)
+
+type replica struct {
+  pb.UnimplementedGatewayServiceServer
+
+  listener net.Listener
+  version string
+  hits int32
+}
+
+func (self *replica) Version() string {
+  if len(self.version) == 0 {
+    return "v1"
+  }
+
+  return self.version
+}
+
+func (self *replica) Listen(protocol string) (net.Listener, error) {
+  return self.listener, nil
+}
+
+func (self *replica) New(srv *grpc.Server) error {
+  pb.RegisterGatewayServiceServer(srv, self)
+  return nil
+}
+
+func (self *replica) OnServing(protocol string) error {
+  return nil
+}
+
+func (self *replica) OnStopping() {
+}
+
+func (self *replica) Ping(ctx context.Context, in *pb.GatewayRequest) (*pb.GatewayResponse, error) {
+  atomic.AddInt32(&self.hits, 1)
+  return &pb.GatewayResponse{}, nil
+}
+
+type balancedPatron struct {
+  sock int
+  version string
+
+  // @NOTE: health stores the last health of each server
+  health map[string]bool
+  changed chan struct{}
+  lock sync.Mutex
+}
+
+func (self *balancedPatron) Version() string {
+  if len(self.version) == 0 {
+    return "v1"
+  }
+
+  return self.version
+}
+
+func (self *balancedPatron) Socket() int {
+  return self.sock
+}
+
+func (self *balancedPatron) New(conn *grpc.ClientConn) error {
+  return nil
+}
+
+func (self *balancedPatron) OnConnecting(protocol string) error {
+  return nil
+}
+
+func (self *balancedPatron) OnConnected(sock int) error {
+  self.sock = sock
+  return nil
+}
+
+func (self *balancedPatron) OnBroken(sock int) error {
+  return nil
+}
+
+func (self *balancedPatron) OnDisconnecting() {
+}
+
+func (self *balancedPatron) OnHealth(sock int, address string, healthy bool) {
+  self.lock.Lock()
+  self.health[address] = healthy
+  self.lock.Unlock()
+
+  select {
+  case self.changed <- struct{}{}:
+  default:
+  }
+}
+
+func (self *balancedPatron) await(t *testing.T, address string, healthy bool) {
+  deadline := time.After(5 * time.Second)
+
+  for {
+    self.lock.Lock()
+    current, ok := self.health[address]
+    self.lock.Unlock()
+
+    if ok && current == healthy {
+      return
+    }
+
+    select {
+    case <-self.changed:
+    case <-deadline:
+      t.Fatalf("%s never becomes healthy=%v", address, healthy)
+    }
+  }
+}
+
+func startReplicas(t *testing.T, count int) ([]*replica, []*srv.GRpcContext, []string) {
+  replicas := []*replica{}
+  contexts := []*srv.GRpcContext{}
+  addresses := []string{}
+
+  for i := 0; i < count; i++ {
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+      t.Fatal("can't listen: ", err.Error())
+    }
+
+    imp := &replica{listener: listener}
+    ctx := srv.NewGRpcContext()
+
+    if _, err := ctx.Start(imp, "tcp"); err != nil {
+      t.Fatal("can't serve replica: ", err.Error())
+    }
+
+    replicas = append(replicas, imp)
+    contexts = append(contexts, ctx)
+    addresses = append(addresses, listener.Addr().String())
+  }
+
+  return replicas, contexts, addresses
+}
+
+func connectBalanced(t *testing.T, discovery srv.Discovery, policy int,
+                     weights map[string]int) (*srv.GRpcContext, *balancedPatron) {
+  ctx := srv.NewGRpcContext()
+  cli := &balancedPatron{
+    sock: -1,
+    health: make(map[string]bool),
+    changed: make(chan struct{}, 1),
+  }
+
+  if err := ctx.Prefer("tcp"); err != nil {
+    t.Fatal("can't prefer tcp: ", err.Error())
+  } else if err := ctx.Resolve("tcp", discovery, policy); err != nil {
+    t.Fatal("can't resolve tcp: ", err.Error())
+  }
+
+  for address, weight := range weights {
+    ctx.Weigh("tcp", address, weight)
+  }
+
+  if err := ctx.Connect(cli); err != nil {
+    t.Fatal("can't connect replicas: ", err.Error())
+  }
+
+  return ctx, cli
+}
+
+func hitsOf(replicas []*replica) []int32 {
+  ret := []int32{}
+
+  for _, item := range replicas {
+    ret = append(ret, atomic.SwapInt32(&item.hits, 0))
+  }
+
+  return ret
+}
+
+func TestBalanceAcrossServers(t *testing.T) {
+  replicas, servers, addresses := startReplicas(t, 3)
+
+  for _, item := range servers {
+    defer item.StopAll(context.Background())
+  }
+
+  cases := []struct {
+    policy int
+    weights map[string]int
+    expect []int32
+  }{
+    {srv.ROUND_ROBIN, nil, []int32{10, 10, 10}},
+    {srv.LEAST_REQUEST, nil, []int32{10, 10, 10}},
+    {srv.WEIGHTED_ROUND_ROBIN,
+     map[string]int{addresses[1]: 2, addresses[2]: 3},
+     []int32{5, 10, 15}},
+    {srv.PICK_FIRST, nil, []int32{30, 0, 0}},
+  }
+
+  for _, item := range cases {
+    ctx, cli := connectBalanced(t, srv.NewStaticDiscovery(addresses...),
+                                item.policy, item.weights)
+
+    // @NOTE: every server must be ready before we count calls
+    for _, address := range addresses {
+      cli.await(t, address, true)
+    }
+
+    hitsOf(replicas)
+
+    for i := 0; i < 30; i++ {
+      if err := ctx.Invoke(context.Background(), cli,
+                           "/internal.GatewayService/Ping",
+                           &pb.GatewayRequest{}, &pb.GatewayResponse{}); err != nil {
+        t.Fatalf("policy %d: receive %v, expect OK", item.policy, err)
+      }
+    }
+
+    hits := hitsOf(replicas)
+
+    for index, expect := range item.expect {
+      if hits[index] != expect {
+        t.Errorf("policy %d: replica %d receives %d calls, expect %d",
+                 item.policy, index, hits[index], expect)
+      }
+    }
+
+    ctx.Disconnect(cli)
+  }
+
+  // @NOTE: a stopped server is reported and its calls move to the next one
+  ctx, cli := connectBalanced(t, srv.NewStaticDiscovery(addresses...),
+                              srv.PICK_FIRST, nil)
+  defer ctx.Disconnect(cli)
+
+  cli.await(t, addresses[0], true)
+  servers[0].StopAll(context.Background())
+  cli.await(t, addresses[0], false)
+
+  hitsOf(replicas)
+
+  if err := ctx.Invoke(context.Background(), cli,
+                       "/internal.GatewayService/Ping",
+                       &pb.GatewayRequest{}, &pb.GatewayResponse{}); err != nil {
+    t.Errorf("receive %v after the first server stops, expect OK", err)
+  } else if hits := hitsOf(replicas); hits[0] != 0 || hits[1] + hits[2] != 1 {
+    t.Errorf("replicas receive %v, expect the call on another server", hits)
+  }
+}
+
+func TestBalanceMixedVersions(t *testing.T) {
+  t.Parallel()
+
+  addresses := []string{}
+  replicas := []*replica{}
+
+  // @NOTE: a rollout has servers of two minor versions and a server which
+  // isn't hosted by GRpcContext at all
+  for _, version := range []string{"v1.1", "v1.2", ""} {
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+      t.Fatal("can't listen: ", err.Error())
+    }
+
+    imp := &replica{listener: listener, version: version}
+
+    if len(version) == 0 {
+      server := grpc.NewServer()
+
+      imp.New(server)
+      go server.Serve(listener)
+      defer server.Stop()
+    } else {
+      ctx := srv.NewGRpcContext()
+
+      if _, err := ctx.Start(imp, "tcp"); err != nil {
+        t.Fatal("can't serve replica: ", err.Error())
+      }
+
+      defer ctx.StopAll(context.Background())
+    }
+
+    addresses = append(addresses, listener.Addr().String())
+    replicas = append(replicas, imp)
+  }
+
+  ctx := srv.NewGRpcContext()
+  cli := &balancedPatron{
+    sock: -1,
+    version: "v1.1",
+    health: make(map[string]bool),
+    changed: make(chan struct{}, 1),
+  }
+
+  ctx.Prefer("tcp")
+  ctx.Resolve("tcp", srv.NewStaticDiscovery(addresses...), srv.ROUND_ROBIN)
+
+  if err := ctx.Connect(cli); err != nil {
+    t.Fatal("can't connect replicas: ", err.Error())
+  }
+
+  defer ctx.Disconnect(cli)
+
+  for _, address := range addresses {
+    cli.await(t, address, true)
+  }
+
+  for i := 0; i < 6; i++ {
+    if err := ctx.Invoke(context.Background(), cli,
+                         "/internal.GatewayService/Ping",
+                         &pb.GatewayRequest{}, &pb.GatewayResponse{}); err != nil {
+      t.Fatalf("receive %v, expect every server to serve v1.1", err)
+    }
+  }
+
+  if hits := hitsOf(replicas); hits[0] != 2 || hits[1] != 2 || hits[2] != 2 {
+    t.Errorf("replicas receive %v, expect 2 calls each", hits)
+  }
+
+  for index, expected := range []string{"v1.1", "v1.2", ""} {
+    if version, err := ctx.NegotiatedWith(cli, addresses[index]); err != nil || version != expected {
+      t.Errorf("%s negotiates %s %v, expect %s", addresses[index], version,
+               err, expected)
+    }
+  }
+
+  if _, err := ctx.Negotiated(cli); err == nil {
+    t.Error("servers with different versions must be reported")
+  }
+}
+
+func TestHeadlessDiscovery(t *testing.T) {
+  t.Parallel()
+
+  addresses, err := srv.NewHeadlessDiscovery("localhost", "50051").Resolve()
+  if err != nil {
+    t.Fatal("can't resolve localhost: ", err.Error())
+  }
+
+  for _, address := range addresses {
+    if ! strings.HasSuffix(address, ":50051") {
+      t.Errorf("receive %s, expect port 50051", address)
+    }
+  }
+
+  if len(addresses) == 0 {
+    t.Errorf("localhost doesn't have any address")
+  }
+}
+
+func TestDisconnectWhileInvoking(t *testing.T) {
+  _, servers, addresses := startReplicas(t, 1)
+  defer servers[0].StopAll(context.Background())
+
+  ctx := srv.NewGRpcContext()
+  ctx.Prefer("tcp")
+  ctx.Resolve("tcp", srv.NewStaticDiscovery(addresses...), srv.ROUND_ROBIN)
+
+  clients := []*balancedPatron{}
+
+  for i := 0; i < 3; i++ {
+    cli := &balancedPatron{
+      sock: -1,
+      health: make(map[string]bool),
+      changed: make(chan struct{}, 1),
+    }
+
+    if err := ctx.Connect(cli); err != nil {
+      t.Fatal("can't connect replica: ", err.Error())
+    }
+
+    clients = append(clients, cli)
+  }
+
+  last := clients[2]
+  defer ctx.Disconnect(last)
+
+  // @NOTE: the last invent keeps calling while others disconnect, its
+  // connection must never be closed or replaced by theirs
+  done := make(chan struct{})
+  failures := make(chan error, 1)
+
+  go func() {
+    defer close(failures)
+
+    for {
+      select {
+      case <-done:
+        return
+      default:
+      }
+
+      if err := ctx.Invoke(context.Background(), last,
+                           "/internal.GatewayService/Ping",
+                           &pb.GatewayRequest{}, &pb.GatewayResponse{}); err != nil {
+        failures <- err
+        return
+      }
+    }
+  }()
+
+  for _, cli := range clients[:2] {
+    if err := ctx.Disconnect(cli); err != nil {
+      t.Error("can't disconnect: ", err.Error())
+    }
+  }
+
+  close(done)
+
+  if err := <-failures; err != nil {
+    t.Errorf("receive %v while others disconnect, expect OK", err)
+  }
+
+  if err := ctx.Invoke(context.Background(), clients[0],
+                       "/internal.GatewayService/Ping",
+                       &pb.GatewayRequest{}, &pb.GatewayResponse{}); err == nil {
+    t.Error("invoke through a disconnected invent must be failed")
+  } else if err := ctx.Disconnect(clients[1]); err == nil {
+    t.Error("disconnect twice must be failed")
+  } else if err := ctx.Invoke(context.Background(), last,
+                              "/internal.GatewayService/Ping",
+                              &pb.GatewayRequest{}, &pb.GatewayResponse{}); err != nil {
+    t.Errorf("receive %v after others disconnect, expect OK", err)
+  }
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+  pb "dev.io/cloud/protoc"
+  srv "dev.io/cloud/utils"
+  grpc "google.golang.org/grpc"
+
+  "google.golang.org/genproto/googleapis/rpc/errdetails"
+  "google.golang.org/grpc/metadata"
+  "google.golang.org/grpc/status"
+  "google.golang.org/grpc/codes"
+
+  "testing"
+  "context"
+  "time"
+  "net"
+)
+
+type turnstile struct {
+  pb.UnimplementedGatewayServiceServer
+
+  // @NOTE: gate holds calls until the test releases them, entered tells the
+  // test that a call is held
+  gate, entered chan struct{}
+}
+
+func (self *turnstile) Version() string {
+  return "v1"
+}
+
+func (self *turnstile) Listen(protocol string) (net.Listener, error) {
+  return nil, nil
+}
+
+func (self *turnstile) New(srv *grpc.Server) error {
+  pb.RegisterGatewayServiceServer(srv, self)
+  return nil
+}
+
+func (self *turnstile) OnServing(protocol string) error {
+  return nil
+}
+
+func (self *turnstile) OnStopping() {
+}
+
+func (self *turnstile) Ping(ctx context.Context, in *pb.GatewayRequest) (*pb.GatewayResponse, error) {
+  if self.gate != nil {
+    self.entered <- struct{}{}
+    <-self.gate
+  }
+
+  return &pb.GatewayResponse{}, nil
+}
+
+type visitor struct {
+  sock int
+}
+
+func (self *visitor) Version() string {
+  return "v1"
+}
+
+func (self *visitor) Socket() int {
+  return self.sock
+}
+
+func (self *visitor) New(conn *grpc.ClientConn) error {
+  return nil
+}
+
+func (self *visitor) OnConnecting(protocol string) error {
+  return nil
+}
+
+func (self *visitor) OnConnected(sock int) error {
+  self.sock = sock
+  return nil
+}
+
+func (self *visitor) OnBroken(sock int) error {
+  return nil
+}
+
+func (self *visitor) OnDisconnecting() {
+}
+
+func serveTurnstile(t *testing.T, limiter *srv.RpcLimiter, imp *turnstile,
+                    keys *srv.ApiKeyAuthenticator) (*srv.GRpcContext, *visitor) {
+  ctx := srv.NewGRpcContext()
+  cli := &visitor{sock: -1}
+
+  // @NOTE: keys are authenticated before the limiter reads their principal
+  if keys != nil {
+    ctx.Intercept(keys.Interceptors())
+  }
+
+  ctx.Intercept(limiter.Interceptors())
+
+  if err := ctx.Prefer("memory"); err != nil {
+    t.Fatal("can't prefer memory: ", err.Error())
+  } else if _, err := ctx.Start(imp, "memory"); err != nil {
+    t.Fatal("can't serve turnstile: ", err.Error())
+  } else if err := ctx.Connect(cli); err != nil {
+    t.Fatal("can't connect turnstile: ", err.Error())
+  }
+
+  return ctx, cli
+}
+
+func ping(ctx *srv.GRpcContext, cli *visitor, key string) error {
+  call := context.Background()
+
+  if len(key) > 0 {
+    call = metadata.AppendToOutgoingContext(call, "x-api-key", key)
+  }
+
+  return ctx.Invoke(call, cli, "/internal.GatewayService/Ping",
+                    &pb.GatewayRequest{}, &pb.GatewayResponse{})
+}
+
+func TestRpcRateLimits(t *testing.T) {
+  t.Parallel()
+
+  // @NOTE: rates are tiny so buckets are never refilled during the test
+  limiter := srv.NewRpcLimiter().
+    Limit("*", srv.RateLimit{Rate: 0.01, Burst: 3}).
+    Limit("/internal.GatewayService/Ping",
+          srv.RateLimit{Rate: 0.01, Burst: 1, By: srv.LIMIT_BY_APIKEY})
+
+  keys := srv.NewApiKeyAuthenticator("")
+
+  for _, name := range []string{"alice", "bob", "carol", "dave"} {
+    keys.Key(name, srv.Principal{Name: name})
+  }
+
+  ctx, cli := serveTurnstile(t, limiter, &turnstile{}, keys)
+  defer ctx.StopAll(context.Background())
+  defer ctx.Disconnect(cli)
+
+  if err := ping(ctx, cli, "alice"); err != nil {
+    t.Fatal("can't ping: ", err.Error())
+  }
+
+  err := ping(ctx, cli, "alice")
+  if code := status.Code(err); code != codes.ResourceExhausted {
+    t.Fatalf("receive %v for the second ping of alice, expect ResourceExhausted",
+             code)
+  }
+
+  retried := false
+
+  for _, detail := range status.Convert(err).Details() {
+    if info, ok := detail.(*errdetails.RetryInfo); ok {
+      wait := info.RetryDelay.AsDuration()
+      retried = wait > 90 * time.Second && wait <= 100 * time.Second
+    }
+  }
+
+  if ! retried {
+    t.Errorf("receive %v, expect a retry delay of 100 seconds", err)
+  }
+
+  // @NOTE: bob has his own key bucket but everyone shares the bucket of "*",
+  // the refused ping of alice doesn't cost it a token so two are left
+  if err := ping(ctx, cli, "bob"); err != nil {
+    t.Errorf("receive %v for bob, expect OK", err)
+  } else if err := ping(ctx, cli, "carol"); err != nil {
+    t.Errorf("receive %v for carol, expect OK", err)
+  } else if code := status.Code(ping(ctx, cli, "dave")); code != codes.ResourceExhausted {
+    t.Errorf("receive %v when the shared bucket is empty, expect ResourceExhausted",
+             code)
+  }
+
+  // @NOTE: unknown keys are refused, they never reach the limiter
+  if code := status.Code(ping(ctx, cli, "mallory")); code != codes.Unauthenticated {
+    t.Errorf("receive %v for an unknown key, expect Unauthenticated", code)
+  }
+}
+
+func TestRpcRateLimitsOfUnknownKeys(t *testing.T) {
+  t.Parallel()
+
+  // @NOTE: without an authenticator keys don't own a bucket, changing them
+  // doesn't refill the bucket of the caller
+  limiter := srv.NewRpcLimiter().
+    Limit("*", srv.RateLimit{Rate: 0.01, Burst: 1, By: srv.LIMIT_BY_APIKEY})
+
+  ctx, cli := serveTurnstile(t, limiter, &turnstile{}, nil)
+  defer ctx.StopAll(context.Background())
+  defer ctx.Disconnect(cli)
+
+  if err := ping(ctx, cli, "k1"); err != nil {
+    t.Errorf("receive %v for an unknown key, expect OK", err)
+  } else if code := status.Code(ping(ctx, cli, "k2")); code != codes.ResourceExhausted {
+    t.Errorf("receive %v for another unknown key, expect ResourceExhausted", code)
+  }
+}
+
+func TestRpcConcurrency(t *testing.T) {
+  t.Parallel()
+
+  imp := &turnstile{gate: make(chan struct{}), entered: make(chan struct{}, 1)}
+  limiter := srv.NewRpcLimiter().Concurrency(1)
+
+  ctx, cli := serveTurnstile(t, limiter, imp, nil)
+  defer ctx.StopAll(context.Background())
+  defer ctx.Disconnect(cli)
+
+  done := make(chan error)
+  go func() {
+    done <- ping(ctx, cli, "")
+  }()
+
+  // @NOTE: wait until the first call holds the only slot
+  <-imp.entered
+
+  if code := status.Code(ping(ctx, cli, "")); code != codes.ResourceExhausted {
+    t.Errorf("receive %v while the first call is in flight, expect ResourceExhausted",
+             code)
+  }
+
+  close(imp.gate)
+
+  if err := <-done; err != nil {
+    t.Errorf("receive %v for the first call, expect OK", err)
+  } else if err := ping(ctx, cli, ""); err != nil {
+    t.Errorf("receive %v after the slot is released, expect OK", err)
+  }
+
+  // @NOTE: sequential calls never keep more than one slot busy, so an
+  // adaptive limiter must not grow far beyond that
+  adaptive := srv.NewRpcLimiter().Adaptive(1, 64)
+  other, visiting := serveTurnstile(t, adaptive, &turnstile{}, nil)
+  defer other.StopAll(context.Background())
+  defer other.Disconnect(visiting)
+
+  for i := 0; i < 50; i++ {
+    if err := ping(other, visiting, ""); err != nil {
+      t.Fatalf("receive %v from the adaptive limiter, expect OK", err)
+    }
+  }
+
+  if capacity := adaptive.Capacity(); capacity < 1 || capacity > 2 {
+    t.Errorf("adaptive limiter grows to %d while idle, expect at most 2", capacity)
+  }
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+  pb "dev.io/cloud/protoc"
+  srv "dev.io/cloud/utils"
+  grpc "google.golang.org/grpc"
+
+  "google.golang.org/grpc/status"
+  "google.golang.org/grpc/codes"
+
+  "sync/atomic"
+  "testing"
+  "context"
+  "time"
+  "net"
+)
+
+type flaky struct {
+  pb.UnimplementedGatewayServiceServer
+
+  // @NOTE: answer decides the result of each call from its number
+  answer func(ctx context.Context, call int32) error
+  calls int32
+}
+
+func (self *flaky) Version() string {
+  return "v1"
+}
+
+func (self *flaky) Listen(protocol string) (net.Listener, error) {
+  return nil, nil
+}
+
+func (self *flaky) New(srv *grpc.Server) error {
+  pb.RegisterGatewayServiceServer(srv, self)
+  return nil
+}
+
+func (self *flaky) OnServing(protocol string) error {
+  return nil
+}
+
+func (self *flaky) OnStopping() {
+}
+
+func (self *flaky) Ping(ctx context.Context, in *pb.GatewayRequest) (*pb.GatewayResponse, error) {
+  if err := self.answer(ctx, atomic.AddInt32(&self.calls, 1)); err != nil {
+    return nil, err
+  }
+
+  return &pb.GatewayResponse{}, nil
+}
+
+type patron struct {
+  sock int
+  broken int32
+}
+
+func (self *patron) Version() string {
+  return "v1"
+}
+
+func (self *patron) Socket() int {
+  return self.sock
+}
+
+func (self *patron) New(conn *grpc.ClientConn) error {
+  return nil
+}
+
+func (self *patron) OnConnecting(protocol string) error {
+  return nil
+}
+
+func (self *patron) OnConnected(sock int) error {
+  self.sock = sock
+  return nil
+}
+
+func (self *patron) OnBroken(sock int) error {
+  atomic.AddInt32(&self.broken, 1)
+  return nil
+}
+
+func (self *patron) OnDisconnecting() {
+}
+
+func serveFlaky(t *testing.T, imp *flaky) (*srv.GRpcContext, *patron) {
+  ctx := srv.NewGRpcContext()
+  cli := &patron{sock: -1}
+
+  if err := ctx.Prefer("memory"); err != nil {
+    t.Fatal("can't prefer memory: ", err.Error())
+  } else if _, err := ctx.Start(imp, "memory"); err != nil {
+    t.Fatal("can't serve flaky: ", err.Error())
+  } else if err := ctx.Connect(cli); err != nil {
+    t.Fatal("can't connect flaky: ", err.Error())
+  }
+
+  return ctx, cli
+}
+
+func knock(ctx *srv.GRpcContext, cli *patron) error {
+  return ctx.Invoke(context.Background(), cli, "/internal.GatewayService/Ping",
+                    &pb.GatewayRequest{}, &pb.GatewayResponse{})
+}
+
+func TestRetryCalls(t *testing.T) {
+  t.Parallel()
+
+  imp := &flaky{answer: func(ctx context.Context, call int32) error {
+    switch(call) {
+      case 1, 2:
+        return status.Error(codes.Unavailable, "warming up")
+
+      case 4:
+        return status.Error(codes.NotFound, "nothing")
+
+      default:
+        return nil
+    }
+  }}
+
+  ctx, cli := serveFlaky(t, imp)
+  defer ctx.StopAll(context.Background())
+  defer ctx.Disconnect(cli)
+
+  ctx.Retry("/internal.GatewayService/", srv.RetryPolicy{
+    Attempts: 3,
+    Backoff: 10 * time.Millisecond,
+  })
+
+  if err := knock(ctx, cli); err != nil {
+    t.Errorf("receive %v, expect OK after retries", err)
+  } else if calls := atomic.LoadInt32(&imp.calls); calls != 3 {
+    t.Errorf("server receives %d calls, expect 3", calls)
+  }
+
+  // @NOTE: other codes are never retried
+  if code := status.Code(knock(ctx, cli)); code != codes.NotFound {
+    t.Errorf("receive %v, expect NotFound", code)
+  } else if calls := atomic.LoadInt32(&imp.calls); calls != 4 {
+    t.Errorf("server receives %d calls, expect 4", calls)
+  }
+}
+
+func TestHedgeCalls(t *testing.T) {
+  t.Parallel()
+
+  cancelled := make(chan struct{})
+  imp := &flaky{answer: func(ctx context.Context, call int32) error {
+    if call == 1 {
+      <-ctx.Done()
+      close(cancelled)
+      return ctx.Err()
+    }
+
+    return nil
+  }}
+
+  ctx, cli := serveFlaky(t, imp)
+  defer ctx.StopAll(context.Background())
+  defer ctx.Disconnect(cli)
+
+  ctx.Hedge("*", srv.HedgePolicy{Attempts: 2, Delay: 20 * time.Millisecond})
+
+  if err := knock(ctx, cli); err != nil {
+    t.Errorf("receive %v, expect the second copy to win", err)
+  }
+
+  select {
+  case <-cancelled:
+  case <-time.After(time.Second):
+    t.Errorf("the slow copy is never cancelled")
+  }
+}
+
+func TestCircuitBreaker(t *testing.T) {
+  t.Parallel()
+
+  var healthy int32
+
+  imp := &flaky{answer: func(ctx context.Context, call int32) error {
+    if atomic.LoadInt32(&healthy) == 0 {
+      return status.Error(codes.Unavailable, "down")
+    }
+
+    return nil
+  }}
+
+  ctx, cli := serveFlaky(t, imp)
+  defer ctx.StopAll(context.Background())
+  defer ctx.Disconnect(cli)
+
+  ctx.Break(srv.BreakerPolicy{Failures: 2, Cooldown: 50 * time.Millisecond})
+
+  for i := 0; i < 4; i++ {
+    if code := status.Code(knock(ctx, cli)); code != codes.Unavailable {
+      t.Errorf("receive %v, expect Unavailable", code)
+    }
+  }
+
+  // @NOTE: calls fail fast while the breaker is open
+  if calls := atomic.LoadInt32(&imp.calls); calls != 2 {
+    t.Errorf("server receives %d calls, expect 2", calls)
+  } else if broken := atomic.LoadInt32(&cli.broken); broken != 1 {
+    t.Errorf("OnBroken is raised %d times, expect 1", broken)
+  }
+
+  // @NOTE: a failed probe keeps the breaker open without raising OnBroken
+  time.Sleep(60 * time.Millisecond)
+  knock(ctx, cli)
+  knock(ctx, cli)
+
+  if calls := atomic.LoadInt32(&imp.calls); calls != 3 {
+    t.Errorf("server receives %d calls, expect only the probe", calls)
+  } else if broken := atomic.LoadInt32(&cli.broken); broken != 1 {
+    t.Errorf("OnBroken is raised %d times after the probe, expect 1", broken)
+  }
+
+  atomic.StoreInt32(&healthy, 1)
+  time.Sleep(60 * time.Millisecond)
+
+  for i := 0; i < 3; i++ {
+    if err := knock(ctx, cli); err != nil {
+      t.Errorf("receive %v after the server recovers, expect OK", err)
+    }
+  }
+}
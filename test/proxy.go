@@ -0,0 +1,141 @@
+package main
+
+import (
+  srv "dev.io/cloud/utils"
+
+  "net/http/httptest"
+  "io/ioutil"
+  "net/http"
+  "testing"
+  "time"
+  "fmt"
+  "os"
+)
+
+func backend(name string, code int, hits *int) *httptest.Server {
+  return httptest.NewServer(http.HandlerFunc(
+    func(w http.ResponseWriter, r *http.Request) {
+      *hits += 1
+
+      w.WriteHeader(code)
+      fmt.Fprintf(w, "%s%s", name, r.URL.Path)
+    }))
+}
+
+func fetch(api *srv.ApiServer, method, path string) (int, string) {
+  w := httptest.NewRecorder()
+  r := httptest.NewRequest(method, path, nil)
+
+  api.GetMuxer().ServeHTTP(w, r)
+  return w.Code, w.Body.String()
+}
+
+func TestProxyRoundRobin(t *testing.T) {
+  var hits [2]int
+
+  first := backend("a", 200, &hits[0])
+  defer first.Close()
+
+  second := backend("b", 200, &hits[1])
+  defer second.Close()
+
+  api := srv.NewApiServer()
+  gw := srv.NewGateway(api, srv.NewGRpcContext())
+  orders := gw.Upstream(srv.NewStaticDiscovery(first.URL, second.URL))
+
+  api.Version("v1").
+    Endpoint("orders").
+      Handle("*", orders.Forward).
+      Prefix("/orders")
+
+  responses := make(map[string]bool)
+
+  for i := 0; i < 2; i++ {
+    if code, body := fetch(api, "GET", "/orders/1"); code != 200 {
+      t.Error("proxy responds wrong code: ", code, body)
+    } else {
+      responses[body] = true
+    }
+  }
+
+  if ! responses["a/orders/1"] || ! responses["b/orders/1"] {
+    t.Error("requests aren't balanced: ", responses)
+  }
+}
+
+func TestProxyEjectAndRetry(t *testing.T) {
+  var hits [2]int
+
+  broken := backend("broken", 503, &hits[0])
+  defer broken.Close()
+
+  healthy := backend("healthy", 200, &hits[1])
+  defer healthy.Close()
+
+  api := srv.NewApiServer()
+  gw := srv.NewGateway(api, srv.NewGRpcContext())
+  orders := gw.Upstream(srv.NewStaticDiscovery(broken.URL, healthy.URL)).
+    Eject(1, time.Minute).
+    Retry(2, 0.2, 1)
+
+  api.Version("v1").
+    Endpoint("orders").
+      Handle("*", orders.Forward).
+      Prefix("/orders")
+
+  for i := 0; i < 4; i++ {
+    if code, body := fetch(api, "GET", "/v1/orders"); code != 200 {
+      t.Error("request isn't retried: ", code, body)
+    }
+  }
+
+  if hits[0] != 1 {
+    t.Error("broken upstream isn't ejected, it's hit ", hits[0], " times")
+  }
+
+  // @NOTE: POST isn't idempotent so it's never retried, ejection is disabled
+  // here so the broken upstream is picked first
+  hits[0], hits[1] = 0, 0
+
+  payments := gw.Upstream(srv.NewStaticDiscovery(broken.URL, healthy.URL)).
+    Eject(0, 0)
+
+  api.Version("v1").
+    Endpoint("payments").
+      Handle("*", payments.Forward).
+      Prefix("/payments")
+
+  if code, _ := fetch(api, "POST", "/payments"); code != 503 {
+    t.Error("POST must not be retried but got: ", code)
+  } else if hits[0] != 1 || hits[1] != 0 {
+    t.Error("POST is forwarded to wrong upstreams: ", hits)
+  }
+}
+
+func TestKubeDiscovery(t *testing.T) {
+  file, err := ioutil.TempFile("", "endpoints")
+  if err != nil {
+    t.Fatal("can't create endpoints file: ", err.Error())
+  }
+
+  defer os.Remove(file.Name())
+
+  fmt.Fprintf(file, `{
+    "kind": "Endpoints",
+    "subsets": [{
+      "addresses": [{"ip": "10.0.0.1"}, {"ip": "10.0.0.2"}],
+      "ports": [{"name": "grpc", "port": 50051}, {"name": "http", "port": 8080}]
+    }]
+  }`)
+  file.Close()
+
+  if addresses, err := srv.NewKubeDiscovery(file.Name(), "http").Resolve(); err != nil {
+    t.Error("can't resolve endpoints: ", err.Error())
+  } else if len(addresses) != 2 || addresses[0] != "10.0.0.1:8080" {
+    t.Error("resolve wrong addresses: ", addresses)
+  }
+
+  if _, err := srv.NewKubeDiscovery(file.Name(), "metrics").Resolve(); err == nil {
+    t.Error("resolve an unknown port must be failed")
+  }
+}
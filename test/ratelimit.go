@@ -0,0 +1,154 @@
+package main
+
+import (
+  srv "dev.io/cloud/utils"
+
+  "net/http/httptest"
+  "net/http"
+  "strconv"
+  "testing"
+  "errors"
+  "time"
+)
+
+type brokenStore struct {
+  takes int
+}
+
+func (self *brokenStore) Take(key string, rate float64, burst int) (time.Duration, error) {
+  self.takes += 1
+  return 0, errors.New("store is unreachable")
+}
+
+func (self *brokenStore) Refund(key string, rate float64, burst int) error {
+  return errors.New("store is unreachable")
+}
+
+func hit(api *srv.ApiServer, method, path, addr, key string) *httptest.ResponseRecorder {
+  w := httptest.NewRecorder()
+  r := httptest.NewRequest(method, path, nil)
+
+  r.RemoteAddr = addr
+  if len(key) > 0 {
+    r.Header.Set("X-Api-Key", key)
+  }
+
+  api.ServeHTTP(w, r)
+  return w
+}
+
+func TestRateLimits(t *testing.T) {
+  t.Parallel()
+
+  api := srv.NewApiServer().Authenticate(srv.NewApiKeyAuthenticator("").
+    Key("alice", srv.Principal{Name: "alice"}).
+    Key("bob", srv.Principal{Name: "bob"}))
+
+  served := func(w http.ResponseWriter, r *http.Request) {
+    api.Ok(w)("")
+  }
+
+  // @NOTE: rates are tiny so buckets are never refilled during the test
+  api.Version("v1").Limit(srv.RateLimit{Rate: 0.01, Burst: 5})
+  api.Version("v1").Endpoint("orders").
+    Handle("GET", served).
+    Handle("POST", served).
+    Limit("POST", srv.RateLimit{Rate: 0.01, Burst: 1, By: srv.LIMIT_BY_PRINCIPAL}).
+    Mock("/orders")
+  api.Version("v1").Endpoint("search").
+    Handle("GET", served).
+    Limit("*", srv.RateLimit{Rate: 0.01, Burst: 2, By: srv.LIMIT_BY_APIKEY}).
+    Mock("/search")
+
+  if w := hit(api, "POST", "/v1/orders", "10.0.0.1:1000", "alice"); w.Code != 200 {
+    t.Errorf("receive %d, expect 200", w.Code)
+  }
+
+  w := hit(api, "POST", "/v1/orders", "10.0.0.2:1000", "alice")
+  if w.Code != 429 {
+    t.Errorf("receive %d for the second post of alice, expect 429", w.Code)
+  } else if after, _ := strconv.Atoi(w.Header().Get("Retry-After")); after < 90 || after > 100 {
+    t.Errorf("receive Retry-After %s, expect 100 seconds",
+             w.Header().Get("Retry-After"))
+  }
+
+  // @NOTE: principals have their own bucket and other methods aren't
+  // limited by the bucket of POST
+  if w := hit(api, "POST", "/v1/orders", "10.0.0.1:1000", "bob"); w.Code != 200 {
+    t.Errorf("receive %d for bob, expect 200", w.Code)
+  } else if w := hit(api, "GET", "/v1/orders", "10.0.0.1:1000", "alice"); w.Code != 200 {
+    t.Errorf("receive %d for get, expect 200", w.Code)
+  }
+
+  // @NOTE: every endpoint of the version shares the bucket of each ip, this
+  // ip has 2 tokens left
+  if w := hit(api, "GET", "/v1/search", "10.0.0.1:1000", "alice"); w.Code != 200 {
+    t.Errorf("receive %d for search, expect 200", w.Code)
+  } else if w := hit(api, "GET", "/v1/search", "10.0.0.1:1000", "bob"); w.Code != 200 {
+    t.Errorf("receive %d for search, expect 200", w.Code)
+  } else if w := hit(api, "GET", "/v1/search", "10.0.0.1:1000", "bob"); w.Code != 429 {
+    t.Errorf("receive %d when version bucket is empty, expect 429", w.Code)
+  }
+
+  if w := hit(api, "GET", "/v1/search", "10.0.0.3:1000", "alice"); w.Code != 200 {
+    t.Errorf("receive %d for alice from another ip, expect 200", w.Code)
+  } else if w := hit(api, "GET", "/v1/search", "10.0.0.4:1000", "alice"); w.Code != 429 {
+    t.Errorf("receive %d when key bucket is empty, expect 429", w.Code)
+  }
+
+  // @NOTE: the last search of bob is refused by the version bucket, so the
+  // token of his key is given back
+  if w := hit(api, "GET", "/v1/search", "10.0.0.5:1000", "bob"); w.Code != 200 {
+    t.Errorf("receive %d for bob from another ip, expect 200", w.Code)
+  } else if w := hit(api, "GET", "/v1/search", "10.0.0.6:1000", "bob"); w.Code != 429 {
+    t.Errorf("receive %d when key bucket of bob is empty, expect 429", w.Code)
+  }
+
+  // @NOTE: keys are read from the header of our api key authenticator
+  custom := srv.NewApiServer().Authenticate(srv.NewApiKeyAuthenticator("X-Token").
+    Key("carol", srv.Principal{Name: "carol"}))
+
+  custom.Version("v1").Endpoint("search").
+    Handle("GET", served).
+    Limit("*", srv.RateLimit{Rate: 0.01, Burst: 1, By: srv.LIMIT_BY_APIKEY}).
+    Mock("/search")
+
+  for index, expected := range []int{200, 429} {
+    w := httptest.NewRecorder()
+    r := httptest.NewRequest("GET", "/v1/search", nil)
+
+    r.RemoteAddr = "10.0.1." + strconv.Itoa(index) + ":1000"
+    r.Header.Set("X-Token", "carol")
+    custom.ServeHTTP(w, r)
+
+    if w.Code != expected {
+      t.Errorf("receive %d for key of carol from %s, expect %d", w.Code,
+               r.RemoteAddr, expected)
+    }
+  }
+
+  // @NOTE: keys which aren't authenticated don't own a bucket, changing
+  // them doesn't refill the bucket of the ip
+  anonymous := srv.NewApiServer()
+
+  anonymous.Version("v1").Endpoint("search").
+    Handle("GET", served).
+    Limit("*", srv.RateLimit{Rate: 0.01, Burst: 1, By: srv.LIMIT_BY_APIKEY}).
+    Mock("/search")
+
+  if w := hit(anonymous, "GET", "/v1/search", "10.0.2.1:1000", "k1"); w.Code != 200 {
+    t.Errorf("receive %d for an unknown key, expect 200", w.Code)
+  } else if w := hit(anonymous, "GET", "/v1/search", "10.0.2.1:1000", "k2"); w.Code != 429 {
+    t.Errorf("receive %d for another unknown key, expect 429", w.Code)
+  }
+
+  // @NOTE: a broken store never refuses requests
+  store := &brokenStore{}
+  api.SetLimitStore(store)
+
+  if w := hit(api, "POST", "/v1/orders", "10.0.0.1:1000", "alice"); w.Code != 200 {
+    t.Errorf("receive %d with a broken store, expect 200", w.Code)
+  } else if store.takes != 2 {
+    t.Errorf("store receives %d takes, expect 2", store.takes)
+  }
+}
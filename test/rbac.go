@@ -0,0 +1,171 @@
+package main
+
+import (
+  srv "dev.io/cloud/utils"
+
+  "net/http/httptest"
+  "io/ioutil"
+  "net/http"
+  "testing"
+  "time"
+  "os"
+)
+
+const bindingsOfOrders = `
+kind: ClusterRoleBinding
+metadata:
+  name: operators
+roleRef:
+  kind: ClusterRole
+  name: reader
+subjects:
+- kind: Group
+  name: ops
+- kind: ServiceAccount
+  name: builder
+  namespace: default
+---
+kind: RoleBinding
+metadata:
+  name: carol-admin
+  namespace: v1
+roleRef:
+  kind: Role
+  name: admin
+subjects:
+- kind: User
+  name: carol
+---
+kind: RoleBinding
+metadata:
+  name: bob-admin
+  namespace: v2
+roleRef:
+  kind: Role
+  name: admin
+subjects:
+- kind: User
+  name: bob
+---
+kind: ConfigMap
+metadata:
+  name: ignored
+`
+
+func writeBindings(t *testing.T, path, data string, modified time.Time) {
+  if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+    t.Fatal("can't write bindings: ", err.Error())
+  }
+
+  os.Chtimes(path, modified, modified)
+}
+
+func call(api *srv.ApiServer, method, key string) int {
+  w := httptest.NewRecorder()
+  r := httptest.NewRequest(method, "/v1/orders", nil)
+
+  if len(key) > 0 {
+    r.Header.Set("X-Api-Key", key)
+  }
+
+  api.ServeHTTP(w, r)
+  return w.Code
+}
+
+func TestRoleBindings(t *testing.T) {
+  t.Parallel()
+
+  dir, err := ioutil.TempDir("", "rbac")
+  if err != nil {
+    t.Fatal("can't create directory: ", err.Error())
+  }
+
+  defer os.RemoveAll(dir)
+
+  path := dir + "/bindings.yaml"
+  now := time.Now()
+
+  writeBindings(t, path, bindingsOfOrders, now)
+
+  bindings, err := srv.LoadRoleBindings(path, 10 * time.Millisecond)
+  if err != nil {
+    t.Fatal("can't load bindings: ", err.Error())
+  }
+
+  defer bindings.Close()
+
+  keys := srv.NewApiKeyAuthenticator("").
+    Key("alice", srv.Principal{Name: "alice", Groups: []string{"ops"}, Scopes: []string{"orders:read"}}).
+    Key("bob", srv.Principal{Name: "bob", Scopes: []string{"orders:read"}}).
+    Key("carol", srv.Principal{Name: "carol"}).
+    Key("builder", srv.Principal{Name: "system:serviceaccount:default:builder", Scopes: []string{"orders:read"}})
+
+  api := srv.NewApiServer().Authenticate(keys).Authorize(bindings)
+  served := func(w http.ResponseWriter, r *http.Request) {
+    api.Ok(w)("")
+  }
+
+  api.Version("v1").Endpoint("orders").
+    Handle("GET", served).
+    Handle("DELETE", served).
+    Require("GET", "reader", "admin").
+    Require("DELETE", "admin").
+    Scope("GET", "orders:read").
+    Mock("/orders")
+
+  cases := []struct {
+    method, key string
+    code int
+  }{
+    {"GET", "", 401},
+    {"GET", "alice", 200},
+    {"DELETE", "alice", 403},
+    {"GET", "builder", 200},
+
+    // @NOTE: carol is admin of v1 but her credential lacks the scope
+    {"GET", "carol", 403},
+    {"DELETE", "carol", 200},
+
+    // @NOTE: bob is admin of v2 only
+    {"GET", "bob", 403},
+    {"DELETE", "bob", 403},
+  }
+
+  for _, item := range cases {
+    if code := call(api, item.method, item.key); code != item.code {
+      t.Errorf("%s by %q: receive %d, expect %d", item.method, item.key,
+               code, item.code)
+    }
+  }
+
+  // @NOTE: bindings are reloaded when the file changes
+  writeBindings(t, path, bindingsOfOrders + `
+---
+kind: ClusterRoleBinding
+metadata:
+  name: operators-admin
+roleRef:
+  kind: ClusterRole
+  name: admin
+subjects:
+- kind: Group
+  name: ops
+`, now.Add(time.Hour))
+
+  for i := 0; call(api, "DELETE", "alice") != 200; i++ {
+    if i >= 100 {
+      t.Fatal("bindings aren't reloaded")
+    }
+
+    time.Sleep(10 * time.Millisecond)
+  }
+
+  // @NOTE: a broken file never replaces good bindings
+  writeBindings(t, path, "kind: [", now.Add(2 * time.Hour))
+
+  if err := bindings.Reload(); err == nil {
+    t.Error("reload a broken file")
+  } else if code := call(api, "DELETE", "alice"); code != 200 {
+    t.Errorf("receive %d after a broken reload, expect 200", code)
+  }
+}
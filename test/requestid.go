@@ -0,0 +1,191 @@
+package main
+
+import (
+  pb "dev.io/cloud/protoc"
+  srv "dev.io/cloud/utils"
+  grpc "google.golang.org/grpc"
+
+  "net/http/httptest"
+  "encoding/json"
+  "net/http"
+  "strings"
+  "testing"
+  "context"
+  "sync"
+  "net"
+)
+
+type archivist struct {
+  pb.UnimplementedGatewayServiceServer
+
+  // @NOTE: ids stores request ids of every call in the order they come
+  ids []string
+  lock sync.Mutex
+}
+
+func (self *archivist) Version() string {
+  return "v1"
+}
+
+func (self *archivist) Listen(protocol string) (net.Listener, error) {
+  return nil, nil
+}
+
+func (self *archivist) New(srv *grpc.Server) error {
+  pb.RegisterGatewayServiceServer(srv, self)
+  return nil
+}
+
+func (self *archivist) OnServing(protocol string) error {
+  return nil
+}
+
+func (self *archivist) OnStopping() {
+}
+
+func (self *archivist) Ping(ctx context.Context, in *pb.GatewayRequest) (*pb.GatewayResponse, error) {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
+  self.ids = append(self.ids, srv.RequestIdOf(ctx))
+  return &pb.GatewayResponse{}, nil
+}
+
+func (self *archivist) last() string {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+
+  if len(self.ids) == 0 {
+    return ""
+  }
+
+  return self.ids[len(self.ids) - 1]
+}
+
+type courier struct {
+  sock int
+}
+
+func (self *courier) Version() string {
+  return "v1"
+}
+
+func (self *courier) Socket() int {
+  return self.sock
+}
+
+func (self *courier) New(conn *grpc.ClientConn) error {
+  return nil
+}
+
+func (self *courier) OnConnecting(protocol string) error {
+  return nil
+}
+
+func (self *courier) OnConnected(sock int) error {
+  self.sock = sock
+  return nil
+}
+
+func (self *courier) OnBroken(sock int) error {
+  return nil
+}
+
+func (self *courier) OnDisconnecting() {
+}
+
+func TestRequestIdAcrossHttpAndRpc(t *testing.T) {
+  t.Parallel()
+
+  ctx := srv.NewGRpcContext()
+  imp := &archivist{}
+  cli := &courier{sock: -1}
+
+  if err := ctx.Prefer("memory"); err != nil {
+    t.Fatal("can't prefer memory: ", err.Error())
+  } else if _, err := ctx.Start(imp, "memory"); err != nil {
+    t.Fatal("can't serve archivist: ", err.Error())
+  } else if err := ctx.Connect(cli); err != nil {
+    t.Fatal("can't connect archivist: ", err.Error())
+  }
+
+  defer ctx.StopAll(context.Background())
+  defer ctx.Disconnect(cli)
+
+  api := srv.NewApiServer()
+  api.Version("v1").Endpoint("books").Handle("GET",
+    func(w http.ResponseWriter, r *http.Request) {
+      err := ctx.Invoke(r.Context(), cli, "/internal.GatewayService/Ping",
+                        &pb.GatewayRequest{}, &pb.GatewayResponse{})
+      if err != nil {
+        w.WriteHeader(502)
+        api.Nok(w)(502, err.Error())
+      } else {
+        api.Nok(w)(409, "conflict")
+      }
+    }).Mock("/books")
+
+  // @NOTE: an id of the caller is kept and forwarded to grpc servers
+  w := httptest.NewRecorder()
+  r := httptest.NewRequest("GET", "/v1/books", nil)
+  r.Header.Set(srv.REQUEST_ID_HEADER, "order-42")
+  api.ServeHTTP(w, r)
+
+  var envelope struct {
+    Code int `json:"code"`
+    RequestId string `json:"request_id"`
+  }
+
+  if err := json.Unmarshal(w.Body.Bytes(), &envelope); err != nil {
+    t.Fatalf("can't decode %s: %s", w.Body.String(), err.Error())
+  } else if envelope.Code != 409 || envelope.RequestId != "order-42" {
+    t.Errorf("receive %s, expect request id order-42", w.Body.String())
+  } else if id := w.Header().Get(srv.REQUEST_ID_HEADER); id != "order-42" {
+    t.Errorf("response echoes %s, expect order-42", id)
+  } else if id := imp.last(); id != "order-42" {
+    t.Errorf("archivist receives %s, expect order-42", id)
+  }
+
+  // @NOTE: a request without a valid id gets a new one
+  w = httptest.NewRecorder()
+  r = httptest.NewRequest("GET", "/v1/books", nil)
+  r.Header.Set(srv.REQUEST_ID_HEADER, strings.Repeat("x", 256))
+  api.ServeHTTP(w, r)
+
+  if id := w.Header().Get(srv.REQUEST_ID_HEADER); len(id) != 32 {
+    t.Errorf("response echoes %s, expect a generated id", id)
+  } else if imp.last() != id {
+    t.Errorf("archivist receives %s, expect %s", imp.last(), id)
+  } else if ! strings.Contains(w.Body.String(), id) {
+    t.Errorf("receive %s, expect request id %s", w.Body.String(), id)
+  }
+
+  // @NOTE: requests which aren't routed get an id too
+  w = httptest.NewRecorder()
+  api.ServeHTTP(w, httptest.NewRequest("GET", "/v2/books", nil))
+
+  if id := w.Header().Get(srv.REQUEST_ID_HEADER); len(id) == 0 {
+    t.Errorf("404 doesn't carry any request id")
+  } else if ! strings.Contains(w.Body.String(), id) {
+    t.Errorf("receive %s, expect request id %s", w.Body.String(), id)
+  }
+
+  // @NOTE: ok responses keep their envelope as it was
+  w = httptest.NewRecorder()
+  w.Header().Set(srv.REQUEST_ID_HEADER, "order-43")
+  api.Ok(w)("")
+
+  if w.Body.String() != "{\"code\": 200, \"data\": \"\"}" {
+    t.Errorf("receive %s, expect an envelope without request id", w.Body.String())
+  }
+
+  // @NOTE: jobs could attach their own ids to grpc calls
+  err := ctx.Invoke(srv.WithRequestId(context.Background(), "job-7"), cli,
+                    "/internal.GatewayService/Ping",
+                    &pb.GatewayRequest{}, &pb.GatewayResponse{})
+  if err != nil {
+    t.Errorf("receive %v, expect OK", err)
+  } else if id := imp.last(); id != "job-7" {
+    t.Errorf("archivist receives %s, expect job-7", id)
+  }
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+  pb "dev.io/cloud/protoc"
+  srv "dev.io/cloud/utils"
+  gw "dev.io/cloud/gw"
+  grpc "google.golang.org/grpc"
+
+  "google.golang.org/grpc/status"
+  "google.golang.org/grpc/codes"
+
+  "net/http/httptest"
+  "encoding/json"
+  "net/http"
+  "net/url"
+  "strings"
+  "testing"
+  "context"
+  "time"
+  "fmt"
+)
+
+type announcer struct {
+  conn *grpc.ClientConn
+  sock int
+}
+
+func (self *announcer) Version() string {
+  return "v1"
+}
+
+func (self *announcer) Socket() int {
+  return self.sock
+}
+
+func (self *announcer) New(conn *grpc.ClientConn) error {
+  self.conn = conn
+  return nil
+}
+
+func (self *announcer) OnConnecting(protocol string) error {
+  return nil
+}
+
+func (self *announcer) OnConnected(sock int) error {
+  self.sock = sock
+  return nil
+}
+
+func (self *announcer) OnBroken(sock int) error {
+  return nil
+}
+
+func (self *announcer) OnDisconnecting() {
+}
+
+func exchange(api *srv.ApiServer, method, path, body string) (int, interface{}) {
+  var ret struct {
+    Code int `json:"code"`
+    Data interface{} `json:"data"`
+  }
+
+  w := httptest.NewRecorder()
+  api.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+
+  if err := json.Unmarshal(w.Body.Bytes(), &ret); err != nil {
+    return -1, w.Body.String()
+  }
+
+  return ret.Code, ret.Data
+}
+
+func request(api *srv.ApiServer, method, path string) (int, string) {
+  code, data := exchange(api, method, path, "")
+  return code, fmt.Sprintf("%v", data)
+}
+
+func waitFor(timeout time.Duration, check func() bool) bool {
+  for deadline := time.Now().Add(timeout); time.Now().Before(deadline); {
+    if check() {
+      return true
+    }
+
+    time.Sleep(50 * time.Millisecond)
+  }
+
+  return check()
+}
+
+func TestRegisterRoutes(t *testing.T) {
+  t.Parallel()
+
+  backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    srv.Pack(w)(200, r.Method + " " + r.URL.Path)
+  }))
+  defer backend.Close()
+
+  target, _ := url.Parse(backend.URL)
+  api := srv.NewApiServer()
+  ctx := srv.NewGRpcContext()
+  cli := &announcer{}
+
+  if err := ctx.Prefer("memory"); err != nil {
+    t.Fatal("can't prefer memory: ", err.Error())
+  }
+
+  if _, err := ctx.Start(gw.NewGateway(api, ctx), "memory"); err != nil {
+    t.Fatal("can't serve gateway: ", err.Error())
+  }
+
+  defer ctx.StopAll(context.Background())
+
+  if err := ctx.Connect(cli); err != nil {
+    t.Fatal("can't connect gateway: ", err.Error())
+  }
+
+  defer ctx.Disconnect(cli)
+
+  client := pb.NewGatewayServiceClient(cli.conn)
+  orders := &pb.Route{
+    Version: "v2",
+    Endpoint: "orders",
+    Methods: []string{"get"},
+    Path: "/orders",
+    Upstream: target.Host,
+  }
+
+  if code, _ := request(api, "GET", "/v2/orders/1"); code != 404 {
+    t.Errorf("receive %d before registering, expect 404", code)
+  }
+
+  lease, err := client.Register(context.Background(), &pb.RegisterRequest{
+    Backend: "orders",
+    Routes: []*pb.Route{orders},
+  })
+  if err != nil {
+    t.Fatal("can't register: ", err.Error())
+  }
+
+  if code, data := request(api, "GET", "/v2/orders/1"); code != 200 || data != "GET /v2/orders/1" {
+    t.Errorf("receive %d %s, expect 200 GET /v2/orders/1", code, data)
+  }
+
+  if code, _ := request(api, "POST", "/v2/orders"); code != 501 {
+    t.Errorf("receive %d for POST, expect 501", code)
+  }
+
+  // @NOTE: an endpoint can't be owned by two backends
+  _, err = client.Register(context.Background(), &pb.RegisterRequest{
+    Backend: "billing",
+    Routes: []*pb.Route{orders},
+  })
+  if status.Code(err) != codes.AlreadyExists {
+    t.Errorf("receive %v, expect AlreadyExists", err)
+  }
+
+  _, err = client.Register(context.Background(), &pb.RegisterRequest{
+    Backend: "billing",
+    Routes: []*pb.Route{{Version: "v2", Endpoint: "bills", Path: "bills"}},
+  })
+  if status.Code(err) != codes.InvalidArgument {
+    t.Errorf("receive %v, expect InvalidArgument", err)
+  }
+
+  if resp, err := client.ListRoutes(context.Background(),
+                                    &pb.ListRoutesRequest{Version: "v2"}); err != nil {
+    t.Error("can't list routes: ", err.Error())
+  } else if len(resp.Routes) != 1 || resp.Routes[0].Endpoint != "orders" {
+    t.Errorf("receive %v, expect only orders", resp.Routes)
+  }
+
+  if _, err := client.Unregister(context.Background(),
+                                 &pb.UnregisterRequest{Lease: lease.Lease}); err != nil {
+    t.Fatal("can't unregister: ", err.Error())
+  }
+
+  if code, _ := request(api, "GET", "/v2/orders/1"); code != 404 {
+    t.Errorf("receive %d after unregistering, expect 404", code)
+  }
+
+  if _, err := client.Unregister(context.Background(),
+                                 &pb.UnregisterRequest{Lease: lease.Lease}); status.Code(err) != codes.NotFound {
+    t.Errorf("receive %v, expect NotFound", err)
+  }
+}
+
+func TestExpireLease(t *testing.T) {
+  t.Parallel()
+
+  api := srv.NewApiServer()
+  gateway := gw.NewGateway(api, srv.NewGRpcContext())
+  announce := &pb.RegisterRequest{
+    Backend: "users",
+    Routes: []*pb.Route{{
+      Version: "v2",
+      Endpoint: "users",
+      Path: "/users",
+      Upstream: "localhost:1",
+    }},
+    Ttl: 1,
+  }
+
+  lease, err := gateway.Register(context.Background(), announce)
+  if err != nil {
+    t.Fatal("can't register: ", err.Error())
+  } else if lease.Ttl != 1 {
+    t.Errorf("receive ttl %d, expect 1", lease.Ttl)
+  }
+
+  time.Sleep(600 * time.Millisecond)
+
+  if _, err := gateway.Renew(context.Background(),
+                             &pb.RenewRequest{Lease: lease.Lease}); err != nil {
+    t.Fatal("can't renew: ", err.Error())
+  }
+
+  // @NOTE: the first deadline has passed but the lease has been renewed
+  time.Sleep(600 * time.Millisecond)
+
+  if resp, _ := gateway.ListRoutes(context.Background(),
+                                   &pb.ListRoutesRequest{}); len(resp.Routes) != 1 {
+    t.Fatal("lease expires although it has been renewed")
+  }
+
+  expired := waitFor(2 * time.Second, func() bool {
+    resp, _ := gateway.ListRoutes(context.Background(), &pb.ListRoutesRequest{})
+    return len(resp.Routes) == 0
+  })
+  if ! expired {
+    t.Fatal("lease doesn't expire")
+  }
+
+  if _, err := gateway.Renew(context.Background(),
+                             &pb.RenewRequest{Lease: lease.Lease}); status.Code(err) != codes.NotFound {
+    t.Errorf("receive %v, expect NotFound", err)
+  }
+
+  if code, _ := request(api, "GET", "/v2/users"); code != 404 {
+    t.Errorf("receive %d after expiring, expect 404", code)
+  }
+
+  // @NOTE: the path is free again once its lease is gone, even for another
+  // endpoint
+  people := &pb.RegisterRequest{
+    Backend: "people",
+    Routes: []*pb.Route{{
+      Version: "v2",
+      Endpoint: "people",
+      Path: "/users",
+      Upstream: "localhost:1",
+    }},
+  }
+
+  if _, err := gateway.Register(context.Background(), people); err != nil {
+    t.Error("can't register the path of an expired lease: ", err.Error())
+  }
+}
+
+func TestAdminRoutes(t *testing.T) {
+  t.Parallel()
+
+  backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    srv.Pack(w)(200, "pong")
+  }))
+  defer backend.Close()
+
+  target, _ := url.Parse(backend.URL)
+  api := srv.NewApiServer()
+  gateway := gw.NewGateway(api, srv.NewGRpcContext())
+
+  gateway.Admin("v1")
+
+  code, data := exchange(api, "POST", "/v1/routes", fmt.Sprintf(`{
+    "backend": "pinger",
+    "routes": [{"version": "v2", "endpoint": "ping", "methods": ["GET"],
+                "path": "/ping", "upstream": "%s", "level": "PUBLIC"}],
+    "ttl": 60
+  }`, target.Host))
+  if code != 200 {
+    t.Fatalf("receive %d %v, expect 200", code, data)
+  }
+
+  lease, _ := data.(map[string]interface{})["lease"].(string)
+
+  if code, data := request(api, "GET", "/v2/ping"); code != 200 || data != "pong" {
+    t.Errorf("receive %d %s, expect 200 pong", code, data)
+  }
+
+  if code, data := exchange(api, "GET", "/v1/routes?version=v2", ""); code != 200 {
+    t.Errorf("receive %d %v, expect 200", code, data)
+  } else if routes, _ := data.(map[string]interface{})["routes"].([]interface{}); len(routes) != 1 {
+    t.Errorf("receive %v, expect one route", data)
+  }
+
+  if code, _ := request(api, "PUT", "/v1/routes/" + lease); code != 200 {
+    t.Errorf("receive %d for renewing, expect 200", code)
+  }
+
+  // @NOTE: backends can't take the endpoint of admin api
+  code, _ = exchange(api, "POST", "/v1/routes", `{
+    "backend": "thief",
+    "routes": [{"version": "v1", "endpoint": "routes", "path": "/routes",
+                "upstream": "localhost:1"}]
+  }`)
+  if code != 409 {
+    t.Errorf("receive %d for stealing admin, expect 409", code)
+  }
+
+  if code, _ := request(api, "POST", "/v1/routes"); code != 400 {
+    t.Errorf("receive %d for empty body, expect 400", code)
+  }
+
+  if code, _ := request(api, "DELETE", "/v1/routes/" + lease); code != 200 {
+    t.Errorf("receive %d for unregistering, expect 200", code)
+  }
+
+  if code, _ := request(api, "DELETE", "/v1/routes/" + lease); code != 404 {
+    t.Errorf("receive %d for unregistering twice, expect 404", code)
+  }
+}
+
+func TestReplaceAndOverlapRoutes(t *testing.T) {
+  t.Parallel()
+
+  backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    srv.Pack(w)(200, r.URL.Path)
+  }))
+  defer backend.Close()
+
+  target, _ := url.Parse(backend.URL)
+  api := srv.NewApiServer()
+  gateway := gw.NewGateway(api, srv.NewGRpcContext())
+  register := func(backend string, routes ...*pb.Route) (*pb.RegisterResponse, error) {
+    return gateway.Register(context.Background(), &pb.RegisterRequest{
+      Backend: backend,
+      Routes: routes,
+    })
+  }
+  route := func(version, endpoint, path string) *pb.Route {
+    return &pb.Route{
+      Version: version,
+      Endpoint: endpoint,
+      Path: path,
+      Upstream: target.Host,
+    }
+  }
+
+  // @NOTE: versions of one backend have their own prefixes
+  stale, err := register("orders", route("v1", "orders", "/orders"),
+                         route("v2", "orders", "/orders"))
+  if err != nil {
+    t.Fatal("can't register: ", err.Error())
+  }
+
+  for _, path := range []string{"/v1/orders/1", "/v2/orders/1"} {
+    if code, data := request(api, "GET", path); code != 200 || data != path {
+      t.Errorf("receive %d %s, expect 200 %s", code, data, path)
+    }
+  }
+
+  // @NOTE: a restarted backend takes over its stale lease
+  if _, err := register("orders", route("v2", "orders", "/orders")); err != nil {
+    t.Fatal("can't register again: ", err.Error())
+  } else if _, err := gateway.Renew(context.Background(),
+                                    &pb.RenewRequest{Lease: stale.Lease}); status.Code(err) != codes.NotFound {
+    t.Errorf("receive %v for the stale lease, expect NotFound", err)
+  } else if code, _ := request(api, "GET", "/v1/orders/1"); code != 404 {
+    t.Errorf("receive %d for a route of the stale lease, expect 404", code)
+  } else if code, _ := request(api, "GET", "/v2/orders/1"); code != 200 {
+    t.Errorf("receive %d for the new lease, expect 200", code)
+  }
+
+  // @NOTE: prefixes which shadow each other are refused
+  if _, err := register("shop", route("v2", "shop", "/")); status.Code(err) != codes.AlreadyExists {
+    t.Errorf("receive %v for a catch-all prefix, expect AlreadyExists", err)
+  } else if _, err := register("shop", route("v2", "items", "/orders/items")); status.Code(err) != codes.AlreadyExists {
+    t.Errorf("receive %v for a nested prefix, expect AlreadyExists", err)
+  } else if _, err := register("shop", route("v3", "carts", "/carts"),
+                               route("v3", "cartsv2", "/cartsv2")); status.Code(err) != codes.AlreadyExists {
+    t.Errorf("receive %v for overlapping routes, expect AlreadyExists", err)
+  } else if _, err := register("shop", route("v1", "shop", "/")); err != nil {
+    t.Errorf("can't register a catch-all prefix of a free version: %s", err.Error())
+  }
+}
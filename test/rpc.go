@@ -5,20 +5,47 @@ import (
   srv "dev.io/cloud/utils"
   grpc "google.golang.org/grpc"
 
+  "google.golang.org/protobuf/types/known/wrapperspb"
+  "google.golang.org/grpc/credentials"
+  "google.golang.org/grpc/metadata"
+  "google.golang.org/grpc/status"
+  "google.golang.org/grpc/codes"
+  "google.golang.org/grpc/peer"
+
+  "crypto/elliptic"
+  "crypto/ecdsa"
+  "crypto/rand"
+  "crypto/x509"
+  "crypto/tls"
+  "math/big"
+  "strings"
   "testing"
   "errors"
   "context"
+  "time"
   "fmt"
   "net"
 )
 
 type sample struct {
+  pb.UnimplementedGatewayServiceServer
+
+  version string
   listener net.Listener
   server *grpc.Server
+  serving []string
+  stopped int
+
+  // @NOTE: failure is returned by New to simulate a broken implementer
+  failure error
 }
 
 func (self *sample) Version() string {
-  return "v1"
+  if len(self.version) == 0 {
+    return "v1"
+  }
+
+  return self.version
 }
 
 
@@ -27,33 +54,568 @@ func (self *sample) Ping(ctx context.Context, in *pb.GatewayRequest) (*pb.Gatewa
 }
 
 func (self *sample) New(srv *grpc.Server) error {
+  if self.failure != nil {
+    return self.failure
+  }
+
   self.server = srv
 
   pb.RegisterGatewayServiceServer(srv, self)
   return nil
 }
 
+func (self *sample) OnServing(protocol string) error {
+  self.serving = append(self.serving, protocol)
+  return nil
+}
+
+func (self *sample) OnStopping() {
+  self.stopped += 1
+}
+
 func (self *sample) Listen(protocol string) (net.Listener, error) {
-  if protocol != "tcp" {
-    return nil, errors.New(fmt.Sprintf("don't support %s", protocol))
-  }
+  switch(protocol) {
+    case "memory":
+      // @NOTE: use the in-memory listener of the context
+      return nil, nil
 
-  if lis, err := net.Listen("tcp", "localhost:50051"); err != nil {
-    return nil, err
-  } else {
-    self.listener = lis
-  }
+    case "tcp":
+      if lis, err := net.Listen("tcp", "localhost:0"); err != nil {
+        return nil, err
+      } else {
+        self.listener = lis
+      }
 
-  return self.listener, nil
+      return self.listener, nil
+
+    default:
+      return nil, errors.New(fmt.Sprintf("don't support %s", protocol))
+  }
 }
 
 func TestStartStopRPCServer(t *testing.T) {
   grpc.EnableTracing = true
+  t.Parallel()
 
   ctx := srv.NewGRpcContext()
   smp := &sample{}
 
-  go func() {
-    ctx.Serve(smp)
-  }()
+  serving, err := ctx.Start(smp)
+  if err != nil {
+    t.Fatal("can't start serving: ", err.Error())
+  }
+
+  if protocols := serving.Protocols(); len(protocols) != 1 || protocols[0] != "tcp" {
+    t.Error("serve on wrong protocols: ", protocols)
+  }
+
+  serving.GracefulStop()
+
+  if err := serving.Wait(); err != nil {
+    t.Error("serving is stopped with error: ", err.Error())
+  }
+}
+
+func TestStopServingImplement(t *testing.T) {
+  t.Parallel()
+
+  ctx := srv.NewGRpcContext()
+  smp := &sample{}
+
+  serving, err := ctx.Start(smp, "memory")
+  if err != nil {
+    t.Fatal("can't start serving: ", err.Error())
+  }
+
+  if len(smp.serving) != 1 || smp.serving[0] != "memory" {
+    t.Error("OnServing is raised with wrong protocols: ", smp.serving)
+  }
+
+  if err := ctx.Stop(smp); err != nil {
+    t.Error("can't stop serving: ", err.Error())
+  }
+
+  if err := serving.Wait(); err != nil {
+    t.Error("serving is stopped with error: ", err.Error())
+  }
+
+  if smp.stopped != 1 {
+    t.Error("OnStopping must be raised once but got: ", smp.stopped)
+  }
+
+  if err := ctx.Stop(smp); err == nil {
+    t.Error("stop an unserved implement must be failed")
+  }
+}
+
+func TestStartBrokenImplement(t *testing.T) {
+  t.Parallel()
+
+  ctx := srv.NewGRpcContext()
+  smp := &sample{failure: errors.New("broken")}
+
+  if _, err := ctx.Start(smp, "memory"); err == nil {
+    t.Fatal("start a broken implement must be failed")
+  }
+
+  if len(smp.serving) != 1 || smp.stopped != 1 {
+    t.Error("OnServing and OnStopping aren't balanced: ", smp.serving,
+            smp.stopped)
+  }
+
+  serving, err := ctx.Start(&sample{}, "memory")
+  if err != nil {
+    t.Fatal("can't start serving: ", err.Error())
+  }
+
+  defer ctx.StopAll(context.Background())
+
+  other := &sample{version: "v2", failure: errors.New("broken")}
+
+  if err := serving.Host(other); err == nil {
+    t.Error("host a broken implement must be failed")
+  } else if len(other.serving) != 1 || other.stopped != 1 {
+    t.Error("OnServing and OnStopping aren't balanced: ", other.serving,
+            other.stopped)
+  }
+}
+
+type rejecting struct {
+  attempts []string
+}
+
+func (self *rejecting) Version() string {
+  return "v1"
+}
+
+func (self *rejecting) Socket() int {
+  return -1
+}
+
+func (self *rejecting) New(conn *grpc.ClientConn) error {
+  return nil
+}
+
+func (self *rejecting) OnConnecting(protocol string) error {
+  self.attempts = append(self.attempts, protocol)
+  return errors.New(fmt.Sprintf("reject %s", protocol))
+}
+
+func (self *rejecting) OnConnected(sock int) error {
+  return nil
+}
+
+func (self *rejecting) OnBroken(sock int) error {
+  return nil
+}
+
+func (self *rejecting) OnDisconnecting() {
+}
+
+func TestConnectFallbackReason(t *testing.T) {
+  t.Parallel()
+
+  ctx := srv.NewGRpcContext()
+  inv := &rejecting{}
+
+  if err := ctx.Prefer("unknown"); err == nil {
+    t.Error("prefer an unsupported protocol must be failed")
+  }
+
+  if err := ctx.Prefer("tcp"); err != nil {
+    t.Error("can't prefer tcp: ", err.Error())
+  }
+
+  if err := ctx.Connect(inv); err == nil {
+    t.Error("connect must be failed when every protocol is rejected")
+  } else if failures, ok := err.(*srv.ConnectError); ! ok {
+    t.Error("expect ConnectError but got: ", err.Error())
+  } else if reason := failures.Reason("tcp"); reason == nil {
+    t.Error("can't find the reason of tcp")
+  } else if reason.Error() != "reject tcp" {
+    t.Error("receive wrong reason: ", reason.Error())
+  }
+
+  if len(inv.attempts) != 1 || inv.attempts[0] != "tcp" {
+    t.Error("protocols are tried in wrong order: ", inv.attempts)
+  }
+}
+
+type client struct {
+  version string
+  conn *grpc.ClientConn
+  sock int
+}
+
+func (self *client) Version() string {
+  return self.version
+}
+
+func (self *client) Socket() int {
+  return self.sock
+}
+
+func (self *client) New(conn *grpc.ClientConn) error {
+  self.conn = conn
+  return nil
+}
+
+func (self *client) OnConnecting(protocol string) error {
+  return nil
+}
+
+func (self *client) OnConnected(sock int) error {
+  self.sock = sock
+  return nil
+}
+
+func (self *client) OnBroken(sock int) error {
+  return nil
+}
+
+func (self *client) OnDisconnecting() {
+}
+
+func TestNegotiateVersion(t *testing.T) {
+  t.Parallel()
+
+  ctx := srv.NewGRpcContext()
+  ctx.Prefer("memory")
+
+  serving, err := ctx.Start(&sample{version: "v1.0"}, "memory", "tcp")
+  if err != nil {
+    t.Fatal("can't start serving: ", err.Error())
+  }
+
+  defer ctx.StopAll(context.Background())
+
+  if err := serving.Host(&sample{version: "v2.0"}); err != nil {
+    t.Fatal("can't host v2.0: ", err.Error())
+  }
+
+  if err := serving.Host(&sample{version: "v2.0"}); err == nil {
+    t.Error("host the same version twice must be failed")
+  }
+
+  latest := &client{version: "v2.0"}
+
+  if err := ctx.Connect(latest); err != nil {
+    t.Fatal("can't connect v2.0: ", err.Error())
+  } else if version, _ := ctx.Negotiated(latest); version != "v2.0" {
+    t.Error("v2.0 is routed to wrong version: ", version)
+  }
+
+  if err := ctx.Connect(&client{version: "v1.1"}); err == nil {
+    t.Error("v1.1 must be rejected by compatible policy")
+  }
+
+  if err := ctx.Connect(&client{version: "v3"}); err == nil {
+    t.Error("v3 must be rejected")
+  } else if failures, ok := err.(*srv.ConnectError); ! ok {
+    t.Error("expect ConnectError but got: ", err.Error())
+  } else if failures.Reason("memory") == nil {
+    t.Error("can't find the reason of memory")
+  }
+
+  // @NOTE: plain grpc clients are served by the primary version unless they
+  // send their version through metadata
+  timeout, cancel := context.WithTimeout(context.Background(), time.Second)
+  defer cancel()
+
+  conn, err := grpc.DialContext(timeout, serving.Addr("tcp").String(),
+                                grpc.WithInsecure(), grpc.WithBlock())
+  if err != nil {
+    t.Fatal("plain grpc client can't connect: ", err.Error())
+  }
+
+  defer conn.Close()
+
+  for _, expected := range []string{"v1.0", "v2.0"} {
+    var header metadata.MD
+
+    call := timeout
+    if expected != "v1.0" {
+      call = metadata.AppendToOutgoingContext(timeout,
+                                              srv.GRPC_VERSION_METADATA,
+                                              expected)
+    }
+
+    _, err := pb.NewGatewayServiceClient(conn).Ping(call, &pb.GatewayRequest{},
+                                                     grpc.Header(&header))
+    if err != nil {
+      t.Errorf("plain grpc client can't reach %s: %s", expected, err.Error())
+    } else if values := header.Get(srv.GRPC_VERSION_METADATA); len(values) == 0 || values[0] != expected {
+      t.Errorf("plain grpc client reaches %v, expect %s", values, expected)
+    }
+  }
+
+  call := metadata.AppendToOutgoingContext(timeout,
+                                           srv.GRPC_VERSION_METADATA, "v3")
+  _, err = pb.NewGatewayServiceClient(conn).Ping(call, &pb.GatewayRequest{})
+  if status.Code(err) != codes.FailedPrecondition {
+    t.Errorf("receive %v, expect v3 to be rejected", err)
+  }
+
+  ctx.SetVersionPolicy(srv.DOWNGRADE_VERSION)
+  older := &client{version: "v1.1"}
+
+  if err := ctx.Connect(older); err != nil {
+    t.Fatal("can't connect v1.1: ", err.Error())
+  } else if version, _ := ctx.Negotiated(older); version != "v1.0" {
+    t.Error("v1.1 isn't downgraded to v1.0: ", version)
+  }
+}
+
+func TestServeInMemory(t *testing.T) {
+  t.Parallel()
+
+  ctx := srv.NewGRpcContext()
+  smp := &sample{}
+  cli := &client{version: "v1"}
+
+  if err := ctx.Prefer("memory"); err != nil {
+    t.Fatal("can't prefer memory: ", err.Error())
+  }
+
+  if _, err := ctx.Start(smp, "memory"); err != nil {
+    t.Fatal("can't start serving: ", err.Error())
+  }
+
+  if err := ctx.Connect(cli); err != nil {
+    t.Fatal("can't connect in memory: ", err.Error())
+  }
+
+  _, err := pb.NewGatewayServiceClient(cli.conn).Ping(context.Background(),
+                                                       &pb.GatewayRequest{})
+  if err != nil {
+    t.Error("can't ping in memory: ", err.Error())
+  }
+
+  // @NOTE: the address is taken by the first serving, a second one mustn't
+  // steal its connections
+  if _, err := ctx.Start(&sample{}, "memory"); err == nil {
+    t.Error("serve the same memory address twice must be failed")
+  }
+
+  if err := ctx.Disconnect(cli); err != nil {
+    t.Error("can't disconnect: ", err.Error())
+  }
+
+  if err := ctx.StopAll(context.Background()); err != nil {
+    t.Error("can't stop serving: ", err.Error())
+  }
+
+  if _, err := ctx.Start(smp, "memory"); err != nil {
+    t.Error("can't serve memory again after stopping: ", err.Error())
+  } else if err := ctx.StopAll(context.Background()); err != nil {
+    t.Error("can't stop serving again: ", err.Error())
+  }
+}
+
+func TestConnectPlainServer(t *testing.T) {
+  t.Parallel()
+
+  listener, err := net.Listen("tcp", "localhost:0")
+  if err != nil {
+    t.Fatal("can't listen: ", err.Error())
+  }
+
+  // @NOTE: servers which aren't hosted by GRpcContext don't negotiate
+  // version, our clients must still reach them
+  server := grpc.NewServer()
+  pb.RegisterGatewayServiceServer(server, &sample{})
+
+  go server.Serve(listener)
+  defer server.Stop()
+
+  ctx := srv.NewGRpcContext()
+  cli := &client{version: "v2.0"}
+
+  ctx.Prefer("tcp")
+  ctx.SetTimeout("tcp", time.Second)
+
+  if err := ctx.Resolve("tcp", srv.NewStaticDiscovery(listener.Addr().String()),
+                        srv.ROUND_ROBIN); err != nil {
+    t.Fatal("can't resolve: ", err.Error())
+  } else if err := ctx.Connect(cli); err != nil {
+    t.Fatal("can't connect plain server: ", err.Error())
+  }
+
+  defer ctx.Disconnect(cli)
+
+  err = ctx.Invoke(context.Background(), cli, "/internal.GatewayService/Ping",
+                   &pb.GatewayRequest{}, &pb.GatewayResponse{})
+  if err != nil {
+    t.Error("can't ping plain server: ", err.Error())
+  } else if version, _ := ctx.Negotiated(cli); version != "" {
+    t.Error("plain server negotiates ", version)
+  }
+}
+
+// @NOTE: warden is served over tls and records the peer of its calls
+type warden struct {
+  sample
+
+  creds credentials.TransportCredentials
+  callers chan *peer.Peer
+}
+
+func (self *warden) New(srv *grpc.Server) error {
+  pb.RegisterGatewayServiceServer(srv, self)
+  return nil
+}
+
+func (self *warden) Ping(ctx context.Context, in *pb.GatewayRequest) (*pb.GatewayResponse, error) {
+  caller, _ := peer.FromContext(ctx)
+  self.callers <- caller
+  return &pb.GatewayResponse{}, nil
+}
+
+func (self *warden) TransportOptions() []grpc.ServerOption {
+  return []grpc.ServerOption{grpc.Creds(self.creds)}
+}
+
+func (self *warden) ServerOptions() []grpc.ServerOption {
+  return []grpc.ServerOption{grpc.MaxRecvMsgSize(512)}
+}
+
+func selfSignedCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+  key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+  if err != nil {
+    t.Fatal("can't generate key: ", err.Error())
+  }
+
+  template := &x509.Certificate{
+    SerialNumber: big.NewInt(1),
+    DNSNames: []string{"localhost"},
+    NotBefore: time.Now().Add(-time.Hour),
+    NotAfter: time.Now().Add(time.Hour),
+    KeyUsage: x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+    ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+    BasicConstraintsValid: true,
+    IsCA: true,
+  }
+
+  der, err := x509.CreateCertificate(rand.Reader, template, template,
+                                     &key.PublicKey, key)
+  if err != nil {
+    t.Fatal("can't create certificate: ", err.Error())
+  }
+
+  parsed, err := x509.ParseCertificate(der)
+  if err != nil {
+    t.Fatal("can't parse certificate: ", err.Error())
+  }
+
+  pool := x509.NewCertPool()
+  pool.AddCert(parsed)
+
+  return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestServeWithTransportOptions(t *testing.T) {
+  t.Parallel()
+
+  certificate, pool := selfSignedCertificate(t)
+  ctx := srv.NewGRpcContext()
+  smp := &warden{
+    creds: credentials.NewServerTLSFromCert(&certificate),
+    callers: make(chan *peer.Peer, 2),
+  }
+
+  if _, err := ctx.Start(smp, "tcp"); err != nil {
+    t.Fatal("can't start serving: ", err.Error())
+  }
+
+  defer ctx.StopAll(context.Background())
+
+  creds := credentials.NewTLS(&tls.Config{RootCAs: pool, ServerName: "localhost"})
+  conn, err := grpc.Dial(smp.listener.Addr().String(),
+                         grpc.WithTransportCredentials(creds))
+  if err != nil {
+    t.Fatal("can't dial: ", err.Error())
+  }
+
+  defer conn.Close()
+
+  // @NOTE: tls is ended by the front server, versions still see the caller
+  // with its auth info
+  _, err = pb.NewGatewayServiceClient(conn).Ping(context.Background(),
+                                                 &pb.GatewayRequest{})
+  if err != nil {
+    t.Fatal("can't ping over tls: ", err.Error())
+  } else if caller := <-smp.callers; caller == nil || caller.AuthInfo == nil {
+    t.Errorf("receive peer %v, expect its auth info", caller)
+  } else if caller.AuthInfo.AuthType() != "tls" {
+    t.Errorf("receive auth info %s, expect tls", caller.AuthInfo.AuthType())
+  } else if _, ok := caller.Addr.(*net.TCPAddr); ! ok {
+    t.Errorf("receive peer %s, expect the actual caller", caller.Addr.String())
+  }
+
+  // @NOTE: options of the implementer still apply to its messages
+  large := &wrapperspb.StringValue{Value: strings.Repeat("x", 1024)}
+  err = conn.Invoke(context.Background(), "/internal.GatewayService/Ping", large,
+                    &pb.GatewayResponse{})
+  if status.Code(err) != codes.ResourceExhausted {
+    t.Errorf("receive %v for a large message, expect ResourceExhausted", err)
+  }
+}
+
+// @NOTE: settled leaves its listeners to the context
+type settled struct {
+  sample
+}
+
+func (self *settled) Listen(protocol string) (net.Listener, error) {
+  return nil, nil
+}
+
+func TestServeOnAddress(t *testing.T) {
+  t.Parallel()
+
+  // @NOTE: borrow a free port from the system
+  borrowed, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal("can't listen: ", err.Error())
+  }
+
+  address := borrowed.Addr().String()
+  borrowed.Close()
+
+  ctx := srv.NewGRpcContext()
+  cli := &client{version: "v1"}
+
+  if err := ctx.SetAddress("carrier-pigeon", address); err == nil {
+    t.Error("set address of an unsupported protocol")
+  } else if err := ctx.SetAddress("tcp", address); err != nil {
+    t.Fatal("can't set address: ", err.Error())
+  } else if err := ctx.Prefer("tcp"); err != nil {
+    t.Fatal("can't prefer tcp: ", err.Error())
+  }
+
+  if _, err := ctx.Start(&settled{}, "tcp"); err != nil {
+    t.Fatal("can't start serving: ", err.Error())
+  }
+
+  defer ctx.StopAll(context.Background())
+
+  if err := ctx.Connect(cli); err != nil {
+    t.Fatal("can't connect: ", err.Error())
+  }
+
+  defer ctx.Disconnect(cli)
+
+  // @NOTE: plain clients reach the address too
+  conn, err := grpc.Dial(address, grpc.WithInsecure())
+  if err != nil {
+    t.Fatal("can't dial: ", err.Error())
+  }
+
+  defer conn.Close()
+
+  _, err = pb.NewGatewayServiceClient(conn).Ping(context.Background(),
+                                                 &pb.GatewayRequest{})
+  if err != nil {
+    t.Error("can't ping the address: ", err.Error())
+  }
 }
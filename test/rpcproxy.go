@@ -0,0 +1,226 @@
+package main
+
+import (
+  healthpb "google.golang.org/grpc/health/grpc_health_v1"
+  pb "dev.io/cloud/protoc"
+  srv "dev.io/cloud/utils"
+  grpc "google.golang.org/grpc"
+
+  "google.golang.org/grpc/metadata"
+  "google.golang.org/grpc/health"
+  "google.golang.org/grpc/status"
+  "google.golang.org/grpc/codes"
+
+  "testing"
+  "context"
+  "net"
+)
+
+type upstream struct {
+  pb.UnimplementedGatewayServiceServer
+
+  name string
+  health *health.Server
+}
+
+func (self *upstream) Version() string {
+  return "v1"
+}
+
+func (self *upstream) Listen(protocol string) (net.Listener, error) {
+  return net.Listen("tcp", "localhost:0")
+}
+
+func (self *upstream) New(srv *grpc.Server) error {
+  self.health = health.NewServer()
+
+  pb.RegisterGatewayServiceServer(srv, self)
+  healthpb.RegisterHealthServer(srv, self.health)
+  return nil
+}
+
+func (self *upstream) OnServing(protocol string) error {
+  return nil
+}
+
+func (self *upstream) OnStopping() {
+}
+
+func (self *upstream) Ping(ctx context.Context, in *pb.GatewayRequest) (*pb.GatewayResponse, error) {
+  grpc.SetHeader(ctx, metadata.Pairs("served-by", self.name))
+  return &pb.GatewayResponse{}, nil
+}
+
+func (self *upstream) Register(ctx context.Context, in *pb.RegisterRequest) (*pb.RegisterResponse, error) {
+  if len(in.Backend) == 0 {
+    return nil, status.Error(codes.InvalidArgument, "backend is empty")
+  }
+
+  return &pb.RegisterResponse{Lease: in.Backend + "@" + self.name}, nil
+}
+
+type downstream struct {
+  conn *grpc.ClientConn
+  sock int
+}
+
+func (self *downstream) Version() string {
+  return "v1"
+}
+
+func (self *downstream) Socket() int {
+  return self.sock
+}
+
+func (self *downstream) New(conn *grpc.ClientConn) error {
+  self.conn = conn
+  return nil
+}
+
+func (self *downstream) OnConnecting(protocol string) error {
+  return nil
+}
+
+func (self *downstream) OnConnected(sock int) error {
+  self.sock = sock
+  return nil
+}
+
+func (self *downstream) OnBroken(sock int) error {
+  return nil
+}
+
+func (self *downstream) OnDisconnecting() {
+}
+
+func serveUpstream(t *testing.T, name string) (*srv.GRpcContext, string) {
+  ctx := srv.NewGRpcContext()
+  imp := &upstream{name: name}
+
+  serving, err := ctx.Start(imp, "tcp")
+  if err != nil {
+    t.Fatal("can't serve upstream: ", err.Error())
+  }
+
+  return ctx, serving.Addr("tcp").String()
+}
+
+func servePlainUpstream(t *testing.T, name string) (*grpc.Server, *upstream, string) {
+  listener, err := net.Listen("tcp", "localhost:0")
+  if err != nil {
+    t.Fatal("can't listen: ", err.Error())
+  }
+
+  // @NOTE: upstreams don't need to be served by GRpcContext
+  server := grpc.NewServer()
+  imp := &upstream{name: name}
+
+  imp.New(server)
+  go server.Serve(listener)
+  return server, imp, listener.Addr().String()
+}
+
+func TestProxyGRpcCalls(t *testing.T) {
+  t.Parallel()
+
+  blue, address := serveUpstream(t, "blue")
+  green, checker, other := servePlainUpstream(t, "green")
+  local := srv.NewGRpcContext()
+  gw := srv.NewGateway(nil, local)
+  cli := &downstream{}
+
+  defer blue.StopAll(context.Background())
+  defer green.Stop()
+  defer local.StopAll(context.Background())
+
+  if err := local.Prefer("memory"); err != nil {
+    t.Fatal("can't prefer memory: ", err.Error())
+  }
+
+  if rule, err := gw.Route("/internal.GatewayService/Ping", address); err != nil {
+    t.Fatal("can't route to blue: ", err.Error())
+  } else {
+    rule.Match("X-Tenant", "blue")
+  }
+
+  discovery := srv.NewStaticDiscovery(other)
+
+  if _, err := gw.RouteDiscovery("/internal.GatewayService/", discovery); err != nil {
+    t.Fatal("can't route to green: ", err.Error())
+  }
+
+  if _, err := gw.RouteDiscovery("/grpc.health.v1.Health/Watch", discovery); err != nil {
+    t.Fatal("can't route health to green: ", err.Error())
+  }
+
+  if _, err := gw.Proxy("v1", "memory"); err != nil {
+    t.Fatal("can't serve proxy: ", err.Error())
+  }
+
+  if err := local.Connect(cli); err != nil {
+    t.Fatal("can't connect to proxy: ", err.Error())
+  }
+
+  defer gw.Disconnect()
+  defer local.Disconnect(cli)
+
+  client := pb.NewGatewayServiceClient(cli.conn)
+
+  // @NOTE: check unary calls are routed by metadata and headers are
+  // forwarded back to client
+  for tenant, expected := range map[string]string{"blue": "blue", "red": "green"} {
+    var header metadata.MD
+
+    ctx := metadata.AppendToOutgoingContext(context.Background(),
+                                            "x-tenant", tenant)
+    if _, err := client.Ping(ctx, &pb.GatewayRequest{}, grpc.Header(&header)); err != nil {
+      t.Fatalf("can't ping tenant %s: %s", tenant, err.Error())
+    } else if served := header.Get("served-by"); len(served) != 1 || served[0] != expected {
+      t.Errorf("tenant %s is served by %v, expect %s", tenant, served, expected)
+    }
+  }
+
+  // @NOTE: check messages and statuses are forwarded as is
+  if resp, err := client.Register(context.Background(),
+                                  &pb.RegisterRequest{Backend: "users"}); err != nil {
+    t.Error("can't register: ", err.Error())
+  } else if resp.Lease != "users@green" {
+    t.Errorf("receive lease %s, expect users@green", resp.Lease)
+  }
+
+  if _, err := client.Register(context.Background(),
+                               &pb.RegisterRequest{}); status.Code(err) != codes.InvalidArgument {
+    t.Errorf("receive %v, expect InvalidArgument", err)
+  }
+
+  // @NOTE: methods without any rule are rejected by proxy itself
+  health := healthpb.NewHealthClient(cli.conn)
+
+  if _, err := health.Check(context.Background(),
+                            &healthpb.HealthCheckRequest{}); status.Code(err) != codes.Unimplemented {
+    t.Errorf("receive %v, expect Unimplemented", err)
+  }
+
+  // @NOTE: check server streaming is forwarded frame by frame
+  ctx, cancel := context.WithCancel(context.Background())
+  defer cancel()
+
+  watcher, err := health.Watch(ctx, &healthpb.HealthCheckRequest{})
+  if err != nil {
+    t.Fatal("can't watch health: ", err.Error())
+  }
+
+  if resp, err := watcher.Recv(); err != nil {
+    t.Fatal("can't receive health: ", err.Error())
+  } else if resp.Status != healthpb.HealthCheckResponse_SERVING {
+    t.Errorf("receive %s, expect SERVING", resp.Status)
+  }
+
+  checker.health.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+
+  if resp, err := watcher.Recv(); err != nil {
+    t.Fatal("can't receive health: ", err.Error())
+  } else if resp.Status != healthpb.HealthCheckResponse_NOT_SERVING {
+    t.Errorf("receive %s, expect NOT_SERVING", resp.Status)
+  }
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+  healthpb "google.golang.org/grpc/health/grpc_health_v1"
+  srv "dev.io/cloud/utils"
+  grpc "google.golang.org/grpc"
+
+  "google.golang.org/grpc/reflection"
+  "google.golang.org/grpc/health"
+  "github.com/gorilla/websocket"
+
+  "net/http/httptest"
+  "encoding/json"
+  "sync/atomic"
+  "net/http"
+  "strings"
+  "testing"
+  "context"
+  "bufio"
+  "time"
+  "net"
+)
+
+type watchtower struct {
+  *health.Server
+
+  watching int32
+}
+
+func (self *watchtower) Version() string {
+  return "v1"
+}
+
+func (self *watchtower) Listen(protocol string) (net.Listener, error) {
+  return nil, nil
+}
+
+func (self *watchtower) New(srv *grpc.Server) error {
+  healthpb.RegisterHealthServer(srv, self)
+  reflection.Register(srv)
+  return nil
+}
+
+func (self *watchtower) OnServing(protocol string) error {
+  return nil
+}
+
+func (self *watchtower) OnStopping() {
+}
+
+func (self *watchtower) Watch(in *healthpb.HealthCheckRequest, stream healthpb.Health_WatchServer) error {
+  atomic.AddInt32(&self.watching, 1)
+  defer atomic.AddInt32(&self.watching, -1)
+
+  return self.Server.Watch(in, stream)
+}
+
+func readData(reader *bufio.Reader) string {
+  for {
+    line, err := reader.ReadString('\n')
+    if err != nil {
+      return ""
+    } else if strings.HasPrefix(line, "data: ") {
+      return strings.TrimSpace(strings.TrimPrefix(line, "data: "))
+    }
+  }
+}
+
+func TestBridgeStreamingRpcs(t *testing.T) {
+  t.Parallel()
+
+  api := srv.NewApiServer()
+  ctx := srv.NewGRpcContext()
+  gw := srv.NewGateway(api, ctx)
+  tower := &watchtower{Server: health.NewServer()}
+
+  if err := ctx.Prefer("memory"); err != nil {
+    t.Fatal("can't prefer memory: ", err.Error())
+  } else if _, err := ctx.Start(tower, "memory"); err != nil {
+    t.Fatal("can't serve watchtower: ", err.Error())
+  } else if err := gw.Connect("v1"); err != nil {
+    t.Fatal("can't connect gateway: ", err.Error())
+  }
+
+  defer ctx.StopAll(context.Background())
+  defer gw.Disconnect()
+
+  api.Version("v1").Endpoint("health").
+    Events(gw.Events("/grpc.health.v1.Health/Watch")).
+    Mock("/health/{service}")
+
+  api.Version("v1").Endpoint("reflection").
+    Socket(gw.Socket("/grpc.reflection.v1alpha.ServerReflection/ServerReflectionInfo")).
+    Mock("/reflection")
+
+  server := httptest.NewServer(api)
+  defer server.Close()
+
+  tower.SetServingStatus("orders", healthpb.HealthCheckResponse_SERVING)
+
+  // @NOTE: path params become the rpc request and each update becomes an
+  // event
+  resp, err := http.Get(server.URL + "/v1/health/orders")
+  if err != nil {
+    t.Fatal("can't watch orders: ", err.Error())
+  }
+
+  reader := bufio.NewReader(resp.Body)
+
+  if data := readData(reader); data != `{"status":"SERVING"}` {
+    t.Errorf("receive %s, expect serving", data)
+  }
+
+  tower.SetServingStatus("orders", healthpb.HealthCheckResponse_NOT_SERVING)
+
+  if data := readData(reader); data != `{"status":"NOT_SERVING"}` {
+    t.Errorf("receive %s, expect not serving", data)
+  }
+
+  // @NOTE: browser leaves, the watch must be cancelled
+  resp.Body.Close()
+
+  for i := 0; atomic.LoadInt32(&tower.watching) > 0; i++ {
+    if i >= 100 {
+      t.Fatal("watch isn't cancelled after browser leaves")
+    }
+
+    time.Sleep(20 * time.Millisecond)
+  }
+
+  url := "ws" + strings.TrimPrefix(server.URL, "http") + "/v1/reflection"
+  conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+  if err != nil {
+    t.Fatal("can't dial reflection: ", err.Error())
+  }
+
+  defer conn.Close()
+
+  // @NOTE: a bidirectional stream answers every message
+  for i := 0; i < 2; i++ {
+    var reply struct {
+      ListServicesResponse struct {
+        Service []struct {
+          Name string `json:"name"`
+        } `json:"service"`
+      } `json:"listServicesResponse"`
+    }
+
+    if err := conn.WriteMessage(websocket.TextMessage, []byte(`{"listServices": "*"}`)); err != nil {
+      t.Fatal("can't write: ", err.Error())
+    } else if err := conn.ReadJSON(&reply); err != nil {
+      t.Fatal("can't read: ", err.Error())
+    }
+
+    names := []string{}
+    for _, service := range reply.ListServicesResponse.Service {
+      names = append(names, service.Name)
+    }
+
+    if found, _ := json.Marshal(names); ! strings.Contains(string(found), "grpc.health.v1.Health") {
+      t.Errorf("receive %s, expect grpc.health.v1.Health", found)
+    }
+  }
+
+  conn.WriteMessage(websocket.TextMessage, []byte(`{"listServices": 1}`))
+
+  if _, _, err := conn.ReadMessage(); ! websocket.IsCloseError(err, websocket.CloseInternalServerErr) {
+    t.Errorf("receive %v, expect invalid message is refused", err)
+  }
+}
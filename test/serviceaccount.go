@@ -0,0 +1,297 @@
+package main
+
+import (
+  pb "dev.io/cloud/protoc"
+  srv "dev.io/cloud/utils"
+  grpc "google.golang.org/grpc"
+
+  "google.golang.org/grpc/metadata"
+  "google.golang.org/grpc/status"
+  "google.golang.org/grpc/codes"
+  "github.com/golang-jwt/jwt/v4"
+
+  "net/http/httptest"
+  "encoding/base64"
+  "encoding/json"
+  "crypto/sha256"
+  "crypto/x509"
+  "encoding/pem"
+  "crypto/rand"
+  "crypto/rsa"
+  "io/ioutil"
+  "net/http"
+  "strings"
+  "testing"
+  "context"
+  "time"
+  "net"
+  "os"
+)
+
+const clusterIssuer = "https://kubernetes.default.svc.cluster.local"
+
+type ledger struct {
+  pb.UnimplementedGatewayServiceServer
+
+  caller string
+}
+
+func (self *ledger) Version() string {
+  return "v1"
+}
+
+func (self *ledger) Listen(protocol string) (net.Listener, error) {
+  return nil, nil
+}
+
+func (self *ledger) New(srv *grpc.Server) error {
+  pb.RegisterGatewayServiceServer(srv, self)
+  return nil
+}
+
+func (self *ledger) OnServing(protocol string) error {
+  return nil
+}
+
+func (self *ledger) OnStopping() {
+}
+
+func (self *ledger) Ping(ctx context.Context, in *pb.GatewayRequest) (*pb.GatewayResponse, error) {
+  self.caller = srv.PrincipalOf(ctx).Name
+  return &pb.GatewayResponse{}, nil
+}
+
+type teller struct {
+  sock int
+}
+
+func (self *teller) Version() string {
+  return "v1"
+}
+
+func (self *teller) Socket() int {
+  return self.sock
+}
+
+func (self *teller) New(conn *grpc.ClientConn) error {
+  return nil
+}
+
+func (self *teller) OnConnecting(protocol string) error {
+  return nil
+}
+
+func (self *teller) OnConnected(sock int) error {
+  self.sock = sock
+  return nil
+}
+
+func (self *teller) OnBroken(sock int) error {
+  return nil
+}
+
+func (self *teller) OnDisconnecting() {
+}
+
+func projectToken(t *testing.T, key *rsa.PrivateKey, claims jwt.MapClaims) string {
+  der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+  digest := sha256.Sum256(der)
+
+  token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+  token.Header["kid"] = base64.RawURLEncoding.EncodeToString(digest[:])
+
+  ret, err := token.SignedString(key)
+  if err != nil {
+    t.Fatal("can't sign token: ", err.Error())
+  }
+
+  return ret
+}
+
+func accountClaims(namespace, name string) jwt.MapClaims {
+  return jwt.MapClaims{
+    "iss": clusterIssuer,
+    "aud": []string{"api"},
+    "sub": "system:serviceaccount:" + namespace + ":" + name,
+    "exp": time.Now().Add(time.Hour).Unix(),
+    "kubernetes.io": map[string]interface{}{
+      "namespace": namespace,
+      "serviceaccount": map[string]interface{}{"name": name, "uid": "1"},
+    },
+  }
+}
+
+func TestServiceAccountTokens(t *testing.T) {
+  t.Parallel()
+
+  key, _ := rsa.GenerateKey(rand.Reader, 2048)
+  der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+
+  file, err := ioutil.TempFile("", "sa.pub")
+  if err != nil {
+    t.Fatal("can't create file: ", err.Error())
+  }
+
+  defer os.Remove(file.Name())
+
+  pem.Encode(file, &pem.Block{Type: "PUBLIC KEY", Bytes: der})
+  file.Close()
+
+  accounts := srv.NewServiceAccountAuthenticator(clusterIssuer, "api")
+  if err := accounts.Keys(file.Name()); err != nil {
+    t.Fatal("can't load keys: ", err.Error())
+  }
+
+  secret := []byte("secret")
+  api := srv.NewApiServer().Authenticate(accounts,
+                                         srv.NewJwtAuthenticator().Key("", secret))
+  served := func(w http.ResponseWriter, r *http.Request) {
+    api.Ok(w)(srv.PrincipalOf(r.Context()).Name)
+  }
+
+  api.Version("v1").Endpoint("billing").Handle("GET", served).
+    Protect("payments").Mock("/billing")
+  api.Version("v1").Endpoint("status").Handle("GET", served).
+    Protect().Mock("/status")
+  api.Version("v1").Endpoint("me").Handle("GET", served).
+    Level(srv.AUTHENTICATED).Mock("/me")
+
+  worker := projectToken(t, key, accountClaims("payments", "worker"))
+  probe := projectToken(t, key, accountClaims("default", "probe"))
+
+  legacy := projectToken(t, key, jwt.MapClaims{
+    "iss": clusterIssuer,
+    "aud": "api",
+    "sub": "system:serviceaccount:payments:legacy",
+    "kubernetes.io/serviceaccount/namespace": "payments",
+    "kubernetes.io/serviceaccount/service-account.name": "legacy",
+  })
+
+  forged := accountClaims("payments", "worker")
+  forged["sub"] = "system:serviceaccount:kube-system:admin"
+
+  other := accountClaims("payments", "worker")
+  other["aud"] = []string{"vault"}
+
+  cases := []struct {
+    path, token string
+    code int
+  }{
+    {"/v1/billing", worker, 200},
+    {"/v1/billing", legacy, 200},
+    {"/v1/status", probe, 200},
+
+    // @NOTE: protected endpoints stay hidden from other namespaces and
+    // from anonymous requests
+    {"/v1/billing", probe, 404},
+    {"/v1/billing", "", 404},
+    {"/v1/billing", projectToken(t, key, forged), 401},
+    {"/v1/billing", projectToken(t, key, other), 401},
+
+    // @NOTE: tokens of another issuer go to the next authenticator and
+    // they are never internal
+    {"/v1/status", signStatic(t, secret), 404},
+    {"/v1/me", signStatic(t, secret), 200},
+  }
+
+  for _, item := range cases {
+    w := httptest.NewRecorder()
+    r := httptest.NewRequest("GET", item.path, nil)
+
+    if len(item.token) > 0 {
+      r.Header.Set("Authorization", "Bearer " + item.token)
+    }
+
+    api.ServeHTTP(w, r)
+
+    // @NOTE: hidden endpoints respond 404 inside our envelope
+    envelope := struct{ Code int `json:"code"` }{}
+    json.Unmarshal(w.Body.Bytes(), &envelope)
+
+    if envelope.Code != item.code {
+      t.Errorf("%s: receive %d %s, expect %d", item.path, w.Code,
+               w.Body.String(), item.code)
+    }
+  }
+
+  // @NOTE: a jwt authenticator which expects its issuer leaves service
+  // account tokens to the next one, so the order doesn't matter
+  reversed := srv.NewApiServer().Authenticate(
+    srv.NewJwtAuthenticator().Key("", secret).Expect("dev.io", ""),
+    accounts)
+  reversed.Version("v1").Endpoint("me").Handle("GET",
+    func(w http.ResponseWriter, r *http.Request) {
+      reversed.Ok(w)(srv.PrincipalOf(r.Context()).Name)
+    }).Level(srv.AUTHENTICATED).Mock("/me")
+
+  w := httptest.NewRecorder()
+  r := httptest.NewRequest("GET", "/v1/me", nil)
+  r.Header.Set("Authorization", "Bearer " + worker)
+  reversed.ServeHTTP(w, r)
+
+  if w.Code != 200 || ! strings.Contains(w.Body.String(), "system:serviceaccount:payments:worker") {
+    t.Errorf("receive %d %s, expect the service account", w.Code, w.Body.String())
+  }
+
+  // @NOTE: grpc calls are authenticated by interceptors of the context
+  ctx := srv.NewGRpcContext()
+  imp := &ledger{}
+  cli := &teller{sock: -1}
+
+  ctx.Intercept(accounts.Interceptors("payments"))
+
+  if err := ctx.Prefer("memory"); err != nil {
+    t.Fatal("can't prefer memory: ", err.Error())
+  } else if _, err := ctx.Start(imp, "memory"); err != nil {
+    t.Fatal("can't serve ledger: ", err.Error())
+  } else if err := ctx.Connect(cli); err != nil {
+    t.Fatal("can't connect ledger: ", err.Error())
+  }
+
+  defer ctx.StopAll(context.Background())
+  defer ctx.Disconnect(cli)
+
+  calls := []struct {
+    token string
+    code codes.Code
+  }{
+    {worker, codes.OK},
+    {probe, codes.PermissionDenied},
+    {"", codes.Unauthenticated},
+    {signStatic(t, secret), codes.Unauthenticated},
+  }
+
+  for _, item := range calls {
+    call := context.Background()
+
+    if len(item.token) > 0 {
+      call = metadata.AppendToOutgoingContext(call, "authorization",
+                                              "Bearer " + item.token)
+    }
+
+    err := ctx.Invoke(call, cli, "/internal.GatewayService/Ping",
+                      &pb.GatewayRequest{}, &pb.GatewayResponse{})
+
+    if code := status.Code(err); code != item.code {
+      t.Errorf("receive %v, expect %v", code, item.code)
+    }
+  }
+
+  if imp.caller != "system:serviceaccount:payments:worker" {
+    t.Errorf("ledger is called by %s, expect the worker", imp.caller)
+  }
+}
+
+func signStatic(t *testing.T, secret []byte) string {
+  token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+    "iss": "dev.io",
+    "sub": "bob",
+  })
+
+  ret, err := token.SignedString(secret)
+  if err != nil {
+    t.Fatal("can't sign token: ", err.Error())
+  }
+
+  return ret
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+  pb "dev.io/cloud/protoc"
+  srv "dev.io/cloud/utils"
+  grpc "google.golang.org/grpc"
+
+  "google.golang.org/grpc/status"
+  "google.golang.org/grpc/codes"
+
+  "net/http/httptest"
+  "encoding/json"
+  "strings"
+  "testing"
+  "context"
+  "fmt"
+  "net"
+)
+
+type catalog struct {
+  pb.UnimplementedGatewayServiceServer
+}
+
+func (self *catalog) Version() string {
+  return "v1"
+}
+
+func (self *catalog) Listen(protocol string) (net.Listener, error) {
+  return nil, nil
+}
+
+func (self *catalog) New(srv *grpc.Server) error {
+  pb.RegisterGatewayServiceServer(srv, self)
+  return nil
+}
+
+func (self *catalog) OnServing(protocol string) error {
+  return nil
+}
+
+func (self *catalog) OnStopping() {
+}
+
+func (self *catalog) Ping(ctx context.Context, in *pb.GatewayRequest) (*pb.GatewayResponse, error) {
+  return &pb.GatewayResponse{}, nil
+}
+
+func (self *catalog) ListRoutes(ctx context.Context, in *pb.ListRoutesRequest) (*pb.ListRoutesResponse, error) {
+  return &pb.ListRoutesResponse{
+    Routes: []*pb.Route{{
+      Version: in.Version,
+      Endpoint: "orders",
+      Methods: []string{"GET", "POST"},
+      Level: pb.Level_PROTECTED,
+    }},
+  }, nil
+}
+
+func (self *catalog) Register(ctx context.Context, in *pb.RegisterRequest) (*pb.RegisterResponse, error) {
+  if len(in.Routes) != 1 || in.Routes[0].Level != pb.Level_PRIVATE {
+    return nil, status.Error(codes.InvalidArgument, "expect one private route")
+  }
+
+  return &pb.RegisterResponse{Lease: in.Backend, Ttl: in.Ttl * 2}, nil
+}
+
+func graph(api *srv.ApiServer, body string) map[string]interface{} {
+  ret := make(map[string]interface{})
+  w := httptest.NewRecorder()
+
+  api.ServeHTTP(w, httptest.NewRequest("POST", "/v1/graph",
+                                       strings.NewReader(body)))
+  json.Unmarshal(w.Body.Bytes(), &ret)
+  return ret
+}
+
+func TestStitchGRpcServices(t *testing.T) {
+  t.Parallel()
+
+  api := srv.NewApiServer()
+  ctx := srv.NewGRpcContext()
+  gw := srv.NewGateway(api, ctx)
+
+  if err := ctx.Prefer("memory"); err != nil {
+    t.Fatal("can't prefer memory: ", err.Error())
+  } else if _, err := ctx.Start(&catalog{}, "memory"); err != nil {
+    t.Fatal("can't serve catalog: ", err.Error())
+  } else if err := gw.Connect("v1"); err != nil {
+    t.Fatal("can't connect gateway: ", err.Error())
+  }
+
+  defer ctx.StopAll(context.Background())
+  defer gw.Disconnect()
+
+  if services := ctx.Services(); len(services) != 1 || services[0] != "internal.GatewayService" {
+    t.Fatalf("receive services %v, expect internal.GatewayService", services)
+  }
+
+  schema, err := gw.Stitch()
+  if err != nil {
+    t.Fatal("can't stitch: ", err.Error())
+  }
+
+  api.Version("v1").Endpoint("graph").Schema(schema, false).Mock("/graph")
+
+  resp := graph(api, `{"query": "{ listRoutes(version: \"v2\") { routes { version endpoint methods level } } }"}`)
+  if resp["errors"] != nil {
+    t.Fatalf("receive %v, expect no error", resp["errors"])
+  }
+
+  routes := fmt.Sprintf("%v", resp["data"])
+  if routes != "map[listRoutes:map[routes:[map[endpoint:orders level:PROTECTED methods:[GET POST] version:v2]]]]" {
+    t.Errorf("receive %s", routes)
+  }
+
+  // @NOTE: methods with side effects become mutations and int64 becomes
+  // string like protojson
+  resp = graph(api, `{"query": "mutation { register(backend: \"orders\", ttl: \"30\", routes: [{endpoint: \"orders\", level: PRIVATE}]) { lease ttl } }"}`)
+  if resp["errors"] != nil {
+    t.Fatalf("receive %v, expect no error", resp["errors"])
+  } else if lease := fmt.Sprintf("%v", resp["data"]); lease != "map[register:map[lease:orders ttl:60]]" {
+    t.Errorf("receive %s", lease)
+  }
+
+  resp = graph(api, `{"query": "mutation { register(backend: \"orders\") { lease } }"}`)
+  if errs, _ := resp["errors"].([]interface{}); len(errs) != 1 {
+    t.Errorf("receive %v, expect an error from catalog", resp)
+  }
+
+  // @NOTE: empty messages are exchanged as json
+  resp = graph(api, `{"query": "mutation { ping }"}`)
+  if resp["errors"] != nil {
+    t.Errorf("receive %v, expect no error", resp["errors"])
+  }
+
+  resp = graph(api, `{"query": "{ listRoutes { routes { upstream } } }"}`)
+  if resp["errors"] != nil {
+    t.Errorf("receive %v, expect no error", resp["errors"])
+  }
+
+  if _, err := gw.Stitch("internal.Missing"); err == nil {
+    t.Error("stitch a missing service")
+  }
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+  srv "dev.io/cloud/utils"
+
+  "github.com/gorilla/websocket"
+
+  "net/http/httptest"
+  "net/http"
+  "strings"
+  "testing"
+  "context"
+  "bufio"
+  "time"
+  "fmt"
+)
+
+func subscribe(t *testing.T, url string) (*bufio.Reader, func()) {
+  resp, err := http.Get(url)
+  if err != nil {
+    t.Fatal("can't subscribe: ", err.Error())
+  } else if resp.StatusCode != 200 {
+    t.Fatalf("receive %d, expect 200", resp.StatusCode)
+  } else if kind := resp.Header.Get("Content-Type"); kind != "text/event-stream" {
+    t.Fatalf("receive %s, expect text/event-stream", kind)
+  }
+
+  return bufio.NewReader(resp.Body), func() { resp.Body.Close() }
+}
+
+func nextEvent(reader *bufio.Reader) (string, error) {
+  var event strings.Builder
+
+  for {
+    line, err := reader.ReadString('\n')
+    if err != nil {
+      return event.String(), err
+    } else if line == "\n" {
+      return event.String(), nil
+    }
+
+    event.WriteString(line)
+  }
+}
+
+func TestStreamEndpoints(t *testing.T) {
+  t.Parallel()
+
+  api := srv.NewApiServer().SetHeartbeat(50 * time.Millisecond)
+  started := make(chan struct{}, 1)
+
+  api.Version("v1").Endpoint("ticks").
+    Events(func(r *http.Request, stream *srv.EventStream) error {
+      for i := 0; i < 2; i++ {
+        event := srv.Event{Id: fmt.Sprint(i), Name: "tick", Data: "a\nb"}
+
+        if err := stream.Send(event); err != nil {
+          return err
+        }
+      }
+
+      started <- struct{}{}
+      <-stream.Context().Done()
+      return nil
+    }).
+    Mock("/ticks")
+
+  api.Version("v1").Endpoint("echo").
+    Socket(func(r *http.Request, socket *srv.Socket) error {
+      for {
+        message, err := socket.Receive()
+        if err != nil {
+          return nil
+        } else if string(message) == "fail" {
+          return fmt.Errorf("echo fails")
+        } else if err := socket.Send(map[string]string{"echo": string(message)}); err != nil {
+          return err
+        }
+      }
+    }).
+    Mock("/echo")
+
+  server := httptest.NewServer(api)
+  defer server.Close()
+
+  // @NOTE: events are framed by blank lines and heartbeats are comments
+  reader, unsubscribe := subscribe(t, server.URL + "/v1/ticks")
+
+  if event, err := nextEvent(reader); err != nil {
+    t.Fatal("can't read event: ", err.Error())
+  } else if event != "id: 0\nevent: tick\ndata: a\ndata: b\n" {
+    t.Errorf("receive %q", event)
+  }
+
+  nextEvent(reader)
+  <-started
+
+  if beat, err := nextEvent(reader); err != nil || beat != ": ping\n" {
+    t.Errorf("receive %q %v, expect a heartbeat", beat, err)
+  }
+
+  unsubscribe()
+
+  // @NOTE: a plain GET can't reach a websocket endpoint
+  if resp, err := http.Get(server.URL + "/v1/echo"); err != nil {
+    t.Fatal("can't get echo: ", err.Error())
+  } else if resp.StatusCode == http.StatusSwitchingProtocols {
+    t.Error("upgrade without websocket headers")
+  }
+
+  url := "ws" + strings.TrimPrefix(server.URL, "http") + "/v1/echo"
+  conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+  if err != nil {
+    t.Fatal("can't dial echo: ", err.Error())
+  }
+
+  defer conn.Close()
+
+  reply := make(map[string]string)
+
+  if err := conn.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+    t.Fatal("can't write: ", err.Error())
+  } else if err := conn.ReadJSON(&reply); err != nil {
+    t.Fatal("can't read: ", err.Error())
+  } else if reply["echo"] != "hello" {
+    t.Errorf("receive %v, expect hello", reply)
+  }
+
+  conn.WriteMessage(websocket.TextMessage, []byte("fail"))
+
+  if _, _, err := conn.ReadMessage(); ! websocket.IsCloseError(err, websocket.CloseInternalServerErr) {
+    t.Errorf("receive %v, expect internal server error", err)
+  }
+
+  // @NOTE: shutdown closes open streams and refuses new ones
+  reader, unsubscribe = subscribe(t, server.URL + "/v1/ticks")
+  defer unsubscribe()
+
+  conn, _, err = websocket.DefaultDialer.Dial(url, nil)
+  if err != nil {
+    t.Fatal("can't dial echo: ", err.Error())
+  }
+
+  defer conn.Close()
+  <-started
+
+  ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+  defer cancel()
+
+  if err := api.Shutdown(ctx); err != nil {
+    t.Fatal("can't shutdown streams: ", err.Error())
+  }
+
+  if _, _, err := conn.ReadMessage(); ! websocket.IsCloseError(err, websocket.CloseGoingAway) {
+    t.Errorf("receive %v, expect going away", err)
+  }
+
+  for {
+    if _, err := nextEvent(reader); err != nil {
+      break
+    }
+  }
+
+  if resp, err := http.Get(server.URL + "/v1/ticks"); err != nil {
+    t.Fatal("can't subscribe: ", err.Error())
+  } else if resp.StatusCode != 503 || resp.Header.Get("Content-Type") == "text/event-stream" {
+    t.Errorf("receive %d %s, expect the stream is refused",
+             resp.StatusCode, resp.Header.Get("Content-Type"))
+  }
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+  pb "dev.io/cloud/protoc"
+  srv "dev.io/cloud/utils"
+  grpc "google.golang.org/grpc"
+
+  "net/http/httptest"
+  "encoding/json"
+  "net/http"
+  "testing"
+  "context"
+  "bytes"
+  "time"
+  "net"
+  "io"
+)
+
+const remoteTrace = "4bf92f3577b34da6a3ce929d0e0e4736"
+const remoteSpan = "00f067aa0ba902b7"
+
+type beacon struct {
+  pb.UnimplementedGatewayServiceServer
+}
+
+func (self *beacon) Version() string {
+  return "v1"
+}
+
+func (self *beacon) Listen(protocol string) (net.Listener, error) {
+  return nil, nil
+}
+
+func (self *beacon) New(srv *grpc.Server) error {
+  pb.RegisterGatewayServiceServer(srv, self)
+  srv.RegisterService(&tallyService, self)
+  return nil
+}
+
+func (self *beacon) OnServing(protocol string) error {
+  return nil
+}
+
+func (self *beacon) OnStopping() {
+}
+
+func (self *beacon) Ping(ctx context.Context, in *pb.GatewayRequest) (*pb.GatewayResponse, error) {
+  return &pb.GatewayResponse{}, nil
+}
+
+// @NOTE: the proto has no streams, tally counts what a client streams to it
+var tallyService = grpc.ServiceDesc{
+  ServiceName: "test.Tally",
+  HandlerType: (*interface{})(nil),
+  Streams: []grpc.StreamDesc{
+    {
+      StreamName: "Count",
+      Handler: tally,
+      ClientStreams: true,
+    },
+  },
+}
+
+func tally(srv interface{}, stream grpc.ServerStream) error {
+  for {
+    if err := stream.RecvMsg(&pb.GatewayRequest{}); err == io.EOF {
+      return stream.SendMsg(&pb.GatewayResponse{})
+    } else if err != nil {
+      return err
+    }
+  }
+}
+
+type scout struct {
+  sock int
+  conn *grpc.ClientConn
+}
+
+func (self *scout) Version() string {
+  return "v1"
+}
+
+func (self *scout) Socket() int {
+  return self.sock
+}
+
+func (self *scout) New(conn *grpc.ClientConn) error {
+  self.conn = conn
+  return nil
+}
+
+func (self *scout) OnConnecting(protocol string) error {
+  return nil
+}
+
+func (self *scout) OnConnected(sock int) error {
+  self.sock = sock
+  return nil
+}
+
+func (self *scout) OnBroken(sock int) error {
+  return nil
+}
+
+func (self *scout) OnDisconnecting() {
+}
+
+func spanNamed(spans []srv.Span, name string, kind int) *srv.Span {
+  for index := range spans {
+    if spans[index].Name == name && spans[index].Kind == kind {
+      return &spans[index]
+    }
+  }
+
+  return nil
+}
+
+func TestTraceAcrossHttpAndRpc(t *testing.T) {
+  t.Parallel()
+
+  exporter := srv.NewMemoryExporter()
+  tracer := srv.NewTracer(exporter)
+
+  ctx := srv.NewGRpcContext()
+  cli := &scout{sock: -1}
+
+  ctx.Trace(tracer)
+
+  if err := ctx.Prefer("memory"); err != nil {
+    t.Fatal("can't prefer memory: ", err.Error())
+  } else if _, err := ctx.Start(&beacon{}, "memory"); err != nil {
+    t.Fatal("can't serve beacon: ", err.Error())
+  } else if err := ctx.Connect(cli); err != nil {
+    t.Fatal("can't connect beacon: ", err.Error())
+  }
+
+  defer ctx.StopAll(context.Background())
+  defer ctx.Disconnect(cli)
+
+  api := srv.NewApiServer().Trace(tracer)
+  api.Version("v1").Endpoint("orders").Handle("GET",
+    func(w http.ResponseWriter, r *http.Request) {
+      err := ctx.Invoke(r.Context(), cli, "/internal.GatewayService/Ping",
+                        &pb.GatewayRequest{}, &pb.GatewayResponse{})
+      if err != nil {
+        w.WriteHeader(502)
+      }
+
+      api.Ok(w)("")
+    }).Mock("/orders")
+
+  w := httptest.NewRecorder()
+  r := httptest.NewRequest("GET", "/v1/orders", nil)
+  r.Header.Set("traceparent", "00-" + remoteTrace + "-" + remoteSpan + "-01")
+  api.ServeHTTP(w, r)
+
+  spans := exporter.Spans()
+  route := spanNamed(spans, "v1/orders/GET", srv.SPAN_SERVER)
+  client := spanNamed(spans, "/internal.GatewayService/Ping", srv.SPAN_CLIENT)
+  server := spanNamed(spans, "/internal.GatewayService/Ping", srv.SPAN_SERVER)
+
+  if len(spans) != 3 || route == nil || client == nil {
+    t.Fatalf("receive %d spans %v, expect route, client and server", len(spans),
+             spans)
+  }
+
+  for _, span := range spans {
+    if span.TraceId != remoteTrace {
+      t.Errorf("%s belongs to trace %s, expect %s", span.Name, span.TraceId,
+               remoteTrace)
+    } else if len(span.Error) > 0 {
+      t.Errorf("%s fails with %s", span.Name, span.Error)
+    }
+  }
+
+  if route.ParentId != remoteSpan {
+    t.Errorf("route is a child of %s, expect the remote span", route.ParentId)
+  } else if client.ParentId != route.SpanId {
+    t.Errorf("client is a child of %s, expect the route", client.ParentId)
+  } else if server == nil || server.ParentId != client.SpanId {
+    t.Errorf("server %v isn't a child of the client", server)
+  } else if route.Attributes["http.status_code"] != "200" {
+    t.Errorf("route has status %s, expect 200", route.Attributes["http.status_code"])
+  }
+
+  // @NOTE: callers which don't sample are respected, nothing is exported
+  exporter.Reset()
+
+  r = httptest.NewRequest("GET", "/v1/orders", nil)
+  r.Header.Set("traceparent", "00-" + remoteTrace + "-" + remoteSpan + "-00")
+  api.ServeHTTP(httptest.NewRecorder(), r)
+
+  if spans := exporter.Spans(); len(spans) != 0 {
+    t.Errorf("receive %d spans of an unsampled trace, expect 0", len(spans))
+  }
+
+  // @NOTE: a malformed traceparent starts a new trace
+  r = httptest.NewRequest("GET", "/v1/orders", nil)
+  r.Header.Set("traceparent", "00-" + remoteTrace + "-0000000000000000-01")
+  api.ServeHTTP(httptest.NewRecorder(), r)
+
+  if route := spanNamed(exporter.Spans(), "v1/orders/GET", srv.SPAN_SERVER); route == nil {
+    t.Errorf("route isn't traced with a malformed traceparent")
+  } else if route.TraceId == remoteTrace || len(route.ParentId) > 0 {
+    t.Errorf("route continues trace %s, expect a new one", route.TraceId)
+  }
+}
+
+func TestTraceClientStreams(t *testing.T) {
+  t.Parallel()
+
+  exporter := srv.NewMemoryExporter()
+  ctx := srv.NewGRpcContext()
+  cli := &scout{sock: -1}
+
+  ctx.Trace(srv.NewTracer(exporter))
+
+  if err := ctx.Prefer("memory"); err != nil {
+    t.Fatal("can't prefer memory: ", err.Error())
+  } else if _, err := ctx.Start(&beacon{}, "memory"); err != nil {
+    t.Fatal("can't serve beacon: ", err.Error())
+  } else if err := ctx.Connect(cli); err != nil {
+    t.Fatal("can't connect beacon: ", err.Error())
+  }
+
+  defer ctx.StopAll(context.Background())
+  defer ctx.Disconnect(cli)
+
+  // @NOTE: a client stream ends with the only reply of its server
+  stream, err := cli.conn.NewStream(context.Background(), &tallyService.Streams[0],
+                                    "/test.Tally/Count")
+  if err != nil {
+    t.Fatal("can't open a stream: ", err.Error())
+  }
+
+  for i := 0; i < 3; i++ {
+    if err := stream.SendMsg(&pb.GatewayRequest{}); err != nil {
+      t.Fatal("can't send to the stream: ", err.Error())
+    }
+  }
+
+  if err := stream.CloseSend(); err != nil {
+    t.Fatal("can't close the stream: ", err.Error())
+  } else if err := stream.RecvMsg(&pb.GatewayResponse{}); err != nil {
+    t.Fatal("can't receive the reply: ", err.Error())
+  }
+
+  client := spanNamed(exporter.Spans(), "/test.Tally/Count", srv.SPAN_CLIENT)
+  if client == nil {
+    t.Fatalf("client span isn't exported after the reply")
+  } else if len(client.Error) > 0 {
+    t.Errorf("client span fails with %s", client.Error)
+  }
+
+  // @NOTE: a stream abandoned with its context ends too
+  exporter.Reset()
+
+  cancelable, cancel := context.WithCancel(context.Background())
+  stream, err = cli.conn.NewStream(cancelable, &tallyService.Streams[0],
+                                   "/test.Tally/Count")
+  if err != nil {
+    t.Fatal("can't open a stream: ", err.Error())
+  } else if err := stream.SendMsg(&pb.GatewayRequest{}); err != nil {
+    t.Fatal("can't send to the stream: ", err.Error())
+  }
+
+  cancel()
+
+  for deadline := time.Now().Add(time.Second); ; {
+    client = spanNamed(exporter.Spans(), "/test.Tally/Count", srv.SPAN_CLIENT)
+
+    if client != nil || time.Now().After(deadline) {
+      break
+    }
+
+    time.Sleep(10 * time.Millisecond)
+  }
+
+  if client == nil {
+    t.Fatalf("client span isn't exported after its context is canceled")
+  } else if len(client.Error) == 0 {
+    t.Errorf("client span of a canceled stream has no error")
+  }
+}
+
+func TestStdoutExporter(t *testing.T) {
+  t.Parallel()
+
+  output := &bytes.Buffer{}
+  tracer := srv.NewTracer(srv.NewStdoutExporter(output))
+
+  _, span := tracer.Start(context.Background(), "job", srv.SPAN_INTERNAL)
+  span.Set("attempt", "1")
+  span.End(nil)
+  span.End(nil)
+
+  lines := bytes.Split(bytes.TrimSpace(output.Bytes()), []byte("\n"))
+  if len(lines) != 1 {
+    t.Fatalf("receive %d lines, expect 1", len(lines))
+  }
+
+  var decoded srv.Span
+
+  if err := json.Unmarshal(lines[0], &decoded); err != nil {
+    t.Errorf("can't decode span: %s", err.Error())
+  } else if decoded.Name != "job" || decoded.Attributes["attempt"] != "1" ||
+            len(decoded.TraceId) != 32 || len(decoded.SpanId) != 16 {
+    t.Errorf("receive %s, expect span job", string(lines[0]))
+  }
+}